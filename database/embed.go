@@ -0,0 +1,20 @@
+// Package database embeds the SQL migrations of the phone book schema into the server binary.
+// Migrations are applied by the migrate package, one directory per SQL dialect.
+package database
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed migrations
+var files embed.FS
+
+// Migrations returns the migration files of a dialect, "postgres" or "sqlite"
+func Migrations(dialect string) fs.FS {
+	sub, err := fs.Sub(files, "migrations/"+dialect)
+	if err != nil {
+		panic(err) // only an invalid path fails, and the path is built from a directory name
+	}
+	return sub
+}
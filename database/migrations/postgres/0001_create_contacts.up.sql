@@ -0,0 +1,16 @@
+-- Databases created by the old database/init.sql already have the table, possibly without
+-- the columns added since, so every statement only adds what is missing.
+CREATE TABLE IF NOT EXISTS contacts (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(100) NOT NULL,
+    last_name VARCHAR(100) NOT NULL,
+    phone_number VARCHAR(20) NOT NULL,
+    phone_e164 VARCHAR(20), -- canonical form used for lookups, filled in by the server on startup
+    address TEXT,
+    version INTEGER NOT NULL DEFAULT 1 -- bumped on every update, served as the ETag
+);
+
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS phone_e164 VARCHAR(20);
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+CREATE INDEX IF NOT EXISTS contacts_phone_e164_idx ON contacts (phone_e164);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS contact_addresses;
+DROP TABLE IF EXISTS contact_emails;
+DROP TABLE IF EXISTS contact_phones;
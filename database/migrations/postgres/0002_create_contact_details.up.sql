@@ -0,0 +1,43 @@
+-- Every phone number, email and postal address of a contact. The primary phone and address
+-- are mirrored into contacts.phone_number, phone_e164 and address.
+CREATE TABLE IF NOT EXISTS contact_phones (
+    id SERIAL PRIMARY KEY,
+    contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    type VARCHAR(10) NOT NULL, -- mobile, work, home or fax
+    number VARCHAR(20) NOT NULL,
+    e164 VARCHAR(20),
+    is_primary BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS contact_phones_contact_id_idx ON contact_phones (contact_id);
+CREATE INDEX IF NOT EXISTS contact_phones_e164_idx ON contact_phones (e164);
+
+CREATE TABLE IF NOT EXISTS contact_emails (
+    id SERIAL PRIMARY KEY,
+    contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    type VARCHAR(10) NOT NULL, -- home, work or other
+    address VARCHAR(255) NOT NULL,
+    is_primary BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS contact_emails_contact_id_idx ON contact_emails (contact_id);
+
+CREATE TABLE IF NOT EXISTS contact_addresses (
+    id SERIAL PRIMARY KEY,
+    contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    type VARCHAR(10) NOT NULL, -- home, work or other
+    address TEXT NOT NULL,
+    is_primary BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE INDEX IF NOT EXISTS contact_addresses_contact_id_idx ON contact_addresses (contact_id);
+
+-- Existing contacts keep their phone number and address as their primary entries
+INSERT INTO contact_phones (contact_id, type, number, e164, is_primary)
+SELECT id, 'mobile', phone_number, phone_e164, TRUE FROM contacts
+WHERE NOT EXISTS (SELECT 1 FROM contact_phones WHERE contact_phones.contact_id = contacts.id);
+
+INSERT INTO contact_addresses (contact_id, type, address, is_primary)
+SELECT id, 'home', address, TRUE FROM contacts
+WHERE address IS NOT NULL AND address <> ''
+AND NOT EXISTS (SELECT 1 FROM contact_addresses WHERE contact_addresses.contact_id = contacts.id);
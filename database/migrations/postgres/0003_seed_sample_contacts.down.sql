@@ -0,0 +1,10 @@
+-- Removes the sample rows nobody has edited since
+DELETE FROM contacts
+WHERE version = 1 AND first_name = 'Jonathan' AND last_name = 'Makovsky'
+AND (phone_number, address) IN (
+    ('0543435590', 'Tel Aviv'),
+    ('0543435590', 'Jerusalem'),
+    ('0543435590', 'Eilat'),
+    ('1', 'Tel Aviv'),
+    ('2', 'Tel Aviv')
+);
@@ -1,15 +1,12 @@
-CREATE TABLE IF NOT EXISTS contacts (
-    id SERIAL PRIMARY KEY,
-    first_name VARCHAR(100) NOT NULL,
-    last_name VARCHAR(100) NOT NULL,
-    phone_number VARCHAR(20) NOT NULL,
-    address TEXT
-);
-
--- I added some rows to the table, so we had something to work with
-INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES
+-- I added some rows to the table, so we had something to work with.
+-- Only a new, empty database gets them. The server fills in phone_e164 and the detail
+-- rows on startup.
+INSERT INTO contacts (first_name, last_name, phone_number, address)
+SELECT first_name, last_name, phone_number, address FROM (VALUES
     ('Jonathan', 'Makovsky', '0543435590', 'Tel Aviv'),
     ('Jonathan', 'Makovsky', '0543435590', 'Jerusalem'),
     ('Jonathan', 'Makovsky', '0543435590', 'Eilat'),
     ('Jonathan', 'Makovsky', '1', 'Tel Aviv'),
-    ('Jonathan', 'Makovsky', '2', 'Tel Aviv');
+    ('Jonathan', 'Makovsky', '2', 'Tel Aviv')
+) AS seed (first_name, last_name, phone_number, address)
+WHERE NOT EXISTS (SELECT 1 FROM contacts);
@@ -0,0 +1,11 @@
+-- API keys accepted by the auth middleware. Only the SHA-256 of a key is stored, the key
+-- itself is shown once when it is created.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(20) NOT NULL, -- start of the key, shown to tell keys apart
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    admin BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
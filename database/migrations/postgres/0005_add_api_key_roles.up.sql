@@ -0,0 +1,4 @@
+-- API keys carry a role instead of the admin flag, admin keys become admin and the others editor
+ALTER TABLE api_keys ADD COLUMN role VARCHAR(50) NOT NULL DEFAULT 'editor';
+UPDATE api_keys SET role = 'admin' WHERE admin;
+ALTER TABLE api_keys DROP COLUMN admin;
@@ -0,0 +1,27 @@
+-- Append-only log of every contact write, written in the transaction of the write.
+-- contact_id has no foreign key: entries outlive the contacts they describe.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(10) NOT NULL, -- create, update or delete
+    contact_id INTEGER NOT NULL,
+    contact_before JSONB, -- NULL for created contacts
+    contact_after JSONB, -- NULL for deleted contacts
+    request_id VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_contact_id_idx ON audit_log (tenant_id, contact_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (tenant_id, created_at);
+
+-- Entries are never changed once written, they only go away with their tenant
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE ON audit_log
+    FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS contact_group_members;
+DROP TABLE IF EXISTS contact_groups;
+DROP TABLE IF EXISTS contact_tags;
@@ -0,0 +1,26 @@
+-- Free-form tags of a contact, lower case, each at most once per contact
+CREATE TABLE IF NOT EXISTS contact_tags (
+    id SERIAL PRIMARY KEY,
+    contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    tag VARCHAR(50) NOT NULL,
+    UNIQUE (contact_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS contact_tags_tag_idx ON contact_tags (tag);
+
+-- Named groups of a tenant's contacts, a contact can be in any number of groups
+CREATE TABLE IF NOT EXISTS contact_groups (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS contact_group_members (
+    group_id INTEGER NOT NULL REFERENCES contact_groups (id) ON DELETE CASCADE,
+    contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, contact_id)
+);
+
+CREATE INDEX IF NOT EXISTS contact_group_members_contact_id_idx ON contact_group_members (contact_id);
@@ -0,0 +1,24 @@
+-- Custom fields defined by the admins of a tenant, each contact of the tenant can have a
+-- value for every field. options lists the values of an enum field as a JSON array.
+CREATE TABLE IF NOT EXISTS contact_fields (
+    id SERIAL PRIMARY KEY,
+    tenant_id VARCHAR(63) NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+    name VARCHAR(50) NOT NULL,
+    type VARCHAR(10) NOT NULL, -- string, number, date, enum or bool
+    required BOOLEAN NOT NULL DEFAULT FALSE,
+    pattern TEXT NOT NULL DEFAULT '', -- regular expression string values must match
+    options TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (tenant_id, name)
+);
+
+-- The values of the custom fields, as text: numbers in decimal, dates as YYYY-MM-DD and
+-- booleans as true or false, so equal values compare equal
+CREATE TABLE IF NOT EXISTS contact_field_values (
+    contact_id INTEGER NOT NULL REFERENCES contacts (id) ON DELETE CASCADE,
+    field_id INTEGER NOT NULL REFERENCES contact_fields (id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    PRIMARY KEY (contact_id, field_id)
+);
+
+CREATE INDEX IF NOT EXISTS contact_field_values_field_id_idx ON contact_field_values (field_id, value);
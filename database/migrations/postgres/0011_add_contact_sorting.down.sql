@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS contacts_created_at_idx;
+DROP INDEX IF EXISTS contacts_address_idx;
+DROP INDEX IF EXISTS contacts_phone_number_idx;
+DROP INDEX IF EXISTS contacts_last_name_idx;
+DROP INDEX IF EXISTS contacts_first_name_idx;
+ALTER TABLE contacts DROP COLUMN IF EXISTS created_at;
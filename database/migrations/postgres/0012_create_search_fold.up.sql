@@ -0,0 +1,10 @@
+-- search_fold lower-cases text and folds accented Latin letters to their base letter, like
+-- search.Normalize in Go, so searches can narrow contacts down in SQL before ranking them.
+-- Combining accents and Hebrew points are dropped. SQLite gets the same function from Go.
+CREATE OR REPLACE FUNCTION search_fold(value TEXT) RETURNS TEXT AS $$
+    SELECT replace(replace(replace(replace(
+        translate(regexp_replace(lower(value), '[\u0300-\u036f\u0591-\u05c7]', '', 'g'),
+            'àáâãäåāăąçćĉċčďđèéêëēĕėęěĝğġģĥħìíîïĩīĭįıĵķĺļľŀłñńņňŉòóôõöøōŏőŕŗřśŝşšșţťŧțùúûüũūŭůűųŵýÿŷźżž',
+            'aaaaaaaaacccccddeeeeeeeeegggghhiiiiiiiiijklllllnnnnnooooooooorrrsssssttttuuuuuuuuuuwyyyzzz'),
+        'æ', 'ae'), 'œ', 'oe'), 'ß', 'ss'), 'þ', 'th')
+$$ LANGUAGE SQL IMMUTABLE;
@@ -0,0 +1,8 @@
+-- Restores search_fold as created by 0012_create_search_fold
+CREATE OR REPLACE FUNCTION search_fold(value TEXT) RETURNS TEXT AS $$
+    SELECT replace(replace(replace(replace(
+        translate(regexp_replace(lower(value), '[\u0300-\u036f\u0591-\u05c7]', '', 'g'),
+            'àáâãäåāăąçćĉċčďđèéêëēĕėęěĝğġģĥħìíîïĩīĭįıĵķĺļľŀłñńņňŉòóôõöøōŏőŕŗřśŝşšșţťŧțùúûüũūŭůűųŵýÿŷźżž',
+            'aaaaaaaaacccccddeeeeeeeeegggghhiiiiiiiiijklllllnnnnnooooooooorrrsssssttttuuuuuuuuuuwyyyzzz'),
+        'æ', 'ae'), 'œ', 'oe'), 'ß', 'ss'), 'þ', 'th')
+$$ LANGUAGE SQL IMMUTABLE;
@@ -0,0 +1,11 @@
+-- search_fold drops the same combining marks as search.Normalize in Go, the ranges of
+-- search.CombiningMarks as written by search.MarkClass, instead of only the Latin accents
+-- and Hebrew points, so Arabic harakat and the other marks no longer hide contacts from
+-- searches narrowed down in SQL.
+CREATE OR REPLACE FUNCTION search_fold(value TEXT) RETURNS TEXT AS $$
+    SELECT replace(replace(replace(replace(
+        translate(regexp_replace(lower(value), '[\u0300-\u036f\u0483-\u0489\u0591-\u05bd\u05bf\u05c1-\u05c2\u05c4-\u05c5\u05c7\u0610-\u061a\u064b-\u065f\u0670\u06d6-\u06dc\u06df-\u06e4\u06e7-\u06e8\u06ea-\u06ed\u1ab0-\u1aff\u1dc0-\u1dff\u20d0-\u20ff\ufe20-\ufe2f]', '', 'g'),
+            'àáâãäåāăąçćĉċčďđèéêëēĕėęěĝğġģĥħìíîïĩīĭįıĵķĺļľŀłñńņňŉòóôõöøōŏőŕŗřśŝşšșţťŧțùúûüũūŭůűųŵýÿŷźżž',
+            'aaaaaaaaacccccddeeeeeeeeegggghhiiiiiiiiijklllllnnnnnooooooooorrrsssssttttuuuuuuuuuuwyyyzzz'),
+        'æ', 'ae'), 'œ', 'oe'), 'ß', 'ss'), 'þ', 'th')
+$$ LANGUAGE SQL IMMUTABLE;
@@ -0,0 +1,4 @@
+-- Restores the admin flag, keys with any role but admin become non-admin keys
+ALTER TABLE api_keys ADD COLUMN admin BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE api_keys SET admin = TRUE WHERE role = 'admin';
+ALTER TABLE api_keys DROP COLUMN role;
@@ -0,0 +1,5 @@
+-- The phonebooks of every tenant are merged back into one
+DROP INDEX IF EXISTS contacts_tenant_id_idx;
+ALTER TABLE api_keys DROP COLUMN tenant_id;
+ALTER TABLE contacts DROP COLUMN tenant_id;
+DROP TABLE IF EXISTS tenants;
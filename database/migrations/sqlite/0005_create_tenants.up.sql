@@ -0,0 +1,18 @@
+-- Every contact belongs to one tenant's phonebook. Rows stored before tenants existed move
+-- to the default tenant. SQLite cannot add a column with both a foreign key and a default,
+-- nor drop one with a foreign key, so deleting a tenant removes its rows explicitly.
+CREATE TABLE IF NOT EXISTS tenants (
+    id VARCHAR(63) PRIMARY KEY, -- a DNS label, so it can also be used as a subdomain
+    name VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO tenants (id, name, created_at) VALUES ('default', 'Default', CURRENT_TIMESTAMP)
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE contacts ADD COLUMN tenant_id VARCHAR(63) NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS contacts_tenant_id_idx ON contacts (tenant_id, id);
+
+-- API keys of one tenant, NULL for keys that may pick any tenant
+ALTER TABLE api_keys ADD COLUMN tenant_id VARCHAR(63);
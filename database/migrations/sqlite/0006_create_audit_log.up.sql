@@ -0,0 +1,22 @@
+-- Append-only log of every contact write, written in the transaction of the write.
+-- contact_id has no foreign key: entries outlive the contacts they describe.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant_id VARCHAR(63) NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(10) NOT NULL, -- create, update or delete
+    contact_id INTEGER NOT NULL,
+    contact_before TEXT, -- JSON, NULL for created contacts
+    contact_after TEXT, -- JSON, NULL for deleted contacts
+    request_id VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_contact_id_idx ON audit_log (tenant_id, contact_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (tenant_id, created_at);
+
+-- Entries are never changed once written, they only go away with their tenant
+CREATE TRIGGER IF NOT EXISTS audit_log_append_only BEFORE UPDATE ON audit_log
+BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
@@ -0,0 +1,4 @@
+-- Contacts in the trash are deleted for good, as they were before the trash existed
+DELETE FROM contacts WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS contacts_deleted_at_idx;
+ALTER TABLE contacts DROP COLUMN deleted_at;
@@ -0,0 +1,5 @@
+-- Deleted contacts stay in the trash, stamped with the time they were deleted, until they
+-- are restored or purged
+ALTER TABLE contacts ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS contacts_deleted_at_idx ON contacts (deleted_at) WHERE deleted_at IS NOT NULL;
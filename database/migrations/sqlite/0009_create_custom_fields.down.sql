@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS contact_field_values;
+DROP TABLE IF EXISTS contact_fields;
@@ -0,0 +1,16 @@
+-- Contacts are stamped with the time they were added, so the list can be sorted by it.
+-- Existing contacts get the time of their first audit entry, or the time of the migration
+-- when they were added before the audit log existed.
+ALTER TABLE contacts ADD COLUMN created_at TIMESTAMP;
+
+UPDATE contacts SET created_at = COALESCE(
+    (SELECT MIN(created_at) FROM audit_log WHERE audit_log.tenant_id = contacts.tenant_id AND audit_log.contact_id = contacts.id),
+    CURRENT_TIMESTAMP
+) WHERE created_at IS NULL;
+
+-- The contact list is sorted and filtered within a tenant, text in lowercase
+CREATE INDEX IF NOT EXISTS contacts_first_name_idx ON contacts (tenant_id, LOWER(first_name), id);
+CREATE INDEX IF NOT EXISTS contacts_last_name_idx ON contacts (tenant_id, LOWER(last_name), id);
+CREATE INDEX IF NOT EXISTS contacts_phone_number_idx ON contacts (tenant_id, LOWER(phone_number), id);
+CREATE INDEX IF NOT EXISTS contacts_address_idx ON contacts (tenant_id, LOWER(address), id);
+CREATE INDEX IF NOT EXISTS contacts_created_at_idx ON contacts (tenant_id, created_at, id);
@@ -1,63 +1,343 @@
 package main
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
-	"github.com/gorilla/mux"
 	_ "github.com/lib/pq" // Importing PostgreSQL driver for SQL database interaction
+	_ "modernc.org/sqlite" // Importing pure Go SQLite driver for running without Docker
 
 	"Rise/src" // Import my source code
+	"Rise/src/auth"
+	"Rise/src/migrate"
+	"Rise/src/phone"
 )
 
 
-// enableCORS sets up Cross-Origin Resource Sharing (CORS) headers for all routes.
-// This allows the frontend to make requests to the backend from different domains.
-func enableCORS(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Allow cross-origin requests
-        w.Header().Set("Access-Control-Allow-Origin", "*") 
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-        // If the request method is OPTIONS, respond with a status of 200 (OK)
-        if r.Method == "OPTIONS" {
-            w.WriteHeader(http.StatusOK)
-            return
-        }
-		// Otherwise, pass the request to the next handler
-        next.ServeHTTP(w, r)
-	})
+// openStore builds the contact store selected by the STORE environment variable:
+// "postgres" (default) uses DATABASE_URL, "sqlite" uses SQLITE_PATH and "memory" keeps
+// everything in process memory. The returned function closes the underlying connection.
+// Phone numbers without a country code are read in the PHONE_REGION region (default IL).
+// Pending migrations are applied unless MIGRATE_ON_START is false.
+func openStore() (src.ContactStore, func() error, error) {
+	region, err := phoneRegion()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if os.Getenv("STORE") == "memory" {
+		return src.NewMemoryStore(region), func() error { return nil }, nil
+	}
+	db, dialect, err := openDatabase()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dialect == migrate.Postgres && os.Getenv("MIGRATE_ON_START") != "false" {
+		err = runMigrations(db, dialect, "up", nil)
+	}
+	var store *src.SQLStore
+	if err == nil {
+		store, err = backfilledStore(db, dialect, region)
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return store, db.Close, nil
 }
 
+// phoneRegion returns the PHONE_REGION numbers without a country code are read in (default IL)
+func phoneRegion() (string, error) {
+	region := os.Getenv("PHONE_REGION")
+	if region == "" {
+		region = "IL"
+	}
+	if !phone.IsSupportedRegion(region) {
+		return "", fmt.Errorf("unsupported PHONE_REGION %q, expected one of %v", region, phone.Regions())
+	}
+	return region, nil
+}
+
+// backfilledStore builds the SQL store for db and normalizes the phone numbers stored before
+// they were kept in E.164 form, see backfillPhoneNumbers
+func backfilledStore(db *sql.DB, dialect migrate.Dialect, region string) (*src.SQLStore, error) {
+	var store *src.SQLStore
+	var err error
+	switch dialect {
+	case migrate.Postgres:
+		store = src.NewPostgresStore(db, region)
+	case migrate.SQLite:
+		// The SQLite store applies its migrations itself
+		store, err = src.NewSQLiteStore(db, region)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, backfillPhoneNumbers(store)
+}
+
+// openDatabase opens the database selected by the STORE environment variable, see openStore
+func openDatabase() (*sql.DB, migrate.Dialect, error) {
+	switch os.Getenv("STORE") {
+	case "", "postgres":
+		dbURL := os.Getenv("DATABASE_URL")
+		if dbURL == "" {
+			dbURL = "postgres://postgres:postgres@db:5432/phonebook?sslmode=disable"
+		}
+		db, err := sql.Open("postgres", dbURL)
+		return db, migrate.Postgres, err
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "phonebook.db"
+		}
+		db, err := sql.Open("sqlite", path)
+		return db, migrate.SQLite, err
+	case "memory":
+		return nil, "", fmt.Errorf("STORE=memory has no database to migrate")
+	default:
+		return nil, "", fmt.Errorf("unknown STORE %q, expected postgres, sqlite or memory", os.Getenv("STORE"))
+	}
+}
+
+// runMigrations runs a migrate command: "up" applies every pending migration, "down [n]"
+// reverts the last n migrations (default 1) and "status" lists them
+func runMigrations(db *sql.DB, dialect migrate.Dialect, command string, args []string) error {
+	migrator, err := src.Migrator(db, dialect)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 0 {
+			if steps, err = strconv.Atoi(args[0]); err != nil || steps < 1 {
+				return fmt.Errorf("migrate down takes a positive number of steps, got %q", args[0])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		for _, m := range reverted {
+			log.Printf("Reverted migration %04d_%s", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status()
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+}
+
+// migrateCommand handles "migrate up|down [n]|status" against the database selected by STORE.
+// "up" also backfills the E.164 form of the stored phone numbers like server startup does,
+// so a schema migrated by hand is complete when the server runs with MIGRATE_ON_START=false.
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [n]|status")
+	}
+	db, dialect, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if dialect == migrate.SQLite {
+		db.SetMaxOpenConns(1)
+	}
+	if err := runMigrations(db, dialect, args[0], args[1:]); err != nil || args[0] != "up" {
+		return err
+	}
+	region, err := phoneRegion()
+	if err != nil {
+		return err
+	}
+	_, err = backfilledStore(db, dialect, region)
+	return err
+}
+
+// backfillPhoneNumbers normalizes phone numbers stored before they were kept in E.164 form,
+// such as the rows seeded by the sample contacts migration
+func backfillPhoneNumbers(store *src.SQLStore) error {
+	updated, err := store.BackfillPhoneNumbers()
+	if err != nil {
+		return fmt.Errorf("backfilling phone numbers: %w", err)
+	}
+	if updated > 0 {
+		log.Printf("Normalized %d stored phone number(s)", updated)
+	}
+	return nil
+}
+
+// openAuthenticator builds the authenticator from the environment. AUTH=off serves the API
+// without authentication. ADMIN_API_KEY is always accepted with the admin role, used to
+// create the first stored keys. JWT bearer tokens are accepted when JWT_HS256_SECRET,
+// JWT_KEYS_FILE (a JSON Web Key Set) or JWT_RS256_PUBLIC_KEY_FILE (PEM) is set, and must
+// match JWT_ISSUER and JWT_AUDIENCE when those are set. ROLES_FILE adds custom roles,
+// a JSON object of role names to permissions, to the built-in ones.
+func openAuthenticator(store src.ContactStore) (*src.Authenticator, error) {
+	if os.Getenv("AUTH") == "off" {
+		log.Printf("AUTH=off, the API is served without authentication")
+		return nil, nil
+	}
+	keys, ok := store.(src.APIKeyStore)
+	if !ok {
+		return nil, fmt.Errorf("the store cannot hold API keys")
+	}
+
+	var jwtKeys []auth.Key
+	if secret := os.Getenv("JWT_HS256_SECRET"); secret != "" {
+		jwtKeys = append(jwtKeys, auth.NewHMACKey("", []byte(secret)))
+	}
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		set, err := auth.ParseJWKS(data)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_KEYS_FILE: %w", err)
+		}
+		jwtKeys = append(jwtKeys, set...)
+	}
+	if path := os.Getenv("JWT_RS256_PUBLIC_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		public, err := auth.ParseRSAPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+		}
+		jwtKeys = append(jwtKeys, auth.NewRSAKey("", public))
+	}
+
+	var tokens *auth.Validator
+	if len(jwtKeys) > 0 {
+		tokens = &auth.Validator{
+			Keys:     jwtKeys,
+			Issuer:   os.Getenv("JWT_ISSUER"),
+			Audience: os.Getenv("JWT_AUDIENCE"),
+			Leeway:   time.Minute,
+		}
+	}
+	roles := src.DefaultRoles()
+	if path := os.Getenv("ROLES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if roles, err = src.ParseRoles(data); err != nil {
+			return nil, fmt.Errorf("ROLES_FILE: %w", err)
+		}
+	}
+	return src.NewAuthenticator(keys, tokens, roles, os.Getenv("ADMIN_API_KEY")), nil
+}
+
+// startPurger starts removing contacts from the trash once they have been there for
+// TRASH_RETENTION (a Go duration, default 720h, i.e. 30 days), checking every
+// TRASH_PURGE_INTERVAL (default 1h). The returned function stops it.
+func startPurger(store src.ContactStore) (func(), error) {
+	trash, ok := store.(src.TrashStore)
+	if !ok {
+		return func() {}, nil
+	}
+	retention, err := durationSetting("TRASH_RETENTION", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	interval, err := durationSetting("TRASH_PURGE_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return src.StartPurger(trash, retention, interval), nil
+}
+
+// durationSetting reads a positive duration from the environment variable, or returns the fallback when it is unset
+func durationSetting(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration such as 720h, got %q", name, value)
+	}
+	return duration, nil
+}
 
 func main() {
-	// Database connection setup
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		dbURL = "postgres://postgres:postgres@db:5432/phonebook?sslmode=disable"
+	// "migrate up|down [n]|status" manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	// Open the database connection
-	db, err := sql.Open("postgres", dbURL)
+	// Storage setup
+	store, closeStore, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeStore()
+
+	// Contacts left in the trash are purged in the background
+	stopPurger, err := startPurger(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer stopPurger()
+
+	// Authentication of every request
+	authenticator, err := openAuthenticator(store)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
-	// Create router
-	r := mux.NewRouter()
+	// Create router with all API routes
+	var r http.Handler = src.NewRouter(store, authenticator)
+
+	// Contacts added one at a time are checked against the stored ones under
+	// DUPLICATE_POLICY: allow, warn (default) or reject
+	policyName := os.Getenv("DUPLICATE_POLICY")
+	if policyName == "" {
+		policyName = string(src.DuplicatesWarn)
+	}
+	policy, err := src.ParseDuplicatePolicy(policyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r = src.WithDuplicatePolicy(policy, r)
 
-	// Use the new handler for retrieving contacts
-	r.HandleFunc("/getContacts", src.GetContactsHandler(db)).Methods("GET")
-	r.HandleFunc("/addContact", src.AddContactHandler(db)).Methods("POST")
-	r.HandleFunc("/deleteContact/{phone_number}", src.DeleteContactHandler(db)).Methods("DELETE")
-	r.HandleFunc("/searchContact/{phone_number}", src.SearchContactHandler(db)).Methods("GET")
-	r.HandleFunc("/editContact/{phone_number}", src.EditContactHandler(db)).Methods("PUT")
+	// Tenants may also be picked by subdomain, e.g. acme.TENANT_DOMAIN
+	if domain := os.Getenv("TENANT_DOMAIN"); domain != "" {
+		r = src.TenantSubdomains(domain, r)
+	}
 
-	// Wrap router with CORS middleware
-    handler := enableCORS(r)
+	// Browsers may call the API from ALLOWED_ORIGINS, by default the frontend opened as a file
+	origins := src.DefaultAllowedOrigins
+	if value := os.Getenv("ALLOWED_ORIGINS"); value != "" {
+		origins = src.ParseAllowedOrigins(value)
+	}
+    handler := src.CORS(origins, r)
 
     // Start server
     log.Printf("Server starting on port 8080...")
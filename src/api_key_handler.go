@@ -0,0 +1,139 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"Rise/src/auth"
+)
+
+// apiKeyNotFoundMessage is shown when no active API key has the requested id
+const apiKeyNotFoundMessage = "No active API key exists with the given id"
+
+// CreateAPIKeyHandler handles POST /api/v1/admin/api-keys. The key gets one of the roles,
+// viewer when none is given, and a caller cannot grant a permission it lacks itself.
+// Keys created by a caller bound to a tenant are bound to the same tenant, other callers
+// may name one or leave the key free to pick any tenant.
+// The response is the only time the key itself is shown, the server keeps just its hash.
+func CreateAPIKeyHandler(keys APIKeyStore, tenants TenantStore, roles Roles) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Name   string `json:"name"`
+			Role   string `json:"role"`
+			Tenant string `json:"tenant"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Role == "" {
+			request.Role = RoleViewer
+		}
+		principal, _ := PrincipalFromContext(r.Context())
+		if principal.Tenant != "" {
+			if request.Tenant != "" && request.Tenant != principal.Tenant {
+				writeError(w, r, http.StatusForbidden, CodeForbidden,
+					fmt.Sprintf("The credentials only allow keys of tenant %s.", principal.Tenant))
+				return
+			}
+			request.Tenant = principal.Tenant
+		}
+		// Only keys that may manage tenants are left unbound, see Principal.bound
+		if request.Tenant == "" && tenants != nil && !slices.Contains(roles[request.Role], PermissionManageTenants) {
+			request.Tenant = DefaultTenant
+		}
+
+		var details []ErrorDetail
+		if request.Name == "" {
+			details = append(details, ErrorDetail{Field: "name", Issue: "is required"})
+		}
+		if _, ok := roles[request.Role]; !ok {
+			details = append(details, ErrorDetail{Field: "role", Issue: "must be one of " + strings.Join(roles.Names(), ", ")})
+		}
+		if request.Tenant != "" && tenants == nil {
+			details = append(details, ErrorDetail{Field: "tenant", Issue: "is not supported by the store"})
+		} else if request.Tenant != "" {
+			if _, err := tenants.GetTenant(request.Tenant); errors.Is(err, ErrNotFound) {
+				details = append(details, ErrorDetail{Field: "tenant", Issue: "must name an existing tenant"})
+			} else if err != nil {
+				writeStoreError(w, r, err, "")
+				return
+			}
+		}
+		if len(details) > 0 {
+			writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The API key is invalid.", details...)
+			return
+		}
+		for _, permission := range roles[request.Role] {
+			if !principal.Can(permission) {
+				writeError(w, r, http.StatusForbidden, CodeForbidden,
+					fmt.Sprintf("Granting the %s role needs the %s permission.", request.Role, permission),
+					ErrorDetail{Field: "permission", Issue: permission + " is missing"})
+				return
+			}
+		}
+
+		key, prefix, err := auth.GenerateAPIKey()
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		created, err := keys.CreateAPIKey(APIKey{Name: request.Name, Prefix: prefix, Role: request.Role, Tenant: request.Tenant}, auth.HashAPIKey(key))
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+
+		response := struct {
+			APIKey
+			Key string `json:"key"`
+		}{created, key}
+		writeJSON(w, http.StatusCreated, response)
+	}
+}
+
+// ListAPIKeysHandler handles GET /api/v1/admin/api-keys, revoked keys included. Callers
+// bound to a tenant only see that tenant's keys.
+func ListAPIKeysHandler(keys APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		list, err := keys.ListAPIKeys(principal.Tenant)
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		if list == nil {
+			list = []APIKey{}
+		}
+		writeJSON(w, http.StatusOK, struct {
+			APIKeys []APIKey `json:"api_keys"`
+		}{list})
+	}
+}
+
+// RevokeAPIKeyHandler handles DELETE /api/v1/admin/api-keys/{id} and answers 204.
+// A revoked key is refused from the next request on. Callers bound to a tenant can only
+// revoke that tenant's keys.
+func RevokeAPIKeyHandler(keys APIKeyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil || id < 1 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The API key id must be a positive number.")
+			return
+		}
+		principal, _ := PrincipalFromContext(r.Context())
+		if err := keys.RevokeAPIKey(principal.Tenant, id); err != nil {
+			writeStoreError(w, r, err, apiKeyNotFoundMessage)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,86 @@
+package src
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// anonymousActor is recorded for requests served without authentication
+const anonymousActor = "anonymous"
+
+// actorOf returns who a request is made by: the subject of its principal, or anonymousActor
+// when authentication is off, along with the request id
+func actorOf(r *http.Request) Actor {
+	actor := Actor{Name: anonymousActor, RequestID: RequestIDFromContext(r.Context())}
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		actor.Name = principal.Subject
+	}
+	return actor
+}
+
+// AuditLogHandler handles GET /audit with the audit entries of the tenant, newest first.
+// ?contact_id= and ?actor= narrow the entries down, ?since= and ?until= (RFC 3339) bound the
+// time they were made, and ?limit= and ?before= page through them.
+func AuditLogHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		audited, ok := store.(AuditStore)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "The store keeps no audit log.")
+			return
+		}
+		filter, ok := readAuditFilter(w, r)
+		if !ok {
+			return
+		}
+
+		entries, hasMore, err := audited.AuditLog(filter)
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		response := struct {
+			Entries    []AuditEntry `json:"entries"`
+			NextCursor string       `json:"next_cursor,omitempty"`
+		}{Entries: entries}
+		if hasMore {
+			response.NextCursor = encodeCursor(entries[len(entries)-1].ID)
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// readAuditFilter reads the query parameters of GET /audit. On failure the error response
+// has been written and ok is false.
+func readAuditFilter(w http.ResponseWriter, r *http.Request) (filter AuditFilter, ok bool) {
+	query := r.URL.Query()
+	limit, err := parsePageSize(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return filter, false
+	}
+	filter.Limit = limit
+	if filter.BeforeID, err = decodeCursor(query.Get("before")); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid before cursor.")
+		return filter, false
+	}
+	if value := query.Get("contact_id"); value != "" {
+		if filter.ContactID, err = strconv.Atoi(value); err != nil || filter.ContactID < 1 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "contact_id must be a positive number.")
+			return filter, false
+		}
+	}
+	filter.Actor = query.Get("actor")
+	for _, bound := range []struct {
+		name   string
+		target *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if value := query.Get(bound.name); value != "" {
+			if *bound.target, err = time.Parse(time.RFC3339, value); err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, bound.name+" must be an RFC 3339 time, e.g. 2024-01-31T09:00:00Z.")
+				return filter, false
+			}
+		}
+	}
+	return filter, true
+}
@@ -0,0 +1,160 @@
+package src
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"Rise/src/auth"
+)
+
+// Authentication methods a Principal can come from
+const (
+	AuthAPIKey = "api_key"
+	AuthJWT    = "jwt"
+)
+
+// Principal is the caller a request was authenticated as
+type Principal struct {
+	Subject     string   // "api_key:<id>" for stored keys, the sub claim for tokens
+	Method      string   // AuthAPIKey or AuthJWT
+	Roles       []string // the role of the key, or the roles claim of the token
+	Tenant      string   // the only tenant the caller may use, empty when it may pick any, see bound
+	permissions map[string]bool
+}
+
+// PrincipalFromContext returns the principal attached by the Authenticator
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(Principal)
+	return principal, ok
+}
+
+// Authenticator checks the credentials of every request: an API key in X-API-Key or
+// as a bearer token, or a JWT bearer token signed by one of the configured keys.
+type Authenticator struct {
+	keys      APIKeyStore
+	tokens    *auth.Validator // nil when no JWT keys are configured
+	roles     Roles
+	adminHash string // hash of the bootstrap admin key, empty when unset
+}
+
+// NewAuthenticator returns an authenticator over the stored API keys and, when tokens is
+// not nil, JWT bearer tokens. Principals get the permissions of their roles, nil roles
+// means DefaultRoles. adminKey is a key that is always accepted with the admin role, used
+// to create the first stored keys; leave it empty to disable it.
+func NewAuthenticator(keys APIKeyStore, tokens *auth.Validator, roles Roles, adminKey string) *Authenticator {
+	if roles == nil {
+		roles = DefaultRoles()
+	}
+	a := &Authenticator{keys: keys, tokens: tokens, roles: roles}
+	if adminKey != "" {
+		a.adminHash = auth.HashAPIKey(adminKey)
+	}
+	return a
+}
+
+// credentialError explains why the credentials of a request were not accepted
+type credentialError struct {
+	reason string
+}
+
+func (e *credentialError) Error() string {
+	return e.reason
+}
+
+// Middleware rejects requests without valid credentials with 401 and attaches the
+// Principal to the context of the others
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r)
+		var credentialErr *credentialError
+		switch {
+		case errors.As(err, &credentialErr):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="phonebook"`)
+			writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, credentialErr.reason)
+		case err != nil:
+			writeStoreError(w, r, err, "")
+		default:
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, principal)))
+		}
+	})
+}
+
+// authenticate finds the principal behind the request credentials
+func (a *Authenticator) authenticate(r *http.Request) (Principal, error) {
+	credential := r.Header.Get("X-API-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && credential == "" {
+		credential = strings.TrimSpace(bearer)
+		if a.tokens != nil && auth.LooksLikeJWT(credential) {
+			return a.verifyToken(credential)
+		}
+	}
+	if credential == "" {
+		return Principal{}, &credentialError{"Missing credentials, send an API key in X-API-Key or a bearer token in Authorization."}
+	}
+	return a.verifyAPIKey(credential)
+}
+
+// verifyToken checks a JWT bearer token. Its roles come from the roles claim, a list of
+// role names or a single name, and the tenant claim binds it to one tenant.
+func (a *Authenticator) verifyToken(token string) (Principal, error) {
+	claims, err := a.tokens.Verify(token, time.Now())
+	if err != nil {
+		return Principal{}, &credentialError{"The bearer token was not accepted: " + err.Error() + "."}
+	}
+	if claims.Subject == "" {
+		return Principal{}, &credentialError{"The bearer token has no sub claim."}
+	}
+	var roles []string
+	switch claim := claims.Raw["roles"].(type) {
+	case string:
+		roles = []string{claim}
+	case []any:
+		for _, role := range claim {
+			if name, ok := role.(string); ok {
+				roles = append(roles, name)
+			}
+		}
+	}
+	tenant, _ := claims.Raw["tenant"].(string)
+	return a.principal(claims.Subject, AuthJWT, roles).bound(tenant), nil
+}
+
+// verifyAPIKey looks an API key up by its hash
+func (a *Authenticator) verifyAPIKey(key string) (Principal, error) {
+	hash := auth.HashAPIKey(key)
+	if a.adminHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.adminHash)) == 1 {
+		return a.principal("api_key:admin", AuthAPIKey, []string{RoleAdmin}), nil
+	}
+	stored, err := a.keys.APIKeyByHash(hash)
+	if errors.Is(err, ErrNotFound) {
+		return Principal{}, &credentialError{"The API key is not known."}
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if stored.RevokedAt != nil {
+		return Principal{}, &credentialError{"The API key was revoked."}
+	}
+	return a.principal("api_key:"+strconv.Itoa(stored.ID), AuthAPIKey, []string{stored.Role}).bound(stored.Tenant), nil
+}
+
+// bound binds the principal to the tenant of its credentials. Only principals that may
+// manage tenants can be left unbound, others without a tenant are bound to DefaultTenant so
+// that missing tenants fail closed rather than opening every tenant.
+func (p Principal) bound(tenant string) Principal {
+	if tenant == "" && !p.Can(PermissionManageTenants) {
+		tenant = DefaultTenant
+	}
+	p.Tenant = tenant
+	return p
+}
+
+// principal builds a principal with the permissions granted by its roles
+func (a *Authenticator) principal(subject, method string, roles []string) Principal {
+	return Principal{Subject: subject, Method: method, Roles: roles, permissions: a.roles.permissionsOf(roles)}
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// apiKeyPrefix starts every generated API key, which tells keys apart from JWTs at a glance
+const apiKeyPrefix = "rk_"
+
+// GenerateAPIKey returns a new random API key and the short prefix stored to identify it
+func GenerateAPIKey() (key, prefix string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, key[:len(apiKeyPrefix)+6], nil
+}
+
+// HashAPIKey returns the hash an API key is stored and looked up by. Keys are 256 random
+// bits, so a plain SHA-256 cannot be brute forced and keeps lookups to one indexed query.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LooksLikeJWT reports whether a bearer credential has the three segments of a compact JWT
+func LooksLikeJWT(credential string) bool {
+	return strings.Count(credential, ".") == 2 && !strings.HasPrefix(credential, apiKeyPrefix)
+}
@@ -0,0 +1,241 @@
+// Package auth verifies the credentials accepted by the server: JWT bearer tokens signed
+// with HS256 or RS256 (RFC 7519), checked against a configured key set, and random API
+// keys that are only ever stored as a hash.
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+)
+
+// Errors returned by Validator.Verify
+var (
+	ErrMalformedToken = errors.New("token is not a well-formed JWT")
+	ErrUnknownKey     = errors.New("token is not signed by a known key")
+	ErrBadSignature   = errors.New("token signature is invalid")
+	ErrExpired        = errors.New("token has expired")
+	ErrNoExpiry       = errors.New("token has no expiry")
+	ErrNotYetValid    = errors.New("token is not valid yet")
+	ErrClaims         = errors.New("token issuer or audience does not match")
+)
+
+// Key is a verification key. HS256 keys hold the shared secret, RS256 keys the public key.
+type Key struct {
+	ID        string // matched against the kid header, empty matches any token
+	Algorithm string
+	secret    []byte
+	public    *rsa.PublicKey
+}
+
+// NewHMACKey returns an HS256 key
+func NewHMACKey(id string, secret []byte) Key {
+	return Key{ID: id, Algorithm: HS256, secret: secret}
+}
+
+// NewRSAKey returns an RS256 key
+func NewRSAKey(id string, public *rsa.PublicKey) Key {
+	return Key{ID: id, Algorithm: RS256, public: public}
+}
+
+// ParseRSAPublicKey reads a PEM encoded RSA public key (PKIX or PKCS #1)
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("PEM block does not hold an RSA public key")
+	}
+	return key, nil
+}
+
+// ParseJWKS reads a JSON Web Key Set (RFC 7517) holding "oct" keys for HS256 and "RSA"
+// keys for RS256. Keys meant for other algorithms are skipped.
+func ParseJWKS(data []byte) ([]Key, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("reading key set: %w", err)
+	}
+
+	var keys []Key
+	for i, jwk := range set.Keys {
+		switch {
+		case jwk.Kty == "oct" && (jwk.Alg == "" || jwk.Alg == HS256):
+			secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("key %d: invalid k", i)
+			}
+			keys = append(keys, NewHMACKey(jwk.Kid, secret))
+		case jwk.Kty == "RSA" && (jwk.Alg == "" || jwk.Alg == RS256):
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %d: invalid n or e", i)
+			}
+			public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys = append(keys, NewRSAKey(jwk.Kid, public))
+		}
+	}
+	return keys, nil
+}
+
+// Claims are the registered claims of a verified token. Every claim, including private
+// ones, is kept in Raw.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	Raw       map[string]any
+}
+
+// Validator verifies tokens against a key set and optional issuer and audience
+type Validator struct {
+	Keys     []Key
+	Issuer   string        // required iss claim, empty accepts any issuer
+	Audience string        // required member of the aud claim, empty accepts any audience
+	Leeway   time.Duration // clock skew tolerated for exp and nbf
+}
+
+// Verify checks the signature and time claims of a compact JWT and returns its claims.
+// The algorithm must match the key that verifies it, so an RSA public key can never be
+// used as an HMAC secret. Tokens must carry an exp claim, a leaked token without one would
+// be valid forever.
+func (v *Validator) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformedToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified, known := false, false
+	for _, key := range v.Keys {
+		if key.Algorithm != header.Alg || (header.Kid != "" && key.ID != "" && key.ID != header.Kid) {
+			continue
+		}
+		known = true
+		if key.verify(signed, signature) {
+			verified = true
+			break
+		}
+	}
+	switch {
+	case !known:
+		return Claims{}, ErrUnknownKey
+	case !verified:
+		return Claims{}, ErrBadSignature
+	}
+
+	var raw map[string]any
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+	claims := Claims{Raw: raw}
+	claims.Subject, _ = raw["sub"].(string)
+	claims.Issuer, _ = raw["iss"].(string)
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+	exp, ok := raw["exp"].(float64)
+	if !ok {
+		return Claims{}, ErrNoExpiry
+	}
+	claims.ExpiresAt = time.Unix(int64(exp), 0)
+	if now.After(claims.ExpiresAt.Add(v.Leeway)) {
+		return Claims{}, ErrExpired
+	}
+	if nbf, ok := raw["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return Claims{}, ErrNotYetValid
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return Claims{}, ErrClaims
+	}
+	if v.Audience != "" && !contains(claims.Audience, v.Audience) {
+		return Claims{}, ErrClaims
+	}
+	return claims, nil
+}
+
+// verify checks a signature made with the key's algorithm
+func (k Key) verify(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch k.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case RS256:
+		return rsa.VerifyPKCS1v15(k.public, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Batch modes, see BatchHandler
+const (
+	BatchAllOrNothing = "all_or_nothing" // one transaction, the first failure undoes every operation
+	BatchBestEffort   = "best_effort"    // every operation on its own, each with its result
+)
+
+// maxBatchOperations bounds the number of operations in one batch
+const maxBatchOperations = 1000
+
+// Operations of a batch
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+)
+
+// batchRequest is the body of POST /contacts:batch
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation is one create, update or delete of a batch. Updates and deletes pick their
+// contact by id, or every contact with phone_number like /editContact and /deleteContact.
+type batchOperation struct {
+	Op          string          `json:"op"`
+	ID          int             `json:"id"`
+	PhoneNumber string          `json:"phone_number"`
+	Version     int             `json:"version"`           // checked like If-Match, only with id
+	Contact     json.RawMessage `json:"contact,omitempty"` // the new contact, or a merge patch for updates
+}
+
+// BatchResult is the outcome of one operation of a batch: the status it would have answered
+// on its own, the ids of the contacts it touched and the stored contacts, or the error.
+// Creates under the warn duplicate policy also name the contacts they likely duplicate.
+type BatchResult struct {
+	Index              int            `json:"index"`
+	Op                 string         `json:"op"`
+	Status             int            `json:"status"`
+	IDs                []int          `json:"ids,omitempty"`
+	Contacts           []Contact      `json:"contacts,omitempty"`
+	PossibleDuplicates []int          `json:"possible_duplicates,omitempty"`
+	Error              *ErrorResponse `json:"error,omitempty"`
+}
+
+// BatchHandler handles POST /contacts:batch, which runs a list of operations, e.g.
+// {"mode":"best_effort","operations":[{"op":"create","contact":{...}},
+// {"op":"update","phone_number":"0521234567","contact":{"address":"Haifa"}},{"op":"delete","id":7}]}.
+// In all_or_nothing mode (the default) the operations run in one transaction: either every
+// operation is applied and it answers 200 with their results, or none is and it answers with
+// the error of the first failed operation. In best_effort mode every operation runs in its
+// own transaction and it answers 200 with the result of each. Deletes need contacts:delete,
+// and creates follow the duplicate policy, see WithDuplicatePolicy.
+func BatchHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transactions, ok := store.(TransactionStore)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "The store cannot run batches.")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		var request batchRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+			return
+		}
+		if request.Mode == "" {
+			request.Mode = BatchAllOrNothing
+		}
+		if request.Mode != BatchAllOrNothing && request.Mode != BatchBestEffort {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "mode must be all_or_nothing or best_effort.")
+			return
+		}
+		if len(request.Operations) == 0 || len(request.Operations) > maxBatchOperations {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest,
+				fmt.Sprintf("operations must list between 1 and %d operations.", maxBatchOperations))
+			return
+		}
+		if principal, ok := PrincipalFromContext(r.Context()); ok && !principal.Can(PermissionDelete) {
+			for _, op := range request.Operations {
+				if op.Op == batchDelete {
+					writeForbidden(w, r, PermissionDelete)
+					return
+				}
+			}
+		}
+
+		// Creates are checked against the stored contacts within the batch's transaction
+		policy := requestPolicy(r)
+		results := make([]BatchResult, len(request.Operations))
+		failed := 0
+		if request.Mode == BatchAllOrNothing {
+			failedAt := -1
+			err := transactions.InTransaction(func(tx ContactStore) error {
+				for i, op := range request.Operations {
+					result, err := runBatchOperation(tx, policy, op)
+					if err != nil {
+						failedAt = i
+						return err
+					}
+					results[i] = result
+				}
+				return nil
+			})
+			if err != nil && failedAt < 0 {
+				writeStoreError(w, r, err, "")
+				return
+			}
+			if err != nil {
+				writeBatchError(w, r, failedAt, request.Operations[failedAt], err)
+				return
+			}
+		} else {
+			for i, op := range request.Operations {
+				err := transactions.InTransaction(func(tx ContactStore) error {
+					var err error
+					results[i], err = runBatchOperation(tx, policy, op)
+					return err
+				})
+				if err != nil {
+					status, response := storeError(r, err, op.notFoundMessage())
+					response.RequestID = ""
+					results[i] = BatchResult{Op: op.Op, Status: status, Error: &response}
+					failed++
+				}
+			}
+		}
+		for i := range results {
+			results[i].Index = i
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			Mode      string        `json:"mode"`
+			Succeeded int           `json:"succeeded"`
+			Failed    int           `json:"failed"`
+			Results   []BatchResult `json:"results"`
+		}{request.Mode, len(results) - failed, failed, results})
+	}
+}
+
+// writeBatchError answers with the error of the operation that undid an all_or_nothing
+// batch, its details prefixed with the position of the operation
+func writeBatchError(w http.ResponseWriter, r *http.Request, index int, op batchOperation, err error) {
+	status, response := storeError(r, err, op.notFoundMessage())
+	prefix := fmt.Sprintf("operations[%d]", index)
+	details := []ErrorDetail{{Field: prefix, Issue: response.Message}}
+	for _, detail := range response.Details {
+		details = append(details, ErrorDetail{Field: prefix + "." + detail.Field, Issue: detail.Issue})
+	}
+	writeError(w, r, status, response.Code,
+		fmt.Sprintf("Operation %d failed, no operation was applied.", index), details...)
+}
+
+// runBatchOperation runs one operation of a batch on the store, in a transaction. Creates
+// are checked under the duplicate policy, a likely duplicate fails them under DuplicatesReject.
+func runBatchOperation(store ContactStore, policy DuplicatePolicy, op batchOperation) (BatchResult, error) {
+	result := BatchResult{Op: op.Op, Status: http.StatusOK}
+	if details := op.fieldErrors(); len(details) > 0 {
+		return result, &ValidationError{Details: details}
+	}
+
+	if op.Op == batchCreate {
+		var contact Contact
+		if err := json.Unmarshal(op.Contact, &contact); err != nil {
+			return result, &ValidationError{Details: []ErrorDetail{{Field: "contact", Issue: "must be a contact object"}}}
+		}
+		if details := contactErrors(&contact); len(details) > 0 {
+			return result, &ValidationError{Details: details}
+		}
+		id, matches, err := addChecked(store, policy, contact)
+		if err != nil {
+			return result, err
+		}
+		stored, err := store.GetContact(id)
+		if err != nil {
+			return result, err
+		}
+		result.Status, result.IDs, result.Contacts = http.StatusCreated, []int{id}, []Contact{stored}
+		result.PossibleDuplicates = duplicateIDs(matches)
+		return result, nil
+	}
+
+	var patch ContactPatch
+	if op.Op == batchUpdate {
+		var err error
+		if patch, err = parseMergePatch(bytes.NewReader(op.Contact)); err != nil {
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				err = &ValidationError{Details: []ErrorDetail{{Field: "contact", Issue: err.Error()}}}
+			}
+			return result, err
+		}
+	}
+	ids, err := op.targets(store)
+	if err != nil {
+		return result, err
+	}
+	for _, id := range ids {
+		if op.Op == batchDelete {
+			err = store.DeleteContact(id, op.Version)
+		} else {
+			var contact Contact
+			if contact, err = store.PatchContact(id, patch, op.Version); err == nil {
+				result.Contacts = append(result.Contacts, contact)
+			}
+		}
+		if err != nil {
+			return result, err
+		}
+		result.IDs = append(result.IDs, id)
+	}
+	if op.Op == batchDelete {
+		result.Status = http.StatusNoContent
+	}
+	return result, nil
+}
+
+// fieldErrors checks the shape of an operation before it runs
+func (op batchOperation) fieldErrors() []ErrorDetail {
+	var details []ErrorDetail
+	switch op.Op {
+	case batchCreate:
+		if op.ID != 0 || op.PhoneNumber != "" || op.Version != 0 {
+			details = append(details, ErrorDetail{Field: "op", Issue: "create takes no id, phone_number or version"})
+		}
+	case batchUpdate, batchDelete:
+		if (op.ID > 0) == (op.PhoneNumber != "") {
+			details = append(details, ErrorDetail{Field: "id", Issue: "either id or phone_number is required"})
+		}
+		if op.Version != 0 && op.ID == 0 {
+			details = append(details, ErrorDetail{Field: "version", Issue: "is only allowed with id"})
+		}
+	default:
+		return []ErrorDetail{{Field: "op", Issue: "must be create, update or delete"}}
+	}
+	if op.Op != batchDelete && len(op.Contact) == 0 {
+		details = append(details, ErrorDetail{Field: "contact", Issue: "is required"})
+	}
+	return details
+}
+
+// targets returns the ids of the contacts an update or delete acts on
+func (op batchOperation) targets(store ContactStore) ([]int, error) {
+	if op.ID > 0 {
+		return []int{op.ID}, nil
+	}
+	contacts, err := store.SearchContact(op.PhoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(contacts))
+	for i, contact := range contacts {
+		ids[i] = contact.ID
+	}
+	return ids, nil
+}
+
+// notFoundMessage is the error message of an operation whose contact does not exist
+func (op batchOperation) notFoundMessage() string {
+	if op.PhoneNumber != "" {
+		return "The number provided is not in the phone book"
+	}
+	return contactNotFoundMessage
+}
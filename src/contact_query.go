@@ -0,0 +1,276 @@
+package src
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators of the column filters of the contact list, e.g. ?last_name.prefix=co
+const (
+	FilterEq       = "eq"       // the whole value matches
+	FilterPrefix   = "prefix"   // the value starts with the text
+	FilterContains = "contains" // the value contains the text
+)
+
+var (
+	// filterOperators lists every operator of the column filters
+	filterOperators = []string{FilterEq, FilterPrefix, FilterContains}
+	// filterFields lists the fields the contact list can be filtered by, see columnExpressions
+	filterFields = []string{"first_name", "last_name", "phone_number", "address"}
+	// sortFields lists the fields the contact list can be sorted by, see columnExpressions
+	sortFields = []string{"first_name", "last_name", "phone_number", "address", "created_at"}
+)
+
+// ColumnCondition matches the contacts whose field, one of filterFields, matches the value
+// under the operator. Text is compared in lowercase.
+type ColumnCondition struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// SortKey orders contacts by one of sortFields or by a custom field. Contacts without a
+// value come last in either direction, ties are ordered by id.
+type SortKey struct {
+	Field   string
+	Custom  bool // Field names a custom field
+	Numeric bool // compare the values as numbers rather than as text
+	Desc    bool
+}
+
+// SortCursor is a position in a sorted contact list: the values of the sort keys of a
+// contact, nil where it has none, and its id. Values are kept as stored, not lowercased, and
+// compared the way the keys compare the contacts, see cursorOrder.
+type SortCursor struct {
+	Values []*string `json:"values"`
+	ID     int       `json:"id"`
+}
+
+// parseColumnConditions reads the ?<field>.<operator>= parameters of a request, such as
+// ?address.eq=tel aviv or ?first_name.contains=an. On failure the error response has been
+// written and ok is false.
+func parseColumnConditions(w http.ResponseWriter, r *http.Request) (conditions []ColumnCondition, ok bool) {
+	var parameters []string
+	for parameter := range r.URL.Query() {
+		if field, _, found := strings.Cut(parameter, "."); found && oneOf(field, filterFields) {
+			parameters = append(parameters, parameter)
+		}
+	}
+	sort.Strings(parameters)
+	for _, parameter := range parameters {
+		field, op, _ := strings.Cut(parameter, ".")
+		if !oneOf(op, filterOperators) {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest,
+				fmt.Sprintf("%s is not a filter, use %s.eq, %s.prefix or %s.contains.", parameter, field, field, field))
+			return nil, false
+		}
+		value := strings.TrimSpace(r.URL.Query().Get(parameter))
+		if value == "" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("%s must not be empty.", parameter))
+			return nil, false
+		}
+		conditions = append(conditions, ColumnCondition{Field: field, Op: op, Value: value})
+	}
+	return conditions, true
+}
+
+// parseContactSort reads ?sort=, a comma separated list of the fields to order the contact
+// list by, each prefixed with - for descending order, e.g. sort=address,-created_at or
+// sort=custom_fields.team,last_name. On failure the error response has been written and ok
+// is false.
+func parseContactSort(w http.ResponseWriter, r *http.Request, store ContactStore) (keys []SortKey, ok bool) {
+	value := r.URL.Query().Get("sort")
+	if value == "" {
+		return nil, true
+	}
+	for _, item := range strings.Split(value, ",") {
+		key := SortKey{}
+		item, key.Desc = strings.CutPrefix(strings.TrimSpace(item), "-")
+		name, custom := strings.CutPrefix(item, customFieldPrefix)
+		switch {
+		case oneOf(item, sortFields):
+			key.Field = item
+		case custom && name != "":
+			registry, ok := fieldStore(w, r, store)
+			if !ok {
+				return nil, false
+			}
+			field, ok := lookupField(w, r, registry, name)
+			if !ok {
+				return nil, false
+			}
+			key.Field, key.Custom, key.Numeric = field.Name, true, field.Type == FieldNumber
+		default:
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest,
+				fmt.Sprintf("sort can only order by %s or custom fields, e.g. sort=last_name,-%sbirthday.",
+					strings.Join(sortFields, ", "), customFieldPrefix))
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// columnText returns the value of one of filterFields or sortFields as it is compared, the
+// way columnExpressions compares it in the database
+func columnText(contact Contact, field string) string {
+	switch field {
+	case "first_name":
+		return strings.ToLower(contact.FirstName)
+	case "last_name":
+		return strings.ToLower(contact.LastName)
+	case "phone_number":
+		return strings.ToLower(contact.PhoneNumber)
+	case "address":
+		return strings.ToLower(contact.Address)
+	case "created_at":
+		if !contact.CreatedAt.IsZero() {
+			return contact.CreatedAt.UTC().Format(time.RFC3339)
+		}
+	}
+	return ""
+}
+
+// matchesColumn reports whether the contact passes a column filter
+func matchesColumn(contact Contact, condition ColumnCondition) bool {
+	value, text := columnText(contact, condition.Field), strings.ToLower(condition.Value)
+	switch condition.Op {
+	case FilterEq:
+		return value == text
+	case FilterPrefix:
+		return strings.HasPrefix(value, text)
+	case FilterContains:
+		return strings.Contains(value, text)
+	}
+	return false
+}
+
+// sortValue returns the value the contact is ordered by for the key, as a number for numeric
+// custom fields and as text otherwise. ok is false when the contact has no value.
+func sortValue(key SortKey, contact Contact) (text string, number float64, ok bool) {
+	if !key.Custom {
+		text = columnText(contact, key.Field)
+		return text, 0, text != "" || key.Field != "created_at"
+	}
+	value, ok := contact.CustomFields[key.Field]
+	if !ok {
+		return "", 0, false
+	}
+	if key.Numeric {
+		number, _ = value.(float64)
+	}
+	return fieldText(value), number, true
+}
+
+// sortCursor returns the position of the contact in a list ordered by the keys
+func sortCursor(keys []SortKey, contact Contact) SortCursor {
+	cursor := SortCursor{Values: make([]*string, len(keys)), ID: contact.ID}
+	for i, key := range keys {
+		var value string
+		switch {
+		case key.Custom:
+			stored, ok := contact.CustomFields[key.Field]
+			if !ok {
+				continue
+			}
+			value = fieldText(stored)
+		case key.Field == "first_name":
+			value = contact.FirstName
+		case key.Field == "last_name":
+			value = contact.LastName
+		case key.Field == "phone_number":
+			value = contact.PhoneNumber
+		case key.Field == "address":
+			value = contact.Address
+		case key.Field == "created_at":
+			if contact.CreatedAt.IsZero() {
+				continue
+			}
+			value = contact.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		cursor.Values[i] = &value
+	}
+	return cursor
+}
+
+// validCursor reports whether the cursor holds a value of the right form for every key
+func validCursor(keys []SortKey, cursor SortCursor) bool {
+	if len(cursor.Values) != len(keys) || cursor.ID < 0 {
+		return false
+	}
+	for i, key := range keys {
+		value := cursor.Values[i]
+		switch {
+		case value == nil:
+		case key.Numeric:
+			if _, err := strconv.ParseFloat(*value, 64); err != nil {
+				return false
+			}
+		case !key.Custom && key.Field == "created_at":
+			if _, err := time.Parse(time.RFC3339, *value); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cursorOrder compares the contact with a position in the list ordered by the keys, negative
+// when the contact comes before it and positive when it comes after
+func cursorOrder(keys []SortKey, contact Contact, cursor SortCursor) int {
+	for i, key := range keys {
+		text, number, ok := sortValue(key, contact)
+		value := cursor.Values[i]
+		switch {
+		case !ok && value == nil:
+			continue
+		case !ok || value == nil:
+			if ok {
+				return -1 // contacts without a value come last
+			}
+			return 1
+		}
+		order := cmp.Compare(text, *value)
+		switch {
+		case key.Numeric:
+			position, _ := strconv.ParseFloat(*value, 64)
+			order = cmp.Compare(number, position)
+		case !key.Custom && key.Field != "created_at":
+			order = cmp.Compare(text, strings.ToLower(*value))
+		}
+		if key.Desc {
+			order = -order
+		}
+		if order != 0 {
+			return order
+		}
+	}
+	return cmp.Compare(contact.ID, cursor.ID)
+}
+
+// compareContacts orders two contacts by the sort keys, then by id
+func compareContacts(keys []SortKey, a, b Contact) bool {
+	for _, key := range keys {
+		xText, xNumber, xok := sortValue(key, a)
+		yText, yNumber, yok := sortValue(key, b)
+		switch {
+		case !xok && !yok:
+			continue
+		case !xok || !yok:
+			return xok // contacts without a value come last
+		}
+		order := cmp.Compare(xText, yText)
+		if key.Numeric {
+			order = cmp.Compare(xNumber, yNumber)
+		}
+		if order != 0 {
+			return (order < 0) != key.Desc
+		}
+	}
+	return a.ID < b.ID
+}
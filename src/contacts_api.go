@@ -0,0 +1,207 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// apiPrefix is the path under which the versioned resource API is mounted
+const apiPrefix = "/api/v1"
+
+// contactNotFoundMessage is shown when no contact has the requested id
+const contactNotFoundMessage = "No contact exists with the given id"
+
+// ListContactsHandler handles GET /api/v1/contacts, see readContactPage for paging
+func ListContactsHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := readContactPage(w, r, store)
+		if !ok {
+			return
+		}
+		if page.Contacts == nil {
+			page.Contacts = []Contact{} // an empty page is [] rather than null
+		}
+		w.Header().Set("Link", pageLinks(r, page))
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// CreateContactHandler handles POST /api/v1/contacts and answers 201 with the stored contact
+func CreateContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contact, ok := decodeContact(w, r)
+		if !ok {
+			return
+		}
+
+		id, ok := addContact(w, r, store, contact)
+		if !ok {
+			return
+		}
+
+		// Read the contact back so the response carries the normalized fields
+		created, err := store.GetContact(id)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/contacts/%d", apiPrefix, id))
+		w.Header().Set("ETag", contactETag(created))
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+// GetContactHandler handles GET /api/v1/contacts/{id}. The response carries an ETag, and
+// If-None-Match with the current tag answers 304 without a body.
+func GetContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := contactID(w, r)
+		if !ok {
+			return
+		}
+
+		contact, err := store.GetContact(id)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.Header().Set("ETag", contactETag(contact))
+		if notModified(r, contact) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, contact)
+	}
+}
+
+// ReplaceContactHandler handles PUT /api/v1/contacts/{id}, every field must be provided.
+// PUT, PATCH and DELETE honour If-Match and answer 412 when the contact changed since.
+func ReplaceContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := contactID(w, r)
+		if !ok {
+			return
+		}
+		contact, ok := decodeContact(w, r)
+		if !ok {
+			return
+		}
+		version, ok := ifMatchVersion(w, r, store, id)
+		if !ok {
+			return
+		}
+
+		updated, err := store.EditContact(id, contact, version)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.Header().Set("ETag", contactETag(updated))
+		writeJSON(w, http.StatusOK, updated)
+	}
+}
+
+// PatchContactHandler handles PATCH /api/v1/contacts/{id}, only the fields in the patch are changed.
+// The body is a JSON Merge Patch (RFC 7396) or, with Content-Type application/json-patch+json,
+// a JSON Patch (RFC 6902).
+func PatchContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := contactID(w, r)
+		if !ok {
+			return
+		}
+		document, ok := readPatch(w, r)
+		if !ok {
+			return
+		}
+		version, ok := ifMatchVersion(w, r, store, id)
+		if !ok {
+			return
+		}
+
+		// JSON Patch operations run against the stored values, so the write is made
+		// conditional on the version they were applied to
+		var current Contact
+		if document.needsContact() {
+			var err error
+			if current, err = store.GetContact(id); err != nil {
+				writeStoreError(w, r, err, contactNotFoundMessage)
+				return
+			}
+			if version > 0 && current.Version != version {
+				writeStoreError(w, r, ErrVersionMismatch, contactNotFoundMessage)
+				return
+			}
+			version = current.Version
+		}
+		patch, err := document.apply(current)
+		if err != nil {
+			writePatchError(w, r, err)
+			return
+		}
+
+		updated, err := store.PatchContact(id, patch, version)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.Header().Set("ETag", contactETag(updated))
+		writeJSON(w, http.StatusOK, updated)
+	}
+}
+
+// RemoveContactHandler handles DELETE /api/v1/contacts/{id} and answers 204
+func RemoveContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := contactID(w, r)
+		if !ok {
+			return
+		}
+
+		version, ok := ifMatchVersion(w, r, store, id)
+		if !ok {
+			return
+		}
+
+		if err := store.DeleteContact(id, version); err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// contactID reads the {id} path variable. On failure the error response has been written.
+func contactID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id < 1 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The contact id must be a positive number.")
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeContact reads a complete contact from the request body.
+// On failure the error response has been written.
+func decodeContact(w http.ResponseWriter, r *http.Request) (Contact, bool) {
+	var contact Contact
+	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+		return Contact{}, false
+	}
+	if !validContact(w, r, &contact) {
+		return Contact{}, false
+	}
+	return contact, true
+}
+
+// writeJSON sends value as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
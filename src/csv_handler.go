@@ -0,0 +1,370 @@
+package src
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Rise/src/dedupe"
+)
+
+// csvFields are the contact fields a CSV column must be mapped to
+var csvFields = []string{"first_name", "last_name", "phone_number", "address"}
+
+// csvOptionalFields are the contact fields a CSV column can also be mapped to
+var csvOptionalFields = []string{"tags"}
+
+// csvFormulaPrefixes are the characters that make a spreadsheet evaluate a cell as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvExportHeader is the header row written by the CSV export
+var csvExportHeader = []string{"id", "first_name", "last_name", "phone_number", "phone_e164", "address", "tags"}
+
+// ExportCSVHandler handles the HTTP request for downloading contacts as a CSV file.
+// All contacts are exported unless ?phone_number=, ?tag= or ?group= narrow the export down.
+// The tags of a contact share one column, separated by semicolons.
+// Text cells that a spreadsheet would run as a formula are prefixed with a quote,
+// which the import strips again.
+func ExportCSVHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, ok := parseContactFilter(w, r, store)
+		if !ok {
+			return
+		}
+		contacts, err := exportContacts(store, r, filter)
+		if err != nil {
+			writeStoreError(w, r, err, "No contacts were found with the given phone number")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+		w.WriteHeader(http.StatusOK)
+
+		writer := csv.NewWriter(w)
+		writer.Write(csvExportHeader)
+		for _, contact := range contacts {
+			writer.Write([]string{
+				strconv.Itoa(contact.ID), csvCell(contact.FirstName), csvCell(contact.LastName),
+				csvCell(contact.PhoneNumber), contact.PhoneE164, csvCell(contact.Address), csvCell(strings.Join(contact.Tags, ";")),
+			})
+		}
+		writer.Flush()
+	}
+}
+
+// ImportCSVHandler handles the HTTP request for importing contacts from a CSV file.
+//
+// The file is sent as the request body or as the "file" field of a multipart form and must
+// start with a header row. Columns are matched to contact fields by name, or through the
+// ?mapping= JSON object from header to field, e.g. {"Mobile": "phone_number"}.
+// Valid rows are inserted in one transaction, or in transactions of ?batch_size= rows, each
+// row checked under the duplicate policy, see WithDuplicatePolicy, against the contacts
+// stored before it. ?dry_run=true only validates and looks for duplicates among the stored
+// contacts, and ?report=csv returns the rejected rows as a CSV file.
+func ImportCSVHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun, err := parseDryRun(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		batchSize, err := parseBatchSize(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		body, closeBody, err := importBody(w, r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		defer closeBody()
+
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1 // ragged rows are reported per row instead of failing the upload
+		reader.TrimLeadingSpace = true
+		header, err := reader.Read()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The upload must start with a CSV header row.")
+			return
+		}
+		header[0] = strings.TrimPrefix(header[0], "\ufeff") // byte order mark written by Excel
+
+		columns, details := csvColumns(header, r.URL.Query().Get("mapping"))
+		if len(details) > 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The column mapping is invalid.", details...)
+			return
+		}
+
+		// Validate every row first, then insert the valid ones
+		var results []ImportResult
+		var records [][]string
+		var checked []int // indexes into results of the rows left for the store to check
+		var candidates []Contact
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			result := ImportResult{Index: len(results) + 1}
+			if err != nil {
+				var parseErr *csv.ParseError
+				if !errors.As(err, &parseErr) {
+					writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The upload could not be read: "+err.Error())
+					return
+				}
+				result.Line = parseErr.Line
+				result.Status = importStatusRejected
+				result.Errors = []ErrorDetail{{Field: "row", Issue: parseErr.Err.Error()}}
+			} else {
+				result.Line, _ = reader.FieldPos(0)
+				contact := Contact{}
+				for i, value := range record {
+					if i < len(columns) && columns[i] != "" {
+						setContactField(&contact, columns[i], csvValue(strings.TrimSpace(value)))
+					}
+				}
+				if details := contactErrors(&contact); len(details) > 0 {
+					result.Status = importStatusRejected
+					result.Errors = details
+				} else {
+					checked = append(checked, len(results))
+					candidates = append(candidates, contact)
+				}
+			}
+			results = append(results, result)
+			records = append(records, record)
+		}
+		if len(results) == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The upload does not contain any rows.")
+			return
+		}
+
+		// The custom field definitions are read once for the whole upload
+		var valid []int // indexes into results
+		var pending []Contact
+		prepared, errs := store.PrepareContacts(candidates)
+		for i, position := range checked {
+			result := &results[position]
+			if errs[i] != nil {
+				result.Status = importStatusRejected
+				result.Errors = importErrorDetails(errs[i])
+				continue
+			}
+			result.Status = importStatusValid
+			result.Contact = &prepared[i]
+			valid = append(valid, position)
+			pending = append(pending, prepared[i])
+		}
+
+		if dryRun {
+			checkImportDuplicates(store, requestPolicy(r), pending, valid, results)
+		} else {
+			insertBatches(store, requestPolicy(r), pending, valid, results, batchSize)
+		}
+
+		if r.URL.Query().Get("report") == "csv" {
+			writeCSVErrorReport(w, header, records, results)
+			return
+		}
+		writeImportResponse(w, results, dryRun)
+	}
+}
+
+// insertBatches stores the valid rows, one transaction per batch. Rows of a batch that
+// fails are marked as rejected, earlier batches stay committed. Unless the policy allows
+// duplicates the rows are checked and added one by one, and under DuplicatesReject a likely
+// duplicate is rejected on its own while the rest of its batch is stored.
+func insertBatches(store ContactStore, policy DuplicatePolicy, contacts []Contact, positions []int, results []ImportResult, batchSize int) {
+	if batchSize <= 0 {
+		batchSize = len(contacts)
+	}
+	for start := 0; start < len(contacts); start += batchSize {
+		end := start + batchSize
+		if end > len(contacts) {
+			end = len(contacts)
+		}
+		ids := make([]int, end-start)
+		matches := make([][]dedupe.Pair, end-start)
+		refused := make([]error, end-start)
+		var err error
+		if policy == DuplicatesWarn || policy == DuplicatesReject {
+			err = inTransaction(store, func(store ContactStore) error {
+				for i, contact := range contacts[start:end] {
+					var err error
+					ids[i], matches[i], err = addChecked(store, policy, contact)
+					var duplicate duplicateError
+					if errors.As(err, &duplicate) {
+						refused[i] = err
+					} else if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		} else {
+			ids, err = store.AddContacts(contacts[start:end])
+		}
+		for i := start; i < end; i++ {
+			result := &results[positions[i]]
+			failure := err
+			if failure == nil {
+				failure = refused[i-start]
+			}
+			if failure != nil {
+				result.Status = importStatusRejected
+				result.Contact = nil
+				result.Errors = importErrorDetails(failure)
+				continue
+			}
+			result.Status = importStatusImported
+			result.Contact.ID = ids[i-start]
+			result.PossibleDuplicates = duplicateIDs(matches[i-start])
+		}
+	}
+}
+
+// checkImportDuplicates looks for the stored contacts the valid rows of a dry run likely
+// duplicate, rejecting the rows that would be refused under the policy
+func checkImportDuplicates(store ContactStore, policy DuplicatePolicy, contacts []Contact, positions []int, results []ImportResult) {
+	for i, contact := range contacts {
+		result := &results[positions[i]]
+		matches, err := checkDuplicates(store, policy, contact)
+		if err != nil {
+			result.Status = importStatusRejected
+			result.Contact = nil
+			result.Errors = importErrorDetails(err)
+			continue
+		}
+		result.PossibleDuplicates = duplicateIDs(matches)
+	}
+}
+
+// csvColumns maps every header column to a contact field, or to "" when the column is ignored.
+// Columns missing from the mapping are used when they are named like a contact field.
+func csvColumns(header []string, mappingJSON string) ([]string, []ErrorDetail) {
+	mapping := make(map[string]string)
+	if mappingJSON != "" {
+		if err := json.Unmarshal([]byte(mappingJSON), &mapping); err != nil {
+			return nil, []ErrorDetail{{Field: "mapping", Issue: "must be a JSON object from column name to field"}}
+		}
+	}
+
+	var details []ErrorDetail
+	isField := make(map[string]bool)
+	for _, field := range append(csvFields, csvOptionalFields...) {
+		isField[field] = true
+	}
+	for column, field := range mapping {
+		if !isField[field] {
+			details = append(details, ErrorDetail{Field: "mapping." + column, Issue: fmt.Sprintf("unknown field %q, expected one of %s", field, strings.Join(append(csvFields, csvOptionalFields...), ", "))})
+		}
+	}
+
+	columns := make([]string, len(header))
+	mapped := make(map[string]bool)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		field, ok := mapping[name]
+		if !ok {
+			if candidate := strings.ToLower(name); isField[candidate] {
+				field = candidate
+			}
+		}
+		if field != "" && isField[field] {
+			columns[i] = field
+			mapped[field] = true
+		}
+	}
+	for _, field := range csvFields {
+		if !mapped[field] {
+			details = append(details, ErrorDetail{Field: field, Issue: "no column is mapped to this field"})
+		}
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].Field < details[j].Field })
+	return columns, details
+}
+
+// setContactField assigns a value to the contact field with the given JSON name
+func setContactField(contact *Contact, field, value string) {
+	switch field {
+	case "first_name":
+		contact.FirstName = value
+	case "last_name":
+		contact.LastName = value
+	case "phone_number":
+		contact.PhoneNumber = value
+	case "address":
+		contact.Address = value
+	case "tags":
+		contact.Tags = []string{}
+		for _, tag := range strings.Split(value, ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				contact.Tags = append(contact.Tags, tag)
+			}
+		}
+	}
+}
+
+// csvCell quotes a value that a spreadsheet would evaluate as a formula, such as
+// =HYPERLINK(...), by prefixing it with an apostrophe
+func csvCell(value string) string {
+	if value != "" && strings.IndexByte(csvFormulaPrefixes, value[0]) >= 0 {
+		return "'" + value
+	}
+	return value
+}
+
+// csvValue undoes csvCell, so exported files and error reports import unchanged
+func csvValue(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.IndexByte(csvFormulaPrefixes, value[1]) >= 0 {
+		return value[1:]
+	}
+	return value
+}
+
+// writeCSVErrorReport sends the rejected rows with their errors as a CSV file that can be
+// fixed and uploaded again, the extra "line" and "errors" columns are ignored on import
+func writeCSVErrorReport(w http.ResponseWriter, header []string, records [][]string, results []ImportResult) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="import-errors.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write(append([]string{"line", "errors"}, header...))
+	for i, result := range results {
+		if result.Status != importStatusRejected {
+			continue
+		}
+		issues := make([]string, len(result.Errors))
+		for j, detail := range result.Errors {
+			issues[j] = detail.Field + ": " + detail.Issue
+		}
+		row := []string{strconv.Itoa(result.Line), strings.Join(issues, "; ")}
+		for _, value := range records[i] {
+			row = append(row, csvCell(value))
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+}
+
+// parseBatchSize reads the batch_size query parameter, 0 means a single transaction
+func parseBatchSize(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("batch_size")
+	if value == "" {
+		return 0, nil
+	}
+	batchSize, err := strconv.Atoi(value)
+	if err != nil || batchSize < 0 {
+		return 0, errors.New("batch_size must be a non-negative number")
+	}
+	return batchSize, nil
+}
@@ -0,0 +1,222 @@
+// Package dedupe finds records that likely describe the same person. Candidate pairs are
+// records sharing a phone number or the start of a name word, and each pair is scored on
+// its phone numbers, names and addresses.
+//
+// Pairs scores a whole list and Matches scores one new record against it, Clusters then
+// joins the reported pairs into groups. Without a shared phone number a pair scores at most
+// NameWeight+AddressWeight, below DefaultThreshold, so stores narrow the list down to the
+// records sharing a number with the new record before it reaches Matches.
+package dedupe
+
+import (
+	"sort"
+	"strings"
+
+	"Rise/src/search"
+)
+
+// Weights of the signals in the score of a pair, they add up to 1
+const (
+	PhoneWeight   = 0.5
+	NameWeight    = 0.35
+	AddressWeight = 0.15
+)
+
+// DefaultThreshold is the score from which a pair is reported as duplicates: a shared
+// phone number with a similar name, but not a shared name and address alone
+const DefaultThreshold = 0.75
+
+// blockPrefix is how many letters of a name word candidate pairs must share
+const blockPrefix = 3
+
+// Record is the comparable form of one record
+type Record struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Address   string
+	Phones    []string // normalized, e.g. E.164, so equal numbers compare equal
+}
+
+// Pair is the score of two records, between 0 and 1, with the similarity of each signal
+type Pair struct {
+	A, B    int // record ids, A < B apart from Matches
+	Score   float64
+	Phone   float64 // 1 when the records share a phone number
+	Name    float64
+	Address float64
+}
+
+// Compare scores two records
+func Compare(a, b Record) Pair {
+	pair := Pair{A: a.ID, B: b.ID}
+	if pair.A > pair.B {
+		pair.A, pair.B = pair.B, pair.A
+	}
+	if sharePhone(a.Phones, b.Phones) {
+		pair.Phone = 1
+	}
+	pair.Name = nameSimilarity(a, b)
+	pair.Address = similarity(strings.Join(search.Tokenize(a.Address), " "), strings.Join(search.Tokenize(b.Address), " "))
+	pair.Score = PhoneWeight*pair.Phone + NameWeight*pair.Name + AddressWeight*pair.Address
+	return pair
+}
+
+// Pairs returns the pairs of records scoring at least threshold, highest score first
+func Pairs(records []Record, threshold float64) []Pair {
+	byID := map[int]Record{}
+	blocks := map[string][]int{}
+	for _, record := range records {
+		byID[record.ID] = record
+		for _, key := range blockKeys(record) {
+			blocks[key] = append(blocks[key], record.ID)
+		}
+	}
+
+	seen := map[[2]int]bool{}
+	var pairs []Pair
+	for _, ids := range blocks {
+		for i := range ids {
+			for j := i + 1; j < len(ids); j++ {
+				key := [2]int{min(ids[i], ids[j]), max(ids[i], ids[j])}
+				if key[0] == key[1] || seen[key] {
+					continue
+				}
+				seen[key] = true
+				if pair := Compare(byID[ids[i]], byID[ids[j]]); pair.Score >= threshold {
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+	}
+	sortPairs(pairs)
+	return pairs
+}
+
+// Matches returns the pairs of record with the records scoring at least threshold against
+// it, highest score first. A is always record and B the other record, record itself is
+// skipped when it is among them.
+func Matches(record Record, records []Record, threshold float64) []Pair {
+	keys := map[string]bool{}
+	for _, key := range blockKeys(record) {
+		keys[key] = true
+	}
+	var pairs []Pair
+	for _, other := range records {
+		if other.ID == record.ID || !sharesKey(keys, other) {
+			continue
+		}
+		if pair := Compare(record, other); pair.Score >= threshold {
+			pair.A, pair.B = record.ID, other.ID
+			pairs = append(pairs, pair)
+		}
+	}
+	sortPairs(pairs)
+	return pairs
+}
+
+// Clusters groups the ids linked by the pairs, directly or through other records. Each
+// cluster is in id order and clusters are ordered by their lowest id.
+func Clusters(pairs []Pair) [][]int {
+	parent := map[int]int{}
+	var find func(id int) int
+	find = func(id int) int {
+		if p, ok := parent[id]; ok && p != id {
+			parent[id] = find(p)
+			return parent[id]
+		}
+		parent[id] = id
+		return id
+	}
+	for _, pair := range pairs {
+		a, b := find(pair.A), find(pair.B)
+		parent[max(a, b)] = min(a, b)
+	}
+
+	groups := map[int][]int{}
+	for id := range parent {
+		root := find(id)
+		groups[root] = append(groups[root], id)
+	}
+	clusters := make([][]int, 0, len(groups))
+	for _, ids := range groups {
+		sort.Ints(ids)
+		clusters = append(clusters, ids)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+	return clusters
+}
+
+// blockKeys returns the keys a record is grouped by to find candidate pairs: each phone
+// number and the start of each name word, which survives most typos
+func blockKeys(record Record) []string {
+	var keys []string
+	for _, phone := range record.Phones {
+		if phone != "" {
+			keys = append(keys, "phone:"+phone)
+		}
+	}
+	for _, word := range search.Tokenize(record.FirstName + " " + record.LastName) {
+		if runes := []rune(word); len(runes) > blockPrefix {
+			word = string(runes[:blockPrefix])
+		}
+		keys = append(keys, "name:"+word)
+	}
+	return keys
+}
+
+// sharesKey reports whether any block key of the record is among keys
+func sharesKey(keys map[string]bool, record Record) bool {
+	for _, key := range blockKeys(record) {
+		if keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// sharePhone reports whether the lists have a phone number in common
+func sharePhone(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x != "" && x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nameSimilarity compares the full names, also with the words sorted so a first and last
+// name entered the other way round still match
+func nameSimilarity(a, b Record) float64 {
+	wordsA := search.Tokenize(a.FirstName + " " + a.LastName)
+	wordsB := search.Tokenize(b.FirstName + " " + b.LastName)
+	best := similarity(strings.Join(wordsA, " "), strings.Join(wordsB, " "))
+	sort.Strings(wordsA)
+	sort.Strings(wordsB)
+	return max(best, similarity(strings.Join(wordsA, " "), strings.Join(wordsB, " ")))
+}
+
+// similarity is 1 for equal strings, falling with their edit distance to 0. Empty strings
+// carry no evidence and score 0.
+func similarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	longest := max(len([]rune(a)), len([]rune(b)))
+	return 1 - float64(search.Distance(a, b))/float64(longest)
+}
+
+// sortPairs orders pairs by score, highest first, then by ids
+func sortPairs(pairs []Pair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Score != pairs[j].Score {
+			return pairs[i].Score > pairs[j].Score
+		}
+		if pairs[i].A != pairs[j].A {
+			return pairs[i].A < pairs[j].A
+		}
+		return pairs[i].B < pairs[j].B
+	})
+}
@@ -0,0 +1,311 @@
+package src
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"Rise/src/phone"
+)
+
+// Phone types
+const (
+	PhoneMobile = "mobile"
+	PhoneWork   = "work"
+	PhoneHome   = "home"
+	PhoneFax    = "fax"
+)
+
+// Email and postal address types
+const (
+	AddressHome  = "home"
+	AddressWork  = "work"
+	AddressOther = "other"
+)
+
+var (
+	phoneTypes   = []string{PhoneMobile, PhoneWork, PhoneHome, PhoneFax}
+	addressTypes = []string{AddressHome, AddressWork, AddressOther}
+)
+
+// maxTagLength bounds the length of a tag, see contact_tags
+const maxTagLength = 50
+
+// Phone is one of the phone numbers of a contact, stored in contact_phones
+type Phone struct {
+	Type    string `json:"type"`
+	Number  string `json:"number"` // as the user typed it
+	E164    string `json:"e164"`   // canonical form used for lookups
+	Primary bool   `json:"primary"`
+}
+
+// Email is one of the email addresses of a contact, stored in contact_emails
+type Email struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Primary bool   `json:"primary"`
+}
+
+// PostalAddress is one of the postal addresses of a contact, stored in contact_addresses
+type PostalAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	Primary bool   `json:"primary"`
+}
+
+// clone returns a copy of the contact that shares no slices or maps with the original
+func (c Contact) clone() Contact {
+	if c.Phones != nil {
+		c.Phones = append([]Phone{}, c.Phones...)
+	}
+	if c.Emails != nil {
+		c.Emails = append([]Email{}, c.Emails...)
+	}
+	if c.Addresses != nil {
+		c.Addresses = append([]PostalAddress{}, c.Addresses...)
+	}
+	if c.Tags != nil {
+		c.Tags = append([]string{}, c.Tags...)
+	}
+	if c.CustomFields != nil {
+		fields := make(map[string]any, len(c.CustomFields))
+		for name, value := range c.CustomFields {
+			fields[name] = value
+		}
+		c.CustomFields = fields
+	}
+	return c
+}
+
+// primaryPhone returns the index of the primary phone, or -1
+func primaryPhone(phones []Phone) int {
+	for i, p := range phones {
+		if p.Primary {
+			return i
+		}
+	}
+	return -1
+}
+
+// primaryAddress returns the index of the primary postal address, or -1
+func primaryAddress(addresses []PostalAddress) int {
+	for i, a := range addresses {
+		if a.Primary {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeDetails validates a complete contact and fills in its derived fields: a contact
+// given only a phone_number and address gets them as its primary phone and address, and
+// the phone_number and address of a contact given lists mirror their primary entries.
+func normalizeDetails(contact *Contact, region string) error {
+	patch := patchAll(*contact)
+	if err := normalizePatchDetails(&patch, region); err != nil {
+		return err
+	}
+	normalized := patch.Apply(Contact{ID: contact.ID, Version: contact.Version})
+	if normalized.Phones == nil {
+		normalized.Phones = []Phone{}
+	}
+	if normalized.Emails == nil {
+		normalized.Emails = []Email{}
+	}
+	if normalized.Addresses == nil {
+		normalized.Addresses = []PostalAddress{}
+	}
+	if normalized.Tags == nil {
+		normalized.Tags = []string{}
+	}
+	if normalized.CustomFields == nil {
+		normalized.CustomFields = map[string]any{}
+	}
+	*contact = normalized
+	return nil
+}
+
+// normalizePatchDetails validates the fields, phone numbers, emails, addresses and tags of
+// a patch against contactSchema and the rules of their entries. Replaced lists also patch
+// phone_number, phone_e164 and address to their primary entry, a patched phone_number alone
+// gets its E.164 form.
+func normalizePatchDetails(patch *ContactPatch, region string) error {
+	details := patchErrors(patch)
+
+	switch {
+	case patch.Phones != nil:
+		phones, issues := normalizePhones(*patch.Phones, region)
+		details = append(details, issues...)
+		if len(issues) == 0 {
+			primary := phones[primaryPhone(phones)]
+			patch.Phones, patch.PhoneNumber, patch.PhoneE164 = &phones, &primary.Number, &primary.E164
+		}
+	case patch.PhoneNumber != nil && !hasDetail(details, "phone_number"):
+		e164, err := phone.Normalize(*patch.PhoneNumber, region)
+		if err != nil {
+			details = append(details, ErrorDetail{Field: "phone_number", Issue: err.Error()})
+		}
+		patch.PhoneE164 = &e164
+	}
+
+	if patch.Emails != nil {
+		emails, issues := normalizeEmails(*patch.Emails)
+		details = append(details, issues...)
+		patch.Emails = &emails
+	}
+
+	if patch.Addresses != nil {
+		addresses, issues := normalizeAddresses(*patch.Addresses)
+		details = append(details, issues...)
+		if len(issues) == 0 {
+			primary := addresses[primaryAddress(addresses)]
+			patch.Addresses, patch.Address = &addresses, &primary.Address
+		}
+	}
+
+	if patch.Tags != nil {
+		tags, issues := normalizeTags(*patch.Tags)
+		details = append(details, issues...)
+		patch.Tags = &tags
+	}
+
+	if len(details) > 0 {
+		return &ValidationError{Details: details}
+	}
+	return nil
+}
+
+// normalizePhones validates a list of phones, fills in their E.164 form and default type,
+// and makes the first one primary when none is
+func normalizePhones(phones []Phone, region string) ([]Phone, []ErrorDetail) {
+	if len(phones) == 0 {
+		return nil, []ErrorDetail{{Field: "phones", Issue: "must list at least one phone number"}}
+	}
+	var details []ErrorDetail
+	normalized := make([]Phone, len(phones))
+	primaries := 0
+	for i, p := range phones {
+		field := fmt.Sprintf("phones[%d]", i)
+		if p.Type == "" {
+			p.Type = PhoneMobile
+		}
+		if !oneOf(p.Type, phoneTypes) {
+			details = append(details, ErrorDetail{Field: field + ".type", Issue: "must be one of " + strings.Join(phoneTypes, ", ")})
+		}
+		if issues := checkValue(field+".number", &p.Number, phoneRules); len(issues) > 0 {
+			details = append(details, issues...)
+		} else if e164, err := phone.Normalize(p.Number, region); err != nil {
+			details = append(details, ErrorDetail{Field: field + ".number", Issue: err.Error()})
+		} else {
+			p.E164 = e164
+		}
+		if p.Primary {
+			primaries++
+		}
+		normalized[i] = p
+	}
+	switch primaries {
+	case 0:
+		normalized[0].Primary = true
+	case 1:
+	default:
+		details = append(details, ErrorDetail{Field: "phones", Issue: "only one phone number can be primary"})
+	}
+	return normalized, details
+}
+
+// normalizeEmails validates a list of email addresses. An empty list is allowed, otherwise
+// the first address is made primary when none is.
+func normalizeEmails(emails []Email) ([]Email, []ErrorDetail) {
+	var details []ErrorDetail
+	normalized := make([]Email, len(emails))
+	primaries := 0
+	for i, e := range emails {
+		field := fmt.Sprintf("emails[%d]", i)
+		if e.Type == "" {
+			e.Type = AddressHome
+		}
+		if !oneOf(e.Type, addressTypes) {
+			details = append(details, ErrorDetail{Field: field + ".type", Issue: "must be one of " + strings.Join(addressTypes, ", ")})
+		}
+		if issues := checkValue(field+".address", &e.Address, emailRules); len(issues) > 0 {
+			details = append(details, issues...)
+		} else if parsed, err := mail.ParseAddress(e.Address); err != nil || parsed.Address != e.Address {
+			details = append(details, ErrorDetail{Field: field + ".address", Issue: "must be a valid email address"})
+		}
+		if e.Primary {
+			primaries++
+		}
+		normalized[i] = e
+	}
+	switch {
+	case len(normalized) > 0 && primaries == 0:
+		normalized[0].Primary = true
+	case primaries > 1:
+		details = append(details, ErrorDetail{Field: "emails", Issue: "only one email address can be primary"})
+	}
+	return normalized, details
+}
+
+// normalizeAddresses validates a list of postal addresses and makes the first one primary when none is
+func normalizeAddresses(addresses []PostalAddress) ([]PostalAddress, []ErrorDetail) {
+	if len(addresses) == 0 {
+		return nil, []ErrorDetail{{Field: "addresses", Issue: "must list at least one address"}}
+	}
+	var details []ErrorDetail
+	normalized := make([]PostalAddress, len(addresses))
+	primaries := 0
+	for i, a := range addresses {
+		field := fmt.Sprintf("addresses[%d]", i)
+		if a.Type == "" {
+			a.Type = AddressHome
+		}
+		if !oneOf(a.Type, addressTypes) {
+			details = append(details, ErrorDetail{Field: field + ".type", Issue: "must be one of " + strings.Join(addressTypes, ", ")})
+		}
+		details = append(details, checkValue(field+".address", &a.Address, addressRules)...)
+		if a.Primary {
+			primaries++
+		}
+		normalized[i] = a
+	}
+	switch primaries {
+	case 0:
+		normalized[0].Primary = true
+	case 1:
+	default:
+		details = append(details, ErrorDetail{Field: "addresses", Issue: "only one address can be primary"})
+	}
+	return normalized, details
+}
+
+// normalizeTags trims and lowercases a list of tags, drops repeated ones and sorts them.
+// An empty list is allowed.
+func normalizeTags(tags []string) ([]string, []ErrorDetail) {
+	var details []ErrorDetail
+	normalized := []string{}
+	seen := map[string]bool{}
+	for i, tag := range tags {
+		if issues := checkValue(fmt.Sprintf("tags[%d]", i), &tag, tagRules); len(issues) > 0 {
+			details = append(details, issues...)
+			continue
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, details
+}
+
+// oneOf reports whether value is in the list
+func oneOf(value string, list []string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,445 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Rise/src/dedupe"
+)
+
+// DuplicatePolicy is what adding a contact that looks like an existing one does
+type DuplicatePolicy string
+
+// Duplicate policies, see WithDuplicatePolicy
+const (
+	DuplicatesAllow  DuplicatePolicy = "allow"  // add it as usual
+	DuplicatesWarn   DuplicatePolicy = "warn"   // add it and name the likely duplicates in X-Possible-Duplicates
+	DuplicatesReject DuplicatePolicy = "reject" // refuse it with 409
+)
+
+// ParseDuplicatePolicy reads a policy name, as set in DUPLICATE_POLICY
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch policy := DuplicatePolicy(strings.ToLower(name)); policy {
+	case DuplicatesAllow, DuplicatesWarn, DuplicatesReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown duplicate policy %q, expected allow, warn or reject", name)
+}
+
+// duplicatePolicyKey is the context key of the policy set by WithDuplicatePolicy
+type duplicatePolicyKey struct{}
+
+// WithDuplicatePolicy applies the policy to every contact added through the requests it
+// serves: one at a time on /addContact and POST /api/v1/contacts, and in bulk by
+// POST /contacts:batch and the CSV and vCard imports. Without it they are allowed.
+func WithDuplicatePolicy(policy DuplicatePolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), duplicatePolicyKey{}, policy)))
+	})
+}
+
+// requestPolicy returns the policy set by WithDuplicatePolicy, DuplicatesAllow without it
+func requestPolicy(r *http.Request) DuplicatePolicy {
+	if policy, ok := r.Context().Value(duplicatePolicyKey{}).(DuplicatePolicy); ok {
+		return policy
+	}
+	return DuplicatesAllow
+}
+
+// duplicateError refuses a contact under DuplicatesReject, with its likely duplicates.
+// It is answered with 409 and a duplicate_of detail per duplicate, see storeError.
+type duplicateError struct {
+	matches []dedupe.Pair
+}
+
+func (e duplicateError) Error() string {
+	return fmt.Sprintf("contact looks like a duplicate of %d contacts", len(e.matches))
+}
+
+// details names the likely duplicates and their scores
+func (e duplicateError) details() []ErrorDetail {
+	details := make([]ErrorDetail, len(e.matches))
+	for i, match := range e.matches {
+		details[i] = ErrorDetail{Field: "duplicate_of", Issue: fmt.Sprintf("contact %d scored %.2f", match.B, roundScore(match.Score))}
+	}
+	return details
+}
+
+// addContact adds a contact under the request's duplicate policy and returns its id. ok is
+// false when the contact was refused or could not be added, the error response has then
+// been written. Under DuplicatesWarn the likely duplicates are named in X-Possible-Duplicates.
+func addContact(w http.ResponseWriter, r *http.Request, store ContactStore, contact Contact) (int, bool) {
+	id, matches, err := addWithPolicy(store, requestPolicy(r), contact)
+	if err != nil {
+		writeStoreError(w, r, err, "")
+		return 0, false
+	}
+	if len(matches) > 0 {
+		ids := make([]string, len(matches))
+		for i, match := range matches {
+			ids[i] = strconv.Itoa(match.B)
+		}
+		w.Header().Set("X-Possible-Duplicates", strings.Join(ids, ", "))
+	}
+	return id, true
+}
+
+// addWithPolicy adds a contact under the policy, see addChecked. Under DuplicatesReject the
+// check and the insert run in one transaction that holds the tenant's duplicate lock, so two
+// similar contacts added at once cannot both pass.
+func addWithPolicy(store ContactStore, policy DuplicatePolicy, contact Contact) (id int, matches []dedupe.Pair, err error) {
+	if policy != DuplicatesReject {
+		return addChecked(store, policy, contact)
+	}
+	err = inTransaction(store, func(store ContactStore) error {
+		id, matches, err = addChecked(store, policy, contact)
+		return err
+	})
+	return id, matches, err
+}
+
+// addChecked adds a contact under the policy and returns its id with, under DuplicatesWarn,
+// the stored contacts it likely duplicates. Under DuplicatesReject a likely duplicate fails
+// with a duplicateError, and callers run it in a transaction as addWithPolicy does.
+func addChecked(store ContactStore, policy DuplicatePolicy, contact Contact) (int, []dedupe.Pair, error) {
+	if policy == DuplicatesReject {
+		if merges, ok := store.(MergeStore); ok {
+			if err := merges.LockDuplicates(); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+	matches, err := checkDuplicates(store, policy, contact)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, err := store.AddContact(contact)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, matches, nil
+}
+
+// checkDuplicates looks for the stored contacts a new contact likely duplicates, as dry runs
+// do without adding it. Under DuplicatesReject finding one fails with a duplicateError.
+func checkDuplicates(store ContactStore, policy DuplicatePolicy, contact Contact) ([]dedupe.Pair, error) {
+	if policy != DuplicatesWarn && policy != DuplicatesReject {
+		return nil, nil
+	}
+	matches, err := findDuplicates(store, contact)
+	if err != nil {
+		return nil, err
+	}
+	if policy == DuplicatesReject && len(matches) > 0 {
+		return nil, duplicateError{matches: matches}
+	}
+	return matches, nil
+}
+
+// duplicateIDs returns the ids of the likely duplicates, nil when there are none
+func duplicateIDs(matches []dedupe.Pair) []int {
+	var ids []int
+	for _, match := range matches {
+		ids = append(ids, match.B)
+	}
+	return ids
+}
+
+// findDuplicates returns the stored contacts scoring dedupe.DefaultThreshold or more against
+// a contact about to be added, highest score first. Only the candidates sharing a phone
+// number with it are read when the store is a MergeStore.
+func findDuplicates(store ContactStore, contact Contact) ([]dedupe.Pair, error) {
+	// Invalid contacts are left for AddContact to report
+	prepared, err := store.PrepareContact(contact)
+	if err != nil {
+		return nil, nil
+	}
+	var candidates []Contact
+	if merges, ok := store.(MergeStore); ok {
+		candidates, err = merges.DuplicateCandidates(prepared)
+	} else {
+		candidates, err = allContacts(store, ContactFilter{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := make([]dedupe.Record, len(candidates))
+	for i, c := range candidates {
+		records[i] = contactRecord(c)
+	}
+	return dedupe.Matches(contactRecord(prepared), records, dedupe.DefaultThreshold), nil
+}
+
+// DuplicatePair is two contacts that likely describe the same person, with the score of
+// the pair and the similarity of their phone numbers, names and addresses
+type DuplicatePair struct {
+	ContactIDs [2]int  `json:"contact_ids"`
+	Score      float64 `json:"score"`
+	Phone      float64 `json:"phone"`
+	Name       float64 `json:"name"`
+	Address    float64 `json:"address"`
+}
+
+// DuplicateCluster is a group of contacts linked by duplicate pairs
+type DuplicateCluster struct {
+	Contacts []Contact       `json:"contacts"`
+	Pairs    []DuplicatePair `json:"pairs"`
+}
+
+// DuplicatesHandler handles GET /contacts/duplicates with the clusters of contacts that
+// likely describe the same person. ?threshold= (0 to 1) sets the score from which two
+// contacts are reported, dedupe.DefaultThreshold by default.
+func DuplicatesHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		threshold := dedupe.DefaultThreshold
+		if value := r.URL.Query().Get("threshold"); value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed <= 0 || parsed > 1 {
+				writeError(w, r, http.StatusBadRequest, CodeBadRequest, "threshold must be a number above 0 and at most 1.")
+				return
+			}
+			threshold = parsed
+		}
+
+		contacts, err := allContacts(store, ContactFilter{})
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		byID := map[int]Contact{}
+		records := make([]dedupe.Record, len(contacts))
+		for i, contact := range contacts {
+			byID[contact.ID] = contact
+			records[i] = contactRecord(contact)
+		}
+
+		pairs := dedupe.Pairs(records, threshold)
+		clusters := []DuplicateCluster{}
+		clusterOf := map[int]int{}
+		for _, ids := range dedupe.Clusters(pairs) {
+			cluster := DuplicateCluster{Pairs: []DuplicatePair{}}
+			for _, id := range ids {
+				cluster.Contacts = append(cluster.Contacts, byID[id])
+				clusterOf[id] = len(clusters)
+			}
+			clusters = append(clusters, cluster)
+		}
+		for _, pair := range pairs {
+			cluster := &clusters[clusterOf[pair.A]]
+			cluster.Pairs = append(cluster.Pairs, DuplicatePair{
+				ContactIDs: [2]int{pair.A, pair.B},
+				Score:      roundScore(pair.Score),
+				Phone:      roundScore(pair.Phone),
+				Name:       roundScore(pair.Name),
+				Address:    roundScore(pair.Address),
+			})
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Threshold float64            `json:"threshold"`
+			Clusters  []DuplicateCluster `json:"clusters"`
+		}{threshold, clusters})
+	}
+}
+
+// mergeRequest is the body of POST /api/v1/contacts/merge
+type mergeRequest struct {
+	Survivor   int            `json:"survivor"`
+	Duplicates []int          `json:"duplicates"`
+	Fields     map[string]int `json:"fields"` // field name to the id of the contact it is taken from
+}
+
+// mergeFields are the fields a merge can take from another contact than the survivor
+var mergeFields = []string{"first_name", "last_name", "phone_number", "address", "email"}
+
+// MergeContactsHandler handles POST /api/v1/contacts/merge, which combines duplicates into
+// the survivor, e.g. {"survivor":1,"duplicates":[2,3],"fields":{"address":3}}. Names are
+// taken from the survivor unless fields names another contact; phones, emails and
+// addresses of every contact are kept once each, the primary entry coming from the contact
+// fields names for phone_number, email and address. The duplicates move to the trash.
+// It answers 200 with the survivor at its new version.
+func MergeContactsHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		merger, ok := store.(MergeStore)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, CodeNotFound, "The store cannot merge contacts.")
+			return
+		}
+		var request mergeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+			return
+		}
+		if err := checkMerge(request.Survivor, request.Duplicates); err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		if details := mergeFieldErrors(request); len(details) > 0 {
+			writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The merge is invalid.", details...)
+			return
+		}
+
+		contacts := map[int]Contact{}
+		for _, id := range append([]int{request.Survivor}, request.Duplicates...) {
+			contact, err := store.GetContact(id)
+			if err != nil {
+				writeStoreError(w, r, err, fmt.Sprintf("No contact exists with id %d", id))
+				return
+			}
+			contacts[id] = contact
+		}
+		survivor := contacts[request.Survivor]
+		merged := mergeContacts(contacts, request)
+
+		stored, err := merger.MergeContacts(survivor.ID, patchAll(merged), survivor.Version, request.Duplicates)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.Header().Set("ETag", contactETag(stored))
+		writeJSON(w, http.StatusOK, struct {
+			Contact Contact `json:"contact"`
+			Merged  []int   `json:"merged"`
+		}{stored, request.Duplicates})
+	}
+}
+
+// checkMerge validates the contacts of a merge: a survivor and at least one other
+// contact, each listed once
+func checkMerge(survivor int, merged []int) error {
+	var details []ErrorDetail
+	if survivor < 1 {
+		details = append(details, ErrorDetail{Field: "survivor", Issue: "must be a contact id"})
+	}
+	if len(merged) == 0 {
+		details = append(details, ErrorDetail{Field: "duplicates", Issue: "must list at least one contact"})
+	}
+	seen := map[int]bool{survivor: true}
+	for _, id := range merged {
+		if id < 1 || seen[id] {
+			details = append(details, ErrorDetail{Field: "duplicates", Issue: "must list contact ids other than the survivor, each once"})
+			break
+		}
+		seen[id] = true
+	}
+	if len(details) > 0 {
+		return &ValidationError{Details: details}
+	}
+	return nil
+}
+
+// mergeFieldErrors checks that fields only names mergeable fields and merged contacts
+func mergeFieldErrors(request mergeRequest) []ErrorDetail {
+	ids := map[int]bool{request.Survivor: true}
+	for _, id := range request.Duplicates {
+		ids[id] = true
+	}
+	names := make([]string, 0, len(request.Fields))
+	for field := range request.Fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	var details []ErrorDetail
+	for _, field := range names {
+		id := request.Fields[field]
+		known := false
+		for _, name := range mergeFields {
+			known = known || name == field
+		}
+		switch {
+		case !known:
+			details = append(details, ErrorDetail{Field: "fields." + field, Issue: "cannot be merged, expected one of " + strings.Join(mergeFields, ", ")})
+		case !ids[id]:
+			details = append(details, ErrorDetail{Field: "fields." + field, Issue: "must name the survivor or one of the duplicates"})
+		}
+	}
+	return details
+}
+
+// mergeContacts combines the contacts of a merge field by field into the survivor
+func mergeContacts(contacts map[int]Contact, request mergeRequest) Contact {
+	source := func(field string) Contact {
+		if id, ok := request.Fields[field]; ok {
+			return contacts[id]
+		}
+		return contacts[request.Survivor]
+	}
+	merged := contacts[request.Survivor].clone()
+	merged.FirstName = source("first_name").FirstName
+	merged.LastName = source("last_name").LastName
+
+	// Every contact's entries, the survivor's first. Tags are all kept, the store drops
+	// repeated ones, and each custom field keeps the first value found.
+	var phones [][]Phone
+	var emails [][]Email
+	var addresses [][]PostalAddress
+	merged.Tags = []string{}
+	merged.CustomFields = map[string]any{}
+	for _, id := range append([]int{request.Survivor}, request.Duplicates...) {
+		contact := contacts[id]
+		phones = append(phones, contact.Phones)
+		emails = append(emails, contact.Emails)
+		addresses = append(addresses, contact.Addresses)
+		merged.Tags = append(merged.Tags, contact.Tags...)
+		for name, value := range contact.CustomFields {
+			if _, ok := merged.CustomFields[name]; !ok {
+				merged.CustomFields[name] = value
+			}
+		}
+	}
+	merged.Phones = combine(source("phone_number").Phones, phones,
+		func(p Phone) string { return p.E164 }, func(p *Phone) *bool { return &p.Primary })
+	merged.Emails = combine(source("email").Emails, emails,
+		func(e Email) string { return strings.ToLower(e.Address) }, func(e *Email) *bool { return &e.Primary })
+	merged.Addresses = combine(source("address").Addresses, addresses,
+		func(a PostalAddress) string { return strings.ToLower(strings.TrimSpace(a.Address)) }, func(a *PostalAddress) *bool { return &a.Primary })
+	return merged
+}
+
+// combine joins lists of entries, keeping entries with the same key once. The primary
+// entry of first stays primary and comes first, every other entry is secondary.
+func combine[T any](first []T, lists [][]T, key func(T) string, primary func(*T) *bool) []T {
+	var combined []T
+	seen := map[string]bool{}
+	add := func(entry T, isPrimary bool) {
+		if k := key(entry); !seen[k] {
+			seen[k] = true
+			*primary(&entry) = isPrimary
+			combined = append(combined, entry)
+		}
+	}
+	for _, entry := range first {
+		if *primary(&entry) {
+			add(entry, true)
+		}
+	}
+	for _, list := range lists {
+		for _, entry := range list {
+			add(entry, false)
+		}
+	}
+	return combined
+}
+
+// contactRecord is the form of a contact compared by package dedupe
+func contactRecord(contact Contact) dedupe.Record {
+	record := dedupe.Record{ID: contact.ID, FirstName: contact.FirstName, LastName: contact.LastName, Address: contact.Address}
+	if contact.PhoneE164 != "" {
+		record.Phones = append(record.Phones, contact.PhoneE164)
+	}
+	for _, p := range contact.Phones {
+		record.Phones = append(record.Phones, p.E164)
+	}
+	return record
+}
+
+// roundScore rounds a score to three decimals, like search results
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
+}
@@ -0,0 +1,123 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors returned by the stores so handlers can map them to status codes
+var (
+	ErrNotFound        = errors.New("contact not found")
+	ErrConflict        = errors.New("contact conflicts with an existing contact")
+	ErrVersionMismatch = errors.New("contact was changed since it was read")
+)
+
+// Error codes used in the error envelope
+const (
+	CodeBadRequest       = "bad_request"
+	CodeValidationFailed = "validation_failed"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodePrecondition     = "precondition_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeInternal         = "internal_error"
+)
+
+// ErrorDetail describes a single problem with one field of the request
+type ErrorDetail struct {
+	Field string `json:"field"`
+	Issue string `json:"issue"`
+}
+
+// ErrorResponse is the JSON envelope returned for every failed request
+type ErrorResponse struct {
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   []ErrorDetail `json:"details,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+}
+
+// ValidationError is returned when a contact breaks one or more field rules
+type ValidationError struct {
+	Details []ErrorDetail
+}
+
+func (e *ValidationError) Error() string {
+	issues := make([]string, len(e.Details))
+	for i, detail := range e.Details {
+		issues[i] = detail.Field + " " + detail.Issue
+	}
+	return "validation failed: " + strings.Join(issues, ", ")
+}
+
+// writeError sends an error envelope with the given status
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details ...ErrorDetail) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: RequestIDFromContext(r.Context()),
+	})
+}
+
+// writeStoreError maps an error returned by a ContactStore to the matching error response.
+// notFoundMessage is shown to the client when the contact does not exist.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error, notFoundMessage string) {
+	status, response := storeError(r, err, notFoundMessage)
+	writeError(w, r, status, response.Code, response.Message, response.Details...)
+}
+
+// storeError returns the status and envelope of the error response to an error returned by
+// a ContactStore, see writeStoreError
+func storeError(r *http.Request, err error, notFoundMessage string) (int, ErrorResponse) {
+	var validationErr *ValidationError
+	var duplicate duplicateError
+	requestID := RequestIDFromContext(r.Context())
+	switch {
+	case errors.As(err, &duplicate):
+		return http.StatusConflict, ErrorResponse{Code: CodeConflict, Message: "The contact looks like a duplicate of an existing contact.", Details: duplicate.details(), RequestID: requestID}
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound, ErrorResponse{Code: CodeNotFound, Message: notFoundMessage, RequestID: requestID}
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict, ErrorResponse{Code: CodeConflict, Message: err.Error(), RequestID: requestID}
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed, ErrorResponse{Code: CodePrecondition, Message: "The contact was changed since it was read, fetch it again and retry.", RequestID: requestID}
+	case errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity, ErrorResponse{Code: CodeValidationFailed, Message: "The contact is invalid.", Details: validationErr.Details, RequestID: requestID}
+	default:
+		// Keep database details in the log, not in the response
+		log.Printf("request %s: %v", requestID, err)
+		return http.StatusInternalServerError, ErrorResponse{Code: CodeInternal, Message: "Database error occurred.", RequestID: requestID}
+	}
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation from PostgreSQL or SQLite
+func isUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == "23505" {
+		return true
+	}
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// NotFoundHandler answers unknown routes with the error envelope
+func NotFoundHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "No such endpoint.")
+	}
+}
+
+// MethodNotAllowedHandler answers known routes called with the wrong method
+func MethodNotAllowedHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed on this endpoint.")
+	}
+}
@@ -0,0 +1,82 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// contactETag returns the strong entity tag of the contact's current version
+func contactETag(contact Contact) string {
+	return fmt.Sprintf(`"v%d"`, contact.Version)
+}
+
+// etagVersion reverses contactETag, ok is false for tags we did not issue (including weak ones)
+func etagVersion(tag string) (int, bool) {
+	value, ok := strings.CutPrefix(tag, `"v`)
+	if !ok {
+		return 0, false
+	}
+	value, ok = strings.CutSuffix(value, `"`)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// parseETags splits an If-Match or If-None-Match header into its entity tags
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// notModified reports whether If-None-Match lists the contact's current tag, in which case
+// a GET answers 304. The comparison is weak, so W/"v2" matches "v2".
+func notModified(r *http.Request, contact Contact) bool {
+	current := contactETag(contact)
+	for _, tag := range parseETags(r.Header.Get("If-None-Match")) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion turns the If-Match header into the version a write must still find.
+// It returns 0 when there is no header or it is "*", which leaves the existence check to
+// the write. When the header lists several tags the contact is read to pick the matching one.
+// On failure the error response has been written and ok is false.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request, store ContactStore, id int) (version int, ok bool) {
+	tags := parseETags(r.Header.Get("If-Match"))
+	if len(tags) == 0 || (len(tags) == 1 && tags[0] == "*") {
+		return 0, true
+	}
+	if len(tags) == 1 {
+		if version, ok := etagVersion(tags[0]); ok {
+			return version, true
+		}
+	}
+
+	contact, err := store.GetContact(id)
+	if err != nil {
+		writeStoreError(w, r, err, contactNotFoundMessage)
+		return 0, false
+	}
+	for _, tag := range tags {
+		if tag == "*" || tag == contactETag(contact) { // strong comparison
+			return contact.Version, true
+		}
+	}
+	writeStoreError(w, r, ErrVersionMismatch, contactNotFoundMessage)
+	return 0, false
+}
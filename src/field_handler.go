@@ -0,0 +1,161 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// fieldNotFoundMessage is shown when no custom field has the requested name
+const fieldNotFoundMessage = "No custom field exists with the given name"
+
+// customFieldPrefix starts the query parameters that filter and sort by a custom field,
+// e.g. ?custom_fields.company=Acme or ?sort=-custom_fields.birthday
+const customFieldPrefix = "custom_fields."
+
+// ListFieldsHandler handles GET /fields with every custom field ordered by name
+func ListFieldsHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry, ok := fieldStore(w, r, store)
+		if !ok {
+			return
+		}
+		fields, err := registry.ListFields()
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Fields []CustomField `json:"fields"`
+		}{fields})
+	}
+}
+
+// CreateFieldHandler handles POST /fields, e.g. {"name":"birthday","type":"date"} or
+// {"name":"team","type":"enum","options":["sales","support"],"required":true}, and answers
+// 201 with the field. Contacts stored before a field is defined have no value for it, even
+// when it is required.
+func CreateFieldHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry, ok := fieldStore(w, r, store)
+		if !ok {
+			return
+		}
+		var field CustomField
+		if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+			return
+		}
+		if details := field.fieldIssues(); len(details) > 0 {
+			writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The custom field is invalid.", details...)
+			return
+		}
+
+		created, err := registry.DefineField(field)
+		if errors.Is(err, ErrConflict) {
+			writeError(w, r, http.StatusConflict, CodeConflict, fmt.Sprintf("A custom field named %s already exists.", field.Name))
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/fields/%s", apiPrefix, created.Name))
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+// GetFieldHandler handles GET /fields/{name}
+func GetFieldHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry, ok := fieldStore(w, r, store)
+		if !ok {
+			return
+		}
+		field, err := registry.GetField(mux.Vars(r)["name"])
+		if err != nil {
+			writeStoreError(w, r, err, fieldNotFoundMessage)
+			return
+		}
+		writeJSON(w, http.StatusOK, field)
+	}
+}
+
+// DeleteFieldHandler handles DELETE /fields/{name} and answers 204. Every value of the
+// field is deleted with it.
+func DeleteFieldHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registry, ok := fieldStore(w, r, store)
+		if !ok {
+			return
+		}
+		if err := registry.DeleteField(mux.Vars(r)["name"]); err != nil {
+			writeStoreError(w, r, err, fieldNotFoundMessage)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// fieldStore asserts that the store keeps custom fields. On failure the error response has
+// been written.
+func fieldStore(w http.ResponseWriter, r *http.Request, store ContactStore) (FieldStore, bool) {
+	registry, ok := store.(FieldStore)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "The store keeps no custom fields.")
+	}
+	return registry, ok
+}
+
+// lookupField returns the custom field named by a query parameter, writing a 400 when it
+// is not defined
+func lookupField(w http.ResponseWriter, r *http.Request, registry FieldStore, name string) (CustomField, bool) {
+	field, err := registry.GetField(name)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("%s%s is not a defined custom field.", customFieldPrefix, name))
+		return field, false
+	}
+	if err != nil {
+		writeStoreError(w, r, err, "")
+		return field, false
+	}
+	return field, true
+}
+
+// parseFieldConditions reads the ?custom_fields.<name>= parameters of a request, each
+// matching the contacts whose field has the value. On failure the error response has been
+// written and ok is false.
+func parseFieldConditions(w http.ResponseWriter, r *http.Request, store ContactStore) (conditions []FieldCondition, ok bool) {
+	var names []string
+	for parameter := range r.URL.Query() {
+		if name, found := strings.CutPrefix(parameter, customFieldPrefix); found {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, true
+	}
+	registry, ok := fieldStore(w, r, store)
+	if !ok {
+		return nil, false
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := lookupField(w, r, registry, name)
+		if !ok {
+			return nil, false
+		}
+		value, err := field.parseText(r.URL.Query().Get(customFieldPrefix + name))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error()+".")
+			return nil, false
+		}
+		conditions = append(conditions, FieldCondition{Field: name, Value: value})
+	}
+	return conditions, true
+}
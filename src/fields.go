@@ -0,0 +1,296 @@
+package src
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Types of custom fields
+const (
+	FieldString = "string"
+	FieldNumber = "number"
+	FieldDate   = "date" // YYYY-MM-DD
+	FieldEnum   = "enum" // one of the options of the field
+	FieldBool   = "bool"
+)
+
+// fieldTypes lists every type of custom field
+var fieldTypes = []string{FieldString, FieldNumber, FieldDate, FieldEnum, FieldBool}
+
+// Limits of custom fields, see contact_fields
+const (
+	maxFieldValueLength = 1000
+	maxFieldOptions     = 100
+	dateLayout          = "2006-01-02"
+)
+
+// fieldNamePattern is the form of custom field names, usable as JSON keys and query parameters
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// CustomField defines a field the admins of a tenant added to its contacts, such as a
+// birthday or an employee id. The values of the field are validated against it on every
+// write.
+type CustomField struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	Required  bool           `json:"required"`          // every contact must have a value
+	Pattern   string         `json:"pattern,omitempty"` // regular expression string values must match as a whole
+	Options   []string       `json:"options,omitempty"` // the values of an enum field
+	CreatedAt time.Time      `json:"created_at"`
+	matcher   *regexp.Regexp // Pattern compiled by compile, anchored at both ends
+}
+
+// compile compiles the pattern of the field once, when it is defined or loaded, so values
+// are matched without compiling it again. The pattern must match the whole value, as if
+// written between ^(?: and )$.
+func (f *CustomField) compile() error {
+	f.matcher = nil
+	if f.Pattern == "" {
+		return nil
+	}
+	matcher, err := regexp.Compile(anchoredPattern(f.Pattern))
+	if err != nil {
+		return fmt.Errorf("custom field %s: invalid pattern: %w", f.Name, err)
+	}
+	f.matcher = matcher
+	return nil
+}
+
+// anchoredPattern makes a pattern match whole values only
+func anchoredPattern(pattern string) string {
+	return "^(?:" + pattern + ")$"
+}
+
+// FieldCondition matches the contacts whose custom field has the value, in the text form
+// of fieldText
+type FieldCondition struct {
+	Field string
+	Value string
+}
+
+// fieldIssues checks a new definition and returns its problems
+func (f CustomField) fieldIssues() []ErrorDetail {
+	var details []ErrorDetail
+	if !fieldNamePattern.MatchString(f.Name) {
+		details = append(details, ErrorDetail{Field: "name", Issue: "must be 1 to 50 lowercase letters, digits or underscores, starting with a letter"})
+	}
+	if !oneOf(f.Type, fieldTypes) {
+		details = append(details, ErrorDetail{Field: "type", Issue: "must be string, number, date, enum or bool"})
+	}
+	if f.Pattern != "" {
+		if f.Type != FieldString {
+			details = append(details, ErrorDetail{Field: "pattern", Issue: "is only allowed for string fields"})
+		} else if _, err := regexp.Compile(anchoredPattern(f.Pattern)); err != nil {
+			details = append(details, ErrorDetail{Field: "pattern", Issue: "must be a valid regular expression"})
+		}
+	}
+	switch {
+	case f.Type == FieldEnum && (len(f.Options) == 0 || len(f.Options) > maxFieldOptions):
+		details = append(details, ErrorDetail{Field: "options", Issue: fmt.Sprintf("must list 1 to %d values", maxFieldOptions)})
+	case f.Type != FieldEnum && len(f.Options) > 0:
+		details = append(details, ErrorDetail{Field: "options", Issue: "is only allowed for enum fields"})
+	}
+	seen := map[string]bool{}
+	for i, option := range f.Options {
+		if option == "" || seen[option] {
+			details = append(details, ErrorDetail{Field: fmt.Sprintf("options[%d]", i), Issue: "must be a non-empty value listed once"})
+		}
+		seen[option] = true
+	}
+	return details
+}
+
+// normalize checks a value of the field and returns it in the form it is stored and
+// returned in, issue explains why the value is not allowed
+func (f CustomField) normalize(value any) (normalized any, issue string) {
+	switch f.Type {
+	case FieldNumber:
+		number, ok := value.(float64)
+		if !ok || math.IsInf(number, 0) || math.IsNaN(number) {
+			return nil, "must be a number"
+		}
+		return number, ""
+	case FieldBool:
+		if _, ok := value.(bool); !ok {
+			return nil, "must be true or false"
+		}
+		return value, ""
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return nil, "must be a string"
+	}
+	switch f.Type {
+	case FieldDate:
+		if _, err := time.Parse(dateLayout, text); err != nil {
+			return nil, "must be a date in the form YYYY-MM-DD"
+		}
+	case FieldEnum:
+		if !oneOf(text, f.Options) {
+			return nil, "must be one of the options of the field"
+		}
+	default:
+		if text == "" || utf8.RuneCountInString(text) > maxFieldValueLength {
+			return nil, fmt.Sprintf("must be 1 to %d characters", maxFieldValueLength)
+		}
+		if f.Pattern != "" && (f.matcher == nil || !f.matcher.MatchString(text)) {
+			return nil, "does not match the pattern of the field"
+		}
+	}
+	return text, ""
+}
+
+// parseText reads a value of the field from a query parameter into its text form, see
+// fieldText
+func (f CustomField) parseText(text string) (string, error) {
+	var value any = text
+	switch f.Type {
+	case FieldNumber:
+		number, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return "", fmt.Errorf("custom_fields.%s must be a number", f.Name)
+		}
+		value = number
+	case FieldBool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return "", fmt.Errorf("custom_fields.%s must be true or false", f.Name)
+		}
+		value = b
+	}
+	normalized, issue := f.normalize(value)
+	if issue != "" {
+		return "", fmt.Errorf("custom_fields.%s %s", f.Name, issue)
+	}
+	return fieldText(normalized), nil
+}
+
+// fieldText returns the text a normalized value is stored as
+func fieldText(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// fieldValue reads back a value stored as text by a field of the type
+func fieldValue(fieldType, text string) any {
+	switch fieldType {
+	case FieldNumber:
+		if number, err := strconv.ParseFloat(text, 64); err == nil {
+			return number
+		}
+	case FieldBool:
+		if b, err := strconv.ParseBool(text); err == nil {
+			return b
+		}
+	}
+	return text
+}
+
+// checkCustomFields validates and normalizes the custom fields set by a patch against the
+// tenant's fields. Contacts being created, and patches that replace every custom field,
+// must have a value for each required field; other patches cannot remove one.
+func checkCustomFields(fields []CustomField, patch *ContactPatch, creating bool) error {
+	if patch.CustomFields == nil && !patch.ReplaceCustomFields && !creating {
+		return nil
+	}
+	byName := make(map[string]CustomField, len(fields))
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+	names := make([]string, 0, len(patch.CustomFields))
+	for name := range patch.CustomFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var details []ErrorDetail
+	values := make(map[string]any, len(names))
+	for _, name := range names {
+		field, ok := byName[name]
+		value := patch.CustomFields[name]
+		switch {
+		case !ok:
+			details = append(details, ErrorDetail{Field: "custom_fields." + name, Issue: "is not a defined custom field"})
+		case value == nil:
+			if field.Required && !creating && !patch.ReplaceCustomFields {
+				details = append(details, ErrorDetail{Field: "custom_fields." + name, Issue: "is required and cannot be removed"})
+			}
+			values[name] = nil
+		default:
+			normalized, issue := field.normalize(value)
+			if issue != "" {
+				details = append(details, ErrorDetail{Field: "custom_fields." + name, Issue: issue})
+			}
+			values[name] = normalized
+		}
+	}
+	if creating || patch.ReplaceCustomFields {
+		for _, field := range fields {
+			if field.Required && patch.CustomFields[field.Name] == nil {
+				details = append(details, ErrorDetail{Field: "custom_fields." + field.Name, Issue: "is required"})
+			}
+		}
+	}
+	if len(details) > 0 {
+		return &ValidationError{Details: details}
+	}
+	patch.CustomFields = values
+	return nil
+}
+
+// checkContactFields validates and normalizes the custom fields of a contact being created
+func checkContactFields(fields []CustomField, contact *Contact) error {
+	patch := ContactPatch{CustomFields: contact.CustomFields}
+	if err := checkCustomFields(fields, &patch, true); err != nil {
+		return err
+	}
+	contact.CustomFields = patch.CustomFields
+	return nil
+}
+
+// prepareContacts normalizes the details of every contact and checks its custom fields
+// against the same definitions. fieldsErr is the error reading those definitions, if any,
+// and is reported for every contact.
+func prepareContacts(contacts []Contact, region string, fields []CustomField, fieldsErr error) ([]Contact, []error) {
+	prepared := make([]Contact, len(contacts))
+	errs := make([]error, len(contacts))
+	for i, contact := range contacts {
+		errs[i] = fieldsErr
+		if errs[i] == nil {
+			errs[i] = normalizeDetails(&contact, region)
+		}
+		if errs[i] == nil {
+			errs[i] = checkContactFields(fields, &contact)
+		}
+		prepared[i] = contact
+	}
+	return prepared, errs
+}
+
+// definedFields keeps the values that are valid for the fields as they are defined now,
+// such as when a revision is restored after one of its fields was deleted
+func definedFields(fields []CustomField, values map[string]any) map[string]any {
+	if values == nil {
+		return nil
+	}
+	kept := map[string]any{}
+	for _, field := range fields {
+		if value, ok := values[field.Name]; ok && value != nil {
+			if normalized, issue := field.normalize(value); issue == "" {
+				kept[field.Name] = normalized
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,288 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// groupNotFoundMessage is shown when no group has the requested id
+const groupNotFoundMessage = "No group exists with the given id"
+
+// maxGroupNameLength bounds the length of a group name, see contact_groups
+const maxGroupNameLength = 100
+
+// groupRequest is the body of POST /groups and PATCH /groups/{id}
+type groupRequest struct {
+	Name string `json:"name"`
+}
+
+// ListGroupsHandler handles GET /groups with every group ordered by name
+func ListGroupsHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		list, err := groups.ListGroups()
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Groups []Group `json:"groups"`
+		}{list})
+	}
+}
+
+// CreateGroupHandler handles POST /groups, e.g. {"name":"Family"}, and answers 201 with the
+// group
+func CreateGroupHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		name, ok := decodeGroupName(w, r)
+		if !ok {
+			return
+		}
+
+		created, err := groups.CreateGroup(name)
+		if errors.Is(err, ErrConflict) {
+			writeError(w, r, http.StatusConflict, CodeConflict, fmt.Sprintf("A group named %s already exists.", name))
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/groups/%d", apiPrefix, created.ID))
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+// GetGroupHandler handles GET /groups/{id} with the group and the ids of its members
+func GetGroupHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := groupID(w, r)
+		if !ok {
+			return
+		}
+
+		group, err := groups.GetGroup(id)
+		if err != nil {
+			writeStoreError(w, r, err, groupNotFoundMessage)
+			return
+		}
+		writeJSON(w, http.StatusOK, group)
+	}
+}
+
+// RenameGroupHandler handles PATCH /groups/{id}, e.g. {"name":"Friends"}, and answers 200
+// with the renamed group
+func RenameGroupHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := groupID(w, r)
+		if !ok {
+			return
+		}
+		name, ok := decodeGroupName(w, r)
+		if !ok {
+			return
+		}
+
+		renamed, err := groups.RenameGroup(id, name)
+		if errors.Is(err, ErrConflict) {
+			writeError(w, r, http.StatusConflict, CodeConflict, fmt.Sprintf("A group named %s already exists.", name))
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err, groupNotFoundMessage)
+			return
+		}
+		writeJSON(w, http.StatusOK, renamed)
+	}
+}
+
+// DeleteGroupHandler handles DELETE /groups/{id} and answers 204. The members are kept.
+func DeleteGroupHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := groupID(w, r)
+		if !ok {
+			return
+		}
+
+		if err := groups.DeleteGroup(id); err != nil {
+			writeStoreError(w, r, err, groupNotFoundMessage)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AddGroupMembersHandler handles POST /groups/{id}/members, e.g. {"contact_ids":[1,2]}, and
+// answers 200 with the group. Contacts already in the group are skipped, and when any
+// contact does not exist none is added.
+func AddGroupMembersHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := groupID(w, r)
+		if !ok {
+			return
+		}
+		var request struct {
+			ContactIDs []int `json:"contact_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+			return
+		}
+		if len(request.ContactIDs) == 0 {
+			writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The members are invalid.",
+				ErrorDetail{Field: "contact_ids", Issue: "must list at least one contact id"})
+			return
+		}
+
+		group, err := groups.AddGroupMembers(id, request.ContactIDs)
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The members are invalid.", validationErr.Details...)
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err, groupNotFoundMessage)
+			return
+		}
+		writeJSON(w, http.StatusOK, group)
+	}
+}
+
+// RemoveGroupMemberHandler handles DELETE /groups/{id}/members/{contact_id} and answers 204
+func RemoveGroupMemberHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := groupID(w, r)
+		if !ok {
+			return
+		}
+		contactID, err := strconv.Atoi(mux.Vars(r)["contact_id"])
+		if err != nil || contactID < 1 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The contact id must be a positive number.")
+			return
+		}
+
+		if err := groups.RemoveGroupMember(id, contactID); err != nil {
+			writeStoreError(w, r, err, "The group does not exist or the contact is not in it")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// groupStore asserts that the store keeps groups. On failure the error response has been
+// written.
+func groupStore(w http.ResponseWriter, r *http.Request, store ContactStore) (GroupStore, bool) {
+	groups, ok := store.(GroupStore)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "The store keeps no groups.")
+	}
+	return groups, ok
+}
+
+// groupID reads the {id} path variable of a group route. On failure the error response has
+// been written.
+func groupID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id < 1 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The group id must be a positive number.")
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeGroupName reads and trims the name of a group from the request body. On failure
+// the error response has been written.
+func decodeGroupName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+		return "", false
+	}
+	name := strings.TrimSpace(request.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxGroupNameLength {
+		writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The group is invalid.",
+			ErrorDetail{Field: "name", Issue: fmt.Sprintf("must be 1 to %d characters", maxGroupNameLength)})
+		return "", false
+	}
+	return name, true
+}
+
+// parseContactFilter reads ?tag=, ?group=, the column filters such as ?address.prefix=,
+// see parseColumnConditions, and ?custom_fields.<name>=, which narrow the contact list,
+// search and exports down to the contacts with a tag, in a group, with matching fields or
+// with a custom field value. On failure the error response has been written and ok is false.
+func parseContactFilter(w http.ResponseWriter, r *http.Request, store ContactStore) (filter ContactFilter, ok bool) {
+	filter.Tag = strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag")))
+	if value := r.URL.Query().Get("group"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 1 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "group must be a positive number.")
+			return filter, false
+		}
+		filter.GroupID = id
+	}
+	if filter.Columns, ok = parseColumnConditions(w, r); !ok {
+		return filter, false
+	}
+	if filter.Fields, ok = parseFieldConditions(w, r, store); !ok {
+		return filter, false
+	}
+	if filter.empty() {
+		return filter, true
+	}
+	groups, ok := groupStore(w, r, store)
+	if !ok {
+		return filter, false
+	}
+	if filter.GroupID > 0 {
+		if _, err := groups.GetGroup(filter.GroupID); err != nil {
+			writeStoreError(w, r, err, groupNotFoundMessage)
+			return filter, false
+		}
+	}
+	return filter, true
+}
+
+// listContacts returns a page of the store's contacts matching the filter, which must only
+// be set for a GroupStore, see parseContactFilter
+func listContacts(store ContactStore, filter ContactFilter, limit, afterID, beforeID int) ([]Contact, bool, error) {
+	if filter.empty() {
+		return store.GetContacts(limit, afterID, beforeID)
+	}
+	return store.(GroupStore).FilterContacts(filter, limit, afterID, beforeID)
+}
@@ -1,108 +1,60 @@
 package src
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"sync"
 
 	"github.com/gorilla/mux"
 )
 
-// Pagination control
-var paginationOffset int
-var paginationLock sync.Mutex
-
-// GetContactsHandler handles the HTTP request for retrieving contacts
-func GetContactsHandler(db *sql.DB) http.HandlerFunc {
+// GetContactsHandler handles the HTTP request for retrieving contacts, see readContactPage for paging
+func GetContactsHandler(store ContactStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		const limit = 10 // Lock to control concurrent access to pagination
-		paginationLock.Lock()
-		offset := paginationOffset
-		paginationOffset += limit
-		paginationLock.Unlock()
-
-		contacts, message, err := GetContacts(db, limit, offset)
-		if err != nil {
-			http.Error(w, "Database query error: "+err.Error(), http.StatusInternalServerError)
+		page, ok := readContactPage(w, r, store)
+		if !ok {
 			return
 		}
 
-		if len(contacts) < limit {
-			paginationOffset = 0 // Reset pagination if fewer contacts are returned
+		message := ""
+		if page.NextCursor == "" {
+			message = "end of table, move to the start"
 		}
-		
-		// Send response with contacts and any message
+
+		// Send response with contacts, the page metadata and any message
 		response := struct {
-			Message  string    `json:"message"`
-			Contacts []Contact `json:"contacts"`
+			Message string `json:"message"`
+			contactPage
 		}{
-			Message:  message,
-			Contacts: contacts,
+			Message:     message,
+			contactPage: page,
 		}
 
+		w.Header().Set("Link", pageLinks(r, page))
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(response)
 	}
 }
 
 // AddContactHandler handles the HTTP request for adding contact
-func AddContactHandler(db *sql.DB) http.HandlerFunc {
+func AddContactHandler(store ContactStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var contact Contact
 
 		// Decode the incoming JSON body into a Contact struct
 		if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
-			// Return a good response instead of an error
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "Invalid request body. Please provide correct JSON format.",
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
 			return
 		}
 
-		// Check for empty fields
-		emptyCount := 0
-		if contact.FirstName == "" {
-			emptyCount++
-		}
-		if contact.LastName == "" {
-			emptyCount++
-		}
-		if contact.PhoneNumber == "" {
-			emptyCount++
-		}
-		if contact.Address == "" {
-			emptyCount++
-		}
-
-		// If any fields are empty, return a good response with a message
-		if emptyCount > 0 {
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: fmt.Sprintf("%d field(s) are empty. Please provide all required fields.", emptyCount),
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+		// Check the fields
+		if !validContact(w, r, &contact) {
 			return
 		}
 
-		// Insert the contact into the database
-		id, err := AddContact(db, contact)
-		if err != nil {
-			// Return a success response with an appropriate message
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "Database error occurred while adding the contact.",
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+		// Insert the contact into the database under the duplicate policy
+		id, ok := addContact(w, r, store, contact)
+		if !ok {
 			return
 		}
 
@@ -111,42 +63,45 @@ func AddContactHandler(db *sql.DB) http.HandlerFunc {
 		// Return success message
 		response := struct {
 			Message string `json:"message"`
+			ID      int    `json:"id"`
 		}{
 			Message: "Contact was added successfully",
+			ID:      id,
 		}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(response)
 	}
 }
 
-// DeleteContactHandler handles the HTTP request for deleting contact by his exact phone number
-func DeleteContactHandler(db *sql.DB) http.HandlerFunc {
+// DeleteContactHandler handles the HTTP request for deleting contact by his exact phone number.
+// Every contact with the number is deleted, or none of them when one delete fails.
+// It is kept for the frontend, new clients should use DELETE /api/v1/contacts/{id}.
+func DeleteContactHandler(store ContactStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		phoneNumber := vars["phone_number"]
 		if phoneNumber == "" {
-			// Return a proper message if no phone number was provided
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "No number was given",
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "No number was given")
 			return
 		}
 
-		// Attempt to delete the contact from the db
-		rowsDeleted, err := DeleteContact(db, phoneNumber)
-		if err != nil {
-			// If no rows were deleted, it means the number is not in the phone book
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "The number provided is not in the phone book",
+		// Delete every contact with the number by id, all or none of them
+		rowsDeleted := 0
+		err := inTransaction(store, func(store ContactStore) error {
+			contacts, err := store.SearchContact(phoneNumber)
+			if err != nil {
+				return err
+			}
+			for _, contact := range contacts {
+				if err := store.DeleteContact(contact.ID, 0); err != nil {
+					return err
+				}
 			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			rowsDeleted = len(contacts)
+			return nil
+		})
+		if err != nil {
+			writeStoreError(w, r, err, "The number provided is not in the phone book")
 			return
 		}
 
@@ -162,28 +117,18 @@ func DeleteContactHandler(db *sql.DB) http.HandlerFunc {
 }
 
 // SearchContactHandler handles the HTTP request for searching contact by his phone number
-func SearchContactHandler(db *sql.DB) http.HandlerFunc {
+func SearchContactHandler(store ContactStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		phoneNumber := vars["phone_number"]
 		if phoneNumber == "" {
-			http.Error(w, "Phone number not provided", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Phone number not provided")
 			return
 		}
 
-		contacts, err := SearchContact(db, phoneNumber)
+		contacts, err := store.SearchContact(phoneNumber)
 		if err != nil {
-			// // Return a message if no contacts are found
-			response := struct {
-				Message  string    `json:"message"`
-				Contacts []Contact `json:"contacts"`
-			}{
-				Message:  "No contacts were found with the given phone number",
-				Contacts: []Contact{},
-			}
-
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			writeStoreError(w, r, err, "No contacts were found with the given phone number")
 			return
 		}
 
@@ -201,74 +146,106 @@ func SearchContactHandler(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// EditContactHandler handles the HTTP request for editing contact by his phone number
-func EditContactHandler(db *sql.DB) http.HandlerFunc {
+// EditContactHandler handles the HTTP request for editing contact by his phone number.
+// Every contact with the number is updated, or none of them when one update fails.
+// It is kept for the frontend, new clients should use PUT /api/v1/contacts/{id}.
+func EditContactHandler(store ContactStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		phoneNumber := vars["phone_number"]
 		if phoneNumber == "" {
-			// Return a message if no phone number is provided
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "No number was given",
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "No number was given")
 			return
 		}
 
 		var updatedContact Contact
 		if err := json.NewDecoder(r.Body).Decode(&updatedContact); err != nil {
-			// Return a message if the request body is invalid
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "Invalid request body. Please provide correct JSON format.",
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
 			return
 		}
 
-		// Validate that all fields are provided (not empty)
-		emptyCount := 0
-		if updatedContact.FirstName == "" {
-			emptyCount++
+		// Check the fields
+		if !validContact(w, r, &updatedContact) {
+			return
 		}
-		if updatedContact.LastName == "" {
-			emptyCount++
+
+		// Update every contact with the number by id, all or none of them
+		rowsUpdated := 0
+		err := inTransaction(store, func(store ContactStore) error {
+			contacts, err := store.SearchContact(phoneNumber)
+			if err != nil {
+				return err
+			}
+			for _, contact := range contacts {
+				if _, err := store.EditContact(contact.ID, updatedContact, 0); err != nil {
+					return err
+				}
+			}
+			rowsUpdated = len(contacts)
+			return nil
+		})
+		if err != nil {
+			writeStoreError(w, r, err, "The number provided is not in the phone book")
+			return
 		}
-		if updatedContact.PhoneNumber == "" {
-			emptyCount++
+
+		// Return success message
+		response := struct {
+			Message string `json:"message"`
+		}{
+			Message: fmt.Sprintf("%d contact(s) were updated successfully", rowsUpdated),
 		}
-		if updatedContact.Address == "" {
-			emptyCount++
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// PatchContactByPhoneHandler handles the HTTP request for partially editing contact by his phone number.
+// Only the fields in the patch are changed, on every contact with the number or on none of them,
+// see PatchContactHandler.
+func PatchContactByPhoneHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		phoneNumber := vars["phone_number"]
+		if phoneNumber == "" {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "No number was given")
+			return
 		}
 
-		// If any fields are empty, return a success response with a message
-		if emptyCount > 0 {
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: fmt.Sprintf("%d field(s) are empty. Please provide all required fields.", emptyCount),
-			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+		document, ok := readPatch(w, r)
+		if !ok {
 			return
 		}
 
-		// Attempt to update the contact
-		rowsUpdated, err := EditContact(db, phoneNumber, updatedContact)
+		contacts, err := store.SearchContact(phoneNumber)
 		if err != nil {
-			// If no rows were updated, it means the number is not in the phone book
-			response := struct {
-				Message string `json:"message"`
-			}{
-				Message: "The number provided is not in the phone book",
+			writeStoreError(w, r, err, "The number provided is not in the phone book")
+			return
+		}
+
+		// Work out every change before storing any of them
+		patches := make([]ContactPatch, len(contacts))
+		for i, contact := range contacts {
+			if patches[i], err = document.apply(contact); err != nil {
+				writePatchError(w, r, err)
+				return
+			}
+		}
+		err = inTransaction(store, func(store ContactStore) error {
+			for i, contact := range contacts {
+				// JSON Patches were worked out from the version just read
+				version := 0
+				if document.needsContact() {
+					version = contact.Version
+				}
+				if _, err := store.PatchContact(contact.ID, patches[i], version); err != nil {
+					return err
+				}
 			}
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(response)
+			return nil
+		})
+		if err != nil {
+			writeStoreError(w, r, err, "The number provided is not in the phone book")
 			return
 		}
 
@@ -276,7 +253,7 @@ func EditContactHandler(db *sql.DB) http.HandlerFunc {
 		response := struct {
 			Message string `json:"message"`
 		}{
-			Message: fmt.Sprintf("%d contact(s) were updated successfully", rowsUpdated),
+			Message: fmt.Sprintf("%d contact(s) were updated successfully", len(contacts)),
 		}
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(response)
@@ -0,0 +1,105 @@
+package src
+
+import (
+	"reflect"
+	"time"
+)
+
+// Revision is one state in the history of a contact, read from its audit entries. Revisions
+// are numbered by the version the contact had, so revision 1 is the contact as created.
+// A deletion is listed with the revision it removed and no contact.
+type Revision struct {
+	Revision  int       `json:"revision"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Contact   *Contact  `json:"contact"`
+}
+
+// revisionsOf turns the audit entries of a contact, oldest first, into its revisions, newest first
+func revisionsOf(entries []AuditEntry) []Revision {
+	revisions := make([]Revision, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i].clone()
+		revision := Revision{Action: entry.Action, Actor: entry.Actor, RequestID: entry.RequestID, CreatedAt: entry.CreatedAt, Contact: entry.After}
+		switch {
+		case entry.After != nil:
+			revision.Revision = entry.After.Version
+		case entry.Before != nil:
+			revision.Revision = entry.Before.Version
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions
+}
+
+// findRevision returns the contact as of the revision in the history, newest first, and the
+// latest version the contact reached. ErrNotFound when the history is empty, a
+// ValidationError when the revision is not part of it.
+func findRevision(revisions []Revision, revision int) (Contact, int, error) {
+	if len(revisions) == 0 {
+		return Contact{}, 0, ErrNotFound
+	}
+	latest := revisions[0].Revision
+	for _, candidate := range revisions {
+		if candidate.Revision == revision && candidate.Contact != nil {
+			return candidate.Contact.clone(), latest, nil
+		}
+	}
+	return Contact{}, latest, &ValidationError{Details: []ErrorDetail{{Field: "revision", Issue: "is not a revision of the contact"}}}
+}
+
+// Change is one field that differs between two revisions of a contact
+type Change struct {
+	Field string `json:"field"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// diffContacts lists the fields changed from one revision of a contact to another, each
+// custom field on its own as custom_fields.<name>. PhoneE164 follows PhoneNumber and the
+// version always changes, so neither is listed.
+func diffContacts(from, to Contact) []Change {
+	changes := []Change{}
+	for _, field := range []struct {
+		name     string
+		from, to any
+	}{
+		{"first_name", from.FirstName, to.FirstName},
+		{"last_name", from.LastName, to.LastName},
+		{"phone_number", from.PhoneNumber, to.PhoneNumber},
+		{"address", from.Address, to.Address},
+		{"phones", nonNil(from.Phones), nonNil(to.Phones)},
+		{"emails", nonNil(from.Emails), nonNil(to.Emails)},
+		{"addresses", nonNil(from.Addresses), nonNil(to.Addresses)},
+		{"tags", nonNil(from.Tags), nonNil(to.Tags)},
+	} {
+		if !reflect.DeepEqual(field.from, field.to) {
+			changes = append(changes, Change{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+
+	names := map[string]any{}
+	for name := range from.CustomFields {
+		names[name] = nil
+	}
+	for name := range to.CustomFields {
+		names[name] = nil
+	}
+	for _, name := range fieldNames(names) {
+		if !reflect.DeepEqual(from.CustomFields[name], to.CustomFields[name]) {
+			changes = append(changes, Change{Field: "custom_fields." + name, From: from.CustomFields[name], To: to.CustomFields[name]})
+		}
+	}
+	return changes
+}
+
+// nonNil returns an empty list for nil, so a missing list equals an empty one and is
+// written as [] rather than null
+func nonNil[T any](list []T) []T {
+	if list == nil {
+		return []T{}
+	}
+	return list
+}
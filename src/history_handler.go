@@ -0,0 +1,144 @@
+package src
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ContactHistoryHandler handles GET /api/v1/contacts/{id}/history with every revision of the
+// contact, newest first. Deleted contacts keep their history.
+func ContactHistoryHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		revisions, id, ok := readHistory(w, r, store)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			ContactID int        `json:"contact_id"`
+			Revisions []Revision `json:"revisions"`
+		}{id, revisions})
+	}
+}
+
+// ContactDiffHandler handles GET /api/v1/contacts/{id}/diff?from=&to= with the fields that
+// changed between two revisions. to defaults to the latest revision.
+func ContactDiffHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, ok := revisionParam(w, r, "from")
+		if !ok {
+			return
+		}
+		if from == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The revision to compare from is required.")
+			return
+		}
+		to, ok := revisionParam(w, r, "to")
+		if !ok {
+			return
+		}
+		revisions, _, ok := readHistory(w, r, store)
+		if !ok {
+			return
+		}
+		if to == 0 {
+			for _, revision := range revisions {
+				if revision.Contact != nil {
+					to = revision.Revision
+					break
+				}
+			}
+		}
+
+		fromContact, _, err := findRevision(revisions, from)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		toContact, _, err := findRevision(revisions, to)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			From    int      `json:"from"`
+			To      int      `json:"to"`
+			Changes []Change `json:"changes"`
+		}{from, to, diffContacts(fromContact, toContact)})
+	}
+}
+
+// RestoreContactHandler handles POST /api/v1/contacts/{id}/restore?revision= by reverting
+// the contact to that revision, recreating it if it was deleted. The restored contact is
+// stored as a new version, so the history keeps the revisions it replaced.
+func RestoreContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history, ok := historyStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := contactID(w, r)
+		if !ok {
+			return
+		}
+		revision, ok := revisionParam(w, r, "revision")
+		if !ok {
+			return
+		}
+		if revision == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The revision to restore is required.")
+			return
+		}
+
+		restored, err := history.RestoreContact(id, revision)
+		if err != nil {
+			writeStoreError(w, r, err, contactNotFoundMessage)
+			return
+		}
+		w.Header().Set("ETag", contactETag(restored))
+		writeJSON(w, http.StatusOK, restored)
+	}
+}
+
+// historyStore asserts that the store keeps contact history. On failure the error response
+// has been written.
+func historyStore(w http.ResponseWriter, r *http.Request, store ContactStore) (HistoryStore, bool) {
+	history, ok := store.(HistoryStore)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "The store keeps no contact history.")
+	}
+	return history, ok
+}
+
+// readHistory loads the revisions of the {id} contact. On failure the error response has
+// been written.
+func readHistory(w http.ResponseWriter, r *http.Request, store ContactStore) ([]Revision, int, bool) {
+	history, ok := historyStore(w, r, store)
+	if !ok {
+		return nil, 0, false
+	}
+	id, ok := contactID(w, r)
+	if !ok {
+		return nil, 0, false
+	}
+	revisions, err := history.ContactHistory(id)
+	if err != nil {
+		writeStoreError(w, r, err, contactNotFoundMessage)
+		return nil, 0, false
+	}
+	return revisions, id, true
+}
+
+// revisionParam reads a revision number from the query, 0 when it is absent. On failure the
+// error response has been written.
+func revisionParam(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, true
+	}
+	revision, err := strconv.Atoi(value)
+	if err != nil || revision < 1 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, name+" must be a positive revision number.")
+		return 0, false
+	}
+	return revision, true
+}
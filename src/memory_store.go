@@ -0,0 +1,998 @@
+package src
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"Rise/src/search"
+)
+
+// MemoryStore is a ContactStore, APIKeyStore, TenantStore, AuditStore, HistoryStore,
+// TrashStore, MergeStore, TransactionStore, GroupStore, FieldStore and SearchStore that keeps
+// everything in memory.
+// It needs no database, which makes it handy for local runs and tests.
+// Contacts are copied in and out so callers never share their phone, email and address lists.
+type MemoryStore struct {
+	*memoryData        // shared by the stores of every tenant
+	tenant      string // the tenant whose contacts the store holds
+	actor       Actor  // recorded in the audit log for every write
+}
+
+// memoryData is everything a MemoryStore keeps, for all tenants
+type memoryData struct {
+	mu        sync.RWMutex
+	contacts  map[string][]Contact // per tenant, each ordered by id
+	trash     map[string][]Contact // deleted contacts per tenant, each ordered by id
+	tenants   []Tenant             // ordered by id
+	nextID    int                  // ids are unique across tenants, like database ids
+	region    string               // default region for phone numbers without a country code
+	apiKeys   []memoryAPIKey
+	nextKeyID int
+	audit     map[string][]AuditEntry // per tenant, each ordered by id
+	nextEntry int
+	groups    map[string][]Group // per tenant, each ordered by id with members ordered by id
+	nextGroup int
+	fields    map[string][]CustomField // per tenant, each ordered by name
+}
+
+// memoryAPIKey is an API key with the hash it is looked up by
+type memoryAPIKey struct {
+	APIKey
+	hash string
+}
+
+// NewMemoryStore returns an in-memory store with only the default tenant and no contacts
+func NewMemoryStore(region string) *MemoryStore {
+	data := &memoryData{
+		contacts:  map[string][]Contact{},
+		trash:     map[string][]Contact{},
+		tenants:   []Tenant{{ID: DefaultTenant, Name: "Default", CreatedAt: time.Now().UTC().Truncate(time.Second)}},
+		nextID:    1,
+		region:    region,
+		nextKeyID: 1,
+		audit:     map[string][]AuditEntry{},
+		nextEntry: 1,
+		groups:    map[string][]Group{},
+		nextGroup: 1,
+		fields:    map[string][]CustomField{},
+	}
+	return &MemoryStore{memoryData: data, tenant: DefaultTenant, actor: Actor{Name: systemActor}}
+}
+
+func (s *MemoryStore) GetContacts(limit, afterID, beforeID int) ([]Contact, bool, error) {
+	return s.FilterContacts(ContactFilter{}, limit, afterID, beforeID)
+}
+
+func (s *MemoryStore) FilterContacts(filter ContactFilter, limit, afterID, beforeID int) ([]Contact, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var contacts []Contact
+	for _, contact := range s.contacts[s.tenant] {
+		if s.matches(filter, contact) {
+			contacts = append(contacts, contact)
+		}
+	}
+	var page []Contact
+	if beforeID > 0 {
+		// Collect backwards from the cursor, then restore id order
+		for i := len(contacts) - 1; i >= 0 && len(page) <= limit; i-- {
+			if contacts[i].ID < beforeID {
+				page = append([]Contact{contacts[i].clone()}, page...)
+			}
+		}
+		if len(page) > limit {
+			return page[1:], true, nil
+		}
+		return page, false, nil
+	}
+
+	for _, contact := range contacts {
+		if contact.ID > afterID {
+			page = append(page, contact.clone())
+			if len(page) > limit {
+				return page[:limit], true, nil
+			}
+		}
+	}
+	return page, false, nil
+}
+
+func (s *MemoryStore) SortContacts(filter ContactFilter, keys []SortKey, limit int, after, before *SortCursor) ([]Contact, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	contacts := []Contact{}
+	for _, contact := range s.contacts[s.tenant] {
+		if !s.matches(filter, contact) {
+			continue
+		}
+		if (after != nil && cursorOrder(keys, contact, *after) <= 0) || (before != nil && cursorOrder(keys, contact, *before) >= 0) {
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+	sort.SliceStable(contacts, func(i, j int) bool { return compareContacts(keys, contacts[i], contacts[j]) })
+	hasMore := len(contacts) > limit
+	if hasMore && before != nil {
+		contacts = contacts[len(contacts)-limit:] // the page ending just before the cursor
+	} else if hasMore {
+		contacts = contacts[:limit]
+	}
+	page := make([]Contact, len(contacts))
+	for i, contact := range contacts {
+		page[i] = contact.clone()
+	}
+	return page, hasMore, nil
+}
+
+func (s *MemoryStore) SearchCandidates(query search.Query, filter ContactFilter) ([]Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Scoring is cheap in memory, so the candidates are exactly the matches
+	contacts := []Contact{}
+	for _, contact := range s.contacts[s.tenant] {
+		if _, ok := search.Score(query, contactDocument(contact)); ok && s.matches(filter, contact) {
+			contacts = append(contacts, contact.clone())
+		}
+	}
+	return contacts, nil
+}
+
+func (s *MemoryStore) EstimateContacts(filter ContactFilter) (int, bool, error) {
+	// Counting in memory is as cheap as estimating
+	total, err := s.CountContacts(filter, 0)
+	return total, false, err
+}
+
+func (s *MemoryStore) CountContacts(filter ContactFilter, limit int) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, contact := range s.contacts[s.tenant] {
+		if limit > 0 && count == limit {
+			break
+		}
+		if s.matches(filter, contact) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// matches reports whether the contact passes the filter, callers must hold the lock
+func (s *MemoryStore) matches(filter ContactFilter, contact Contact) bool {
+	if filter.Tag != "" && !oneOf(filter.Tag, contact.Tags) {
+		return false
+	}
+	if filter.GroupID > 0 {
+		i, ok := s.groupIndex(filter.GroupID)
+		if !ok || !containsID(s.groups[s.tenant][i].ContactIDs, contact.ID) {
+			return false
+		}
+	}
+	for _, condition := range filter.Fields {
+		value, ok := contact.CustomFields[condition.Field]
+		if !ok || fieldText(value) != condition.Value {
+			return false
+		}
+	}
+	for _, condition := range filter.Columns {
+		if !matchesColumn(contact, condition) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MemoryStore) AddContact(contact Contact) (int, error) {
+	if err := normalizeDetails(&contact, s.region); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkContactFields(s.fields[s.tenant], &contact); err != nil {
+		return 0, err
+	}
+	contact.ID = s.nextID
+	contact.Version = 1
+	contact.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	s.nextID++
+	s.contacts[s.tenant] = append(s.contacts[s.tenant], contact)
+	s.record(AuditCreate, contact.ID, nil, created(contact))
+	return contact.ID, nil
+}
+
+func (s *MemoryStore) AddContacts(contacts []Contact) ([]int, error) {
+	normalized := make([]Contact, len(contacts))
+	for i, contact := range contacts {
+		if err := normalizeDetails(&contact, s.region); err != nil {
+			return nil, err
+		}
+		normalized[i] = contact
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range normalized {
+		if err := checkContactFields(s.fields[s.tenant], &normalized[i]); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]int, len(normalized))
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, contact := range normalized {
+		contact.ID = s.nextID
+		contact.Version = 1
+		contact.CreatedAt = now
+		s.nextID++
+		s.contacts[s.tenant] = append(s.contacts[s.tenant], contact)
+		s.record(AuditCreate, contact.ID, nil, created(contact))
+		ids[i] = contact.ID
+	}
+	return ids, nil
+}
+
+func (s *MemoryStore) SearchContact(phoneNumber string) ([]Contact, error) {
+	key := phoneLookupKey(phoneNumber, s.region)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var contacts []Contact
+	for _, contact := range s.contacts[s.tenant] {
+		for _, p := range contact.Phones {
+			if p.E164 == key {
+				contacts = append(contacts, contact.clone())
+				break
+			}
+		}
+	}
+	if len(contacts) == 0 {
+		return nil, ErrNotFound
+	}
+	return contacts, nil
+}
+
+func (s *MemoryStore) EditContact(id int, updatedContact Contact, version int) (Contact, error) {
+	return s.PatchContact(id, patchAll(updatedContact), version)
+}
+
+func (s *MemoryStore) PatchContact(id int, patch ContactPatch, version int) (Contact, error) {
+	if err := normalizePatchDetails(&patch, s.region); err != nil {
+		return Contact{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkCustomFields(s.fields[s.tenant], &patch, false); err != nil {
+		return Contact{}, err
+	}
+	i, err := s.find(id, version)
+	if err != nil {
+		return Contact{}, err
+	}
+	contacts := s.contacts[s.tenant]
+	if !patch.changesColumns() && !patch.changesDetails() {
+		return contacts[i].clone(), nil
+	}
+	before := contacts[i].clone()
+	contacts[i] = patch.Apply(contacts[i])
+	contacts[i].Version++
+	after := contacts[i].clone()
+	s.record(AuditUpdate, id, &before, &after)
+	return contacts[i].clone(), nil
+}
+
+func (s *MemoryStore) DeleteContact(id int, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.find(id, version)
+	if err != nil {
+		return err
+	}
+	s.moveToTrash(i)
+	return nil
+}
+
+func (s *MemoryStore) DuplicateCandidates(contact Contact) ([]Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	phones := map[string]bool{}
+	for _, number := range contactRecord(contact).Phones {
+		phones[number] = number != ""
+	}
+	contacts := []Contact{}
+	for _, c := range s.contacts[s.tenant] {
+		for _, number := range contactRecord(c).Phones {
+			if phones[number] {
+				contacts = append(contacts, c.clone())
+				break
+			}
+		}
+	}
+	return contacts, nil
+}
+
+// LockDuplicates has nothing to do, InTransaction holds the write lock of the whole store
+func (s *MemoryStore) LockDuplicates() error {
+	return nil
+}
+
+func (s *MemoryStore) MergeContacts(survivor int, patch ContactPatch, version int, merged []int) (Contact, error) {
+	if err := checkMerge(survivor, merged); err != nil {
+		return Contact{}, err
+	}
+	if err := normalizePatchDetails(&patch, s.region); err != nil {
+		return Contact{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := checkCustomFields(s.fields[s.tenant], &patch, false); err != nil {
+		return Contact{}, err
+	}
+	// Check every contact before changing any
+	i, err := s.find(survivor, version)
+	if err != nil {
+		return Contact{}, err
+	}
+	for _, id := range merged {
+		if _, ok := s.indexOf(id); !ok {
+			return Contact{}, ErrNotFound
+		}
+	}
+
+	contacts := s.contacts[s.tenant]
+	before := contacts[i].clone()
+	contacts[i] = patch.Apply(contacts[i])
+	contacts[i].Version++
+	after := contacts[i].clone()
+	s.record(AuditMerge, survivor, &before, &after)
+	for _, id := range merged {
+		j, _ := s.indexOf(id)
+		s.moveToTrash(j)
+	}
+	i, _ = s.indexOf(survivor)
+	return s.contacts[s.tenant][i].clone(), nil
+}
+
+// moveToTrash moves the contact at position i of the tenant's contacts to the trash and
+// records its deletion. Callers must hold the write lock.
+func (s *MemoryStore) moveToTrash(i int) {
+	contacts := s.contacts[s.tenant]
+	before := contacts[i].clone()
+	id := before.ID
+	s.contacts[s.tenant] = append(contacts[:i], contacts[i+1:]...)
+
+	deletedAt := time.Now().UTC().Truncate(time.Second)
+	trashed := before.clone()
+	trashed.DeletedAt = &deletedAt
+	trash := s.trash[s.tenant]
+	j := sort.Search(len(trash), func(j int) bool { return trash[j].ID >= id })
+	s.trash[s.tenant] = append(trash[:j], append([]Contact{trashed}, trash[j:]...)...)
+	s.record(AuditDelete, id, &before, nil)
+}
+
+func (s *MemoryStore) GetContact(id int) (Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.indexOf(id)
+	if !ok {
+		return Contact{}, ErrNotFound
+	}
+	return s.contacts[s.tenant][i].clone(), nil
+}
+
+func (s *MemoryStore) PrepareContact(contact Contact) (Contact, error) {
+	if err := normalizeDetails(&contact, s.region); err != nil {
+		return contact, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return contact, checkContactFields(s.fields[s.tenant], &contact)
+}
+
+func (s *MemoryStore) PrepareContacts(contacts []Contact) ([]Contact, []error) {
+	s.mu.RLock()
+	fields := append([]CustomField{}, s.fields[s.tenant]...)
+	s.mu.RUnlock()
+	return prepareContacts(contacts, s.region, fields, nil)
+}
+
+func (s *MemoryStore) CreateAPIKey(key APIKey, hash string) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.apiKeys {
+		if stored.hash == hash {
+			return APIKey{}, ErrConflict
+		}
+	}
+	key.ID = s.nextKeyID
+	s.nextKeyID++
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	key.RevokedAt = nil
+	s.apiKeys = append(s.apiKeys, memoryAPIKey{APIKey: key, hash: hash})
+	return key, nil
+}
+
+func (s *MemoryStore) APIKeyByHash(hash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, stored := range s.apiKeys {
+		if stored.hash == hash {
+			return stored.APIKey, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s *MemoryStore) ListAPIKeys(tenant string) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, stored := range s.apiKeys {
+		if tenant == "" || stored.Tenant == tenant {
+			keys = append(keys, stored.APIKey)
+		}
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(tenant string, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, stored := range s.apiKeys {
+		if stored.ID == id && stored.RevokedAt == nil && (tenant == "" || stored.Tenant == tenant) {
+			now := time.Now().UTC().Truncate(time.Second)
+			s.apiKeys[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) ForTenant(tenant string) ContactStore {
+	return &MemoryStore{memoryData: s.memoryData, tenant: tenant, actor: s.actor}
+}
+
+func (s *MemoryStore) CreateTenant(tenant Tenant) (Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.tenants), func(i int) bool { return s.tenants[i].ID >= tenant.ID })
+	if i < len(s.tenants) && s.tenants[i].ID == tenant.ID {
+		return Tenant{}, ErrConflict
+	}
+	tenant.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	s.tenants = append(s.tenants[:i], append([]Tenant{tenant}, s.tenants[i:]...)...)
+	return tenant, nil
+}
+
+func (s *MemoryStore) GetTenant(id string) (Tenant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, tenant := range s.tenants {
+		if tenant.ID == id {
+			return tenant, nil
+		}
+	}
+	return Tenant{}, ErrNotFound
+}
+
+func (s *MemoryStore) ListTenants() ([]Tenant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]Tenant{}, s.tenants...), nil
+}
+
+func (s *MemoryStore) DeleteTenant(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, tenant := range s.tenants {
+		if tenant.ID != id {
+			continue
+		}
+		s.tenants = append(s.tenants[:i], s.tenants[i+1:]...)
+		delete(s.contacts, id)
+		delete(s.trash, id)
+		delete(s.audit, id)
+		delete(s.groups, id)
+		delete(s.fields, id)
+		keys := s.apiKeys[:0]
+		for _, stored := range s.apiKeys {
+			if stored.Tenant != id {
+				keys = append(keys, stored)
+			}
+		}
+		s.apiKeys = keys
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) AsActor(actor Actor) ContactStore {
+	return &MemoryStore{memoryData: s.memoryData, tenant: s.tenant, actor: actor}
+}
+
+func (s *MemoryStore) AuditLog(filter AuditFilter) ([]AuditEntry, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []AuditEntry{}
+	log := s.audit[s.tenant]
+	for i := len(log) - 1; i >= 0; i-- {
+		if filter.BeforeID > 0 && log[i].ID >= filter.BeforeID || !filter.matches(log[i]) {
+			continue
+		}
+		if len(entries) == filter.Limit {
+			return entries, true, nil
+		}
+		entries = append(entries, log[i].clone())
+	}
+	return entries, false, nil
+}
+
+func (s *MemoryStore) ContactHistory(id int) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revisions := revisionsOf(s.history(id))
+	if len(revisions) == 0 {
+		return nil, ErrNotFound
+	}
+	return revisions, nil
+}
+
+func (s *MemoryStore) RestoreContact(id, revision int) (Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target, latest, err := findRevision(revisionsOf(s.history(id)), revision)
+	if err != nil {
+		return Contact{}, err
+	}
+	target.CustomFields = definedFields(s.fields[s.tenant], target.CustomFields)
+	i, ok := s.indexOf(id)
+	if !ok {
+		// A contact in the trash is taken out of it, then reverted like any other
+		if j, trashed := s.untrash(id); trashed {
+			i, ok = j, true
+		}
+	}
+	contacts := s.contacts[s.tenant]
+	if ok {
+		before := contacts[i].clone()
+		contacts[i] = patchAll(target).Apply(contacts[i])
+		contacts[i].Version++
+		after := contacts[i].clone()
+		s.record(AuditRestore, id, &before, &after)
+		return contacts[i].clone(), nil
+	}
+	// Recreate the purged contact at its place in id order
+	target.Version = latest + 1
+	if target.CreatedAt.IsZero() {
+		target.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	s.contacts[s.tenant] = append(contacts[:i], append([]Contact{target}, contacts[i:]...)...)
+	after := target.clone()
+	s.record(AuditRestore, id, nil, &after)
+	return target.clone(), nil
+}
+
+func (s *MemoryStore) ListTrash(limit, afterID int) ([]Contact, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page := []Contact{}
+	for _, contact := range s.trash[s.tenant] {
+		if contact.ID > afterID {
+			if len(page) == limit {
+				return page, true, nil
+			}
+			page = append(page, contact.clone())
+		}
+	}
+	return page, false, nil
+}
+
+func (s *MemoryStore) UndeleteContact(id int) (Contact, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.untrash(id)
+	if !ok {
+		return Contact{}, ErrNotFound
+	}
+	contacts := s.contacts[s.tenant]
+	before := contacts[i].clone()
+	contacts[i].Version++
+	after := contacts[i].clone()
+	s.record(AuditRestore, id, &before, &after)
+	return contacts[i].clone(), nil
+}
+
+func (s *MemoryStore) PurgeTrash(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for tenant, trash := range s.trash {
+		kept := trash[:0]
+		for _, contact := range trash {
+			if contact.DeletedAt.Before(before) {
+				purged++
+				s.leaveGroups(tenant, contact.ID)
+			} else {
+				kept = append(kept, contact)
+			}
+		}
+		s.trash[tenant] = kept
+	}
+	return purged, nil
+}
+
+// InTransaction runs fn against a copy of the store's data and keeps the copy only when fn
+// succeeds. Every other caller waits until fn returns, so the writes apply all at once.
+func (s *MemoryStore) InTransaction(fn func(store ContactStore) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &MemoryStore{memoryData: s.memoryData.copy(), tenant: s.tenant, actor: s.actor}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	s.contacts, s.trash, s.tenants, s.nextID = tx.contacts, tx.trash, tx.tenants, tx.nextID
+	s.apiKeys, s.nextKeyID, s.audit, s.nextEntry = tx.apiKeys, tx.nextKeyID, tx.audit, tx.nextEntry
+	s.groups, s.nextGroup, s.fields = tx.groups, tx.nextGroup, tx.fields
+	return nil
+}
+
+// untrash moves a contact of the tenant from the trash back among its contacts and returns
+// its position there, ok is false if it is not in the trash. Callers must hold the write lock.
+func (s *MemoryStore) untrash(id int) (int, bool) {
+	trash := s.trash[s.tenant]
+	j := sort.Search(len(trash), func(j int) bool { return trash[j].ID >= id })
+	if j == len(trash) || trash[j].ID != id {
+		return 0, false
+	}
+	contact := trash[j]
+	contact.DeletedAt = nil
+	s.trash[s.tenant] = append(trash[:j], trash[j+1:]...)
+
+	i, _ := s.indexOf(id)
+	contacts := s.contacts[s.tenant]
+	s.contacts[s.tenant] = append(contacts[:i], append([]Contact{contact}, contacts[i:]...)...)
+	return i, true
+}
+
+// copy returns a copy of the data, sharing nothing the stores change in place. Callers
+// must hold the lock.
+func (d *memoryData) copy() *memoryData {
+	copied := &memoryData{
+		contacts:  map[string][]Contact{},
+		trash:     map[string][]Contact{},
+		tenants:   append([]Tenant{}, d.tenants...),
+		nextID:    d.nextID,
+		region:    d.region,
+		apiKeys:   append([]memoryAPIKey{}, d.apiKeys...),
+		nextKeyID: d.nextKeyID,
+		audit:     map[string][]AuditEntry{},
+		nextEntry: d.nextEntry,
+		groups:    map[string][]Group{},
+		nextGroup: d.nextGroup,
+		fields:    map[string][]CustomField{},
+	}
+	for _, lists := range []struct{ from, to map[string][]Contact }{{d.contacts, copied.contacts}, {d.trash, copied.trash}} {
+		for tenant, contacts := range lists.from {
+			for _, contact := range contacts {
+				lists.to[tenant] = append(lists.to[tenant], contact.clone())
+			}
+		}
+	}
+	for tenant, entries := range d.audit {
+		for _, entry := range entries {
+			copied.audit[tenant] = append(copied.audit[tenant], entry.clone())
+		}
+	}
+	for tenant, groups := range d.groups {
+		for _, group := range groups {
+			group.ContactIDs = append([]int{}, group.ContactIDs...)
+			copied.groups[tenant] = append(copied.groups[tenant], group)
+		}
+	}
+	for tenant, fields := range d.fields {
+		copied.fields[tenant] = append([]CustomField{}, fields...)
+	}
+	return copied
+}
+
+// history returns the audit entries of one of the tenant's contacts, oldest first. Callers
+// must hold the lock.
+func (s *MemoryStore) history(id int) []AuditEntry {
+	var entries []AuditEntry
+	for _, entry := range s.audit[s.tenant] {
+		if entry.ContactID == id {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// record appends an entry to the tenant's audit log, callers must hold the write lock
+func (s *MemoryStore) record(action string, contactID int, before, after *Contact) {
+	s.audit[s.tenant] = append(s.audit[s.tenant], AuditEntry{
+		ID:        s.nextEntry,
+		Actor:     s.actor.Name,
+		Action:    action,
+		ContactID: contactID,
+		Before:    before,
+		After:     after,
+		RequestID: s.actor.RequestID,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	})
+	s.nextEntry++
+}
+
+// indexOf finds the position of a contact of the tenant by binary search, callers must hold the lock
+func (s *MemoryStore) indexOf(id int) (int, bool) {
+	contacts := s.contacts[s.tenant]
+	i := sort.Search(len(contacts), func(i int) bool { return contacts[i].ID >= id })
+	return i, i < len(contacts) && contacts[i].ID == id
+}
+
+// find returns the position of the contact, checking its version unless version is 0.
+// Callers must hold the lock.
+func (s *MemoryStore) find(id, version int) (int, error) {
+	i, ok := s.indexOf(id)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if version > 0 && s.contacts[s.tenant][i].Version != version {
+		return 0, ErrVersionMismatch
+	}
+	return i, nil
+}
+
+func (s *MemoryStore) CreateGroup(name string) (Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.groupNamed(name) >= 0 {
+		return Group{}, ErrConflict
+	}
+	group := Group{ID: s.nextGroup, Name: name, CreatedAt: time.Now().UTC().Truncate(time.Second), ContactIDs: []int{}}
+	s.nextGroup++
+	s.groups[s.tenant] = append(s.groups[s.tenant], group)
+	return s.visibleGroup(group), nil
+}
+
+func (s *MemoryStore) ListGroups() ([]Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	groups := []Group{}
+	for _, group := range s.groups[s.tenant] {
+		groups = append(groups, s.visibleGroup(group))
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups, nil
+}
+
+func (s *MemoryStore) GetGroup(id int) (Group, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.groupIndex(id)
+	if !ok {
+		return Group{}, ErrNotFound
+	}
+	return s.visibleGroup(s.groups[s.tenant][i]), nil
+}
+
+func (s *MemoryStore) RenameGroup(id int, name string) (Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.groupIndex(id)
+	if !ok {
+		return Group{}, ErrNotFound
+	}
+	if j := s.groupNamed(name); j >= 0 && j != i {
+		return Group{}, ErrConflict
+	}
+	s.groups[s.tenant][i].Name = name
+	return s.visibleGroup(s.groups[s.tenant][i]), nil
+}
+
+func (s *MemoryStore) DeleteGroup(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.groupIndex(id)
+	if !ok {
+		return ErrNotFound
+	}
+	groups := s.groups[s.tenant]
+	s.groups[s.tenant] = append(groups[:i], groups[i+1:]...)
+	return nil
+}
+
+func (s *MemoryStore) AddGroupMembers(id int, contactIDs []int) (Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.groupIndex(id)
+	if !ok {
+		return Group{}, ErrNotFound
+	}
+	var details []ErrorDetail
+	for j, contactID := range contactIDs {
+		if _, ok := s.indexOf(contactID); !ok {
+			details = append(details, ErrorDetail{Field: fmt.Sprintf("contact_ids[%d]", j), Issue: "no contact exists with this id"})
+		}
+	}
+	if len(details) > 0 {
+		return Group{}, &ValidationError{Details: details}
+	}
+
+	group := &s.groups[s.tenant][i]
+	for _, contactID := range contactIDs {
+		if !containsID(group.ContactIDs, contactID) {
+			group.ContactIDs = append(group.ContactIDs, contactID)
+		}
+	}
+	sort.Ints(group.ContactIDs)
+	return s.visibleGroup(*group), nil
+}
+
+func (s *MemoryStore) RemoveGroupMember(id, contactID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.groupIndex(id)
+	if !ok {
+		return ErrNotFound
+	}
+	group := &s.groups[s.tenant][i]
+	for j, member := range group.ContactIDs {
+		if member == contactID {
+			group.ContactIDs = append(group.ContactIDs[:j], group.ContactIDs[j+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// groupIndex finds the position of a group of the tenant, callers must hold the lock
+func (s *MemoryStore) groupIndex(id int) (int, bool) {
+	groups := s.groups[s.tenant]
+	i := sort.Search(len(groups), func(i int) bool { return groups[i].ID >= id })
+	return i, i < len(groups) && groups[i].ID == id
+}
+
+// groupNamed returns the position of the tenant's group with the name, or -1. Callers must
+// hold the lock.
+func (s *MemoryStore) groupNamed(name string) int {
+	for i, group := range s.groups[s.tenant] {
+		if group.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// visibleGroup copies a group without its members in the trash, which are members again
+// once restored. Callers must hold the lock.
+func (s *MemoryStore) visibleGroup(group Group) Group {
+	members := []int{}
+	for _, id := range group.ContactIDs {
+		if _, ok := s.indexOf(id); ok {
+			members = append(members, id)
+		}
+	}
+	group.ContactIDs = members
+	return group
+}
+
+// leaveGroups takes a purged contact out of the tenant's groups, callers must hold the
+// write lock
+func (s *MemoryStore) leaveGroups(tenant string, id int) {
+	for i := range s.groups[tenant] {
+		group := &s.groups[tenant][i]
+		for j, member := range group.ContactIDs {
+			if member == id {
+				group.ContactIDs = append(group.ContactIDs[:j], group.ContactIDs[j+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// containsID reports whether the id is in the list
+func containsID(ids []int, id int) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) DefineField(field CustomField) (CustomField, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := s.fields[s.tenant]
+	i := sort.Search(len(fields), func(i int) bool { return fields[i].Name >= field.Name })
+	if i < len(fields) && fields[i].Name == field.Name {
+		return CustomField{}, ErrConflict
+	}
+	if err := field.compile(); err != nil {
+		return CustomField{}, err
+	}
+	field.Options = append([]string(nil), field.Options...)
+	field.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	s.fields[s.tenant] = append(fields[:i], append([]CustomField{field}, fields[i:]...)...)
+	return field, nil
+}
+
+func (s *MemoryStore) ListFields() ([]CustomField, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]CustomField{}, s.fields[s.tenant]...), nil
+}
+
+func (s *MemoryStore) GetField(name string) (CustomField, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, field := range s.fields[s.tenant] {
+		if field.Name == name {
+			return field, nil
+		}
+	}
+	return CustomField{}, ErrNotFound
+}
+
+func (s *MemoryStore) DeleteField(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := s.fields[s.tenant]
+	for i, field := range fields {
+		if field.Name != name {
+			continue
+		}
+		s.fields[s.tenant] = append(fields[:i], fields[i+1:]...)
+		for _, contacts := range [][]Contact{s.contacts[s.tenant], s.trash[s.tenant]} {
+			for _, contact := range contacts {
+				delete(contact.CustomFields, name)
+			}
+		}
+		return nil
+	}
+	return ErrNotFound
+}
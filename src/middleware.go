@@ -0,0 +1,84 @@
+package src
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+// Keys of the values the middlewares attach to the request context
+const (
+	requestIDKey contextKey = iota
+	principalKey
+	subdomainTenantKey
+)
+
+// RequestID tags every request with an id, reusing the caller's X-Request-ID when present.
+// The id is echoed in the response header and in error envelopes to correlate logs.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// RequestIDFromContext returns the id attached by RequestID, or an empty string
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// DefaultAllowedOrigins are the origins CORS allows when ALLOWED_ORIGINS is not set: the
+// frontend opened as a file, which browsers send as the origin "null"
+var DefaultAllowedOrigins = []string{"null"}
+
+// ParseAllowedOrigins reads a comma-separated list of origins, as set in ALLOWED_ORIGINS,
+// e.g. "https://phonebook.example.com,http://localhost:5500". "*" allows every origin.
+func ParseAllowedOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// CORS lets browsers call the API from the given origins. The Origin of a request is echoed
+// in Access-Control-Allow-Origin only when it is listed, so pages of other origins cannot
+// read the answers, and preflight OPTIONS requests are answered here.
+func CORS(origins []string, next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The answer depends on the Origin, caches must not share it between origins
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && (allowed[origin] || allowed["*"]) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID, If-Match, If-None-Match, Authorization, X-API-Key, X-Tenant-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, ETag, Location, X-Possible-Duplicates, Link, Accept-Patch")
+		}
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
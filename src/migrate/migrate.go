@@ -0,0 +1,291 @@
+// Package migrate applies numbered SQL migrations and records the applied ones in the
+// schema_migrations table, so a database can be upgraded in place instead of recreated.
+//
+// Migrations are files named <version>_<name>.up.sql with a matching .down.sql that
+// reverts them. Each one runs in its own transaction together with its schema_migrations
+// row. On PostgreSQL an advisory lock is held while migrating, so replicas starting at the
+// same time apply every migration exactly once.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect selects the locking used while migrating
+type Dialect string
+
+// Supported dialects
+const (
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// lockKey identifies the PostgreSQL advisory lock taken while migrating, any value works
+// as long as every replica uses the same one
+const lockKey = 7424601
+
+// createTable creates the table recording applied migrations
+const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+)`
+
+// Migration is one schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// Status reports whether a migration is applied. AppliedAt is nil while it is pending.
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Migrator applies the migrations of one directory to a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    Dialect
+	migrations []Migration // ordered by version
+}
+
+// New reads the migrations in files and returns a migrator for db
+func New(db *sql.DB, dialect Dialect, files fs.FS) (*Migrator, error) {
+	if dialect != Postgres && dialect != SQLite {
+		return nil, fmt.Errorf("unknown dialect %q", dialect)
+	}
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// load parses the migration files and checks that every version has an up and a down file
+func load(files fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range names {
+		base := path.Base(file)
+		stem, direction := strings.TrimSuffix(base, ".sql"), ""
+		switch {
+		case strings.HasSuffix(stem, ".up"):
+			stem, direction = strings.TrimSuffix(stem, ".up"), "up"
+		case strings.HasSuffix(stem, ".down"):
+			stem, direction = strings.TrimSuffix(stem, ".down"), "down"
+		default:
+			return nil, fmt.Errorf("migration %s: name must end in .up.sql or .down.sql", base)
+		}
+		number, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s: name must start with a version number and an underscore", base)
+		}
+
+		content, err := fs.ReadFile(files, file)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names, %q and %q", version, m.Name, name)
+		}
+		if direction == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an .up.sql and a .down.sql file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every pending migration in version order and returns the applied ones.
+// On error the migrations before the failing one stay applied.
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(func(conn *sql.Conn) error {
+		done, err := appliedAt(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			err := inTx(conn, migration.up,
+				"INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+				migration.Version, migration.Name, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("applying migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the given number of most recently applied migrations and returns them
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(func(conn *sql.Conn) error {
+		done, err := appliedAt(conn)
+		if err != nil {
+			return err
+		}
+		versions := make([]int, 0, len(done))
+		for version := range done {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for _, version := range versions {
+			if len(reverted) == steps {
+				break
+			}
+			migration, ok := m.find(version)
+			if !ok {
+				return fmt.Errorf("migration %d is applied but unknown to this binary", version)
+			}
+			err := inTx(conn, migration.down, "DELETE FROM schema_migrations WHERE version = $1", version)
+			if err != nil {
+				return fmt.Errorf("reverting migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status lists every known migration and any applied one this binary does not know, by version
+func (m *Migrator) Status() ([]Status, error) {
+	var statuses []Status
+	err := m.locked(func(conn *sql.Conn) error {
+		done, err := appliedAt(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := Status{Version: migration.Version, Name: migration.Name}
+			if at, ok := done[migration.Version]; ok {
+				status.AppliedAt = &at.time
+			}
+			statuses = append(statuses, status)
+		}
+		for version, at := range done {
+			if _, ok := m.find(version); !ok {
+				statuses = append(statuses, Status{Version: version, Name: at.name, AppliedAt: &at.time})
+			}
+		}
+		return nil
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, err
+}
+
+// find returns the known migration with the given version
+func (m *Migrator) find(version int) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// locked runs fn on a single connection holding the migration lock, after making sure the
+// schema_migrations table exists
+func (m *Migrator) locked(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// SQLite serializes writers on its own, PostgreSQL needs a lock shared by every replica
+	if m.dialect == Postgres {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+			return fmt.Errorf("taking the migration lock: %w", err)
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockKey)
+	}
+
+	if _, err := conn.ExecContext(ctx, createTable); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	return fn(conn)
+}
+
+// applied is a row of schema_migrations
+type applied struct {
+	name string
+	time time.Time
+}
+
+// appliedAt reads schema_migrations keyed by version
+func appliedAt(conn *sql.Conn) (map[int]applied, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int]applied)
+	for rows.Next() {
+		var version int
+		var row applied
+		if err := rows.Scan(&version, &row.name, &row.time); err != nil {
+			return nil, err
+		}
+		done[version] = row
+	}
+	return done, rows.Err()
+}
+
+// inTx runs a migration script and the statement recording it in one transaction
+func inTx(conn *sql.Conn, script, record string, args ...any) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,317 @@
+package src
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Page size limits for the contact list
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
+// errInvalidCursor is returned when a client sends a cursor we did not issue
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor turns a contact id into the opaque cursor handed to clients
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(id)))
+}
+
+// decodeCursor reverses encodeCursor, an empty cursor decodes to 0 (the start of the table)
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	value, ok := strings.CutPrefix(string(raw), "id:")
+	if !ok {
+		return 0, errInvalidCursor
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil || id < 0 {
+		return 0, errInvalidCursor
+	}
+	return id, nil
+}
+
+// encodeSortCursor turns a position in a sorted contact list into an opaque cursor. Sorted
+// lists are paged by the sort values and id of the contact at the edge of the page, as the
+// order is not the id order.
+func encodeSortCursor(cursor SortCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(append([]byte("sort:"), raw...))
+}
+
+// decodeSortCursor reverses encodeSortCursor for a list ordered by the keys, an empty cursor
+// decodes to nil (the start of the list)
+func decodeSortCursor(cursor string, keys []SortKey) (*SortCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	value, ok := strings.CutPrefix(string(raw), "sort:")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	var position SortCursor
+	if err := json.Unmarshal([]byte(value), &position); err != nil || !validCursor(keys, position) {
+		return nil, errInvalidCursor
+	}
+	return &position, nil
+}
+
+// lastSortCursor is the cursor of the last page of a sorted contact list, the page that ends
+// before it holds the last contacts: it follows every value, missing ones too
+func lastSortCursor(keys []SortKey) SortCursor {
+	return SortCursor{Values: make([]*string, len(keys)), ID: lastPageID}
+}
+
+// parsePageSize reads the limit query parameter, falling back to the default page size
+func parsePageSize(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 {
+		return 0, errors.New("limit must be a positive number")
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	return limit, nil
+}
+
+// Modes of ?count=, which decides how the total of the contact list is counted
+const (
+	CountEstimated = "estimated" // ask the store for a cheap estimate, the default
+	CountCapped    = "capped"    // stop counting at cappedCountLimit
+	CountExact     = "exact"     // count every matching contact
+	CountNone      = "none"      // leave the total out
+)
+
+// cappedCountLimit is where ?count=capped stops counting, larger lists report it as their
+// total with total_capped set. Stores without row estimates also count this far for
+// ?count=estimated.
+const cappedCountLimit = 10000
+
+// lastPageID is the id cursor of the last page of the contact list, the page that ends
+// before it holds the contacts with the highest ids (ids are 32-bit SERIAL columns)
+const lastPageID = math.MaxInt32
+
+// contactPage is one page of the contact list with the cursors of the neighbouring pages
+// and the total of the list, as sent to clients
+type contactPage struct {
+	Contacts       []Contact `json:"contacts"`
+	Limit          int       `json:"limit"`
+	Total          *int      `json:"total,omitempty"`
+	TotalEstimated bool      `json:"total_estimated,omitempty"`
+	TotalCapped    bool      `json:"total_capped,omitempty"`
+	HasMore        bool      `json:"has_more"`
+	NextCursor     string    `json:"next_cursor,omitempty"`
+	PrevCursor     string    `json:"prev_cursor,omitempty"`
+	lastCursor     string    // the ?before= cursor of the last page, empty when it is not known
+}
+
+// parseCountMode reads the count query parameter, falling back to an estimate
+func parseCountMode(r *http.Request) (string, error) {
+	switch mode := r.URL.Query().Get("count"); mode {
+	case "":
+		return CountEstimated, nil
+	case CountEstimated, CountCapped, CountExact, CountNone:
+		return mode, nil
+	}
+	return "", errors.New("count must be estimated, capped, exact or none")
+}
+
+// readContactPage reads ?limit=, ?after=, ?before= and ?count= and fetches the requested
+// page, narrowed down by ?tag=, ?group=, column and custom field filters, see
+// parseContactFilter, and ordered by ?sort=, see parseContactSort. Pages are addressed with
+// opaque cursors so every client walks the table independently and the order stays stable
+// while contacts are added or deleted. On failure the error response has been written and
+// ok is false.
+func readContactPage(w http.ResponseWriter, r *http.Request, store ContactStore) (page contactPage, ok bool) {
+	filter, ok := parseContactFilter(w, r, store)
+	if !ok {
+		return page, false
+	}
+	keys, ok := parseContactSort(w, r, store)
+	if !ok {
+		return page, false
+	}
+	limit, err := parsePageSize(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return page, false
+	}
+	mode, err := parseCountMode(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return page, false
+	}
+	if len(keys) > 0 {
+		groups, ok := groupStore(w, r, store)
+		if !ok {
+			return page, false
+		}
+		if page, ok = readSortedPage(w, r, groups, filter, keys, limit); !ok {
+			return page, false
+		}
+	} else if page, ok = readIDPage(w, r, store, filter, limit); !ok {
+		return page, false
+	}
+	page.Limit, page.HasMore = limit, page.NextCursor != ""
+
+	// Count the list, stores that cannot filter leave the total out
+	groups, ok := store.(GroupStore)
+	if mode == CountNone || !ok {
+		return page, true
+	}
+	var total int
+	switch mode {
+	case CountEstimated:
+		total, page.TotalEstimated, err = groups.EstimateContacts(filter)
+	case CountCapped:
+		total, err = groups.CountContacts(filter, cappedCountLimit)
+		page.TotalCapped = total >= cappedCountLimit
+	default:
+		total, err = groups.CountContacts(filter, 0)
+	}
+	if err != nil {
+		writeStoreError(w, r, err, "")
+		return page, false
+	}
+	page.Total = &total
+	return page, true
+}
+
+// readIDPage fetches a page of the contact list ordered by id, its cursors hold the ids at
+// the edges of the page. On failure the error response has been written and ok is false.
+func readIDPage(w http.ResponseWriter, r *http.Request, store ContactStore, filter ContactFilter, limit int) (page contactPage, ok bool) {
+	afterID, err := decodeCursor(r.URL.Query().Get("after"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid after cursor.")
+		return page, false
+	}
+	beforeID, err := decodeCursor(r.URL.Query().Get("before"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid before cursor.")
+		return page, false
+	}
+
+	contacts, hasMore, err := listContacts(store, filter, limit, afterID, beforeID)
+	if err != nil {
+		writeStoreError(w, r, err, "")
+		return page, false
+	}
+	page.Contacts = contacts
+	page.lastCursor = encodeCursor(lastPageID)
+
+	// Work out the cursors of the neighbouring pages
+	if len(contacts) > 0 {
+		first, last := contacts[0].ID, contacts[len(contacts)-1].ID
+		if beforeID > 0 {
+			if beforeID != lastPageID {
+				page.NextCursor = encodeCursor(last)
+			}
+			if hasMore {
+				page.PrevCursor = encodeCursor(first)
+			}
+		} else {
+			if hasMore {
+				page.NextCursor = encodeCursor(last)
+			}
+			if afterID > 0 {
+				page.PrevCursor = encodeCursor(first)
+			}
+		}
+	}
+	return page, true
+}
+
+// readSortedPage fetches a page of the contact list ordered by the sort keys, its cursors
+// hold the sort values and ids of the contacts at the edges of the page. On failure the
+// error response has been written and ok is false.
+func readSortedPage(w http.ResponseWriter, r *http.Request, store GroupStore, filter ContactFilter, keys []SortKey, limit int) (page contactPage, ok bool) {
+	after, err := decodeSortCursor(r.URL.Query().Get("after"), keys)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid after cursor.")
+		return page, false
+	}
+	before, err := decodeSortCursor(r.URL.Query().Get("before"), keys)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid before cursor.")
+		return page, false
+	}
+
+	contacts, hasMore, err := store.SortContacts(filter, keys, limit, after, before)
+	if err != nil {
+		writeStoreError(w, r, err, "")
+		return page, false
+	}
+	page.Contacts = contacts
+	last := lastSortCursor(keys)
+	page.lastCursor = encodeSortCursor(last)
+
+	// Work out the cursors of the neighbouring pages
+	if len(contacts) > 0 {
+		first, end := encodeSortCursor(sortCursor(keys, contacts[0])), encodeSortCursor(sortCursor(keys, contacts[len(contacts)-1]))
+		if before != nil {
+			if before.ID != last.ID {
+				page.NextCursor = end
+			}
+			if hasMore {
+				page.PrevCursor = first
+			}
+		} else {
+			if hasMore {
+				page.NextCursor = end
+			}
+			if after != nil {
+				page.PrevCursor = first
+			}
+		}
+	}
+	return page, true
+}
+
+// pageLinks returns the RFC 8288 Link header of a page of the contact list: the first,
+// previous, next and last pages, each keeping the other parameters of the request
+func pageLinks(r *http.Request, page contactPage) string {
+	link := func(rel, parameter, cursor string) string {
+		query := r.URL.Query()
+		query.Del("after")
+		query.Del("before")
+		if cursor != "" {
+			query.Set(parameter, cursor)
+		}
+		target := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		return fmt.Sprintf(`<%s>; rel="%s"`, target.String(), rel)
+	}
+	links := []string{link("first", "", "")}
+	if page.PrevCursor != "" {
+		links = append(links, link("prev", "before", page.PrevCursor))
+	}
+	if page.NextCursor != "" {
+		links = append(links, link("next", "after", page.NextCursor))
+	}
+	if page.lastCursor != "" {
+		links = append(links, link("last", "before", page.lastCursor))
+	}
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,333 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Media types accepted by PATCH requests
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396, also assumed for application/json
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// patchableFields are the contact fields a PATCH request may change
+var patchableFields = []string{"first_name", "last_name", "phone_number", "address"}
+
+// listFields are the contact lists a merge patch may replace as a whole
+var listFields = []string{"phones", "emails", "addresses", "tags"}
+
+// patchOperation is one operation of an RFC 6902 JSON Patch
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// patchDocument is a parsed PATCH body. Merge patches are complete as soon as they are
+// parsed, JSON Patches are applied to the stored contact because test, move and copy
+// depend on its current values.
+type patchDocument struct {
+	merge      ContactPatch
+	operations []patchOperation // nil for merge patches
+}
+
+// needsContact reports whether apply reads the stored contact
+func (d patchDocument) needsContact() bool {
+	return d.operations != nil
+}
+
+// apply returns the changes the patch makes to the given contact
+func (d patchDocument) apply(current Contact) (ContactPatch, error) {
+	if !d.needsContact() {
+		return d.merge, nil
+	}
+	return applyJSONPatch(d.operations, current)
+}
+
+// patchTestError is returned when a JSON Patch test operation does not match
+type patchTestError struct {
+	index int
+	path  string
+}
+
+func (e *patchTestError) Error() string {
+	return fmt.Sprintf("test operation %d failed: %s does not have the expected value", e.index, e.path)
+}
+
+// readPatch parses the PATCH body according to its Content-Type.
+// On failure the error response has been written.
+func readPatch(w http.ResponseWriter, r *http.Request) (patchDocument, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var document patchDocument
+	var err error
+	switch mediaType {
+	case mergePatchType, "application/json", "":
+		document.merge, err = parseMergePatch(r.Body)
+	case jsonPatchType:
+		document.operations, err = parseJSONPatch(r.Body)
+	default:
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+		writeError(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMedia,
+			fmt.Sprintf("PATCH accepts %s or %s.", mergePatchType, jsonPatchType))
+		return patchDocument{}, false
+	}
+	if err != nil {
+		writePatchError(w, r, err)
+		return patchDocument{}, false
+	}
+	return document, true
+}
+
+// writePatchError maps an error from parsing or applying a patch to the matching error response
+func writePatchError(w http.ResponseWriter, r *http.Request, err error) {
+	var validationErr *ValidationError
+	var testErr *patchTestError
+	switch {
+	case errors.As(err, &validationErr):
+		writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The patch is invalid.", validationErr.Details...)
+	case errors.As(err, &testErr):
+		writeError(w, r, http.StatusConflict, CodeConflict, testErr.Error())
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+	}
+}
+
+// parseMergePatch reads an RFC 7396 merge patch. Every contact field is required, so a
+// member set to null (remove) is rejected like an empty value. Lists are replaced as a
+// whole, as RFC 7396 does with arrays, and only emails and tags may be removed. Custom
+// fields are merged one by one, as RFC 7396 does with objects.
+func parseMergePatch(body io.Reader) (ContactPatch, error) {
+	var members map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&members); err != nil || members == nil {
+		return ContactPatch{}, errors.New("the merge patch must be a JSON object")
+	}
+
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var patch ContactPatch
+	var details []ErrorDetail
+	for _, name := range names {
+		if name == "custom_fields" {
+			if issue := patch.setCustomFields(members[name]); issue != "" {
+				details = append(details, ErrorDetail{Field: name, Issue: issue})
+			}
+			continue
+		}
+		if oneOf(name, listFields) {
+			if issue := patch.setList(name, members[name]); issue != "" {
+				details = append(details, ErrorDetail{Field: name, Issue: issue})
+			}
+			continue
+		}
+		value, issue := patchValue(name, members[name])
+		if issue != "" {
+			details = append(details, ErrorDetail{Field: name, Issue: issue})
+			continue
+		}
+		patch.set(name, &value)
+	}
+	if len(details) > 0 {
+		return ContactPatch{}, &ValidationError{Details: details}
+	}
+	return patch, nil
+}
+
+// patchValue decodes the new value of a field, issue explains why the value is not allowed
+func patchValue(field string, raw json.RawMessage) (value, issue string) {
+	switch {
+	case field == "id" || field == "phone_e164":
+		return "", "is read-only"
+	case !isPatchable(field):
+		return "", "is not a contact field"
+	case string(raw) == "null":
+		return "", "is required and cannot be removed"
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", "must be a string"
+	}
+	if value == "" {
+		return "", "is required"
+	}
+	return value, ""
+}
+
+// setList decodes the new value of a contact list, the issue explains why it is not allowed
+func (p *ContactPatch) setList(field string, raw json.RawMessage) (issue string) {
+	if string(raw) == "null" {
+		if field != "emails" && field != "tags" {
+			return "is required and cannot be removed"
+		}
+		raw = json.RawMessage("[]")
+	}
+	var err error
+	switch field {
+	case "phones":
+		var phones []Phone
+		err = json.Unmarshal(raw, &phones)
+		p.Phones = &phones
+	case "emails":
+		var emails []Email
+		err = json.Unmarshal(raw, &emails)
+		p.Emails = &emails
+	case "addresses":
+		var addresses []PostalAddress
+		err = json.Unmarshal(raw, &addresses)
+		p.Addresses = &addresses
+	case "tags":
+		var tags []string
+		if err = json.Unmarshal(raw, &tags); err != nil {
+			return "must be an array of strings"
+		}
+		p.Tags = &tags
+	}
+	if err != nil {
+		return "must be an array of objects"
+	}
+	return ""
+}
+
+// setCustomFields decodes the custom fields changed by a merge patch, null for a field
+// removes it and null for custom_fields removes them all. The values are checked by the store
+// against the definitions of the fields.
+func (p *ContactPatch) setCustomFields(raw json.RawMessage) (issue string) {
+	if string(raw) == "null" {
+		p.CustomFields, p.ReplaceCustomFields = map[string]any{}, true
+		return ""
+	}
+	if err := json.Unmarshal(raw, &p.CustomFields); err != nil || p.CustomFields == nil {
+		return "must be an object"
+	}
+	return ""
+}
+
+// parseJSONPatch reads the operations of an RFC 6902 JSON Patch
+func parseJSONPatch(body io.Reader) ([]patchOperation, error) {
+	var operations []patchOperation
+	if err := json.NewDecoder(body).Decode(&operations); err != nil {
+		return nil, errors.New("the JSON Patch must be an array of operations")
+	}
+	if operations == nil {
+		operations = []patchOperation{}
+	}
+	return operations, nil
+}
+
+// applyJSONPatch runs the operations against the contact and returns the fields that changed.
+// The patch is atomic: the first failing operation rejects the whole patch.
+func applyJSONPatch(operations []patchOperation, current Contact) (ContactPatch, error) {
+	original := map[string]string{
+		"first_name":   current.FirstName,
+		"last_name":    current.LastName,
+		"phone_number": current.PhoneNumber,
+		"address":      current.Address,
+	}
+	document := make(map[string]*string, len(original))
+	for name := range original {
+		value := original[name]
+		document[name] = &value
+	}
+
+	for i, op := range operations {
+		invalid := func(member, issue string) error {
+			return &ValidationError{Details: []ErrorDetail{{Field: fmt.Sprintf("patch[%d].%s", i, member), Issue: issue}}}
+		}
+		field, ok := pointerField(op.Path)
+		if !ok {
+			return ContactPatch{}, invalid("path", fmt.Sprintf("%q is not a writable contact field", op.Path))
+		}
+
+		switch op.Op {
+		case "add", "replace", "test":
+			var value string
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return ContactPatch{}, invalid("value", "must be a string")
+			}
+			if op.Op == "test" {
+				if document[field] == nil || *document[field] != value {
+					return ContactPatch{}, &patchTestError{index: i, path: op.Path}
+				}
+				continue
+			}
+			document[field] = &value
+		case "remove":
+			document[field] = nil
+		case "move", "copy":
+			from, ok := pointerField(op.From)
+			if !ok || document[from] == nil {
+				return ContactPatch{}, invalid("from", fmt.Sprintf("%q is not a contact field with a value", op.From))
+			}
+			value := *document[from]
+			if op.Op == "move" && from != field {
+				document[from] = nil
+			}
+			document[field] = &value
+		default:
+			return ContactPatch{}, invalid("op", fmt.Sprintf("unknown operation %q", op.Op))
+		}
+	}
+
+	// Every field must still hold a value once all operations ran
+	var patch ContactPatch
+	var details []ErrorDetail
+	for _, name := range patchableFields {
+		value := document[name]
+		switch {
+		case value == nil:
+			details = append(details, ErrorDetail{Field: name, Issue: "is required and cannot be removed"})
+		case *value == "":
+			details = append(details, ErrorDetail{Field: name, Issue: "is required"})
+		case *value != original[name]:
+			patch.set(name, value)
+		}
+	}
+	if len(details) > 0 {
+		return ContactPatch{}, &ValidationError{Details: details}
+	}
+	return patch, nil
+}
+
+// pointerField resolves a JSON Pointer such as "/first_name" to a patchable field
+func pointerField(pointer string) (string, bool) {
+	field, ok := strings.CutPrefix(pointer, "/")
+	if !ok {
+		return "", false
+	}
+	field = strings.NewReplacer("~1", "/", "~0", "~").Replace(field)
+	return field, isPatchable(field)
+}
+
+// isPatchable reports whether a PATCH request may change the field
+func isPatchable(field string) bool {
+	for _, name := range patchableFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// set records the new value of the field with the given JSON name
+func (p *ContactPatch) set(field string, value *string) {
+	switch field {
+	case "first_name":
+		p.FirstName = value
+	case "last_name":
+		p.LastName = value
+	case "phone_number":
+		p.PhoneNumber = value
+	case "address":
+		p.Address = value
+	}
+}
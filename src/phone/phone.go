@@ -0,0 +1,134 @@
+// Package phone parses user-entered phone numbers and converts them to the canonical
+// E.164 form (e.g. "054-343-5590" in region IL becomes "+972543435590"). The numbering
+// plans of every country, their calling codes, trunk and international prefixes and number
+// lengths, come from libphonenumber's metadata.
+package phone
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// Errors returned by Parse
+var (
+	ErrEmpty              = errors.New("phone number is empty")
+	ErrInvalidCharacters  = errors.New("phone number contains invalid characters")
+	ErrUnknownRegion      = errors.New("unknown region")
+	ErrInvalidCountryCode = errors.New("unknown country calling code")
+	ErrTooShort           = errors.New("phone number is too short")
+	ErrTooLong            = errors.New("phone number is too long")
+	ErrInvalidLength      = errors.New("phone number has an invalid length for its country")
+)
+
+// E.164 allows at most 15 digits including the country code
+const maxE164Digits = 15
+
+// Number is a parsed phone number
+type Number struct {
+	CountryCode string // country calling code without the +, e.g. "972"
+	National    string // national significant number, e.g. "543435590"
+}
+
+// E164 returns the number in E.164 form, e.g. "+972543435590"
+func (n Number) E164() string {
+	return "+" + n.CountryCode + n.National
+}
+
+// Regions returns the supported region codes in sorted order
+func Regions() []string {
+	codes := make([]string, 0, len(phonenumbers.GetSupportedRegions()))
+	for code := range phonenumbers.GetSupportedRegions() {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// IsSupportedRegion reports whether the region can be used as a default region
+func IsSupportedRegion(code string) bool {
+	return phonenumbers.GetSupportedRegions()[strings.ToUpper(code)]
+}
+
+// Parse parses a phone number as the user typed it. Numbers starting with + or with the
+// region's international prefix are read as international numbers, anything else as a
+// national number of defaultRegion. The number must have a possible length for its
+// country, whether it is assigned is not checked.
+func Parse(raw, defaultRegion string) (Number, error) {
+	region := strings.ToUpper(defaultRegion)
+	if !IsSupportedRegion(region) {
+		return Number{}, ErrUnknownRegion
+	}
+
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" {
+		return Number{}, ErrEmpty
+	}
+	international := strings.HasPrefix(trimmed, "+")
+	digits, err := extractDigits(strings.TrimPrefix(trimmed, "+"))
+	if err != nil {
+		return Number{}, err
+	}
+	if digits == "" {
+		return Number{}, ErrEmpty
+	}
+	if international {
+		digits = "+" + digits
+	}
+
+	number, err := phonenumbers.Parse(digits, region)
+	switch {
+	case errors.Is(err, phonenumbers.ErrInvalidCountryCode):
+		return Number{}, ErrInvalidCountryCode
+	case errors.Is(err, phonenumbers.ErrNumTooLong):
+		return Number{}, ErrTooLong
+	case err != nil:
+		return Number{}, ErrTooShort
+	}
+	switch phonenumbers.IsPossibleNumberWithReason(number) {
+	case phonenumbers.INVALID_COUNTRY_CODE:
+		return Number{}, ErrInvalidCountryCode
+	case phonenumbers.TOO_SHORT, phonenumbers.IS_POSSIBLE_LOCAL_ONLY:
+		return Number{}, ErrTooShort
+	case phonenumbers.TOO_LONG:
+		return Number{}, ErrTooLong
+	case phonenumbers.INVALID_LENGTH:
+		return Number{}, ErrInvalidLength
+	}
+	parsed := Number{
+		CountryCode: strconv.Itoa(int(number.GetCountryCode())),
+		National:    phonenumbers.GetNationalSignificantNumber(number),
+	}
+	if len(parsed.CountryCode)+len(parsed.National) > maxE164Digits {
+		return Number{}, ErrTooLong
+	}
+	return parsed, nil
+}
+
+// Normalize parses the number and returns its E.164 form
+func Normalize(raw, defaultRegion string) (string, error) {
+	number, err := Parse(raw, defaultRegion)
+	if err != nil {
+		return "", err
+	}
+	return number.E164(), nil
+}
+
+// extractDigits drops the punctuation people use to group digits and rejects anything else
+func extractDigits(s string) (string, error) {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')' || c == '/':
+			// separators are ignored
+		default:
+			return "", ErrInvalidCharacters
+		}
+	}
+	return b.String(), nil
+}
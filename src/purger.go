@@ -0,0 +1,35 @@
+package src
+
+import (
+	"log"
+	"time"
+)
+
+// StartPurger starts a goroutine that every interval permanently removes the contacts that
+// have been in the trash for longer than retention, and returns a function that stops it
+func StartPurger(store TrashStore, retention, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				purged, err := store.PurgeTrash(now.Add(-retention))
+				if err != nil {
+					log.Printf("purging the trash: %v", err)
+				} else if purged > 0 {
+					log.Printf("Purged %d contact(s) from the trash", purged)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -2,128 +2,2011 @@ package src
 
 import (
 	"database/sql"
-    "fmt"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"Rise/src/search"
 )
 
-// Contact struct represents a contact entry in the database
+// Contact struct represents a contact entry in the database.
+// PhoneNumber, PhoneE164 and Address mirror the primary entries of Phones and Addresses,
+// which are stored in the contact_phones and contact_addresses tables.
 type Contact struct {
-	ID          int    `json:"id"`
-	FirstName   string `json:"first_name"`
-	LastName    string `json:"last_name"`
-	PhoneNumber string `json:"phone_number"`
-	Address     string `json:"address"`
+	ID           int             `json:"id"`
+	FirstName    string          `json:"first_name"`
+	LastName     string          `json:"last_name"`
+	PhoneNumber  string          `json:"phone_number"` // as the user typed it
+	PhoneE164    string          `json:"phone_e164"`   // canonical form used for lookups
+	Address      string          `json:"address"`
+	Version      int             `json:"version"`    // incremented on every update, see EditContact
+	CreatedAt    time.Time       `json:"created_at"` // set by the store when the contact is added
+	Phones       []Phone         `json:"phones"`
+	Emails       []Email         `json:"emails"`
+	Addresses    []PostalAddress `json:"addresses"`
+	Tags         []string        `json:"tags"`
+	CustomFields map[string]any  `json:"custom_fields"`        // values of the tenant's CustomField definitions
+	DeletedAt    *time.Time      `json:"deleted_at,omitempty"` // set while the contact is in the trash
 }
 
-// GetContacts retrieves contacts with pagination from the database
-func GetContacts(db *sql.DB, limit, offset int) ([]Contact, string, error) {
-	// Query database for contacts with limit and offset
-	rows, err := db.Query(
-		"SELECT id, first_name, last_name, phone_number, address FROM contacts LIMIT $1 OFFSET $2",
-		limit, offset,
-	)
-	if err != nil {
-		return nil, "", err
+// ContactPatch lists the fields changed by a partial update, nil fields keep their stored value.
+// A nil Phones with a PhoneNumber (and likewise Addresses with an Address) changes only the
+// primary entry, a non-nil list replaces every entry.
+type ContactPatch struct {
+	FirstName   *string
+	LastName    *string
+	PhoneNumber *string
+	PhoneE164   *string
+	Address     *string
+	Phones      *[]Phone
+	Emails      *[]Email
+	Addresses   *[]PostalAddress
+	Tags        *[]string
+	// CustomFields sets the custom fields it names, a nil value removes one. With
+	// ReplaceCustomFields the fields it leaves out are removed too.
+	CustomFields        map[string]any
+	ReplaceCustomFields bool
+}
+
+// patchAll returns a patch that overwrites every field of the stored contact.
+// Lists left out of the contact (nil) are kept, apart from their primary entry.
+func patchAll(contact Contact) ContactPatch {
+	patch := ContactPatch{
+		FirstName:   &contact.FirstName,
+		LastName:    &contact.LastName,
+		PhoneNumber: &contact.PhoneNumber,
+		PhoneE164:   &contact.PhoneE164,
+		Address:     &contact.Address,
 	}
-	defer rows.Close()
+	if contact.Phones != nil {
+		patch.Phones = &contact.Phones
+	}
+	if contact.Emails != nil {
+		patch.Emails = &contact.Emails
+	}
+	if contact.Addresses != nil {
+		patch.Addresses = &contact.Addresses
+	}
+	if contact.Tags != nil {
+		patch.Tags = &contact.Tags
+	}
+	if contact.CustomFields != nil {
+		patch.CustomFields, patch.ReplaceCustomFields = contact.CustomFields, true
+	}
+	return patch
+}
+
+// changesColumns reports whether the patch sets any column of the contacts table
+func (p ContactPatch) changesColumns() bool {
+	for _, column := range p.columns() {
+		if column.value != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// changesDetails reports whether the patch touches the contact_* child tables
+func (p ContactPatch) changesDetails() bool {
+	return p.Phones != nil || p.Emails != nil || p.Addresses != nil || p.Tags != nil || p.PhoneNumber != nil || p.Address != nil ||
+		p.CustomFields != nil || p.ReplaceCustomFields
+}
+
+// columns pairs every field of the patch with its column, in contactColumns order
+func (p ContactPatch) columns() []struct {
+	name  string
+	value *string
+} {
+	return []struct {
+		name  string
+		value *string
+	}{
+		{"first_name", p.FirstName},
+		{"last_name", p.LastName},
+		{"phone_number", p.PhoneNumber},
+		{"phone_e164", p.PhoneE164},
+		{"address", p.Address},
+	}
+}
+
+// Apply returns a copy of the contact with the fields of the patch changed
+func (p ContactPatch) Apply(contact Contact) Contact {
+	contact = contact.clone()
+	targets := []*string{&contact.FirstName, &contact.LastName, &contact.PhoneNumber, &contact.PhoneE164, &contact.Address}
+	for i, column := range p.columns() {
+		if column.value != nil {
+			*targets[i] = *column.value
+		}
+	}
+
+	switch {
+	case p.Phones != nil:
+		contact.Phones = append([]Phone{}, *p.Phones...)
+	case p.PhoneNumber != nil:
+		phone := Phone{Type: PhoneMobile, Number: contact.PhoneNumber, E164: contact.PhoneE164, Primary: true}
+		if i := primaryPhone(contact.Phones); i >= 0 {
+			phone.Type = contact.Phones[i].Type
+			contact.Phones[i] = phone
+		} else {
+			contact.Phones = append(contact.Phones, phone)
+		}
+	}
+	if p.Emails != nil {
+		contact.Emails = append([]Email{}, *p.Emails...)
+	}
+	switch {
+	case p.Addresses != nil:
+		contact.Addresses = append([]PostalAddress{}, *p.Addresses...)
+	case p.Address != nil:
+		address := PostalAddress{Type: AddressHome, Address: contact.Address, Primary: true}
+		if i := primaryAddress(contact.Addresses); i >= 0 {
+			address.Type = contact.Addresses[i].Type
+			contact.Addresses[i] = address
+		} else if contact.Address != "" {
+			contact.Addresses = append(contact.Addresses, address)
+		}
+	}
+	if p.Tags != nil {
+		contact.Tags = append([]string{}, *p.Tags...)
+	}
+	if p.ReplaceCustomFields || (p.CustomFields != nil && contact.CustomFields == nil) {
+		contact.CustomFields = map[string]any{}
+	}
+	for name, value := range p.CustomFields {
+		if value == nil {
+			delete(contact.CustomFields, name)
+		} else {
+			contact.CustomFields[name] = value
+		}
+	}
+	return contact
+}
+
+// contactColumns lists the columns read by every contact query, in scanContact order
+const contactColumns = "id, first_name, last_name, phone_number, phone_e164, address, version, created_at"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanContact reads one row selected with contactColumns
+func scanContact(row rowScanner) (Contact, error) {
+	var contact Contact
+	var phoneE164 sql.NullString // empty until BackfillPhoneE164 has run
+	var createdAt sql.NullTime   // empty for contacts inserted around the store
+	err := row.Scan(&contact.ID, &contact.FirstName, &contact.LastName, &contact.PhoneNumber, &phoneE164, &contact.Address, &contact.Version, &createdAt)
+	contact.PhoneE164, contact.CreatedAt = phoneE164.String, createdAt.Time
+	return contact, err
+}
 
+// scanContacts reads every row selected with contactColumns
+func scanContacts(rows *sql.Rows) ([]Contact, error) {
 	var contacts []Contact
 	for rows.Next() {
-		var contact Contact
-		if err := rows.Scan(&contact.ID, &contact.FirstName, &contact.LastName, &contact.PhoneNumber, &contact.Address); err != nil {
-			return nil, "", err
+		contact, err := scanContact(rows)
+		if err != nil {
+			return nil, err
 		}
 		contacts = append(contacts, contact)
 	}
+	return contacts, rows.Err()
+}
+
+// ContactFilter narrows the contact list down, zero fields match every contact
+type ContactFilter struct {
+	Tag     string            // contacts with this tag
+	GroupID int               // members of this group
+	Fields  []FieldCondition  // contacts with every one of these custom field values
+	Columns []ColumnCondition // contacts matching every one of these column filters
+}
+
+// empty reports whether the filter matches every contact
+func (f ContactFilter) empty() bool {
+	return f.Tag == "" && f.GroupID == 0 && len(f.Fields) == 0 && len(f.Columns) == 0
+}
+
+// columnExpressions whitelists the fields the contact list is sorted and filtered by, with
+// the SQL expression each is compared through. Only these expressions are written into the
+// queries built from a request, the values are passed as arguments. Text is compared in
+// lowercase, see the indexes of 0011_add_contact_sorting.
+var columnExpressions = map[string]string{
+	"first_name":   "LOWER(first_name)",
+	"last_name":    "LOWER(last_name)",
+	"phone_number": "LOWER(phone_number)",
+	"address":      "LOWER(address)",
+	"created_at":   "created_at",
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, see the ESCAPE clause of conditions
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// conditions returns the WHERE clause selecting the tenant's contacts outside the trash that
+// match the filter, with its arguments
+func (f ContactFilter) conditions(tenant string) (string, []any, error) {
+	conditions, args := "tenant_id = $1 AND deleted_at IS NULL", []any{tenant}
+	if f.Tag != "" {
+		args = append(args, f.Tag)
+		conditions += fmt.Sprintf(" AND id IN (SELECT contact_id FROM contact_tags WHERE tag = $%d)", len(args))
+	}
+	if f.GroupID > 0 {
+		args = append(args, f.GroupID)
+		conditions += fmt.Sprintf(" AND id IN (SELECT contact_id FROM contact_group_members WHERE group_id = $%d)", len(args))
+	}
+	for _, field := range f.Fields {
+		args = append(args, field.Field, field.Value)
+		conditions += fmt.Sprintf(" AND id IN (SELECT contact_id FROM contact_field_values WHERE field_id = "+
+			"(SELECT id FROM contact_fields WHERE tenant_id = $1 AND name = $%d) AND value = $%d)", len(args)-1, len(args))
+	}
+	for _, column := range f.Columns {
+		expression, ok := columnExpressions[column.Field]
+		if !ok || column.Field == "created_at" {
+			return "", nil, fmt.Errorf("contacts cannot be filtered by %q", column.Field)
+		}
+		value := strings.ToLower(column.Value)
+		switch column.Op {
+		case FilterEq:
+			args = append(args, value)
+			conditions += fmt.Sprintf(" AND %s = $%d", expression, len(args))
+		case FilterPrefix, FilterContains:
+			pattern := likeEscaper.Replace(value) + "%"
+			if column.Op == FilterContains {
+				pattern = "%" + pattern
+			}
+			args = append(args, pattern)
+			conditions += fmt.Sprintf(` AND %s LIKE $%d ESCAPE '\'`, expression, len(args))
+		default:
+			return "", nil, fmt.Errorf("unknown filter operator %q", column.Op)
+		}
+	}
+	return conditions, args, nil
+}
+
+// GetContacts retrieves a page of the tenant's contacts ordered by id, using the id as a
+// keyset cursor. Contacts with an id greater than afterID are returned, or when beforeID is
+// set, the page that ends right before it. The bool result reports whether more contacts
+// exist past the returned page in the direction of travel.
+func GetContacts(db Executor, tenant string, limit, afterID, beforeID int) ([]Contact, bool, error) {
+	return ListContacts(db, tenant, ContactFilter{}, limit, afterID, beforeID)
+}
+
+// ListContacts retrieves a page of the tenant's contacts matching the filter, paged like
+// GetContacts
+func ListContacts(db Executor, tenant string, filter ContactFilter, limit, afterID, beforeID int) ([]Contact, bool, error) {
+	conditions, args, err := filter.conditions(tenant)
+	if err != nil {
+		return nil, false, err
+	}
+	order, cursor := "id > $%d ORDER BY id ASC", afterID
+	if beforeID > 0 {
+		// Walk backwards from the cursor, the page is reversed into id order below
+		order, cursor = "id < $%d ORDER BY id DESC", beforeID
+	}
+	args = append(args, cursor, limit+1)
+	query := fmt.Sprintf("SELECT %s FROM contacts WHERE %s AND %s LIMIT $%d", contactColumns, conditions, fmt.Sprintf(order, len(args)-1), len(args))
+
+	// Fetch one extra row to find out whether another page exists
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	contacts, err := scanContacts(rows)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(contacts) > limit
+	if hasMore {
+		contacts = contacts[:limit]
+	}
+	if beforeID > 0 {
+		for i, j := 0, len(contacts)-1; i < j; i, j = i+1, j-1 {
+			contacts[i], contacts[j] = contacts[j], contacts[i]
+		}
+	}
+	return contacts, hasMore, nil
+}
+
+// SortContacts retrieves a page of the tenant's contacts matching the filter ordered by the
+// keys, using the sort values and id of a contact as a keyset cursor. Contacts after the
+// after cursor are returned, or when before is set the page of contacts that ends just
+// before it. Contacts without a value come last and ties are ordered by id. The bool result
+// reports whether more contacts follow in the direction of the page.
+func SortContacts(db Executor, tenant string, filter ContactFilter, keys []SortKey, limit int, after, before *SortCursor) ([]Contact, bool, error) {
+	conditions, args, err := filter.conditions(tenant)
+	if err != nil {
+		return nil, false, err
+	}
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		value, ok := columnExpressions[key.Field]
+		switch {
+		case key.Custom:
+			args = append(args, key.Field)
+			value = fmt.Sprintf("(SELECT value FROM contact_field_values WHERE contact_id = contacts.id AND field_id = "+
+				"(SELECT id FROM contact_fields WHERE tenant_id = $1 AND name = $%d))", len(args))
+			if key.Numeric {
+				value = "CAST(" + value + " AS DOUBLE PRECISION)"
+			}
+		case !ok:
+			return nil, false, fmt.Errorf("contacts cannot be sorted by %q", key.Field)
+		}
+		values[i] = value
+	}
+
+	cursor, backwards := after, false
+	if before != nil {
+		// Walk backwards from the cursor, the page is reversed into list order below
+		cursor, backwards = before, true
+	}
+	if cursor != nil {
+		if len(cursor.Values) != len(keys) {
+			return nil, false, fmt.Errorf("the cursor does not match the sort keys")
+		}
+		// A contact follows the cursor when its values equal the cursor's up to a key on which
+		// it comes later, or equal them all and its id is higher. Contacts without a value come
+		// last, so they follow every value and nothing follows them on that key.
+		var alternatives, equal []string
+		for i, key := range keys {
+			var later, same string
+			if value := cursor.Values[i]; value == nil {
+				if backwards {
+					later = values[i] + " IS NOT NULL"
+				}
+				same = values[i] + " IS NULL"
+			} else {
+				argument, err := cursorArgument(key, *value)
+				if err != nil {
+					return nil, false, err
+				}
+				args = append(args, argument)
+				placeholder := fmt.Sprintf("$%d", len(args))
+				if !key.Custom && key.Field != "created_at" {
+					placeholder = "LOWER(" + placeholder + ")" // like the column, see columnExpressions
+				}
+				operator := ">"
+				if key.Desc != backwards {
+					operator = "<"
+				}
+				later = fmt.Sprintf("%s %s %s", values[i], operator, placeholder)
+				if !backwards {
+					later = fmt.Sprintf("(%s IS NULL OR %s)", values[i], later)
+				}
+				same = fmt.Sprintf("%s = %s", values[i], placeholder)
+			}
+			if later != "" {
+				alternatives = append(alternatives, strings.Join(append(equal[:len(equal):len(equal)], later), " AND "))
+			}
+			equal = append(equal, same)
+		}
+		args = append(args, cursor.ID)
+		operator := ">"
+		if backwards {
+			operator = "<"
+		}
+		alternatives = append(alternatives, strings.Join(append(equal, fmt.Sprintf("id %s $%d", operator, len(args))), " AND "))
+		conditions += " AND ((" + strings.Join(alternatives, ") OR (") + "))"
+	}
+
+	var order []string
+	for i, key := range keys {
+		nulls, direction := "IS NULL", "ASC"
+		if key.Desc != backwards {
+			direction = "DESC"
+		}
+		if backwards {
+			nulls = "IS NOT NULL"
+		}
+		order = append(order, values[i]+" "+nulls, values[i]+" "+direction)
+	}
+	direction := "ASC"
+	if backwards {
+		direction = "DESC"
+	}
+	args = append(args, limit+1)
+	query := fmt.Sprintf("SELECT %s FROM contacts WHERE %s ORDER BY %s, id %s LIMIT $%d",
+		contactColumns, conditions, strings.Join(order, ", "), direction, len(args))
+
+	// Fetch one extra row to find out whether another page exists
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	contacts, err := scanContacts(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(contacts) > limit
+	if hasMore {
+		contacts = contacts[:limit]
+	}
+	if backwards {
+		for i, j := 0, len(contacts)-1; i < j; i, j = i+1, j-1 {
+			contacts[i], contacts[j] = contacts[j], contacts[i]
+		}
+	}
+	return contacts, hasMore, nil
+}
+
+// cursorArgument converts a value of a SortCursor to the type the key is compared as
+func cursorArgument(key SortKey, value string) (any, error) {
+	switch {
+	case key.Numeric:
+		return strconv.ParseFloat(value, 64)
+	case !key.Custom && key.Field == "created_at":
+		return time.Parse(time.RFC3339, value)
+	}
+	return value, nil
+}
+
+// CountContacts counts the tenant's contacts matching the filter. A positive limit stops
+// the count there, so large lists are not scanned to the end.
+func CountContacts(db Executor, tenant string, filter ContactFilter, limit int) (int, error) {
+	conditions, args, err := filter.conditions(tenant)
+	if err != nil {
+		return 0, err
+	}
+	query := "SELECT COUNT(*) FROM contacts WHERE " + conditions
+	if limit > 0 {
+		args = append(args, limit)
+		query = fmt.Sprintf("SELECT COUNT(*) FROM (SELECT id FROM contacts WHERE %s LIMIT $%d) AS counted", conditions, len(args))
+	}
+	var count int
+	err = db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+// EstimateContacts returns the PostgreSQL planner's estimate of the number of the tenant's
+// contacts matching the filter. The planner scales pg_class.reltuples of the contacts table
+// by the selectivity of the conditions, so no row is read whatever the size of the list.
+func EstimateContacts(db Executor, tenant string, filter ContactFilter) (int, error) {
+	conditions, args, err := filter.conditions(tenant)
+	if err != nil {
+		return 0, err
+	}
+	var plan string
+	if err := db.QueryRow("EXPLAIN (FORMAT JSON) SELECT id FROM contacts WHERE "+conditions, args...).Scan(&plan); err != nil {
+		return 0, err
+	}
+	var plans []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &plans); err != nil {
+		return 0, fmt.Errorf("reading the query plan: %w", err)
+	}
+	if len(plans) == 0 {
+		return 0, errors.New("the query plan is empty")
+	}
+	return int(math.Round(plans[0].Plan.Rows)), nil
+}
+
+// SearchCandidates retrieves the tenant's contacts matching the filter that can match every
+// term of the query, ordered by id: a name or address containing one of the fragments of the
+// term, see search.Term.Fragments, or for phone terms an E.164 number containing its digits.
+// Text is compared through search_fold, which folds like search.Normalize and drops the same
+// search.CombiningMarks, so the candidates include every contact search.Score accepts and
+// only those are ranked.
+func SearchCandidates(db Executor, tenant string, filter ContactFilter, query search.Query) ([]Contact, error) {
+	conditions, args, err := filter.conditions(tenant)
+	if err != nil {
+		return nil, err
+	}
+	for _, term := range query.Terms {
+		var matches []string
+		if term.Phone && (term.Field == "" || term.Field == search.FieldPhone) {
+			// The typed number may start with a trunk prefix that E.164 leaves out
+			args = append(args, "%"+likeEscaper.Replace(strings.TrimLeft(term.Text, "0"))+"%")
+			matches = append(matches, fmt.Sprintf(`phone_e164 LIKE $%d ESCAPE '\' OR id IN (SELECT contact_id FROM contact_phones WHERE e164 LIKE $%d ESCAPE '\')`, len(args), len(args)))
+		}
+		var columns []string
+		if term.Field == "" || term.Field == search.FieldFirst {
+			columns = append(columns, "first_name")
+		}
+		if term.Field == "" || term.Field == search.FieldLast {
+			columns = append(columns, "last_name")
+		}
+		address := !term.Names && (term.Field == "" || term.Field == search.FieldAddress)
+		for _, fragment := range term.Fragments() {
+			if len(columns) == 0 && !address {
+				break
+			}
+			args = append(args, "%"+likeEscaper.Replace(fragment)+"%")
+			for _, column := range columns {
+				matches = append(matches, fmt.Sprintf(`search_fold(%s) LIKE $%d ESCAPE '\'`, column, len(args)))
+			}
+			if address {
+				matches = append(matches, fmt.Sprintf(`search_fold(address) LIKE $%d ESCAPE '\' OR id IN `+
+					`(SELECT contact_id FROM contact_addresses WHERE search_fold(address) LIKE $%d ESCAPE '\')`, len(args), len(args)))
+			}
+		}
+		if len(matches) == 0 {
+			// Text restricted to phone numbers matches no contact
+			return nil, nil
+		}
+		conditions += " AND (" + strings.Join(matches, " OR ") + ")"
+	}
 
-	message := ""
-	// If fewer contacts are returned than requested, it's the end of the table
-	if len(contacts) < limit {
-		message = "end of table, move to the start"
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM contacts WHERE %s ORDER BY id", contactColumns, conditions), args...)
+	if err != nil {
+		return nil, err
 	}
-	return contacts, message, nil
+	defer rows.Close()
+	return scanContacts(rows)
 }
 
-// AddContact inserts a new contact into the database
-func AddContact(db *sql.DB, contact Contact) (int, error) {
+// insertContactQuery inserts one contact and returns its generated id
+const insertContactQuery = "INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, phone_e164, address, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id"
+
+// AddContact inserts a new contact of the tenant with its phones, emails and addresses,
+// recorded in the audit log as created by the actor
+func AddContact(db Executor, tenant string, actor Actor, contact Contact) (int, error) {
+	tx, err := begin(db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() // no-op once committed
+
 	// Insert the contact and get the generated ID
-	err := db.QueryRow(
-		"INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES ($1, $2, $3, $4) RETURNING id",
-		contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address,
+	contact.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	err = tx.QueryRow(
+		insertContactQuery, tenant,
+		contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, contact.CreatedAt,
 	).Scan(&contact.ID)
 
+	if isUniqueViolation(err) {
+		return 0, ErrConflict
+	}
 	if err != nil {
 		return 0, err
 	}
+	if err := insertDetails(tx, contact); err != nil {
+		return 0, err
+	}
+	if err := insertAudit(tx, tenant, actor, AuditCreate, contact.ID, nil, created(contact)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
 	return contact.ID, nil
 }
 
-// DeleteContact removes a contact by phone number and returns the number of deleted rows
-func DeleteContact(db *sql.DB, phoneNumber string) (int, error) {
-	// Delete contact by phone number
-	result, err := db.Exec("DELETE FROM contacts WHERE phone_number = $1", phoneNumber)
+// AddContacts inserts contacts of the tenant in a single transaction and returns their
+// generated ids. Either every contact is inserted or, on the first error, none is.
+// Every contact gets its own audit entry.
+func AddContacts(db Executor, tenant string, actor Actor, contacts []Contact) ([]int, error) {
+	tx, err := begin(db)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	// Get the number of rows deleted
-	rowsAffected, err := result.RowsAffected()
+	defer tx.Rollback() // no-op once committed
+
+	stmt, err := tx.Prepare(insertContactQuery)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if rowsAffected == 0 {
-		return 0, fmt.Errorf("contact not found")
+	defer stmt.Close()
+
+	ids := make([]int, len(contacts))
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, contact := range contacts {
+		contact.CreatedAt = now
+		err := stmt.QueryRow(tenant, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, now).Scan(&ids[i])
+		if isUniqueViolation(err) {
+			return nil, ErrConflict
+		}
+		if err != nil {
+			return nil, err
+		}
+		contact.ID = ids[i]
+		if err := insertDetails(tx, contact); err != nil {
+			return nil, err
+		}
+		if err := insertAudit(tx, tenant, actor, AuditCreate, contact.ID, nil, created(contact)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// DeleteContact moves the tenant's contact with the given id to the trash and records it in
+// the audit log. A version above 0 only deletes the contact if it is still at that version.
+func DeleteContact(db Executor, tenant string, actor Actor, id, version int) error {
+	tx, err := begin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err := trashContact(tx, tenant, actor, id, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// trashContact moves a contact to the trash inside the transaction, see DeleteContact
+func trashContact(tx Executor, tenant string, actor Actor, id, version int) error {
+	before, err := contactSnapshot(tx, tenant, id, version)
+	if err != nil {
+		return err
+	}
+	query := "UPDATE contacts SET deleted_at = $3 WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL"
+	args := []any{id, tenant, time.Now().UTC().Truncate(time.Second)}
+	if version > 0 {
+		query, args = query+" AND version = $4", append(args, version)
 	}
-	return int(rowsAffected), nil
+	// Check that a row was deleted, it may have changed since the snapshot
+	deleted, err := execCount(tx, query, args...)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return missingOrChanged(tx, tenant, id, version)
+	}
+	return insertAudit(tx, tenant, actor, AuditDelete, id, &before, nil)
 }
 
-// SearchContact retrieves all contacts with the given phone number
-func SearchContact(db *sql.DB, phoneNumber string) ([]Contact, error) {
+// SearchContact retrieves all of the tenant's contacts with the given normalized number
+// among their phone numbers
+func SearchContact(db Executor, tenant, phoneE164 string) ([]Contact, error) {
 	// Query database for contacts with the given phone number
 	rows, err := db.Query(
-		"SELECT id, first_name, last_name, phone_number, address FROM contacts WHERE phone_number = $1",
-		phoneNumber,
+		"SELECT "+contactColumns+" FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL AND "+
+			"(phone_e164 = $2 OR id IN (SELECT contact_id FROM contact_phones WHERE e164 = $2))",
+		tenant, phoneE164,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var contacts []Contact
-	for rows.Next() {
-		var contact Contact
-		if err := rows.Scan(&contact.ID, &contact.FirstName, &contact.LastName, &contact.PhoneNumber, &contact.Address); err != nil {
-			return nil, err
-		}
-		contacts = append(contacts, contact)
+	contacts, err := scanContacts(rows)
+	if err != nil {
+		return nil, err
 	}
 	// Return an error if no contacts are found
 	if len(contacts) == 0 {
-		return nil, fmt.Errorf("no contacts found")
+		return nil, ErrNotFound
 	}
 
 	return contacts, nil
 }
 
-// EditContact updates an existing contact based on the provided phone number
-func EditContact(db *sql.DB, phoneNumber string, updatedContact Contact) (int, error) {
-	// Update contact's details based on phone number
-	result, err := db.Exec(
-		"UPDATE contacts SET first_name = $1, last_name = $2, phone_number = $3, address = $4 WHERE phone_number = $5",
-		updatedContact.FirstName, updatedContact.LastName, updatedContact.PhoneNumber, updatedContact.Address, phoneNumber,
-	)
+// EditContact updates only the fields set in the patch of the tenant's contact, bumps the
+// version and returns the stored row. A version above 0 only updates the contact if it is
+// still at that version. The change is recorded in the audit log with the contact before
+// and after it. An empty patch changes nothing and returns the contact as it is.
+func EditContact(db Executor, tenant string, actor Actor, id int, patch ContactPatch, version int) (Contact, error) {
+	if !patch.changesColumns() && !patch.changesDetails() {
+		contact, err := GetContactByID(db, tenant, id)
+		if err == nil && version > 0 && contact.Version != version {
+			return Contact{}, ErrVersionMismatch
+		}
+		return contact, err
+	}
+
+	tx, err := begin(db)
 	if err != nil {
-		return 0, err
+		return Contact{}, err
 	}
-	// Get the number of rows affected (updated)
-	rowsAffected, err := result.RowsAffected()
+	defer tx.Rollback() // no-op once committed
+
+	before, err := contactSnapshot(tx, tenant, id, version)
 	if err != nil {
-		return 0, err
+		return Contact{}, err
 	}
-	if rowsAffected == 0 {
-		return 0, fmt.Errorf("no contacts found to update")
+	contact, err := patchContact(tx, tenant, actor, AuditUpdate, before, patch, version)
+	if err != nil {
+		return Contact{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// patchContact writes the patch over the contact read as before, bumps its version and
+// records the change in the audit log under the action. A version above 0 only updates the
+// contact if it is still at that version.
+func patchContact(tx Executor, tenant string, actor Actor, action string, before Contact, patch ContactPatch, version int) (Contact, error) {
+	// Build the SET clause from the supplied columns
+	var assignments []string
+	var args []any
+	for _, column := range patch.columns() {
+		if column.value != nil {
+			args = append(args, *column.value)
+			assignments = append(assignments, fmt.Sprintf("%s = $%d", column.name, len(args)))
+		}
+	}
+	assignments = append(assignments, "version = version + 1")
+	args = append(args, before.ID, tenant)
+	condition := fmt.Sprintf("id = $%d AND tenant_id = $%d AND deleted_at IS NULL", len(args)-1, len(args))
+	if version > 0 {
+		args = append(args, version)
+		condition += fmt.Sprintf(" AND version = $%d", len(args))
+	}
+	query := fmt.Sprintf("UPDATE contacts SET %s WHERE %s RETURNING %s", strings.Join(assignments, ", "), condition, contactColumns)
+
+	contact, err := scanContact(tx.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return Contact{}, missingOrChanged(tx, tenant, before.ID, version)
+	}
+	if isUniqueViolation(err) {
+		return Contact{}, ErrConflict
+	}
+	if err != nil {
+		return Contact{}, err
+	}
+	if err := updateDetails(tx, contact, patch); err != nil {
+		return Contact{}, err
+	}
+	after := patch.Apply(before)
+	after.Version = contact.Version
+	if err := insertAudit(tx, tenant, actor, action, before.ID, &before, &after); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// DuplicateCandidates retrieves the tenant's contacts with one of the E.164 numbers among
+// their phone numbers, ordered by id
+func DuplicateCandidates(db Executor, tenant string, phones []string) ([]Contact, error) {
+	if len(phones) == 0 {
+		return nil, nil
+	}
+	args := []any{tenant}
+	placeholders := make([]string, len(phones))
+	for i, number := range phones {
+		args = append(args, number)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+	in := strings.Join(placeholders, ", ")
+	query := fmt.Sprintf("SELECT %s FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL AND "+
+		"(phone_e164 IN (%s) OR id IN (SELECT contact_id FROM contact_phones WHERE e164 IN (%s))) ORDER BY id",
+		contactColumns, in, in)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanContacts(rows)
+}
+
+// LockTenant locks the tenant's row until the transaction db runs in ends, making other
+// transactions that lock it wait. Rows referencing the tenant can still be written.
+func LockTenant(db Executor, tenant string) error {
+	_, err := db.Exec("UPDATE tenants SET name = name WHERE id = $1", tenant)
+	return err
+}
+
+// MergeContacts writes the patch over the survivor among the tenant's contacts and moves
+// the merged contacts to the trash, in one transaction. The survivor is recorded in the
+// audit log as merged and the others as deleted. A version above 0 only merges into the
+// survivor if it is still at that version.
+func MergeContacts(db Executor, tenant string, actor Actor, survivor int, patch ContactPatch, version int, merged []int) (Contact, error) {
+	tx, err := begin(db)
+	if err != nil {
+		return Contact{}, err
 	}
-	return int(rowsAffected), nil
+	defer tx.Rollback() // no-op once committed
+
+	before, err := contactSnapshot(tx, tenant, survivor, version)
+	if err != nil {
+		return Contact{}, err
+	}
+	contact, err := patchContact(tx, tenant, actor, AuditMerge, before, patch, version)
+	if err != nil {
+		return Contact{}, err
+	}
+	for _, id := range merged {
+		if err := trashContact(tx, tenant, actor, id, 0); err != nil {
+			return Contact{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// queryRower is implemented by *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// querier is implemented by *sql.DB and *sql.Tx, so reads can also run inside a write
+type querier interface {
+	queryRower
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// Executor is implemented by *sql.DB and *sql.Tx. The repository functions take one so they
+// can run on their own or as part of a transaction of the caller, see WithTransaction.
+type Executor interface {
+	querier
+	Exec(query string, args ...any) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// scopedTx is the transaction a repository write runs in: one begun for the write, or the
+// transaction of the caller, whose commit and rollback are then left to the caller
+type scopedTx struct {
+	Executor
+	own *sql.Tx // nil when the caller's transaction is joined
 }
 
+// begin starts a transaction on db, or joins db when it already is a transaction
+func begin(db Executor) (scopedTx, error) {
+	conn, ok := db.(interface{ Begin() (*sql.Tx, error) })
+	if !ok {
+		return scopedTx{Executor: db}, nil
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return scopedTx{}, err
+	}
+	return scopedTx{Executor: tx, own: tx}, nil
+}
+
+// Commit commits a transaction begun for the write
+func (t scopedTx) Commit() error {
+	if t.own == nil {
+		return nil
+	}
+	return t.own.Commit()
+}
+
+// Rollback rolls back a transaction begun for the write
+func (t scopedTx) Rollback() error {
+	if t.own == nil {
+		return nil
+	}
+	return t.own.Rollback()
+}
+
+// WithTransaction calls fn with a transaction on db, committed when fn returns nil and
+// rolled back otherwise. Repository functions given the transaction take part in it.
+// When db already is a transaction fn runs in it.
+func WithTransaction(db Executor, fn func(tx Executor) error) error {
+	tx, err := begin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
 
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// missingOrChanged tells why a conditional write matched no row: the contact is gone, or
+// it exists at a different version than expected
+func missingOrChanged(db queryRower, tenant string, id, version int) error {
+	if version == 0 {
+		return ErrNotFound
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM contacts WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL)", id, tenant).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return ErrNotFound
+}
+
+// GetContactByID retrieves a single contact of the tenant by its id
+func GetContactByID(db querier, tenant string, id int) (Contact, error) {
+	contact, err := scanContact(db.QueryRow("SELECT "+contactColumns+" FROM contacts WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL", id, tenant))
+	if err == sql.ErrNoRows {
+		return Contact{}, ErrNotFound
+	}
+	if err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// contactSnapshot reads a contact with its details inside the transaction changing it, as
+// the before state of the audit entry, and checks its version unless version is 0
+func contactSnapshot(tx Executor, tenant string, id, version int) (Contact, error) {
+	contact, err := GetContactByID(tx, tenant, id)
+	if err != nil {
+		return Contact{}, err
+	}
+	if version > 0 && contact.Version != version {
+		return Contact{}, ErrVersionMismatch
+	}
+	contacts := []Contact{contact}
+	if err := LoadContactDetails(tx, contacts); err != nil {
+		return Contact{}, err
+	}
+	return contacts[0], nil
+}
+
+// BackfillPhoneE164 fills phone_e164 for rows stored before phone numbers were normalized
+// and returns the number of updated rows. normalize maps a stored number to its lookup key.
+func BackfillPhoneE164(db Executor, normalize func(string) string) (int, error) {
+	rows, err := db.Query("SELECT id, phone_number FROM contacts WHERE phone_e164 IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id          int
+		phoneNumber string
+	}
+	var backlog []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.phoneNumber); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		backlog = append(backlog, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Update after closing the cursor, SQLite runs on a single connection
+	for _, p := range backlog {
+		if _, err := db.Exec("UPDATE contacts SET phone_e164 = $1 WHERE id = $2", normalize(p.phoneNumber), p.id); err != nil {
+			return 0, err
+		}
+	}
+
+	// Rows stored before the detail tables existed get their number and address copied over
+	for _, query := range backfillDetailsQueries {
+		if _, err := db.Exec(query); err != nil {
+			return 0, err
+		}
+	}
+	return len(backlog), nil
+}
+
+// backfillDetailsQueries copy the phone number and address of contacts without detail rows
+var backfillDetailsQueries = []string{
+	`INSERT INTO contact_phones (contact_id, type, number, e164, is_primary)
+	SELECT id, 'mobile', phone_number, phone_e164, TRUE FROM contacts
+	WHERE NOT EXISTS (SELECT 1 FROM contact_phones WHERE contact_phones.contact_id = contacts.id)`,
+	`INSERT INTO contact_addresses (contact_id, type, address, is_primary)
+	SELECT id, 'home', address, TRUE FROM contacts
+	WHERE address IS NOT NULL AND address <> ''
+	AND NOT EXISTS (SELECT 1 FROM contact_addresses WHERE contact_addresses.contact_id = contacts.id)`,
+}
+
+// Queries writing the contact_phones, contact_emails, contact_addresses, contact_tags and
+// contact_field_values tables. A custom field value is stored under the field of the
+// contact's tenant with the name, and skipped when the tenant has no such field.
+const (
+	insertPhoneQuery      = "INSERT INTO contact_phones (contact_id, type, number, e164, is_primary) VALUES ($1, $2, $3, $4, $5)"
+	insertEmailQuery      = "INSERT INTO contact_emails (contact_id, type, address, is_primary) VALUES ($1, $2, $3, $4)"
+	insertAddressQuery    = "INSERT INTO contact_addresses (contact_id, type, address, is_primary) VALUES ($1, $2, $3, $4)"
+	insertTagQuery        = "INSERT INTO contact_tags (contact_id, tag) VALUES ($1, $2)"
+	insertFieldValueQuery = "INSERT INTO contact_field_values (contact_id, field_id, value) SELECT c.id, f.id, $1 FROM contacts c " +
+		"JOIN contact_fields f ON f.tenant_id = c.tenant_id WHERE c.id = $2 AND f.name = $3"
+)
+
+// insertDetails stores the phones, emails, addresses, tags and custom field values of a contact
+func insertDetails(tx Executor, contact Contact) error {
+	for _, p := range contact.Phones {
+		if _, err := tx.Exec(insertPhoneQuery, contact.ID, p.Type, p.Number, p.E164, p.Primary); err != nil {
+			return err
+		}
+	}
+	for _, e := range contact.Emails {
+		if _, err := tx.Exec(insertEmailQuery, contact.ID, e.Type, e.Address, e.Primary); err != nil {
+			return err
+		}
+	}
+	for _, a := range contact.Addresses {
+		if _, err := tx.Exec(insertAddressQuery, contact.ID, a.Type, a.Address, a.Primary); err != nil {
+			return err
+		}
+	}
+	for _, tag := range contact.Tags {
+		if _, err := tx.Exec(insertTagQuery, contact.ID, tag); err != nil {
+			return err
+		}
+	}
+	for _, name := range fieldNames(contact.CustomFields) {
+		if value := contact.CustomFields[name]; value != nil {
+			if _, err := tx.Exec(insertFieldValueQuery, fieldText(value), contact.ID, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldNames returns the names of the custom fields in order, so they are written in the
+// same order every time
+func fieldNames(fields map[string]any) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// updateDetails writes the detail changes of a patch to the edited contact. Replaced lists
+// are deleted and inserted again, a patched phone_number or address alone rewrites the
+// primary entry, or adds one if the contact has none. Patched custom fields are deleted and
+// inserted again unless removed.
+func updateDetails(tx Executor, contact Contact, patch ContactPatch) error {
+	replaced := Contact{ID: contact.ID}
+	switch {
+	case patch.Phones != nil:
+		if _, err := tx.Exec("DELETE FROM contact_phones WHERE contact_id = $1", contact.ID); err != nil {
+			return err
+		}
+		replaced.Phones = *patch.Phones
+	case patch.PhoneNumber != nil:
+		updated, err := execCount(tx, "UPDATE contact_phones SET number = $1, e164 = $2 WHERE contact_id = $3 AND is_primary",
+			contact.PhoneNumber, contact.PhoneE164, contact.ID)
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			replaced.Phones = []Phone{{Type: PhoneMobile, Number: contact.PhoneNumber, E164: contact.PhoneE164, Primary: true}}
+		}
+	}
+
+	if patch.Emails != nil {
+		if _, err := tx.Exec("DELETE FROM contact_emails WHERE contact_id = $1", contact.ID); err != nil {
+			return err
+		}
+		replaced.Emails = *patch.Emails
+	}
+
+	switch {
+	case patch.Addresses != nil:
+		if _, err := tx.Exec("DELETE FROM contact_addresses WHERE contact_id = $1", contact.ID); err != nil {
+			return err
+		}
+		replaced.Addresses = *patch.Addresses
+	case patch.Address != nil:
+		updated, err := execCount(tx, "UPDATE contact_addresses SET address = $1 WHERE contact_id = $2 AND is_primary",
+			contact.Address, contact.ID)
+		if err != nil {
+			return err
+		}
+		if updated == 0 && contact.Address != "" {
+			replaced.Addresses = []PostalAddress{{Type: AddressHome, Address: contact.Address, Primary: true}}
+		}
+	}
+
+	if patch.Tags != nil {
+		if _, err := tx.Exec("DELETE FROM contact_tags WHERE contact_id = $1", contact.ID); err != nil {
+			return err
+		}
+		replaced.Tags = *patch.Tags
+	}
+
+	if patch.ReplaceCustomFields {
+		if _, err := tx.Exec("DELETE FROM contact_field_values WHERE contact_id = $1", contact.ID); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range fieldNames(patch.CustomFields) {
+			_, err := tx.Exec("DELETE FROM contact_field_values WHERE contact_id = $1 AND field_id IN (SELECT id FROM contact_fields WHERE name = $2)", contact.ID, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	replaced.CustomFields = patch.CustomFields
+	return insertDetails(tx, replaced)
+}
+
+// execCount runs a statement and returns the number of affected rows
+func execCount(tx Executor, query string, args ...any) (int64, error) {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// LoadContactDetails fills in the phones, emails, addresses, tags and custom fields of the
+// given contacts, each list ordered as it was stored
+func LoadContactDetails(db querier, contacts []Contact) error {
+	if len(contacts) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Contact, len(contacts))
+	placeholders := make([]string, len(contacts))
+	args := make([]any, len(contacts))
+	for i := range contacts {
+		contacts[i].Phones, contacts[i].Emails, contacts[i].Addresses, contacts[i].Tags = []Phone{}, []Email{}, []PostalAddress{}, []string{}
+		contacts[i].CustomFields = map[string]any{}
+		byID[contacts[i].ID] = &contacts[i]
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = contacts[i].ID
+	}
+	ids := "contact_id IN (" + strings.Join(placeholders, ", ") + ")"
+	in := ids + " ORDER BY id"
+
+	err := queryEach(db, "SELECT contact_id, type, number, e164, is_primary FROM contact_phones WHERE "+in, args, func(rows *sql.Rows) error {
+		var contactID int
+		var p Phone
+		var e164 sql.NullString
+		if err := rows.Scan(&contactID, &p.Type, &p.Number, &e164, &p.Primary); err != nil {
+			return err
+		}
+		p.E164 = e164.String
+		byID[contactID].Phones = append(byID[contactID].Phones, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = queryEach(db, "SELECT contact_id, type, address, is_primary FROM contact_emails WHERE "+in, args, func(rows *sql.Rows) error {
+		var contactID int
+		var e Email
+		if err := rows.Scan(&contactID, &e.Type, &e.Address, &e.Primary); err != nil {
+			return err
+		}
+		byID[contactID].Emails = append(byID[contactID].Emails, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = queryEach(db, "SELECT contact_id, type, address, is_primary FROM contact_addresses WHERE "+in, args, func(rows *sql.Rows) error {
+		var contactID int
+		var a PostalAddress
+		if err := rows.Scan(&contactID, &a.Type, &a.Address, &a.Primary); err != nil {
+			return err
+		}
+		byID[contactID].Addresses = append(byID[contactID].Addresses, a)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = queryEach(db, "SELECT contact_id, tag FROM contact_tags WHERE "+in, args, func(rows *sql.Rows) error {
+		var contactID int
+		var tag string
+		if err := rows.Scan(&contactID, &tag); err != nil {
+			return err
+		}
+		byID[contactID].Tags = append(byID[contactID].Tags, tag)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	query := "SELECT v.contact_id, f.name, f.type, v.value FROM contact_field_values v JOIN contact_fields f ON f.id = v.field_id WHERE v." + ids
+	return queryEach(db, query, args, func(rows *sql.Rows) error {
+		var contactID int
+		var name, fieldType, value string
+		if err := rows.Scan(&contactID, &name, &fieldType, &value); err != nil {
+			return err
+		}
+		byID[contactID].CustomFields[name] = fieldValue(fieldType, value)
+		return nil
+	})
+}
+
+// queryEach runs a query and calls scan for every row
+func queryEach(db querier, query string, args []any, scan func(rows *sql.Rows) error) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// APIKey is a stored API key. The key itself is never stored, only its hash.
+type APIKey struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"` // start of the key, shown to tell keys apart
+	Role      string     `json:"role"`
+	Tenant    string     `json:"tenant,omitempty"` // empty for keys that may pick any tenant, see Principal.bound
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// apiKeyColumns lists the columns read by every API key query, in scanAPIKey order
+const apiKeyColumns = "id, name, prefix, role, tenant_id, created_at, revoked_at"
+
+// scanAPIKey reads one row selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var tenant sql.NullString
+	var revokedAt sql.NullTime
+	if err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.Role, &tenant, &key.CreatedAt, &revokedAt); err != nil {
+		return APIKey{}, err
+	}
+	key.Tenant = tenant.String
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+// InsertAPIKey stores a new API key by its hash and returns its generated id
+func InsertAPIKey(db Executor, key APIKey, hash string) (int, error) {
+	var id int
+	err := db.QueryRow(
+		"INSERT INTO api_keys (name, prefix, key_hash, role, tenant_id, created_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		key.Name, key.Prefix, hash, key.Role, sql.NullString{String: key.Tenant, Valid: key.Tenant != ""}, key.CreatedAt,
+	).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, ErrConflict
+	}
+	return id, err
+}
+
+// GetAPIKeyByHash retrieves the API key with the given hash, revoked keys included
+func GetAPIKeyByHash(db Executor, hash string) (APIKey, error) {
+	key, err := scanAPIKey(db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = $1", hash))
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrNotFound
+	}
+	return key, err
+}
+
+// ListAPIKeys retrieves the API keys of the tenant ordered by id, or every key when tenant is empty
+func ListAPIKeys(db Executor, tenant string) ([]APIKey, error) {
+	query, args := "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY id", []any(nil)
+	if tenant != "" {
+		query, args = "SELECT "+apiKeyColumns+" FROM api_keys WHERE tenant_id = $1 ORDER BY id", []any{tenant}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey marks an active API key as revoked, ErrNotFound if no active key has the id.
+// A tenant limits the match to that tenant's keys.
+func RevokeAPIKey(db Executor, tenant string, id int, at time.Time) error {
+	query, args := "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", []any{at, id}
+	if tenant != "" {
+		query, args = query+" AND tenant_id = $3", append(args, tenant)
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DefaultTenant holds the contacts of requests that name no tenant, and every contact
+// stored before tenants existed
+const DefaultTenant = "default"
+
+// Tenant is one phonebook hosted on the deployment
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InsertTenant stores a new tenant, ErrConflict if the id is taken
+func InsertTenant(db Executor, tenant Tenant) error {
+	_, err := db.Exec("INSERT INTO tenants (id, name, created_at) VALUES ($1, $2, $3)", tenant.ID, tenant.Name, tenant.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// GetTenant retrieves the tenant with the given id
+func GetTenant(db Executor, id string) (Tenant, error) {
+	var tenant Tenant
+	err := db.QueryRow("SELECT id, name, created_at FROM tenants WHERE id = $1", id).Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Tenant{}, ErrNotFound
+	}
+	return tenant, err
+}
+
+// ListTenants retrieves every tenant ordered by id
+func ListTenants(db Executor) ([]Tenant, error) {
+	rows, err := db.Query("SELECT id, name, created_at FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []Tenant{}
+	for rows.Next() {
+		var tenant Tenant
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// DeleteTenant removes a tenant with all of its contacts, groups, custom fields, API keys and
+// audit entries in one transaction
+func DeleteTenant(db Executor, id string) error {
+	tx, err := begin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	// Phones, emails, addresses, tags, group memberships and custom field values go with
+	// their contacts
+	if _, err := tx.Exec("DELETE FROM contacts WHERE tenant_id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM contact_groups WHERE tenant_id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM contact_fields WHERE tenant_id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM api_keys WHERE tenant_id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM audit_log WHERE tenant_id = $1", id); err != nil {
+		return err
+	}
+	deleted, err := execCount(tx, "DELETE FROM tenants WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// Actions recorded in the audit log
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditMerge   = "merge"
+)
+
+// Actor is who makes a change and the request it was made in, recorded with every audit entry
+type Actor struct {
+	Name      string
+	RequestID string
+}
+
+// AuditEntry is one contact write recorded in the append-only audit log. Before is nil for
+// created contacts and After is nil for deleted ones.
+type AuditEntry struct {
+	ID        int       `json:"id"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	ContactID int       `json:"contact_id"`
+	Before    *Contact  `json:"before"`
+	After     *Contact  `json:"after"`
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// clone copies the entry with its snapshots, so callers never share them with the store
+func (e AuditEntry) clone() AuditEntry {
+	for _, snapshot := range []**Contact{&e.Before, &e.After} {
+		if *snapshot != nil {
+			contact := (*snapshot).clone()
+			*snapshot = &contact
+		}
+	}
+	return e
+}
+
+// AuditFilter selects audit entries, zero fields match every entry
+type AuditFilter struct {
+	ContactID int
+	Actor     string
+	Since     time.Time // entries made at or after
+	Until     time.Time // entries made before
+	BeforeID  int       // keyset cursor, entries with a lower id
+	Limit     int
+}
+
+// matches reports whether the entry passes the filter, BeforeID and Limit aside
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	return (f.ContactID == 0 || entry.ContactID == f.ContactID) &&
+		(f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.Since.IsZero() || !entry.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.CreatedAt.Before(f.Until))
+}
+
+// created returns the snapshot of a contact just inserted, which starts at version 1, with
+// empty rather than nil lists like contacts read back from the database
+func created(contact Contact) *Contact {
+	contact = contact.clone()
+	contact.Version = 1
+	if contact.Phones == nil {
+		contact.Phones = []Phone{}
+	}
+	if contact.Emails == nil {
+		contact.Emails = []Email{}
+	}
+	if contact.Addresses == nil {
+		contact.Addresses = []PostalAddress{}
+	}
+	if contact.Tags == nil {
+		contact.Tags = []string{}
+	}
+	if contact.CustomFields == nil {
+		contact.CustomFields = map[string]any{}
+	}
+	return &contact
+}
+
+// auditColumns lists the columns read by every audit query, in scanAuditEntry order
+const auditColumns = "id, actor, action, contact_id, contact_before, contact_after, request_id, created_at"
+
+// insertAudit records a contact write in the transaction making it, so the entry is stored
+// exactly when the change is. Timestamps are kept in UTC to the second.
+func insertAudit(tx Executor, tenant string, actor Actor, action string, contactID int, before, after *Contact) error {
+	var snapshots [2]sql.NullString
+	for i, contact := range []*Contact{before, after} {
+		if contact == nil {
+			continue
+		}
+		encoded, err := json.Marshal(contact)
+		if err != nil {
+			return err
+		}
+		snapshots[i] = sql.NullString{String: string(encoded), Valid: true}
+	}
+	_, err := tx.Exec(
+		"INSERT INTO audit_log (tenant_id, actor, action, contact_id, contact_before, contact_after, request_id, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		tenant, actor.Name, action, contactID, snapshots[0], snapshots[1], actor.RequestID, time.Now().UTC().Truncate(time.Second),
+	)
+	return err
+}
+
+// scanAuditEntry reads one row selected with auditColumns
+func scanAuditEntry(row rowScanner) (AuditEntry, error) {
+	var entry AuditEntry
+	var before, after sql.NullString
+	if err := row.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.ContactID, &before, &after, &entry.RequestID, &entry.CreatedAt); err != nil {
+		return AuditEntry{}, err
+	}
+	for _, snapshot := range []struct {
+		column sql.NullString
+		target **Contact
+	}{{before, &entry.Before}, {after, &entry.After}} {
+		if !snapshot.column.Valid {
+			continue
+		}
+		var contact Contact
+		if err := json.Unmarshal([]byte(snapshot.column.String), &contact); err != nil {
+			return AuditEntry{}, fmt.Errorf("reading audit entry %d: %w", entry.ID, err)
+		}
+		*snapshot.target = &contact
+	}
+	return entry, nil
+}
+
+// AuditLog retrieves the tenant's audit entries matching the filter, newest first, using the
+// entry id as a keyset cursor. The bool result reports whether more entries match.
+func AuditLog(db Executor, tenant string, filter AuditFilter) ([]AuditEntry, bool, error) {
+	conditions, args := []string{"tenant_id = $1"}, []any{tenant}
+	where := func(condition string, value any) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.ContactID > 0 {
+		where("contact_id = $%d", filter.ContactID)
+	}
+	if filter.Actor != "" {
+		where("actor = $%d", filter.Actor)
+	}
+	if !filter.Since.IsZero() {
+		where("created_at >= $%d", filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		where("created_at < $%d", filter.Until.UTC())
+	}
+	if filter.BeforeID > 0 {
+		where("id < $%d", filter.BeforeID)
+	}
+	// Fetch one extra row to find out whether more entries match
+	args = append(args, filter.Limit+1)
+	query := fmt.Sprintf("SELECT %s FROM audit_log WHERE %s ORDER BY id DESC LIMIT $%d", auditColumns, strings.Join(conditions, " AND "), len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(entries) > filter.Limit {
+		return entries[:filter.Limit], true, nil
+	}
+	return entries, false, nil
+}
+
+// ContactHistory retrieves the audit entries of one of the tenant's contacts, oldest first,
+// including those of a deleted contact
+func ContactHistory(db querier, tenant string, id int) ([]AuditEntry, error) {
+	rows, err := db.Query("SELECT "+auditColumns+" FROM audit_log WHERE tenant_id = $1 AND contact_id = $2 ORDER BY id", tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RestoreContact brings one of the tenant's contacts back to the state of a revision in its
+// history, taking it out of the trash, or recreating it under its old id once purged. The restored contact gets a
+// new version and is recorded in the audit log as restored by the actor. Custom field values
+// are only restored while their field is still defined and accepts them.
+func RestoreContact(db Executor, tenant string, actor Actor, id, revision int) (Contact, error) {
+	tx, err := begin(db)
+	if err != nil {
+		return Contact{}, err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	entries, err := ContactHistory(tx, tenant, id)
+	if err != nil {
+		return Contact{}, err
+	}
+	target, latest, err := findRevision(revisionsOf(entries), revision)
+	if err != nil {
+		return Contact{}, err
+	}
+	fields, err := ListCustomFields(tx, tenant)
+	if err != nil {
+		return Contact{}, err
+	}
+	target.CustomFields = definedFields(fields, target.CustomFields)
+
+	var contact Contact
+	before, err := contactSnapshot(tx, tenant, id, 0)
+	if err == ErrNotFound {
+		// A contact in the trash is taken out of it, then reverted like any other
+		if err = untrash(tx, tenant, id); err == nil {
+			before, err = contactSnapshot(tx, tenant, id, 0)
+		}
+	}
+	switch {
+	case err == nil:
+		contact, err = patchContact(tx, tenant, actor, AuditRestore, before, patchAll(target), 0)
+	case err == ErrNotFound:
+		target.Version = latest + 1
+		contact, err = reinsertContact(tx, tenant, actor, target)
+	}
+	if err != nil {
+		return Contact{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// reinsertContact stores a deleted contact again under its id, version and creation time,
+// with its details. Revisions recorded before contacts had a creation time get the current one.
+func reinsertContact(tx Executor, tenant string, actor Actor, contact Contact) (Contact, error) {
+	if contact.CreatedAt.IsZero() {
+		contact.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	_, err := tx.Exec(
+		"INSERT INTO contacts (id, tenant_id, first_name, last_name, phone_number, phone_e164, address, version, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		contact.ID, tenant, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, contact.Version, contact.CreatedAt,
+	)
+	if isUniqueViolation(err) {
+		return Contact{}, ErrConflict
+	}
+	if err != nil {
+		return Contact{}, err
+	}
+	if err := insertDetails(tx, contact); err != nil {
+		return Contact{}, err
+	}
+	if err := insertAudit(tx, tenant, actor, AuditRestore, contact.ID, nil, &contact); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// trashColumns lists the columns read by the trash queries, in scanTrashed order
+const trashColumns = contactColumns + ", deleted_at"
+
+// scanTrashed reads one row selected with trashColumns
+func scanTrashed(row rowScanner) (Contact, error) {
+	var c Contact
+	var deletedAt time.Time
+	var phoneE164 sql.NullString // empty until BackfillPhoneE164 has run
+	var createdAt sql.NullTime
+	err := row.Scan(&c.ID, &c.FirstName, &c.LastName, &c.PhoneNumber, &phoneE164, &c.Address, &c.Version, &createdAt, &deletedAt)
+	c.PhoneE164, c.CreatedAt, c.DeletedAt = phoneE164.String, createdAt.Time, &deletedAt
+	return c, err
+}
+
+// ListTrash retrieves a page of the tenant's deleted contacts ordered by id, using the id as
+// a keyset cursor. The bool result reports whether more contacts are in the trash.
+func ListTrash(db Executor, tenant string, limit, afterID int) ([]Contact, bool, error) {
+	rows, err := db.Query(
+		"SELECT "+trashColumns+" FROM contacts WHERE tenant_id = $1 AND deleted_at IS NOT NULL AND id > $2 ORDER BY id ASC LIMIT $3",
+		tenant, afterID, limit+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		contact, err := scanTrashed(rows)
+		if err != nil {
+			return nil, false, err
+		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(contacts) > limit {
+		return contacts[:limit], true, nil
+	}
+	return contacts, false, nil
+}
+
+// UndeleteContact takes one of the tenant's contacts out of the trash, bumps its version and
+// records it in the audit log as restored by the actor
+func UndeleteContact(db Executor, tenant string, actor Actor, id int) (Contact, error) {
+	tx, err := begin(db)
+	if err != nil {
+		return Contact{}, err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if err := untrash(tx, tenant, id); err != nil {
+		return Contact{}, err
+	}
+	before, err := contactSnapshot(tx, tenant, id, 0)
+	if err != nil {
+		return Contact{}, err
+	}
+	contact, err := patchContact(tx, tenant, actor, AuditRestore, before, ContactPatch{}, 0)
+	if err != nil {
+		return Contact{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Contact{}, err
+	}
+	return contact, nil
+}
+
+// untrash clears the deletion time of one of the tenant's contacts, ErrNotFound if it is not
+// in the trash
+func untrash(tx Executor, tenant string, id int) error {
+	restored, err := execCount(tx, "UPDATE contacts SET deleted_at = NULL WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL", id, tenant)
+	if err != nil {
+		return err
+	}
+	if restored == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// PurgeTrash permanently removes the contacts of every tenant deleted before the given time,
+// with their details, and returns how many were removed. Their history stays in the audit log.
+func PurgeTrash(db Executor, before time.Time) (int, error) {
+	result, err := db.Exec("DELETE FROM contacts WHERE deleted_at IS NOT NULL AND deleted_at < $1", before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// Group is a named set of a tenant's contacts, a contact can be in any number of groups
+type Group struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	ContactIDs []int     `json:"contact_ids"` // members outside the trash, ordered by id
+}
+
+// InsertGroup stores a new group of the tenant and returns its generated id, ErrConflict if
+// the tenant has a group with the name
+func InsertGroup(db Executor, tenant string, group Group) (int, error) {
+	var id int
+	err := db.QueryRow(
+		"INSERT INTO contact_groups (tenant_id, name, created_at) VALUES ($1, $2, $3) RETURNING id",
+		tenant, group.Name, group.CreatedAt,
+	).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, ErrConflict
+	}
+	return id, err
+}
+
+// ListGroups retrieves the tenant's groups ordered by name, with their members
+func ListGroups(db Executor, tenant string) ([]Group, error) {
+	groups := []Group{}
+	err := queryEach(db, "SELECT id, name, created_at FROM contact_groups WHERE tenant_id = $1 ORDER BY name", []any{tenant}, func(rows *sql.Rows) error {
+		var group Group
+		if err := rows.Scan(&group.ID, &group.Name, &group.CreatedAt); err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, loadGroupMembers(db, groups)
+}
+
+// GetGroup retrieves one of the tenant's groups with its members
+func GetGroup(db Executor, tenant string, id int) (Group, error) {
+	var group Group
+	err := db.QueryRow("SELECT id, name, created_at FROM contact_groups WHERE id = $1 AND tenant_id = $2", id, tenant).
+		Scan(&group.ID, &group.Name, &group.CreatedAt)
+	if err == sql.ErrNoRows {
+		return Group{}, ErrNotFound
+	}
+	if err != nil {
+		return Group{}, err
+	}
+	groups := []Group{group}
+	if err := loadGroupMembers(db, groups); err != nil {
+		return Group{}, err
+	}
+	return groups[0], nil
+}
+
+// loadGroupMembers fills in the ids of the contacts in each group, leaving out contacts in
+// the trash, which are members again once restored
+func loadGroupMembers(db querier, groups []Group) error {
+	if len(groups) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Group, len(groups))
+	placeholders := make([]string, len(groups))
+	args := make([]any, len(groups))
+	for i := range groups {
+		groups[i].ContactIDs = []int{}
+		byID[groups[i].ID] = &groups[i]
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = groups[i].ID
+	}
+	query := "SELECT m.group_id, m.contact_id FROM contact_group_members m JOIN contacts c ON c.id = m.contact_id " +
+		"WHERE m.group_id IN (" + strings.Join(placeholders, ", ") + ") AND c.deleted_at IS NULL ORDER BY m.contact_id"
+	return queryEach(db, query, args, func(rows *sql.Rows) error {
+		var groupID, contactID int
+		if err := rows.Scan(&groupID, &contactID); err != nil {
+			return err
+		}
+		byID[groupID].ContactIDs = append(byID[groupID].ContactIDs, contactID)
+		return nil
+	})
+}
+
+// RenameGroup changes the name of one of the tenant's groups, ErrConflict if another group
+// has the name
+func RenameGroup(db Executor, tenant string, id int, name string) error {
+	renamed, err := execCount(db, "UPDATE contact_groups SET name = $1 WHERE id = $2 AND tenant_id = $3", name, id, tenant)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	if renamed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteGroup removes one of the tenant's groups, its contacts are kept
+func DeleteGroup(db Executor, tenant string, id int) error {
+	deleted, err := execCount(db, "DELETE FROM contact_groups WHERE id = $1 AND tenant_id = $2", id, tenant)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddGroupMembers adds the tenant's contacts to one of its groups in one transaction,
+// skipping contacts already in it. ErrNotFound when the group does not exist, a
+// ValidationError naming every contact that does not.
+func AddGroupMembers(db Executor, tenant string, id int, contactIDs []int) error {
+	tx, err := begin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	if _, err := GetGroup(tx, tenant, id); err != nil {
+		return err
+	}
+	var details []ErrorDetail
+	for i, contactID := range contactIDs {
+		if _, err := GetContactByID(tx, tenant, contactID); err == ErrNotFound {
+			details = append(details, ErrorDetail{Field: fmt.Sprintf("contact_ids[%d]", i), Issue: "no contact exists with this id"})
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(details) > 0 {
+		return &ValidationError{Details: details}
+	}
+
+	for _, contactID := range contactIDs {
+		var member bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM contact_group_members WHERE group_id = $1 AND contact_id = $2)", id, contactID).Scan(&member)
+		if err != nil {
+			return err
+		}
+		if member {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO contact_group_members (group_id, contact_id) VALUES ($1, $2)", id, contactID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveGroupMember takes a contact out of one of the tenant's groups, ErrNotFound if the
+// group does not exist or the contact is not in it
+func RemoveGroupMember(db Executor, tenant string, id, contactID int) error {
+	removed, err := execCount(db,
+		"DELETE FROM contact_group_members WHERE group_id = $1 AND contact_id = $2 AND group_id IN (SELECT id FROM contact_groups WHERE tenant_id = $3)",
+		id, contactID, tenant,
+	)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// customFieldColumns lists the columns read by every custom field query, in scanCustomField order
+const customFieldColumns = "name, type, required, pattern, options, created_at"
+
+// scanCustomField reads one row selected with customFieldColumns
+func scanCustomField(row rowScanner) (CustomField, error) {
+	var field CustomField
+	var options string
+	if err := row.Scan(&field.Name, &field.Type, &field.Required, &field.Pattern, &options, &field.CreatedAt); err != nil {
+		return CustomField{}, err
+	}
+	if err := json.Unmarshal([]byte(options), &field.Options); err != nil {
+		return CustomField{}, err
+	}
+	if len(field.Options) == 0 {
+		field.Options = nil
+	}
+	if err := field.compile(); err != nil {
+		return CustomField{}, err
+	}
+	return field, nil
+}
+
+// InsertCustomField stores a new custom field of the tenant, ErrConflict if the tenant has a
+// field with the name
+func InsertCustomField(db Executor, tenant string, field CustomField) error {
+	options, err := json.Marshal(append([]string{}, field.Options...))
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"INSERT INTO contact_fields (tenant_id, name, type, required, pattern, options, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		tenant, field.Name, field.Type, field.Required, field.Pattern, string(options), field.CreatedAt,
+	)
+	if isUniqueViolation(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// ListCustomFields retrieves the tenant's custom fields ordered by name
+func ListCustomFields(db querier, tenant string) ([]CustomField, error) {
+	fields := []CustomField{}
+	query := "SELECT " + customFieldColumns + " FROM contact_fields WHERE tenant_id = $1 ORDER BY name"
+	err := queryEach(db, query, []any{tenant}, func(rows *sql.Rows) error {
+		field, err := scanCustomField(rows)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, field)
+		return nil
+	})
+	return fields, err
+}
+
+// GetCustomField retrieves one of the tenant's custom fields by name
+func GetCustomField(db Executor, tenant, name string) (CustomField, error) {
+	row := db.QueryRow("SELECT "+customFieldColumns+" FROM contact_fields WHERE tenant_id = $1 AND name = $2", tenant, name)
+	field, err := scanCustomField(row)
+	if err == sql.ErrNoRows {
+		return CustomField{}, ErrNotFound
+	}
+	return field, err
+}
+
+// DeleteCustomField removes one of the tenant's custom fields with the value every contact
+// has for it, ErrNotFound if there is no field with the name
+func DeleteCustomField(db Executor, tenant, name string) error {
+	deleted, err := execCount(db, "DELETE FROM contact_fields WHERE tenant_id = $1 AND name = $2", tenant, name)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
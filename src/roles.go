@@ -0,0 +1,125 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Permissions checked on the routes
+const (
+	PermissionRead          = "contacts:read"
+	PermissionWrite         = "contacts:write"
+	PermissionDelete        = "contacts:delete"
+	PermissionManageKeys    = "api_keys:manage"
+	PermissionManageTenants = "tenants:manage"
+	PermissionReadAudit     = "audit:read"
+	PermissionManageFields  = "fields:manage"
+)
+
+// permissions lists every known permission
+var permissions = []string{PermissionRead, PermissionWrite, PermissionDelete, PermissionManageKeys, PermissionManageTenants, PermissionReadAudit, PermissionManageFields}
+
+// Built-in roles
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// Roles maps role names to the permissions they grant
+type Roles map[string][]string
+
+// DefaultRoles returns the built-in roles: viewers read contacts, editors also change and
+// delete them, and admins can do everything including managing API keys, tenants and custom
+// fields and reading the audit log.
+func DefaultRoles() Roles {
+	return Roles{
+		RoleViewer: {PermissionRead},
+		RoleEditor: {PermissionRead, PermissionWrite, PermissionDelete},
+		RoleAdmin:  append([]string(nil), permissions...),
+	}
+}
+
+// ParseRoles reads custom roles from a JSON object of role names to permission lists,
+// e.g. {"support": ["contacts:read", "contacts:write"]}, and adds them to the built-in
+// roles. Built-in roles cannot be redefined.
+func ParseRoles(data []byte) (Roles, error) {
+	var custom map[string][]string
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("reading roles: %w", err)
+	}
+
+	roles := DefaultRoles()
+	for name, granted := range custom {
+		if name == "" {
+			return nil, fmt.Errorf("a role has no name")
+		}
+		if _, ok := roles[name]; ok {
+			return nil, fmt.Errorf("role %q is built in and cannot be redefined", name)
+		}
+		for _, permission := range granted {
+			if !oneOf(permission, permissions) {
+				return nil, fmt.Errorf("role %q: unknown permission %q, expected one of %v", name, permission, permissions)
+			}
+		}
+		roles[name] = granted
+	}
+	return roles, nil
+}
+
+// Names returns the role names in alphabetical order
+func (r Roles) Names() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// permissionsOf returns the permissions granted by any of the roles. Unknown roles grant nothing.
+func (r Roles) permissionsOf(roles []string) map[string]bool {
+	granted := map[string]bool{}
+	for _, role := range roles {
+		for _, permission := range r[role] {
+			granted[permission] = true
+		}
+	}
+	return granted
+}
+
+// Can reports whether the principal has been granted the permission
+func (p Principal) Can(permission string) bool {
+	return p.permissions[permission]
+}
+
+// RequirePermission answers 403 naming the missing permission unless the authenticated
+// principal has it
+func RequirePermission(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := PrincipalFromContext(r.Context()); !ok || !principal.Can(permission) {
+			writeForbidden(w, r, permission)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeForbidden answers 403 naming the missing permission
+func writeForbidden(w http.ResponseWriter, r *http.Request, permission string) {
+	writeError(w, r, http.StatusForbidden, CodeForbidden,
+		fmt.Sprintf("This request needs the %s permission.", permission),
+		ErrorDetail{Field: "permission", Issue: permission + " is missing"})
+}
+
+// ListRolesHandler handles GET /api/v1/admin/roles with the permissions of every role
+func ListRolesHandler(roles Roles) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, struct {
+			Roles       Roles    `json:"roles"`
+			Permissions []string `json:"permissions"`
+		}{roles, permissions})
+	}
+}
@@ -0,0 +1,156 @@
+package src
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// NewRouter registers every API route on a new router backed by the given store.
+// When the store is a TenantStore, every contact request is served from the phonebook of
+// its tenant, see resolveTenant, and the tenant admin routes are registered. When it is an
+// AuditStore, every contact write is recorded as made by the caller of the request.
+// When authenticator is not nil every request must carry valid credentials, each route
+// requires the permission it is registered with, and the API key admin routes are
+// registered; nil serves the API without authentication.
+func NewRouter(store ContactStore, authenticator *Authenticator) http.Handler {
+	r := mux.NewRouter()
+	r.NotFoundHandler = NotFoundHandler()
+	r.MethodNotAllowedHandler = MethodNotAllowedHandler()
+
+	tenants, _ := store.(TenantStore) // nil for stores holding a single phonebook
+
+	// protect registers a route that needs the permission once callers are authenticated
+	protect := func(router *mux.Router, path, permission string, handler http.Handler) *mux.Route {
+		if authenticator == nil {
+			return router.Handle(path, handler)
+		}
+		return router.Handle(path, RequirePermission(permission, handler))
+	}
+
+	_, audited := store.(AuditStore) // false for stores without an audit log
+
+	// handle registers a contact route whose handler is built over the store of the
+	// request's tenant, recording writes as made by the request's caller
+	handle := func(router *mux.Router, path, permission string, handler func(ContactStore) http.HandlerFunc) *mux.Route {
+		if tenants == nil && !audited {
+			return protect(router, path, permission, handler(store))
+		}
+		return protect(router, path, permission, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scoped := store
+			if tenants != nil {
+				tenant, ok := resolveTenant(w, r, tenants)
+				if !ok {
+					return
+				}
+				scoped = tenants.ForTenant(tenant)
+			}
+			if auditor, ok := scoped.(AuditStore); ok {
+				scoped = auditor.AsActor(actorOf(r))
+			}
+			handler(scoped).ServeHTTP(w, r)
+		}))
+	}
+
+	// Legacy verb routes used by frontend/index.html
+	handle(r, "/getContacts", PermissionRead, GetContactsHandler).Methods("GET")
+	handle(r, "/addContact", PermissionWrite, AddContactHandler).Methods("POST")
+	handle(r, "/deleteContact/{phone_number}", PermissionDelete, DeleteContactHandler).Methods("DELETE")
+	handle(r, "/searchContact/{phone_number}", PermissionRead, SearchContactHandler).Methods("GET")
+	handle(r, "/editContact/{phone_number}", PermissionWrite, EditContactHandler).Methods("PUT")
+	handle(r, "/editContact/{phone_number}", PermissionWrite, PatchContactByPhoneHandler).Methods("PATCH")
+
+	// Versioned resource API addressed by contact id
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	handle(api, "/contacts", PermissionRead, ListContactsHandler).Methods("GET")
+	handle(api, "/contacts", PermissionWrite, CreateContactHandler).Methods("POST")
+	handle(api, "/contacts/search", PermissionRead, SearchContactsHandler).Methods("GET")
+	handle(api, "/contacts/duplicates", PermissionRead, DuplicatesHandler).Methods("GET")
+	handle(api, "/contacts/merge", PermissionDelete, MergeContactsHandler).Methods("POST")
+	handle(api, "/contacts:batch", PermissionWrite, BatchHandler).Methods("POST")
+	handle(api, "/audit", PermissionReadAudit, AuditLogHandler).Methods("GET")
+	handle(api, "/contacts/{id:[0-9]+}/history", PermissionRead, ContactHistoryHandler).Methods("GET")
+	handle(api, "/contacts/{id:[0-9]+}/diff", PermissionRead, ContactDiffHandler).Methods("GET")
+	handle(api, "/contacts/{id:[0-9]+}/restore", PermissionWrite, RestoreContactHandler).Methods("POST")
+	handle(api, "/trash", PermissionRead, ListTrashHandler).Methods("GET")
+	handle(api, "/trash/{id:[0-9]+}/restore", PermissionDelete, UndeleteContactHandler).Methods("POST")
+	handle(api, "/groups", PermissionRead, ListGroupsHandler).Methods("GET")
+	handle(api, "/groups", PermissionWrite, CreateGroupHandler).Methods("POST")
+	handle(api, "/groups/{id:[0-9]+}", PermissionRead, GetGroupHandler).Methods("GET")
+	handle(api, "/groups/{id:[0-9]+}", PermissionWrite, RenameGroupHandler).Methods("PATCH")
+	handle(api, "/groups/{id:[0-9]+}", PermissionDelete, DeleteGroupHandler).Methods("DELETE")
+	handle(api, "/groups/{id:[0-9]+}/members", PermissionWrite, AddGroupMembersHandler).Methods("POST")
+	handle(api, "/groups/{id:[0-9]+}/members/{contact_id:[0-9]+}", PermissionWrite, RemoveGroupMemberHandler).Methods("DELETE")
+	handle(api, "/fields", PermissionRead, ListFieldsHandler).Methods("GET")
+	handle(api, "/fields", PermissionManageFields, CreateFieldHandler).Methods("POST")
+	handle(api, "/fields/{name}", PermissionRead, GetFieldHandler).Methods("GET")
+	handle(api, "/fields/{name}", PermissionManageFields, DeleteFieldHandler).Methods("DELETE")
+	handle(api, "/contacts/{id:[0-9]+}", PermissionRead, GetContactHandler).Methods("GET")
+	handle(api, "/contacts/{id:[0-9]+}", PermissionWrite, ReplaceContactHandler).Methods("PUT")
+	handle(api, "/contacts/{id:[0-9]+}", PermissionWrite, PatchContactHandler).Methods("PATCH")
+	handle(api, "/contacts/{id:[0-9]+}", PermissionDelete, RemoveContactHandler).Methods("DELETE")
+
+	// Ranked search by name, address or part of the phone number
+	handle(r, "/contacts/search", PermissionRead, SearchContactsHandler).Methods("GET")
+
+	// Contacts that likely describe the same person, merged by those allowed to delete
+	handle(r, "/contacts/duplicates", PermissionRead, DuplicatesHandler).Methods("GET")
+	handle(r, "/contacts/merge", PermissionDelete, MergeContactsHandler).Methods("POST")
+
+	// Who changed which contact and when
+	handle(r, "/audit", PermissionReadAudit, AuditLogHandler).Methods("GET")
+
+	// Deleted contacts, restored by those allowed to delete them
+	handle(r, "/trash", PermissionRead, ListTrashHandler).Methods("GET")
+	handle(r, "/trash/{id:[0-9]+}/restore", PermissionDelete, UndeleteContactHandler).Methods("POST")
+
+	// Named groups of contacts, deleted by those allowed to delete contacts
+	handle(r, "/groups", PermissionRead, ListGroupsHandler).Methods("GET")
+	handle(r, "/groups", PermissionWrite, CreateGroupHandler).Methods("POST")
+	handle(r, "/groups/{id:[0-9]+}", PermissionRead, GetGroupHandler).Methods("GET")
+	handle(r, "/groups/{id:[0-9]+}", PermissionWrite, RenameGroupHandler).Methods("PATCH")
+	handle(r, "/groups/{id:[0-9]+}", PermissionDelete, DeleteGroupHandler).Methods("DELETE")
+	handle(r, "/groups/{id:[0-9]+}/members", PermissionWrite, AddGroupMembersHandler).Methods("POST")
+	handle(r, "/groups/{id:[0-9]+}/members/{contact_id:[0-9]+}", PermissionWrite, RemoveGroupMemberHandler).Methods("DELETE")
+
+	// Custom fields of the contacts, defined by those allowed to manage them
+	handle(r, "/fields", PermissionRead, ListFieldsHandler).Methods("GET")
+	handle(r, "/fields", PermissionManageFields, CreateFieldHandler).Methods("POST")
+	handle(r, "/fields/{name}", PermissionRead, GetFieldHandler).Methods("GET")
+	handle(r, "/fields/{name}", PermissionManageFields, DeleteFieldHandler).Methods("DELETE")
+
+	// Several creates, updates and deletes in one request, deletes also need contacts:delete
+	handle(r, "/contacts:batch", PermissionWrite, BatchHandler).Methods("POST")
+
+	// Bulk transfer of contacts
+	handle(r, "/contacts/export.vcf", PermissionRead, ExportVCardHandler).Methods("GET")
+	handle(r, "/contacts/import", PermissionWrite, ImportVCardHandler).Methods("POST")
+	handle(r, "/contacts/export.csv", PermissionRead, ExportCSVHandler).Methods("GET")
+	handle(r, "/contacts/import.csv", PermissionWrite, ImportCSVHandler).Methods("POST")
+
+	// Admin routes hang off the root router: a later route under the api subrouter would
+	// match its prefix and turn a wrong method on a contact route into a 404
+	admin := r.PathPrefix(apiPrefix + "/admin").Subrouter()
+
+	// Tenants, managed only by callers that are not bound to one
+	if tenants != nil {
+		protect(admin, "/tenants", PermissionManageTenants, RequireAnyTenant(CreateTenantHandler(tenants))).Methods("POST")
+		protect(admin, "/tenants", PermissionManageTenants, RequireAnyTenant(ListTenantsHandler(tenants))).Methods("GET")
+		protect(admin, "/tenants/{tenant}", PermissionManageTenants, RequireAnyTenant(GetTenantHandler(tenants))).Methods("GET")
+		protect(admin, "/tenants/{tenant}", PermissionManageTenants, RequireAnyTenant(DeleteTenantHandler(tenants))).Methods("DELETE")
+	}
+
+	if authenticator == nil {
+		// Tag every request with an id used in logs and error responses
+		return RequestID(r)
+	}
+
+	// API keys and the roles they can be given
+	protect(admin, "/api-keys", PermissionManageKeys, CreateAPIKeyHandler(authenticator.keys, tenants, authenticator.roles)).Methods("POST")
+	protect(admin, "/api-keys", PermissionManageKeys, ListAPIKeysHandler(authenticator.keys)).Methods("GET")
+	protect(admin, "/api-keys/{id:[0-9]+}", PermissionManageKeys, RevokeAPIKeyHandler(authenticator.keys)).Methods("DELETE")
+	protect(admin, "/roles", PermissionManageKeys, ListRolesHandler(authenticator.roles)).Methods("GET")
+
+	// The request id is assigned first so authentication failures carry it too
+	return RequestID(authenticator.Middleware(r))
+}
@@ -0,0 +1,380 @@
+// Package search ranks contacts against free-text queries such as "jon mako", "4-5590" or
+// "city:haifa last:cohen". Matching is case and diacritic insensitive, names match on
+// prefixes and tolerate typos, and phone numbers match on any run of their digits.
+//
+// The package knows nothing about storage: callers turn each record into a Document and
+// keep the ones Score accepts, so the same ranking is used for every store.
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Fields a query term can be restricted to with a "field:" prefix
+const (
+	FieldFirst   = "first"
+	FieldLast    = "last"
+	FieldAddress = "address"
+	FieldPhone   = "phone"
+)
+
+// filterAliases maps every accepted filter prefix to the field it restricts
+var filterAliases = map[string]string{
+	"first":   FieldFirst,
+	"last":    FieldLast,
+	"name":    "", // first or last
+	"address": FieldAddress,
+	"city":    FieldAddress,
+	"phone":   FieldPhone,
+	"tel":     FieldPhone,
+}
+
+// Term is one word of a query
+type Term struct {
+	Text  string // normalized text, or only the digits for phone terms
+	Field string // restricts the term to one field, "" matches any field
+	Phone bool   // the term was written as a phone number and matches phone digits
+	Names bool   // the term came from name: and matches first or last name only
+}
+
+// Query is a parsed search string, every term must match for a document to be returned
+type Query struct {
+	Terms []Term
+}
+
+// Empty reports whether the query has nothing to search for
+func (q Query) Empty() bool {
+	return len(q.Terms) == 0
+}
+
+// Parse splits a search string into terms. Words are separated by white space, a word
+// such as city:haifa or city:"tel aviv" only matches that field, and a word made of
+// digits and phone punctuation (054-343, +972) is matched against phone numbers.
+// Unknown prefixes are searched as plain text.
+func Parse(raw string) Query {
+	var q Query
+	for _, word := range splitWords(raw) {
+		field, names := "", false
+		if prefix, value, ok := strings.Cut(word, ":"); ok {
+			if target, known := filterAliases[strings.ToLower(prefix)]; known && value != "" {
+				field, names, word = target, target == "", value
+			}
+		}
+
+		if (field == "" && !names) || field == FieldPhone {
+			if digits, ok := phoneDigits(word); ok {
+				q.Terms = append(q.Terms, Term{Text: digits, Field: field, Phone: true})
+				continue
+			}
+		}
+		for _, token := range Tokenize(word) {
+			q.Terms = append(q.Terms, Term{Text: token, Field: field, Names: names})
+		}
+	}
+	return q
+}
+
+// splitWords splits on white space, keeping double-quoted phrases (also after a prefix) together
+func splitWords(raw string) []string {
+	var words []string
+	var b strings.Builder
+	quoted := false
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				words = append(words, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		words = append(words, b.String())
+	}
+	return words
+}
+
+// phoneDigits returns the digits of a word written like a phone number
+func phoneDigits(word string) (string, bool) {
+	var digits strings.Builder
+	for _, r := range word {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case strings.ContainsRune("+-().", r):
+		default:
+			return "", false
+		}
+	}
+	return digits.String(), digits.Len() > 0
+}
+
+// Fragments returns pieces of normalized text of which every word the term matches contains
+// at least one, so a store can narrow a search down with substring matches before scoring.
+// A word within the tolerated typos of the term keeps at least one of 2k+1 pieces of it
+// intact, k being the number of typos, since a typo changes one piece or, for swapped
+// neighbours, two.
+func (t Term) Fragments() []string {
+	runes := []rune(t.Text)
+	pieces := 2*maxTypos(len(runes)) + 1
+	fragments := make([]string, 0, pieces)
+	for i := 0; i < pieces; i++ {
+		fragments = append(fragments, string(runes[i*len(runes)/pieces:(i+1)*len(runes)/pieces]))
+	}
+	return fragments
+}
+
+// Document is the searchable form of one record
+type Document struct {
+	FirstName string
+	LastName  string
+	Address   string
+	Phones    []string // every form of the number, e.g. as typed and E.164
+}
+
+// Score reports how well the document matches the query, between 0 and 1.
+// ok is false when a term matches no field. An empty query matches nothing.
+func Score(q Query, doc Document) (score float64, ok bool) {
+	if q.Empty() {
+		return 0, false
+	}
+	first, last, address := Tokenize(doc.FirstName), Tokenize(doc.LastName), Tokenize(doc.Address)
+	var phones []string
+	for _, p := range doc.Phones {
+		if digits, ok := phoneDigits(strings.ReplaceAll(p, " ", "")); ok {
+			phones = append(phones, digits)
+		}
+	}
+
+	total := 0.0
+	for _, term := range q.Terms {
+		best := 0.0
+		consider := func(field string, s float64) {
+			if (term.Field == "" || term.Field == field) && s > best {
+				best = s
+			}
+		}
+		if term.Phone {
+			consider(FieldPhone, matchDigits(term.Text, phones))
+		}
+		consider(FieldFirst, matchTokens(term.Text, first))
+		consider(FieldLast, matchTokens(term.Text, last))
+		if !term.Names {
+			consider(FieldAddress, 0.8*matchTokens(term.Text, address)) // names rank above addresses
+		}
+		if best == 0 {
+			return 0, false
+		}
+		total += best
+	}
+	return total / float64(len(q.Terms)), true
+}
+
+// matchDigits scores a run of digits against phone numbers: whole number, start or end
+// (such as the last four digits), then anywhere in the number
+func matchDigits(digits string, phones []string) float64 {
+	best := 0.0
+	for _, phone := range phones {
+		var s float64
+		switch {
+		case phone == digits:
+			s = 1
+		case strings.HasPrefix(phone, digits) || strings.HasSuffix(phone, digits):
+			s = 0.9
+		case strings.Contains(phone, digits):
+			s = 0.7
+		}
+		if s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+// matchTokens scores a query term against the words of a field: exact word, prefix of a
+// word, then a word (or word prefix) within a small edit distance
+func matchTokens(term string, tokens []string) float64 {
+	best := 0.0
+	for _, token := range tokens {
+		if s := matchToken(term, token); s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+func matchToken(term, token string) float64 {
+	if term == token {
+		return 1
+	}
+	termLen, tokenLen := len([]rune(term)), len([]rune(token))
+	if strings.HasPrefix(token, term) {
+		// Longer prefixes are more telling: "makov" ranks above "m" for "makovsky"
+		return 0.6 + 0.3*float64(termLen)/float64(tokenLen)
+	}
+
+	allowed := maxTypos(termLen)
+	if allowed == 0 {
+		return 0
+	}
+	distance := Distance(term, token)
+	if tokenLen > termLen {
+		// A typo inside a prefix, e.g. "mkaov" for "makovsky"
+		if d := Distance(term, string([]rune(token)[:termLen])); d < distance {
+			distance = d
+		}
+	}
+	if distance > allowed {
+		return 0
+	}
+	return 0.5 * (1 - float64(distance)/float64(termLen+1))
+}
+
+// maxTypos is the edit distance tolerated for a term of the given length
+func maxTypos(length int) int {
+	switch {
+	case length < 3:
+		return 0
+	case length < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Distance is the optimal string alignment distance between a and b: the number of
+// inserted, deleted or substituted runes and swapped neighbours needed to turn a into b
+func Distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	rows := make([][]int, len(s)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(t)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(s)][len(t)]
+}
+
+// Tokenize normalizes text and splits it into words of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(Normalize(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Normalize lower-cases text and folds accented Latin letters to their base letter, so
+// "José Müller" and "jose muller" compare equal. The CombiningMarks, such as Hebrew vowel
+// points and Arabic harakat, are dropped.
+func Normalize(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.Is(CombiningMarks, r) {
+			continue
+		}
+		if folded, ok := foldTable[r]; ok {
+			b.WriteString(folded)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CombiningMarks are the marks Normalize drops: the combining accents of the Latin, Greek and
+// Cyrillic scripts, Hebrew points and cantillation, Arabic harakat and Quranic marks, and the
+// blocks of combining marks for symbols and half marks. The search_fold function of the
+// PostgreSQL migrations drops the same ranges, written as MarkClass, so searches narrowed
+// down in SQL keep every contact Score accepts.
+var CombiningMarks = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x0300, Hi: 0x036f, Stride: 1}, // combining diacritical marks
+		{Lo: 0x0483, Hi: 0x0489, Stride: 1}, // Cyrillic titlo and palatalization
+		{Lo: 0x0591, Hi: 0x05bd, Stride: 1}, // Hebrew cantillation and points
+		{Lo: 0x05bf, Hi: 0x05bf, Stride: 1}, // Hebrew rafe
+		{Lo: 0x05c1, Hi: 0x05c2, Stride: 1}, // Hebrew shin and sin dots
+		{Lo: 0x05c4, Hi: 0x05c5, Stride: 1}, // Hebrew upper and lower dots
+		{Lo: 0x05c7, Hi: 0x05c7, Stride: 1}, // Hebrew qamats qatan
+		{Lo: 0x0610, Hi: 0x061a, Stride: 1}, // Arabic honorifics
+		{Lo: 0x064b, Hi: 0x065f, Stride: 1}, // Arabic harakat
+		{Lo: 0x0670, Hi: 0x0670, Stride: 1}, // Arabic superscript alef
+		{Lo: 0x06d6, Hi: 0x06dc, Stride: 1}, // Arabic Quranic annotation marks
+		{Lo: 0x06df, Hi: 0x06e4, Stride: 1},
+		{Lo: 0x06e7, Hi: 0x06e8, Stride: 1},
+		{Lo: 0x06ea, Hi: 0x06ed, Stride: 1},
+		{Lo: 0x1ab0, Hi: 0x1aff, Stride: 1}, // combining diacritical marks extended
+		{Lo: 0x1dc0, Hi: 0x1dff, Stride: 1}, // combining diacritical marks supplement
+		{Lo: 0x20d0, Hi: 0x20ff, Stride: 1}, // combining marks for symbols
+		{Lo: 0xfe20, Hi: 0xfe2f, Stride: 1}, // combining half marks
+	},
+}
+
+// MarkClass returns CombiningMarks as a regular expression bracket expression with \u
+// escapes, e.g. [\u0300-\u036f\u0483-\u0489...], as PostgreSQL regular expressions take it
+func MarkClass() string {
+	var b strings.Builder
+	b.WriteString("[")
+	for _, r := range CombiningMarks.R16 {
+		fmt.Fprintf(&b, "\\u%04x", r.Lo)
+		if r.Hi != r.Lo {
+			fmt.Fprintf(&b, "-\\u%04x", r.Hi)
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// foldTable maps lower case accented letters to plain ASCII
+var foldTable = func() map[rune]string {
+	groups := map[string]string{
+		"a":  "àáâãäåāăą",
+		"c":  "çćĉċč",
+		"d":  "ďđ",
+		"e":  "èéêëēĕėęě",
+		"g":  "ĝğġģ",
+		"h":  "ĥħ",
+		"i":  "ìíîïĩīĭįı",
+		"j":  "ĵ",
+		"k":  "ķ",
+		"l":  "ĺļľŀł",
+		"n":  "ñńņňŉ",
+		"o":  "òóôõöøōŏő",
+		"r":  "ŕŗř",
+		"s":  "śŝşšș",
+		"t":  "ţťŧț",
+		"u":  "ùúûüũūŭůűų",
+		"w":  "ŵ",
+		"y":  "ýÿŷ",
+		"z":  "źżž",
+		"ae": "æ",
+		"oe": "œ",
+		"ss": "ß",
+		"th": "þ",
+	}
+	table := make(map[rune]string)
+	for plain, accented := range groups {
+		for _, r := range accented {
+			table[r] = plain
+		}
+	}
+	return table
+}()
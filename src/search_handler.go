@@ -0,0 +1,107 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"Rise/src/search"
+)
+
+// SearchResult is one contact matched by a search, with its relevance between 0 and 1
+type SearchResult struct {
+	Contact Contact `json:"contact"`
+	Score   float64 `json:"score"`
+}
+
+// SearchContactsHandler handles the HTTP request for searching contacts by name, address or
+// part of the phone number, e.g. ?q=jon mako, ?q=5590 or ?q=city:haifa last:cohen.
+// Results are ranked by relevance, ?limit= caps how many are returned and ?tag= or ?group=
+// narrow the search down.
+func SearchContactsHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := search.Parse(r.URL.Query().Get("q"))
+		if query.Empty() {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Please provide a search query in q.")
+			return
+		}
+		limit, err := parsePageSize(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		filter, ok := parseContactFilter(w, r, store)
+		if !ok {
+			return
+		}
+
+		results, err := searchContacts(store, query, filter, limit)
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+
+		response := struct {
+			Message string         `json:"message"`
+			Results []SearchResult `json:"results"`
+		}{
+			Message: fmt.Sprintf("%d contact(s) matched the search", len(results)),
+			Results: results,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// searchContacts scores the contacts of the store matching the filter against the query
+// and returns the best matches, highest score first. A SearchStore narrows the contacts down
+// to the candidates first. Ranking happens here rather than in SQL so every store gives the
+// same results.
+func searchContacts(store ContactStore, query search.Query, filter ContactFilter, limit int) ([]SearchResult, error) {
+	var contacts []Contact
+	var err error
+	if searches, ok := store.(SearchStore); ok {
+		contacts, err = searches.SearchCandidates(query, filter)
+	} else {
+		contacts, err = allContacts(store, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	for _, contact := range contacts {
+		if score, ok := search.Score(query, contactDocument(contact)); ok {
+			results = append(results, SearchResult{Contact: contact, Score: roundScore(score)})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score // contacts arrive in id order, so ties stay in id order
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// contactDocument is the searchable form of a contact
+func contactDocument(contact Contact) search.Document {
+	document := search.Document{
+		FirstName: contact.FirstName,
+		LastName:  contact.LastName,
+		Address:   contact.Address,
+		Phones:    []string{contact.PhoneNumber, contact.PhoneE164},
+	}
+	for _, p := range contact.Phones {
+		document.Phones = append(document.Phones, p.Number, p.E164)
+	}
+	// Every address is searched, the words of secondary ones count like the primary's
+	for _, a := range contact.Addresses {
+		if !a.Primary {
+			document.Address += ", " + a.Address
+		}
+	}
+	return document
+}
@@ -0,0 +1,601 @@
+package src
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"modernc.org/sqlite"
+
+	"Rise/database"
+	"Rise/src/migrate"
+	"Rise/src/phone"
+	"Rise/src/search"
+)
+
+// ContactStore is the storage backend used by the HTTP handlers.
+// It is implemented by SQLStore (PostgreSQL and SQLite) and MemoryStore.
+type ContactStore interface {
+	// GetContacts returns a page of contacts ordered by id, see GetContacts in repository.go
+	GetContacts(limit, afterID, beforeID int) ([]Contact, bool, error)
+	// AddContact inserts a contact and returns its generated id
+	AddContact(contact Contact) (int, error)
+	// AddContacts inserts all contacts or none of them and returns their generated ids
+	AddContacts(contacts []Contact) ([]int, error)
+	// SearchContact returns every contact with the given number among its phone numbers.
+	// Phone numbers passed to the store are normalized before they are matched.
+	SearchContact(phoneNumber string) ([]Contact, error)
+	// EditContact overwrites the contact with the given id and returns the stored contact.
+	// For EditContact, PatchContact and DeleteContact, version is the version the caller
+	// last read: the write fails with ErrVersionMismatch if the contact changed since.
+	// A version of 0 skips the check.
+	EditContact(id int, updatedContact Contact, version int) (Contact, error)
+	// PatchContact changes only the fields set in the patch and returns the stored contact.
+	// A new phone number is normalized and its E.164 form is updated with it.
+	PatchContact(id int, patch ContactPatch, version int) (Contact, error)
+	// DeleteContact moves the contact with the given id to the trash, out of every other read
+	DeleteContact(id int, version int) error
+	// GetContact returns the contact with the given id
+	GetContact(id int) (Contact, error)
+	// PrepareContact validates and normalizes a contact the way AddContact does, without storing it
+	PrepareContact(contact Contact) (Contact, error)
+	// PrepareContacts prepares many contacts like PrepareContact, reading the tenant's
+	// custom fields once. The error at each index belongs to the contact at that index.
+	PrepareContacts(contacts []Contact) ([]Contact, []error)
+}
+
+// APIKeyStore keeps the API keys accepted by the Authenticator.
+// It is implemented by SQLStore and MemoryStore.
+type APIKeyStore interface {
+	// CreateAPIKey stores a key by its hash and returns it with its generated id
+	CreateAPIKey(key APIKey, hash string) (APIKey, error)
+	// APIKeyByHash returns the key with the given hash, revoked keys included
+	APIKeyByHash(hash string) (APIKey, error)
+	// ListAPIKeys returns the keys of the tenant ordered by id, every key when tenant is empty
+	ListAPIKeys(tenant string) ([]APIKey, error)
+	// RevokeAPIKey revokes an active key, ErrNotFound if there is none with the id.
+	// A tenant limits the match to that tenant's keys.
+	RevokeAPIKey(tenant string, id int) error
+}
+
+// TenantStore hosts the phonebooks of several tenants, each isolated from the others.
+// It is implemented by SQLStore and MemoryStore, which as a ContactStore hold the contacts
+// of DefaultTenant.
+type TenantStore interface {
+	// ForTenant returns the ContactStore of the tenant's contacts. It does not check that
+	// the tenant exists.
+	ForTenant(tenant string) ContactStore
+	// CreateTenant stores a new tenant, ErrConflict if the id is taken
+	CreateTenant(tenant Tenant) (Tenant, error)
+	// GetTenant returns the tenant with the given id
+	GetTenant(id string) (Tenant, error)
+	// ListTenants returns every tenant ordered by id
+	ListTenants() ([]Tenant, error)
+	// DeleteTenant removes the tenant with all of its contacts and API keys
+	DeleteTenant(id string) error
+}
+
+// AuditStore records every contact write in an append-only audit log, in the same
+// transaction as the write. It is implemented by SQLStore and MemoryStore.
+type AuditStore interface {
+	// AsActor returns the ContactStore whose writes are recorded as made by the actor
+	AsActor(actor Actor) ContactStore
+	// AuditLog returns the audit entries of the store's tenant matching the filter, newest
+	// first, and whether more entries match past the returned ones
+	AuditLog(filter AuditFilter) ([]AuditEntry, bool, error)
+}
+
+// HistoryStore keeps every revision of the contacts, read back from the audit log, and
+// restores them. It is implemented by SQLStore and MemoryStore.
+type HistoryStore interface {
+	// ContactHistory returns the revisions of the contact with the given id, newest first,
+	// also after it was deleted. ErrNotFound when the contact has no history.
+	ContactHistory(id int) ([]Revision, error)
+	// RestoreContact reverts the contact to the revision, un-deleting it if needed, and
+	// returns the stored contact at its new version
+	RestoreContact(id, revision int) (Contact, error)
+}
+
+// TrashStore keeps deleted contacts in a trash bin until they are restored or purged.
+// It is implemented by SQLStore and MemoryStore.
+type TrashStore interface {
+	// ListTrash returns a page of the deleted contacts ordered by id, with the time each was
+	// deleted, and whether more contacts are in the trash
+	ListTrash(limit, afterID int) ([]Contact, bool, error)
+	// UndeleteContact takes the contact out of the trash at a new version, ErrNotFound if it
+	// is not there
+	UndeleteContact(id int) (Contact, error)
+	// PurgeTrash permanently removes the contacts of every tenant deleted before the given
+	// time and returns how many were removed
+	PurgeTrash(before time.Time) (int, error)
+}
+
+// MergeStore finds and combines duplicate contacts. It is implemented by SQLStore and
+// MemoryStore.
+type MergeStore interface {
+	// DuplicateCandidates returns the contacts sharing a phone number with the contact,
+	// ordered by id. Without one a contact cannot reach dedupe.DefaultThreshold against it,
+	// see dedupe.PhoneWeight.
+	DuplicateCandidates(contact Contact) ([]Contact, error)
+	// LockDuplicates makes the duplicate checks of other transactions on the tenant wait
+	// until the current transaction ends, so a checked contact is added before the next
+	// check runs. Outside InTransaction it has no lasting effect.
+	LockDuplicates() error
+	// MergeContacts writes the patch over the survivor and moves the merged contacts to the
+	// trash, all or nothing, and returns the stored survivor. version is checked on the
+	// survivor as in PatchContact. merged must list other contacts, each once.
+	MergeContacts(survivor int, patch ContactPatch, version int, merged []int) (Contact, error)
+}
+
+// TransactionStore runs several writes as one. It is implemented by SQLStore and MemoryStore.
+type TransactionStore interface {
+	// InTransaction calls fn with a ContactStore whose reads and writes all take part in one
+	// transaction, committed when fn returns nil and rolled back otherwise
+	InTransaction(fn func(store ContactStore) error) error
+}
+
+// inTransaction runs fn in one transaction when the store is a TransactionStore, and
+// directly against the store otherwise
+func inTransaction(store ContactStore, fn func(store ContactStore) error) error {
+	if transactions, ok := store.(TransactionStore); ok {
+		return transactions.InTransaction(fn)
+	}
+	return fn(store)
+}
+
+// GroupStore keeps named groups of contacts and lists the contacts filtered by tag, group,
+// column or custom field, and sorted. It is implemented by SQLStore and MemoryStore.
+type GroupStore interface {
+	// FilterContacts returns a page of the contacts matching the filter, paged like GetContacts
+	FilterContacts(filter ContactFilter, limit, afterID, beforeID int) ([]Contact, bool, error)
+	// SortContacts returns a page of the contacts matching the filter ordered by the keys,
+	// paged by position like GetContacts is by id, see SortContacts in repository.go
+	SortContacts(filter ContactFilter, keys []SortKey, limit int, after, before *SortCursor) ([]Contact, bool, error)
+	// CountContacts returns the number of contacts matching the filter, at most limit when
+	// it is positive
+	CountContacts(filter ContactFilter, limit int) (int, error)
+	// EstimateContacts returns a cheap estimate of the number of contacts matching the
+	// filter, estimated is false when the number happens to be exact
+	EstimateContacts(filter ContactFilter) (total int, estimated bool, err error)
+	// CreateGroup stores a new group with no members, ErrConflict if the name is taken
+	CreateGroup(name string) (Group, error)
+	// ListGroups returns every group ordered by name
+	ListGroups() ([]Group, error)
+	// GetGroup returns the group with the given id and its members
+	GetGroup(id int) (Group, error)
+	// RenameGroup changes the name of the group, ErrConflict if another group has it
+	RenameGroup(id int, name string) (Group, error)
+	// DeleteGroup removes the group, its contacts are kept
+	DeleteGroup(id int) error
+	// AddGroupMembers adds the contacts to the group, all or none of them, and returns the
+	// group. Contacts already in it are skipped, missing contacts fail with a ValidationError.
+	AddGroupMembers(id int, contactIDs []int) (Group, error)
+	// RemoveGroupMember takes the contact out of the group, ErrNotFound if it is not in it
+	RemoveGroupMember(id, contactID int) error
+}
+
+// FieldStore keeps the custom fields defined for the contacts of a tenant. Contact writes
+// validate the custom fields of the contacts against the definitions. It is implemented by
+// SQLStore and MemoryStore.
+type FieldStore interface {
+	// DefineField stores a new custom field, ErrConflict if the name is taken
+	DefineField(field CustomField) (CustomField, error)
+	// ListFields returns every custom field ordered by name
+	ListFields() ([]CustomField, error)
+	// GetField returns the custom field with the given name
+	GetField(name string) (CustomField, error)
+	// DeleteField removes the custom field and the value every contact has for it
+	DeleteField(name string) error
+}
+
+// SearchStore narrows a search down to the contacts that can match it, so only those are
+// ranked. It is implemented by SQLStore and MemoryStore.
+type SearchStore interface {
+	// SearchCandidates returns the contacts matching the filter among which are all those
+	// search.Score accepts for the query, ordered by id
+	SearchCandidates(query search.Query, filter ContactFilter) ([]Contact, error)
+}
+
+// systemActor is recorded for writes made outside of a request, such as by tests and tools
+const systemActor = "system"
+
+// SQLStore is a ContactStore, APIKeyStore, TenantStore, AuditStore, HistoryStore,
+// TrashStore, MergeStore, TransactionStore, GroupStore, FieldStore and SearchStore backed by
+// database/sql.
+// The queries in repository.go only use SQL understood by both PostgreSQL and SQLite,
+// so the same store serves both databases.
+type SQLStore struct {
+	db      Executor        // the database, or the transaction of InTransaction
+	dialect migrate.Dialect // the database behind db, for the few queries that differ
+	region  string          // default region for phone numbers without a country code
+	tenant  string          // every contact query is limited to this tenant
+	actor   Actor           // recorded in the audit log for every write
+}
+
+// NewPostgresStore returns a store using a PostgreSQL connection, the schema is created by
+// running the migrations, see Migrator
+func NewPostgresStore(db *sql.DB, region string) *SQLStore {
+	return &SQLStore{db: db, dialect: migrate.Postgres, region: region, tenant: DefaultTenant, actor: Actor{Name: systemActor}}
+}
+
+func init() {
+	// The PostgreSQL migrations create search_fold in SQL, SQLite calls search.Normalize
+	sqlite.MustRegisterDeterministicScalarFunction("search_fold", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch value := args[0].(type) {
+		case string:
+			return search.Normalize(value), nil
+		case []byte:
+			return search.Normalize(string(value)), nil
+		}
+		return args[0], nil
+	})
+}
+
+// NewSQLiteStore returns a store using a SQLite connection and applies pending migrations
+func NewSQLiteStore(db *sql.DB, region string) (*SQLStore, error) {
+	// SQLite allows a single writer, so share one connection instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	// Foreign keys are off by default in SQLite, they delete the details of a contact with it
+	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		return nil, err
+	}
+	migrator, err := Migrator(db, migrate.SQLite)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrator.Up(); err != nil {
+		return nil, fmt.Errorf("migrating sqlite schema: %w", err)
+	}
+	return &SQLStore{db: db, dialect: migrate.SQLite, region: region, tenant: DefaultTenant, actor: Actor{Name: systemActor}}, nil
+}
+
+// Migrator returns a migrator over the schema migrations embedded from database/migrations
+func Migrator(db *sql.DB, dialect migrate.Dialect) (*migrate.Migrator, error) {
+	return migrate.New(db, dialect, database.Migrations(string(dialect)))
+}
+
+func (s *SQLStore) GetContacts(limit, afterID, beforeID int) ([]Contact, bool, error) {
+	contacts, hasMore, err := GetContacts(s.db, s.tenant, limit, afterID, beforeID)
+	if err != nil {
+		return nil, false, err
+	}
+	return contacts, hasMore, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) AddContact(contact Contact) (int, error) {
+	contact, err := s.PrepareContact(contact)
+	if err != nil {
+		return 0, err
+	}
+	return AddContact(s.db, s.tenant, s.actor, contact)
+}
+
+func (s *SQLStore) AddContacts(contacts []Contact) ([]int, error) {
+	fields, err := ListCustomFields(s.db, s.tenant)
+	if err != nil {
+		return nil, err
+	}
+	normalized := make([]Contact, len(contacts))
+	for i, contact := range contacts {
+		if err := normalizeDetails(&contact, s.region); err != nil {
+			return nil, err
+		}
+		if err := checkContactFields(fields, &contact); err != nil {
+			return nil, err
+		}
+		normalized[i] = contact
+	}
+	return AddContacts(s.db, s.tenant, s.actor, normalized)
+}
+
+func (s *SQLStore) SearchContact(phoneNumber string) ([]Contact, error) {
+	contacts, err := SearchContact(s.db, s.tenant, phoneLookupKey(phoneNumber, s.region))
+	if err != nil {
+		return nil, err
+	}
+	return contacts, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) EditContact(id int, updatedContact Contact, version int) (Contact, error) {
+	return s.PatchContact(id, patchAll(updatedContact), version)
+}
+
+func (s *SQLStore) PatchContact(id int, patch ContactPatch, version int) (Contact, error) {
+	if err := normalizePatchDetails(&patch, s.region); err != nil {
+		return Contact{}, err
+	}
+	if err := s.checkCustomFields(&patch); err != nil {
+		return Contact{}, err
+	}
+	contact, err := EditContact(s.db, s.tenant, s.actor, id, patch, version)
+	if err != nil {
+		return Contact{}, err
+	}
+	return s.withDetails(contact)
+}
+
+func (s *SQLStore) DeleteContact(id int, version int) error {
+	return DeleteContact(s.db, s.tenant, s.actor, id, version)
+}
+
+func (s *SQLStore) GetContact(id int) (Contact, error) {
+	contact, err := GetContactByID(s.db, s.tenant, id)
+	if err != nil {
+		return Contact{}, err
+	}
+	return s.withDetails(contact)
+}
+
+func (s *SQLStore) PrepareContact(contact Contact) (Contact, error) {
+	if err := normalizeDetails(&contact, s.region); err != nil {
+		return contact, err
+	}
+	fields, err := ListCustomFields(s.db, s.tenant)
+	if err != nil {
+		return contact, err
+	}
+	return contact, checkContactFields(fields, &contact)
+}
+
+func (s *SQLStore) PrepareContacts(contacts []Contact) ([]Contact, []error) {
+	fields, err := ListCustomFields(s.db, s.tenant)
+	return prepareContacts(contacts, s.region, fields, err)
+}
+
+// checkCustomFields validates the custom fields set by a patch against the tenant's fields
+func (s *SQLStore) checkCustomFields(patch *ContactPatch) error {
+	if patch.CustomFields == nil && !patch.ReplaceCustomFields {
+		return nil
+	}
+	fields, err := ListCustomFields(s.db, s.tenant)
+	if err != nil {
+		return err
+	}
+	return checkCustomFields(fields, patch, false)
+}
+
+// withDetails loads the phones, emails and addresses of a single contact
+func (s *SQLStore) withDetails(contact Contact) (Contact, error) {
+	contacts := []Contact{contact}
+	if err := LoadContactDetails(s.db, contacts); err != nil {
+		return Contact{}, err
+	}
+	return contacts[0], nil
+}
+
+func (s *SQLStore) CreateAPIKey(key APIKey, hash string) (APIKey, error) {
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	id, err := InsertAPIKey(s.db, key, hash)
+	key.ID = id
+	return key, err
+}
+
+func (s *SQLStore) APIKeyByHash(hash string) (APIKey, error) {
+	return GetAPIKeyByHash(s.db, hash)
+}
+
+func (s *SQLStore) ListAPIKeys(tenant string) ([]APIKey, error) {
+	return ListAPIKeys(s.db, tenant)
+}
+
+func (s *SQLStore) RevokeAPIKey(tenant string, id int) error {
+	return RevokeAPIKey(s.db, tenant, id, time.Now().UTC().Truncate(time.Second))
+}
+
+func (s *SQLStore) ForTenant(tenant string) ContactStore {
+	return &SQLStore{db: s.db, dialect: s.dialect, region: s.region, tenant: tenant, actor: s.actor}
+}
+
+func (s *SQLStore) CreateTenant(tenant Tenant) (Tenant, error) {
+	tenant.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	return tenant, InsertTenant(s.db, tenant)
+}
+
+func (s *SQLStore) GetTenant(id string) (Tenant, error) {
+	return GetTenant(s.db, id)
+}
+
+func (s *SQLStore) ListTenants() ([]Tenant, error) {
+	return ListTenants(s.db)
+}
+
+func (s *SQLStore) DeleteTenant(id string) error {
+	return DeleteTenant(s.db, id)
+}
+
+func (s *SQLStore) AsActor(actor Actor) ContactStore {
+	return &SQLStore{db: s.db, dialect: s.dialect, region: s.region, tenant: s.tenant, actor: actor}
+}
+
+func (s *SQLStore) AuditLog(filter AuditFilter) ([]AuditEntry, bool, error) {
+	return AuditLog(s.db, s.tenant, filter)
+}
+
+func (s *SQLStore) ContactHistory(id int) ([]Revision, error) {
+	entries, err := ContactHistory(s.db, s.tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	return revisionsOf(entries), nil
+}
+
+func (s *SQLStore) RestoreContact(id, revision int) (Contact, error) {
+	contact, err := RestoreContact(s.db, s.tenant, s.actor, id, revision)
+	if err != nil {
+		return Contact{}, err
+	}
+	return s.withDetails(contact)
+}
+
+func (s *SQLStore) ListTrash(limit, afterID int) ([]Contact, bool, error) {
+	contacts, hasMore, err := ListTrash(s.db, s.tenant, limit, afterID)
+	if err != nil {
+		return nil, false, err
+	}
+	return contacts, hasMore, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) UndeleteContact(id int) (Contact, error) {
+	contact, err := UndeleteContact(s.db, s.tenant, s.actor, id)
+	if err != nil {
+		return Contact{}, err
+	}
+	return s.withDetails(contact)
+}
+
+func (s *SQLStore) DuplicateCandidates(contact Contact) ([]Contact, error) {
+	contacts, err := DuplicateCandidates(s.db, s.tenant, contactRecord(contact).Phones)
+	if err != nil {
+		return nil, err
+	}
+	return contacts, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) LockDuplicates() error {
+	return LockTenant(s.db, s.tenant)
+}
+
+func (s *SQLStore) MergeContacts(survivor int, patch ContactPatch, version int, merged []int) (Contact, error) {
+	if err := checkMerge(survivor, merged); err != nil {
+		return Contact{}, err
+	}
+	if err := normalizePatchDetails(&patch, s.region); err != nil {
+		return Contact{}, err
+	}
+	if err := s.checkCustomFields(&patch); err != nil {
+		return Contact{}, err
+	}
+	contact, err := MergeContacts(s.db, s.tenant, s.actor, survivor, patch, version, merged)
+	if err != nil {
+		return Contact{}, err
+	}
+	return s.withDetails(contact)
+}
+
+func (s *SQLStore) InTransaction(fn func(store ContactStore) error) error {
+	return WithTransaction(s.db, func(tx Executor) error {
+		return fn(&SQLStore{db: tx, dialect: s.dialect, region: s.region, tenant: s.tenant, actor: s.actor})
+	})
+}
+
+func (s *SQLStore) PurgeTrash(before time.Time) (int, error) {
+	return PurgeTrash(s.db, before)
+}
+
+func (s *SQLStore) FilterContacts(filter ContactFilter, limit, afterID, beforeID int) ([]Contact, bool, error) {
+	contacts, hasMore, err := ListContacts(s.db, s.tenant, filter, limit, afterID, beforeID)
+	if err != nil {
+		return nil, false, err
+	}
+	return contacts, hasMore, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) SortContacts(filter ContactFilter, keys []SortKey, limit int, after, before *SortCursor) ([]Contact, bool, error) {
+	contacts, hasMore, err := SortContacts(s.db, s.tenant, filter, keys, limit, after, before)
+	if err != nil {
+		return nil, false, err
+	}
+	return contacts, hasMore, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) SearchCandidates(query search.Query, filter ContactFilter) ([]Contact, error) {
+	contacts, err := SearchCandidates(s.db, s.tenant, filter, query)
+	if err != nil {
+		return nil, err
+	}
+	return contacts, LoadContactDetails(s.db, contacts)
+}
+
+func (s *SQLStore) CountContacts(filter ContactFilter, limit int) (int, error) {
+	return CountContacts(s.db, s.tenant, filter, limit)
+}
+
+func (s *SQLStore) EstimateContacts(filter ContactFilter) (int, bool, error) {
+	if s.dialect == migrate.Postgres {
+		total, err := EstimateContacts(s.db, s.tenant, filter)
+		return total, true, err
+	}
+	// SQLite keeps no row estimates, count as far as the cap instead
+	total, err := CountContacts(s.db, s.tenant, filter, cappedCountLimit)
+	return total, total >= cappedCountLimit, err
+}
+
+func (s *SQLStore) CreateGroup(name string) (Group, error) {
+	group := Group{Name: name, CreatedAt: time.Now().UTC().Truncate(time.Second), ContactIDs: []int{}}
+	id, err := InsertGroup(s.db, s.tenant, group)
+	group.ID = id
+	return group, err
+}
+
+func (s *SQLStore) ListGroups() ([]Group, error) {
+	return ListGroups(s.db, s.tenant)
+}
+
+func (s *SQLStore) GetGroup(id int) (Group, error) {
+	return GetGroup(s.db, s.tenant, id)
+}
+
+func (s *SQLStore) RenameGroup(id int, name string) (Group, error) {
+	if err := RenameGroup(s.db, s.tenant, id, name); err != nil {
+		return Group{}, err
+	}
+	return GetGroup(s.db, s.tenant, id)
+}
+
+func (s *SQLStore) DeleteGroup(id int) error {
+	return DeleteGroup(s.db, s.tenant, id)
+}
+
+func (s *SQLStore) AddGroupMembers(id int, contactIDs []int) (Group, error) {
+	if err := AddGroupMembers(s.db, s.tenant, id, contactIDs); err != nil {
+		return Group{}, err
+	}
+	return GetGroup(s.db, s.tenant, id)
+}
+
+func (s *SQLStore) RemoveGroupMember(id, contactID int) error {
+	return RemoveGroupMember(s.db, s.tenant, id, contactID)
+}
+
+func (s *SQLStore) DefineField(field CustomField) (CustomField, error) {
+	if err := field.compile(); err != nil {
+		return CustomField{}, err
+	}
+	field.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	return field, InsertCustomField(s.db, s.tenant, field)
+}
+
+func (s *SQLStore) ListFields() ([]CustomField, error) {
+	return ListCustomFields(s.db, s.tenant)
+}
+
+func (s *SQLStore) GetField(name string) (CustomField, error) {
+	return GetCustomField(s.db, s.tenant, name)
+}
+
+func (s *SQLStore) DeleteField(name string) error {
+	return DeleteCustomField(s.db, s.tenant, name)
+}
+
+// BackfillPhoneNumbers normalizes the phone numbers of rows stored before phone_e164 existed
+// and copies the phone number and address of rows stored before contact_phones and
+// contact_addresses existed into those tables
+func (s *SQLStore) BackfillPhoneNumbers() (int, error) {
+	return BackfillPhoneE164(s.db, func(number string) string {
+		return phoneLookupKey(number, s.region)
+	})
+}
+
+// phoneLookupKey returns the value matched against phone_e164 when looking a number up.
+// Input that does not parse is matched as typed, which is also how legacy rows with
+// unparseable numbers are keyed by the backfill.
+func phoneLookupKey(number, region string) string {
+	if e164, err := phone.Normalize(number, region); err == nil {
+		return e164
+	}
+	return number
+}
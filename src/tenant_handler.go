@@ -0,0 +1,156 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// tenantNotFoundMessage is shown when no tenant has the requested id
+const tenantNotFoundMessage = "No tenant exists with the given id"
+
+// tenantIDPattern accepts DNS labels, so every tenant id can also be used as a subdomain
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// CreateTenantHandler handles POST /api/v1/admin/tenants and answers 201 with the tenant
+func CreateTenantHandler(tenants TenantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var tenant Tenant
+		if err := json.NewDecoder(r.Body).Decode(&tenant); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid request body. Please provide correct JSON format.")
+			return
+		}
+		tenant.Name = strings.TrimSpace(tenant.Name)
+		if tenant.Name == "" {
+			tenant.Name = tenant.ID
+		}
+		if !tenantIDPattern.MatchString(tenant.ID) {
+			writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed, "The tenant is invalid.",
+				ErrorDetail{Field: "id", Issue: "must be 1 to 63 lowercase letters, digits or inner dashes"})
+			return
+		}
+
+		created, err := tenants.CreateTenant(tenant)
+		if errors.Is(err, ErrConflict) {
+			writeError(w, r, http.StatusConflict, CodeConflict, fmt.Sprintf("Tenant %s already exists.", tenant.ID))
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/admin/tenants/%s", apiPrefix, created.ID))
+		writeJSON(w, http.StatusCreated, created)
+	}
+}
+
+// ListTenantsHandler handles GET /api/v1/admin/tenants
+func ListTenantsHandler(tenants TenantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := tenants.ListTenants()
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Tenants []Tenant `json:"tenants"`
+		}{list})
+	}
+}
+
+// GetTenantHandler handles GET /api/v1/admin/tenants/{tenant}
+func GetTenantHandler(tenants TenantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenants.GetTenant(mux.Vars(r)["tenant"])
+		if err != nil {
+			writeStoreError(w, r, err, tenantNotFoundMessage)
+			return
+		}
+		writeJSON(w, http.StatusOK, tenant)
+	}
+}
+
+// DeleteTenantHandler handles DELETE /api/v1/admin/tenants/{tenant} and answers 204.
+// The tenant's contacts and API keys are deleted with it. The default tenant is kept.
+func DeleteTenantHandler(tenants TenantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["tenant"]
+		if id == DefaultTenant {
+			writeError(w, r, http.StatusConflict, CodeConflict, "The default tenant cannot be deleted.")
+			return
+		}
+		if err := tenants.DeleteTenant(id); err != nil {
+			writeStoreError(w, r, err, tenantNotFoundMessage)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// RequireAnyTenant answers 403 to callers bound to a tenant, which must not see or change
+// other tenants
+func RequireAnyTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if principal, ok := PrincipalFromContext(r.Context()); ok && principal.Tenant != "" {
+			writeError(w, r, http.StatusForbidden, CodeForbidden,
+				fmt.Sprintf("The credentials are bound to tenant %s and cannot manage tenants.", principal.Tenant))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TenantSubdomains reads the tenant from the subdomain of domain the request was sent to,
+// so acme.phonebook.example.com selects tenant acme when domain is phonebook.example.com
+func TenantSubdomains(domain string, next http.Handler) http.Handler {
+	suffix := "." + strings.ToLower(strings.Trim(domain, "."))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if label, ok := strings.CutSuffix(host, suffix); ok && label != "" && !strings.Contains(label, ".") {
+			r = r.WithContext(context.WithValue(r.Context(), subdomainTenantKey, label))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resolveTenant finds the tenant a request works on. A caller bound to a tenant always
+// gets that tenant and may not name another one, and only callers that may manage tenants
+// are unbound, see Principal.bound. Unbound callers, and every request when authentication
+// is off, pick one with the X-Tenant-ID header or the subdomain, and get DefaultTenant when
+// they name none.
+// On failure the error response has been written.
+func resolveTenant(w http.ResponseWriter, r *http.Request, tenants TenantStore) (string, bool) {
+	requested := r.Header.Get("X-Tenant-ID")
+	if requested == "" {
+		requested, _ = r.Context().Value(subdomainTenantKey).(string)
+	}
+
+	tenant := requested
+	if principal, ok := PrincipalFromContext(r.Context()); ok && principal.Tenant != "" {
+		if requested != "" && requested != principal.Tenant {
+			writeError(w, r, http.StatusForbidden, CodeForbidden,
+				fmt.Sprintf("The credentials are bound to tenant %s and cannot use tenant %s.", principal.Tenant, requested))
+			return "", false
+		}
+		tenant = principal.Tenant
+	}
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	if _, err := tenants.GetTenant(tenant); err != nil {
+		writeStoreError(w, r, err, tenantNotFoundMessage)
+		return "", false
+	}
+	return tenant, true
+}
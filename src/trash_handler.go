@@ -0,0 +1,73 @@
+package src
+
+import (
+	"net/http"
+)
+
+// ListTrashHandler handles GET /trash with a page of the deleted contacts ordered by id,
+// each with its deleted_at time. ?limit= and ?after= page through them.
+func ListTrashHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trash, ok := trashStore(w, r, store)
+		if !ok {
+			return
+		}
+		limit, err := parsePageSize(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		afterID, err := decodeCursor(r.URL.Query().Get("after"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "Invalid after cursor.")
+			return
+		}
+
+		contacts, hasMore, err := trash.ListTrash(limit, afterID)
+		if err != nil {
+			writeStoreError(w, r, err, "")
+			return
+		}
+		response := struct {
+			Contacts   []Contact `json:"contacts"`
+			NextCursor string    `json:"next_cursor,omitempty"`
+		}{Contacts: contacts}
+		if hasMore {
+			response.NextCursor = encodeCursor(contacts[len(contacts)-1].ID)
+		}
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// UndeleteContactHandler handles POST /trash/{id}/restore by taking the contact out of the
+// trash. It answers 200 with the contact at its new version.
+func UndeleteContactHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trash, ok := trashStore(w, r, store)
+		if !ok {
+			return
+		}
+		id, ok := contactID(w, r)
+		if !ok {
+			return
+		}
+
+		restored, err := trash.UndeleteContact(id)
+		if err != nil {
+			writeStoreError(w, r, err, "No contact with the given id is in the trash")
+			return
+		}
+		w.Header().Set("ETag", contactETag(restored))
+		writeJSON(w, http.StatusOK, restored)
+	}
+}
+
+// trashStore asserts that the store keeps deleted contacts. On failure the error response
+// has been written.
+func trashStore(w http.ResponseWriter, r *http.Request, store ContactStore) (TrashStore, bool) {
+	trash, ok := store.(TrashStore)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "The store keeps no trash.")
+	}
+	return trash, ok
+}
@@ -0,0 +1,141 @@
+// Package validate checks user input against rules declared per field, e.g.
+//
+//	schema := validate.Schema{
+//		{Field: "first_name", Rules: []validate.Rule{validate.Trim, validate.Required, validate.MaxLength(100)}},
+//		{Field: "phone_number", Rules: []validate.Rule{validate.Trim, validate.Required, validate.Phone}},
+//	}
+//	violations := schema.Validate(map[string]*string{"first_name": &first, "phone_number": &number})
+//
+// The rules of a field run in order, each one getting the value normalized by the ones
+// before it, and the first rule the value breaks is reported with the field's path. Every
+// field is checked, so callers report all the problems of an input at once.
+//
+// A Rule is a plain function, so inputs can combine the rules here with their own. Values
+// are passed as pointers and rewritten in place only when every rule passes, and nil
+// values, such as the fields a patch leaves out, are not checked at all.
+package validate
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Violation is a rule broken by the value of a field
+type Violation struct {
+	Field string // path of the value, e.g. last_name or phones[1].number
+	Issue string // e.g. "is required"
+}
+
+// Rule checks a value and returns its normalized form, or an issue explaining why the value
+// is not allowed. Rules other than Required accept the empty value.
+type Rule func(value string) (normalized, issue string)
+
+// Field declares the rules of the value at a path
+type Field struct {
+	Field string
+	Rules []Rule
+}
+
+// Schema declares the fields of an input, in the order their violations are reported
+type Schema []Field
+
+// Validate checks the values, keyed by path, against the schema and replaces each valid
+// value with its normalized form. Missing or nil values, such as the fields a patch leaves
+// unchanged, are skipped.
+func (s Schema) Validate(values map[string]*string) []Violation {
+	var violations []Violation
+	for _, field := range s {
+		if value := values[field.Field]; value != nil {
+			violations = append(violations, Check(field.Field, value, field.Rules...)...)
+		}
+	}
+	return violations
+}
+
+// Check runs the rules on one value, for the fields that are not part of a schema such as
+// the entries of a list. The value is normalized in place unless a rule is broken, then
+// the violation is returned.
+func Check(field string, value *string, rules ...Rule) []Violation {
+	normalized := *value
+	for _, rule := range rules {
+		var issue string
+		if normalized, issue = rule(normalized); issue != "" {
+			return []Violation{{Field: field, Issue: issue}}
+		}
+	}
+	*value = normalized
+	return nil
+}
+
+// Trim removes the white space around a value
+func Trim(value string) (string, string) {
+	return strings.TrimSpace(value), ""
+}
+
+// Lower lowercases a value
+func Lower(value string) (string, string) {
+	return strings.ToLower(value), ""
+}
+
+// Required rejects the empty value
+func Required(value string) (string, string) {
+	if value == "" {
+		return value, "is required"
+	}
+	return value, ""
+}
+
+// MaxLength rejects values longer than n characters
+func MaxLength(n int) Rule {
+	return func(value string) (string, string) {
+		if utf8.RuneCountInString(value) > n {
+			return value, fmt.Sprintf("must be at most %d characters", n)
+		}
+		return value, ""
+	}
+}
+
+// Printable rejects control characters, such as line breaks and tabs, and invalid UTF-8
+func Printable(value string) (string, string) {
+	if !utf8.ValidString(value) || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return value, "must not contain control characters"
+	}
+	return value, ""
+}
+
+// Excludes rejects values containing any of the characters, described by name in the issue,
+// e.g. Excludes(",;", "commas or semicolons")
+func Excludes(chars, name string) Rule {
+	return func(value string) (string, string) {
+		if strings.ContainsAny(value, chars) {
+			return value, "must not contain " + name
+		}
+		return value, ""
+	}
+}
+
+// Phone rejects values that are not written like a phone number: an optional + followed by
+// digits, grouped with spaces, dashes, dots, slashes or parentheses. Whether the number
+// exists in a region is left to the caller.
+func Phone(value string) (string, string) {
+	if value == "" {
+		return value, ""
+	}
+	digits := 0
+	for i, c := range value {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '+' && i == 0:
+		case strings.ContainsRune(" -.()/", c):
+		default:
+			return value, "must only contain digits, a leading + and the separators - . ( ) /"
+		}
+	}
+	if digits == 0 {
+		return value, "must contain digits"
+	}
+	return value, ""
+}
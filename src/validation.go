@@ -0,0 +1,100 @@
+package src
+
+import (
+	"fmt"
+	"net/http"
+
+	"Rise/src/validate"
+)
+
+// Limits of the contact fields, see the contacts and contact_* tables. Addresses are stored
+// as TEXT and get the limit of the other free text columns.
+const (
+	maxNameLength    = 100
+	maxPhoneLength   = 20
+	maxEmailLength   = 255
+	maxAddressLength = 255
+)
+
+// Rules of the values shared by the single fields of a contact and the entries of its lists.
+// Commas and semicolons separate tags in the CSV and vCard exports.
+var (
+	nameRules    = []validate.Rule{validate.Trim, validate.Required, validate.MaxLength(maxNameLength), validate.Printable}
+	phoneRules   = []validate.Rule{validate.Trim, validate.Required, validate.MaxLength(maxPhoneLength), validate.Phone}
+	emailRules   = []validate.Rule{validate.Trim, validate.MaxLength(maxEmailLength)}
+	addressRules = []validate.Rule{validate.Trim, validate.Required, validate.MaxLength(maxAddressLength), validate.Printable}
+	tagRules     = []validate.Rule{validate.Trim, validate.Lower, validate.Required, validate.MaxLength(maxTagLength), validate.Excludes(",;", "commas or semicolons")}
+)
+
+// contactSchema declares the single fields of a contact. The handlers check new contacts
+// against it before anything else runs, and the stores check every contact and patch they
+// write, see normalizePatchDetails. Whether a phone number exists in the store's region is
+// checked by the stores alone.
+var contactSchema = validate.Schema{
+	{Field: "first_name", Rules: nameRules},
+	{Field: "last_name", Rules: nameRules},
+	{Field: "phone_number", Rules: phoneRules},
+	{Field: "address", Rules: addressRules},
+}
+
+// contactErrors checks the single fields of a new contact, normalizing them in place, and
+// lists every violation. A list of phones or addresses stands in for the single field, its
+// entries are checked by the store.
+func contactErrors(contact *Contact) []ErrorDetail {
+	values := map[string]*string{"first_name": &contact.FirstName, "last_name": &contact.LastName}
+	if len(contact.Phones) == 0 {
+		values["phone_number"] = &contact.PhoneNumber
+	}
+	if len(contact.Addresses) == 0 {
+		values["address"] = &contact.Address
+	}
+	return violationDetails(contactSchema.Validate(values))
+}
+
+// patchErrors checks the single fields set by a patch, normalizing them in place. The phone
+// number and address derived from replaced lists are checked through the lists.
+func patchErrors(patch *ContactPatch) []ErrorDetail {
+	values := map[string]*string{"first_name": patch.FirstName, "last_name": patch.LastName}
+	if patch.Phones == nil {
+		values["phone_number"] = patch.PhoneNumber
+	}
+	if patch.Addresses == nil {
+		values["address"] = patch.Address
+	}
+	return violationDetails(contactSchema.Validate(values))
+}
+
+// checkValue runs rules on one value, such as an entry of a list, see validate.Check
+func checkValue(field string, value *string, rules []validate.Rule) []ErrorDetail {
+	return violationDetails(validate.Check(field, value, rules...))
+}
+
+// violationDetails turns the violations of a schema into error details
+func violationDetails(violations []validate.Violation) []ErrorDetail {
+	var details []ErrorDetail
+	for _, violation := range violations {
+		details = append(details, ErrorDetail(violation))
+	}
+	return details
+}
+
+// hasDetail reports whether one of the details is about the field
+func hasDetail(details []ErrorDetail, field string) bool {
+	for _, detail := range details {
+		if detail.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// validContact checks a new contact from a request body, see contactErrors. On failure the
+// error response has been written.
+func validContact(w http.ResponseWriter, r *http.Request, contact *Contact) bool {
+	details := contactErrors(contact)
+	if len(details) > 0 {
+		writeError(w, r, http.StatusUnprocessableEntity, CodeValidationFailed,
+			fmt.Sprintf("%d field(s) are empty or invalid. Please provide all required fields.", len(details)), details...)
+	}
+	return len(details) == 0
+}
@@ -0,0 +1,400 @@
+// Package vcard reads and writes vCard 3.0 (RFC 2426) and 4.0 (RFC 6350) files.
+// Only the properties the phone book uses are modelled: FN, N, TEL, ADR and CATEGORIES.
+package vcard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Supported versions
+const (
+	Version3 = "3.0"
+	Version4 = "4.0"
+)
+
+// Errors reported for individual cards
+var (
+	ErrMissingEnd  = errors.New("card is missing END:VCARD")
+	ErrMissingName = errors.New("card has neither N nor FN")
+	ErrNested      = errors.New("BEGIN:VCARD inside another card")
+)
+
+// Phone is a TEL property
+type Phone struct {
+	Number    string
+	Types     []string // lower case, e.g. "cell", "work"
+	Preferred bool
+}
+
+// Address is an ADR property
+type Address struct {
+	POBox      string
+	Extended   string
+	Street     string
+	Locality   string
+	Region     string
+	PostalCode string
+	Country    string
+	Types      []string
+}
+
+// String joins the non-empty components of the address into one line
+func (a Address) String() string {
+	var parts []string
+	for _, part := range []string{a.POBox, a.Extended, a.Street, a.Locality, a.Region, a.PostalCode, a.Country} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Card is a single vCard
+type Card struct {
+	Version       string
+	FormattedName string
+	FamilyName    string
+	GivenName     string
+	Phones        []Phone
+	Addresses     []Address
+	Categories    []string
+}
+
+// PreferredPhone returns the phone marked as preferred, or the first one
+func (c Card) PreferredPhone() (Phone, bool) {
+	for _, p := range c.Phones {
+		if p.Preferred {
+			return p, true
+		}
+	}
+	if len(c.Phones) == 0 {
+		return Phone{}, false
+	}
+	return c.Phones[0], true
+}
+
+// PreferredAddress returns the address typed as preferred, or the first one
+func (c Card) PreferredAddress() (Address, bool) {
+	for _, a := range c.Addresses {
+		for _, t := range a.Types {
+			if t == "pref" {
+				return a, true
+			}
+		}
+	}
+	if len(c.Addresses) == 0 {
+		return Address{}, false
+	}
+	return c.Addresses[0], true
+}
+
+// Entry is one card read by Parse. Err is set when the card is malformed, so callers
+// can report bad cards individually and keep the good ones.
+type Entry struct {
+	Line int // line of the BEGIN:VCARD property
+	Card Card
+	Err  error
+}
+
+// property is one unfolded content line
+type property struct {
+	name   string
+	params map[string][]string
+	value  string
+}
+
+// Parse reads every card in r. An error is only returned when r itself cannot be read.
+func Parse(r io.Reader) ([]Entry, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	var current *Entry
+	for _, l := range lines {
+		prop, err := parseProperty(l.text)
+		if err != nil {
+			if current != nil && current.Err == nil {
+				current.Err = fmt.Errorf("line %d: %w", l.number, err)
+			}
+			continue
+		}
+		switch {
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VCARD"):
+			if current != nil {
+				current.Err = ErrNested
+				entries = append(entries, *current)
+			}
+			current = &Entry{Line: l.number}
+		case prop.name == "END" && strings.EqualFold(prop.value, "VCARD"):
+			if current == nil {
+				continue
+			}
+			if current.Err == nil && current.Card.FamilyName == "" && current.Card.GivenName == "" && current.Card.FormattedName == "" {
+				current.Err = ErrMissingName
+			}
+			entries = append(entries, *current)
+			current = nil
+		case current != nil:
+			applyProperty(&current.Card, prop)
+		}
+	}
+	if current != nil {
+		current.Err = ErrMissingEnd
+		entries = append(entries, *current)
+	}
+	return entries, nil
+}
+
+// applyProperty copies a property into the card, unknown properties are ignored
+func applyProperty(card *Card, prop property) {
+	switch prop.name {
+	case "VERSION":
+		card.Version = prop.value
+	case "FN":
+		card.FormattedName = unescape(prop.value)
+	case "N":
+		parts := splitComponents(prop.value, ';')
+		card.FamilyName = component(parts, 0)
+		card.GivenName = component(parts, 1)
+	case "TEL":
+		phone := Phone{Number: telNumber(prop.value), Types: types(prop.params)}
+		for _, t := range phone.Types {
+			if t == "pref" {
+				phone.Preferred = true
+			}
+		}
+		if len(prop.params["PREF"]) > 0 {
+			phone.Preferred = true
+		}
+		if phone.Number != "" {
+			card.Phones = append(card.Phones, phone)
+		}
+	case "ADR":
+		parts := splitComponents(prop.value, ';')
+		card.Addresses = append(card.Addresses, Address{
+			POBox:      component(parts, 0),
+			Extended:   component(parts, 1),
+			Street:     component(parts, 2),
+			Locality:   component(parts, 3),
+			Region:     component(parts, 4),
+			PostalCode: component(parts, 5),
+			Country:    component(parts, 6),
+			Types:      types(prop.params),
+		})
+	case "CATEGORIES":
+		for _, category := range splitComponents(prop.value, ',') {
+			if category = strings.TrimSpace(category); category != "" {
+				card.Categories = append(card.Categories, category)
+			}
+		}
+	}
+}
+
+// telNumber strips the tel: URI scheme used by vCard 4.0 and any extension parameters
+func telNumber(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > 4 && strings.EqualFold(value[:4], "tel:") {
+		value = value[4:]
+	}
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	return unescape(value)
+}
+
+// types returns the lower case TYPE parameter values, including vCard 2.1 style bare types
+func types(params map[string][]string) []string {
+	var out []string
+	for _, value := range params["TYPE"] {
+		for _, t := range strings.Split(value, ",") {
+			if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+type line struct {
+	number int
+	text   string
+}
+
+// unfold joins continuation lines (starting with a space or tab) to the line before them
+func unfold(r io.Reader) ([]line, error) {
+	var lines []line
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		lines = append(lines, line{number: number, text: text})
+	}
+	return lines, scanner.Err()
+}
+
+// parseProperty splits a content line into name, parameters and value
+func parseProperty(text string) (property, error) {
+	// Find the colon that ends the name and parameters, skipping quoted parameter values
+	colon, quoted := -1, false
+	for i, c := range text {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property{}, fmt.Errorf("malformed content line %q", text)
+	}
+
+	head := strings.Split(text[:colon], ";")
+	name := strings.ToUpper(head[0])
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:] // drop the group prefix, e.g. item1.TEL
+	}
+	prop := property{name: name, params: make(map[string][]string), value: text[colon+1:]}
+	for _, param := range head[1:] {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			// vCard 2.1 allows bare types such as TEL;CELL:...
+			prop.params["TYPE"] = append(prop.params["TYPE"], param)
+			continue
+		}
+		prop.params[strings.ToUpper(key)] = append(prop.params[strings.ToUpper(key)], strings.Trim(value, `"`))
+	}
+	return prop, nil
+}
+
+// splitComponents splits a structured value on an unescaped separator, a semicolon between
+// components or a comma between list values, and unescapes each part
+func splitComponents(value string, separator rune) []string {
+	var parts []string
+	var b strings.Builder
+	escaped := false
+	for _, c := range value {
+		switch {
+		case escaped:
+			b.WriteRune('\\')
+			b.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == separator:
+			parts = append(parts, unescape(b.String()))
+			b.Reset()
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return append(parts, unescape(b.String()))
+}
+
+func component(parts []string, i int) string {
+	if i < len(parts) {
+		return strings.TrimSpace(parts[i])
+	}
+	return ""
+}
+
+var unescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\:`, ":", `\\`, `\`)
+
+func unescape(value string) string {
+	return unescaper.Replace(value)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, ",", `\,`, ";", `\;`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+// Write serializes the cards in the given version (Version3 or Version4)
+func Write(w io.Writer, cards []Card, version string) error {
+	if version != Version3 && version != Version4 {
+		return fmt.Errorf("unsupported vCard version %q", version)
+	}
+	bw := bufio.NewWriter(w)
+	for _, card := range cards {
+		writeLine(bw, "BEGIN:VCARD")
+		writeLine(bw, "VERSION:"+version)
+		fn := card.FormattedName
+		if fn == "" {
+			fn = strings.TrimSpace(card.GivenName + " " + card.FamilyName)
+		}
+		writeLine(bw, "FN:"+escape(fn))
+		writeLine(bw, "N:"+escape(card.FamilyName)+";"+escape(card.GivenName)+";;;")
+		for _, phone := range card.Phones {
+			writeLine(bw, telLine(phone, version))
+		}
+		for _, a := range card.Addresses {
+			head := "ADR"
+			if len(a.Types) > 0 {
+				head += ";TYPE=" + strings.Join(a.Types, ",")
+			}
+			components := []string{a.POBox, a.Extended, a.Street, a.Locality, a.Region, a.PostalCode, a.Country}
+			for i := range components {
+				components[i] = escape(components[i])
+			}
+			writeLine(bw, head+":"+strings.Join(components, ";"))
+		}
+		if len(card.Categories) > 0 {
+			categories := make([]string, len(card.Categories))
+			for i, category := range card.Categories {
+				categories[i] = escape(category)
+			}
+			writeLine(bw, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+		writeLine(bw, "END:VCARD")
+	}
+	return bw.Flush()
+}
+
+func telLine(phone Phone, version string) string {
+	phoneTypes := phone.Types
+	if phone.Preferred {
+		phoneTypes = append(append([]string{}, phoneTypes...), "pref")
+	}
+	if version == Version4 {
+		head := "TEL;VALUE=uri"
+		if len(phoneTypes) > 0 {
+			head += ";TYPE=" + strings.Join(phoneTypes, ",")
+		}
+		return head + ":tel:" + phone.Number
+	}
+	head := "TEL"
+	if len(phoneTypes) > 0 {
+		head += ";TYPE=" + strings.ToUpper(strings.Join(phoneTypes, ","))
+	}
+	return head + ":" + escape(phone.Number)
+}
+
+// writeLine writes a content line folded at 75 octets without splitting UTF-8 characters
+func writeLine(w *bufio.Writer, text string) {
+	limit := 75
+	for len(text) > limit {
+		cut := limit
+		for cut > 0 && text[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.WriteString(text[:cut] + "\r\n ")
+		text = text[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	w.WriteString(text + "\r\n")
+}
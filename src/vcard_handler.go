@@ -0,0 +1,366 @@
+package src
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"Rise/src/dedupe"
+	"Rise/src/vcard"
+)
+
+// maxImportSize bounds the size of an uploaded import file
+const maxImportSize = 10 << 20
+
+// ImportResult describes what happened to one imported record
+type ImportResult struct {
+	Index              int           `json:"index"`          // 1-based position of the record in the upload
+	Line               int           `json:"line,omitempty"` // line of the record in the upload
+	Status             string        `json:"status"`         // "imported", "valid" (dry run) or "rejected"
+	Contact            *Contact      `json:"contact,omitempty"`
+	PossibleDuplicates []int         `json:"possible_duplicates,omitempty"` // under the warn duplicate policy
+	Errors             []ErrorDetail `json:"errors,omitempty"`
+}
+
+// Import result statuses
+const (
+	importStatusImported = "imported"
+	importStatusValid    = "valid"
+	importStatusRejected = "rejected"
+)
+
+// ExportVCardHandler handles the HTTP request for downloading contacts as a .vcf file.
+// All contacts are exported unless ?phone_number=, ?tag= or ?group= narrow the export down,
+// and ?version= picks vCard 3.0 (default) or 4.0.
+func ExportVCardHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, ok := parseContactFilter(w, r, store)
+		if !ok {
+			return
+		}
+		version := r.URL.Query().Get("version")
+		if version == "" {
+			version = vcard.Version3
+		}
+		if version != vcard.Version3 && version != vcard.Version4 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "version must be 3.0 or 4.0")
+			return
+		}
+
+		contacts, err := exportContacts(store, r, filter)
+		if err != nil {
+			writeStoreError(w, r, err, "No contacts were found with the given phone number")
+			return
+		}
+
+		cards := make([]vcard.Card, len(contacts))
+		for i, contact := range contacts {
+			cards[i] = contactToCard(contact)
+		}
+
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+		w.WriteHeader(http.StatusOK)
+		vcard.Write(w, cards, version)
+	}
+}
+
+// ImportVCardHandler handles the HTTP request for importing a multi-card .vcf file.
+// The file is sent as the request body or as the "file" field of a multipart form.
+// With ?dry_run=true every card is validated and reported but nothing is stored. Every card
+// is checked under the duplicate policy, see WithDuplicatePolicy, against the contacts
+// stored before it.
+func ImportVCardHandler(store ContactStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dryRun, err := parseDryRun(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		body, closeBody, err := importBody(w, r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		defer closeBody()
+
+		entries, err := vcard.Parse(body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The upload could not be read: "+err.Error())
+			return
+		}
+		if len(entries) == 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "The upload does not contain any vCards.")
+			return
+		}
+
+		results := make([]ImportResult, len(entries))
+		for i, entry := range entries {
+			result := ImportResult{Index: i + 1, Line: entry.Line}
+			if entry.Err != nil {
+				result.Status = importStatusRejected
+				result.Errors = []ErrorDetail{{Field: "vcard", Issue: entry.Err.Error()}}
+			} else {
+				result = importContact(store, requestPolicy(r), cardToContact(entry.Card), dryRun, result)
+			}
+			results[i] = result
+		}
+
+		writeImportResponse(w, results, dryRun)
+	}
+}
+
+// importContact validates a contact and stores it under the duplicate policy unless this is
+// a dry run, which only looks for its duplicates
+func importContact(store ContactStore, policy DuplicatePolicy, contact Contact, dryRun bool, result ImportResult) ImportResult {
+	if details := contactErrors(&contact); len(details) > 0 {
+		result.Status = importStatusRejected
+		result.Errors = details
+		return result
+	}
+
+	prepared, err := store.PrepareContact(contact)
+	var matches []dedupe.Pair
+	if err == nil && dryRun {
+		matches, err = checkDuplicates(store, policy, prepared)
+	} else if err == nil {
+		prepared.ID, matches, err = addWithPolicy(store, policy, prepared)
+	}
+	if err != nil {
+		result.Status = importStatusRejected
+		result.Errors = importErrorDetails(err)
+		return result
+	}
+
+	result.Status = importStatusImported
+	if dryRun {
+		result.Status = importStatusValid
+	}
+	result.Contact = &prepared
+	result.PossibleDuplicates = duplicateIDs(matches)
+	return result
+}
+
+// importErrorDetails turns a store error into per-record error details
+func importErrorDetails(err error) []ErrorDetail {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Details
+	}
+	var duplicate duplicateError
+	if errors.As(err, &duplicate) {
+		return duplicate.details()
+	}
+	if errors.Is(err, ErrConflict) {
+		return []ErrorDetail{{Field: "contact", Issue: err.Error()}}
+	}
+	return []ErrorDetail{{Field: "contact", Issue: "database error occurred while adding the contact"}}
+}
+
+// writeImportResponse sends the per-record results of an import with a summary
+func writeImportResponse(w http.ResponseWriter, results []ImportResult, dryRun bool) {
+	accepted, rejected := 0, 0
+	for _, result := range results {
+		if result.Status == importStatusRejected {
+			rejected++
+		} else {
+			accepted++
+		}
+	}
+
+	message := fmt.Sprintf("%d contact(s) imported, %d rejected", accepted, rejected)
+	if dryRun {
+		message = fmt.Sprintf("Dry run: %d contact(s) would be imported, %d rejected", accepted, rejected)
+	}
+
+	response := struct {
+		Message  string         `json:"message"`
+		DryRun   bool           `json:"dry_run"`
+		Accepted int            `json:"accepted"`
+		Rejected int            `json:"rejected"`
+		Results  []ImportResult `json:"results"`
+	}{
+		Message:  message,
+		DryRun:   dryRun,
+		Accepted: accepted,
+		Rejected: rejected,
+		Results:  results,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// exportContacts returns the contacts selected by the export filters: the contacts with
+// ?phone_number= among their numbers, or every contact, narrowed down by the filter
+func exportContacts(store ContactStore, r *http.Request, filter ContactFilter) ([]Contact, error) {
+	phoneNumber := r.URL.Query().Get("phone_number")
+	if phoneNumber == "" {
+		return allContacts(store, filter)
+	}
+	found, err := store.SearchContact(phoneNumber)
+	if err != nil || filter.empty() {
+		return found, err
+	}
+	matching, err := allContacts(store, filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[int]bool{}
+	for _, contact := range matching {
+		ids[contact.ID] = true
+	}
+	contacts := []Contact{}
+	for _, contact := range found {
+		if ids[contact.ID] {
+			contacts = append(contacts, contact)
+		}
+	}
+	return contacts, nil
+}
+
+// allContacts walks every page of the store's contacts matching the filter
+func allContacts(store ContactStore, filter ContactFilter) ([]Contact, error) {
+	var contacts []Contact
+	afterID := 0
+	for {
+		page, hasMore, err := listContacts(store, filter, maxPageSize, afterID, 0)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, page...)
+		if !hasMore || len(page) == 0 {
+			return contacts, nil
+		}
+		afterID = page[len(page)-1].ID
+	}
+}
+
+// parseDryRun reads the dry_run query parameter
+func parseDryRun(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("dry_run must be true or false")
+	}
+	return dryRun, nil
+}
+
+// importBody returns the uploaded file, either the raw body or the "file" multipart field
+func importBody(w http.ResponseWriter, r *http.Request) (io.Reader, func() error, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return r.Body, r.Body.Close, nil
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil, fmt.Errorf("the multipart upload must contain a \"file\" field")
+	}
+	return file, file.Close, nil
+}
+
+// cardToContact maps the N, TEL, ADR and CATEGORIES properties of a card to a contact.
+// The preferred phone and address become the primary ones, the categories its tags.
+func cardToContact(card vcard.Card) Contact {
+	contact := Contact{FirstName: card.GivenName, LastName: card.FamilyName}
+	if contact.FirstName == "" && contact.LastName == "" {
+		// Fall back to splitting the formatted name on its last space
+		name := strings.TrimSpace(card.FormattedName)
+		if i := strings.LastIndexByte(name, ' '); i > 0 {
+			contact.FirstName, contact.LastName = name[:i], name[i+1:]
+		} else {
+			contact.FirstName = name
+		}
+	}
+	preferredPhone, _ := card.PreferredPhone()
+	for _, p := range card.Phones {
+		primary := p.Number == preferredPhone.Number && primaryPhone(contact.Phones) < 0
+		contact.Phones = append(contact.Phones, Phone{Type: phoneTypeFromCard(p.Types), Number: p.Number, Primary: primary})
+		if primary {
+			contact.PhoneNumber = p.Number
+		}
+	}
+	preferredAddress, _ := card.PreferredAddress()
+	for _, a := range card.Addresses {
+		address := a.String()
+		if address == "" {
+			continue
+		}
+		primary := address == preferredAddress.String() && primaryAddress(contact.Addresses) < 0
+		contact.Addresses = append(contact.Addresses, PostalAddress{Type: addressTypeFromCard(a.Types), Address: address, Primary: primary})
+		if primary {
+			contact.Address = address
+		}
+	}
+	if len(card.Categories) > 0 {
+		contact.Tags = append([]string{}, card.Categories...)
+	}
+	return contact
+}
+
+// contactToCard maps a contact to a card, preferring the canonical E.164 numbers, with its
+// tags as categories
+func contactToCard(contact Contact) vcard.Card {
+	card := vcard.Card{
+		GivenName:  contact.FirstName,
+		FamilyName: contact.LastName,
+		Categories: contact.Tags,
+	}
+	phones := contact.Phones
+	if len(phones) == 0 {
+		phones = []Phone{{Type: PhoneMobile, Number: contact.PhoneNumber, E164: contact.PhoneE164, Primary: true}}
+	}
+	for _, p := range phones {
+		number := p.E164
+		if number == "" {
+			number = p.Number
+		}
+		card.Phones = append(card.Phones, vcard.Phone{Number: number, Types: []string{cardPhoneTypes[p.Type]}, Preferred: p.Primary && len(phones) > 1})
+	}
+	addresses := contact.Addresses
+	if len(addresses) == 0 && contact.Address != "" {
+		addresses = []PostalAddress{{Type: AddressHome, Address: contact.Address, Primary: true}}
+	}
+	for _, a := range addresses {
+		types := []string{a.Type}
+		if a.Primary && len(addresses) > 1 {
+			types = append(types, "pref")
+		}
+		card.Addresses = append(card.Addresses, vcard.Address{Street: a.Address, Types: types})
+	}
+	return card
+}
+
+// cardPhoneTypes maps phone types to vCard TEL types
+var cardPhoneTypes = map[string]string{PhoneMobile: "cell", PhoneWork: "work", PhoneHome: "home", PhoneFax: "fax"}
+
+// phoneTypeFromCard returns the phone type for the types of a TEL property, mobile by default
+func phoneTypeFromCard(types []string) string {
+	for _, t := range types {
+		for phoneType, cardType := range cardPhoneTypes {
+			if t == cardType {
+				return phoneType
+			}
+		}
+	}
+	return PhoneMobile
+}
+
+// addressTypeFromCard returns the address type for the types of an ADR property, home by default
+func addressTypeFromCard(types []string) string {
+	for _, t := range types {
+		if t == AddressHome || t == AddressWork {
+			return t
+		}
+	}
+	return AddressHome
+}
@@ -0,0 +1,266 @@
+package tests
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all tests of the v1 resource API
+func TestAPIv1(t *testing.T) {
+    t.Run("Test Contact Lifecycle", testAPIContactLifecycle)
+    t.Run("Test Status Codes", testAPIStatusCodes)
+    t.Run("Test Duplicate Numbers", testAPIDuplicateNumbers)
+    t.Run("Test Conditional Requests", testAPIConditionalRequests)
+    t.Run("Test Phones, Emails and Addresses", testAPIContactDetails)
+}
+
+// Test creating, reading, replacing, patching and deleting a contact by id
+func testAPIContactLifecycle(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+
+    rec := doRequest(router, "POST", "/api/v1/contacts", `{"first_name":"Jonathan","last_name":"Makovsky","phone_number":"054-343-5590","address":"Tel Aviv"}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected status 201, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    location := fmt.Sprintf("/api/v1/contacts/%d", created.ID)
+    if rec.Header().Get("Location") != location || created.PhoneE164 != "+972543435590" {
+        t.Fatalf("Expected Location %s and a normalized contact, got %q %+v", location, rec.Header().Get("Location"), created)
+    }
+
+    rec = doRequest(router, "GET", location, "")
+    var got src.Contact
+    json.NewDecoder(rec.Body).Decode(&got)
+    if rec.Code != http.StatusOK || !reflect.DeepEqual(got, created) {
+        t.Fatalf("Expected to read back %+v, got %d %+v", created, rec.Code, got)
+    }
+
+    rec = doRequest(router, "PUT", location, `{"first_name":"Jon","last_name":"Makovsky","phone_number":"0543435590","address":"Haifa"}`)
+    json.NewDecoder(rec.Body).Decode(&got)
+    if rec.Code != http.StatusOK || got.FirstName != "Jon" || got.Address != "Haifa" || got.ID != created.ID {
+        t.Fatalf("Expected the replaced contact, got %d %+v", rec.Code, got)
+    }
+
+    rec = doRequest(router, "PATCH", location, `{"address":"Eilat"}`)
+    json.NewDecoder(rec.Body).Decode(&got)
+    if rec.Code != http.StatusOK || got.FirstName != "Jon" || got.Address != "Eilat" {
+        t.Fatalf("Expected only the address to change, got %d %+v", rec.Code, got)
+    }
+
+    rec = doRequest(router, "GET", "/api/v1/contacts", "")
+    var list struct {
+        Contacts []src.Contact `json:"contacts"`
+    }
+    json.NewDecoder(rec.Body).Decode(&list)
+    if rec.Code != http.StatusOK || len(list.Contacts) != 1 || !reflect.DeepEqual(list.Contacts[0], got) {
+        t.Fatalf("Expected the list to hold the patched contact, got %d %+v", rec.Code, list.Contacts)
+    }
+
+    rec = doRequest(router, "DELETE", location, "")
+    if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+        t.Fatalf("Expected status 204 with no body, got %d %q", rec.Code, rec.Body.String())
+    }
+    if rec = doRequest(router, "GET", location, ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected the deleted contact to be gone, got %d", rec.Code)
+    }
+}
+
+// Test the error responses of the v1 routes
+func testAPIStatusCodes(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+    id, _ := store.AddContact(src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "052-123-4567", Address: "Haifa"})
+    path := fmt.Sprintf("/api/v1/contacts/%d", id)
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        body   string
+        status int
+        code   string
+    }{
+        {"create with empty fields", "POST", "/api/v1/contacts", `{"first_name":"Dana"}`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"create with invalid phone", "POST", "/api/v1/contacts", `{"first_name":"A","last_name":"B","phone_number":"12ab","address":"C"}`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"get unknown id", "GET", "/api/v1/contacts/999", "", http.StatusNotFound, src.CodeNotFound},
+        {"get non-numeric id", "GET", "/api/v1/contacts/abc", "", http.StatusNotFound, src.CodeNotFound},
+        {"replace unknown id", "PUT", "/api/v1/contacts/999", `{"first_name":"A","last_name":"B","phone_number":"0501234567","address":"C"}`, http.StatusNotFound, src.CodeNotFound},
+        {"replace malformed body", "PUT", path, `nope`, http.StatusBadRequest, src.CodeBadRequest},
+        {"patch blanking a field", "PATCH", path, `{"last_name":""}`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"delete unknown id", "DELETE", "/api/v1/contacts/999", "", http.StatusNotFound, src.CodeNotFound},
+        {"wrong method", "POST", path, "", http.StatusMethodNotAllowed, src.CodeMethodNotAllowed},
+        {"bad cursor", "GET", "/api/v1/contacts?after=not-a-cursor", "", http.StatusBadRequest, src.CodeBadRequest},
+    }
+
+    for _, tt := range tests {
+        rec := doRequest(router, tt.method, tt.path, tt.body)
+        if rec.Code != tt.status {
+            t.Fatalf("%s: expected status %d, got %d (%s)", tt.name, tt.status, rec.Code, rec.Body.String())
+        }
+        if envelope := decodeError(t, rec); envelope.Code != tt.code {
+            t.Fatalf("%s: expected error code %q, got %q", tt.name, tt.code, envelope.Code)
+        }
+    }
+}
+
+// Test that contacts sharing a number are addressed separately by id, while the
+// legacy routes still act on every contact with the number
+func testAPIDuplicateNumbers(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+    var ids []int
+    for _, name := range []string{"Jonathan", "Yael", "Avi"} {
+        id, _ := store.AddContact(src.Contact{FirstName: name, LastName: "Makovsky", PhoneNumber: "0543435590", Address: "Tel Aviv"})
+        ids = append(ids, id)
+    }
+
+    rec := doRequest(router, "DELETE", fmt.Sprintf("/api/v1/contacts/%d", ids[1]), "")
+    if rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected status 204, got %d", rec.Code)
+    }
+    if contacts, _ := store.SearchContact("0543435590"); len(contacts) != 2 {
+        t.Fatalf("Expected only one of the shared numbers to be deleted, got %+v", contacts)
+    }
+
+    rec = doRequest(router, "PUT", "/editContact/0543435590", `{"first_name":"Same","last_name":"Name","phone_number":"0543435590","address":"Haifa"}`)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d", rec.Code)
+    }
+    var response struct {
+        Message string `json:"message"`
+    }
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Message != "2 contact(s) were updated successfully" {
+        t.Fatalf("Expected both remaining contacts to be updated, got %q", response.Message)
+    }
+
+    rec = doRequest(router, "DELETE", "/deleteContact/054-343-5590", "")
+    json.NewDecoder(rec.Body).Decode(&response)
+    if rec.Code != http.StatusOK || response.Message != "2 contact(s) were deleted" {
+        t.Fatalf("Expected the legacy route to delete both contacts, got %d %q", rec.Code, response.Message)
+    }
+}
+
+// doConditional sends a request with a single precondition header such as If-Match
+func doConditional(handler http.Handler, method, path, header, tag, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set(header, tag)
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// Test ETags, If-None-Match on reads and If-Match on writes
+func testAPIConditionalRequests(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+    id, _ := store.AddContact(src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "052-123-4567", Address: "Haifa"})
+    path := fmt.Sprintf("/api/v1/contacts/%d", id)
+
+    rec := doRequest(router, "GET", path, "")
+    etag := rec.Header().Get("ETag")
+    if etag == "" {
+        t.Fatalf("Expected an ETag on a single contact read")
+    }
+
+    // Polling with the current tag is answered without a body
+    rec = doConditional(router, "GET", path, "If-None-Match", etag, "")
+    if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+        t.Fatalf("Expected 304 with the ETag and no body, got %d %q", rec.Code, rec.Body.String())
+    }
+    if rec = doConditional(router, "GET", path, "If-None-Match", "W/"+etag, ""); rec.Code != http.StatusNotModified {
+        t.Fatalf("Expected a weak tag to match for If-None-Match, got %d", rec.Code)
+    }
+
+    // The first writer wins, the second one read an old version
+    rec = doConditional(router, "PATCH", path, "If-Match", etag, `{"address":"Eilat"}`)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    newTag := rec.Header().Get("ETag")
+    if newTag == "" || newTag == etag {
+        t.Fatalf("Expected the update to return a new ETag, got %q", newTag)
+    }
+    rec = doConditional(router, "PUT", path, "If-Match", etag, `{"first_name":"Dana","last_name":"Cohen","phone_number":"0521234567","address":"Acre"}`)
+    if rec.Code != http.StatusPreconditionFailed || decodeError(t, rec).Code != src.CodePrecondition {
+        t.Fatalf("Expected 412 for a stale If-Match, got %d", rec.Code)
+    }
+    if rec = doConditional(router, "DELETE", path, "If-Match", etag, ""); rec.Code != http.StatusPreconditionFailed {
+        t.Fatalf("Expected 412 for a stale delete, got %d", rec.Code)
+    }
+    if rec = doConditional(router, "GET", path, "If-None-Match", etag, ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected the old tag to no longer match, got %d", rec.Code)
+    }
+    if got, _ := store.GetContact(id); got.Address != "Eilat" {
+        t.Fatalf("Expected the stale writes to be refused, got %+v", got)
+    }
+
+    // Any tag of a list may match, weak tags never match If-Match
+    if rec = doConditional(router, "PATCH", path, "If-Match", `"v99", `+newTag, `{"address":"Acre"}`); rec.Code != http.StatusOK {
+        t.Fatalf("Expected a list containing the current tag to match, got %d", rec.Code)
+    }
+    newTag = rec.Header().Get("ETag")
+    if rec = doConditional(router, "DELETE", path, "If-Match", "W/"+newTag, ""); rec.Code != http.StatusPreconditionFailed {
+        t.Fatalf("Expected a weak tag not to match If-Match, got %d", rec.Code)
+    }
+    if rec = doConditional(router, "DELETE", "/api/v1/contacts/999", "If-Match", newTag, ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 for a missing contact, got %d", rec.Code)
+    }
+    if rec = doConditional(router, "DELETE", path, "If-Match", newTag, ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected the current tag to allow the delete, got %d", rec.Code)
+    }
+}
+
+// Test nested phones, emails and addresses in request and response bodies
+func testAPIContactDetails(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+
+    rec := doRequest(router, "POST", "/api/v1/contacts", `{"first_name":"Dana","last_name":"Cohen",
+        "phones":[{"type":"mobile","number":"052-123-4567"},{"type":"fax","number":"03-6123456"}],
+        "emails":[{"type":"work","address":"dana@example.com"}],
+        "addresses":[{"address":"Haifa"}]}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected status 201, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    if created.PhoneNumber != "052-123-4567" || created.Address != "Haifa" || len(created.Phones) != 2 || created.Phones[1].E164 != "+97236123456" {
+        t.Fatalf("Expected the lists to be stored and mirrored, got %+v", created)
+    }
+    location := rec.Header().Get("Location")
+
+    // The legacy routes find the contact by its fax number too
+    rec = doRequest(router, "GET", "/searchContact/03-6123456", "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected the secondary number to be searchable, got %d", rec.Code)
+    }
+
+    rec = doPatch(router, location, "application/merge-patch+json", `{"emails":null,"phones":[{"number":"0501234567"}]}`)
+    var patched src.Contact
+    json.NewDecoder(rec.Body).Decode(&patched)
+    if rec.Code != http.StatusOK || len(patched.Emails) != 0 || len(patched.Phones) != 1 || patched.PhoneE164 != "+972501234567" {
+        t.Fatalf("Expected the emails to be cleared and the phones replaced, got %d %+v", rec.Code, patched)
+    }
+
+    rec = doPatch(router, location, "application/merge-patch+json", `{"phones":null,"addresses":"Haifa"}`)
+    if rec.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("Expected status 422, got %d", rec.Code)
+    }
+    if details := decodeError(t, rec).Details; len(details) != 2 || details[0].Field != "addresses" || details[1].Field != "phones" {
+        t.Fatalf("Expected both lists to be rejected, got %+v", details)
+    }
+
+    rec = doRequest(router, "DELETE", "/deleteContact/0501234567", "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected the legacy delete to find the new number, got %d", rec.Code)
+    }
+}
@@ -0,0 +1,213 @@
+package tests
+
+import (
+    "database/sql"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "Rise/src"
+)
+
+// Test function to run all audit log tests
+func TestAudit(t *testing.T) {
+    t.Run("Test Audit Trail", func(t *testing.T) { forEachStore(t, testAuditTrail) })
+    t.Run("Test Audit Filters", func(t *testing.T) { forEachStore(t, testAuditFilters) })
+    t.Run("Test Audit Permissions and Tenants", testAuditPermissions)
+    t.Run("Test Audit Log is Append-Only", testAuditAppendOnly)
+}
+
+// auditPage is the body of GET /audit
+type auditPage struct {
+    Entries    []src.AuditEntry `json:"entries"`
+    NextCursor string           `json:"next_cursor"`
+}
+
+// doAudited sends a request with an API key and a request id
+func doAudited(handler http.Handler, key, requestID, method, path, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, strings.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-API-Key", key)
+    req.Header.Set("X-Request-ID", requestID)
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// readAudit fetches GET /audit with the query and fails the test unless it answers 200
+func readAudit(t *testing.T, handler http.Handler, key, query string) auditPage {
+    rec := doAudited(handler, key, "audit-read", "GET", "/audit?"+query, "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 reading the audit log with %q, got %d: %s", query, rec.Code, rec.Body.String())
+    }
+    var page auditPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page
+}
+
+// Test that creating, editing and deleting a contact leave who, what and when in the log
+func testAuditTrail(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, src.NewAuthenticator(store.(src.APIKeyStore), nil, nil, "bootstrap-key"))
+
+    rec := doAudited(router, "bootstrap-key", "req-create", "POST", "/api/v1/contacts",
+        `{"first_name":"Dana","last_name":"Cohen","phone_number":"052-123-4567","address":"Haifa","emails":[{"address":"dana@example.com"}]}`)
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating the contact, got %d", rec.Code)
+    }
+    path := "/api/v1/contacts/" + strconv.Itoa(created.ID)
+    if rec := doAudited(router, "bootstrap-key", "req-edit", "PATCH", path, `{"address":"Tel Aviv"}`); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 patching the contact, got %d", rec.Code)
+    }
+    if rec := doAudited(router, "bootstrap-key", "req-delete", "DELETE", "/deleteContact/0521234567", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 deleting the contact, got %d", rec.Code)
+    }
+
+    // Reads are not audited, failed writes neither
+    doAudited(router, "bootstrap-key", "req-read", "GET", path, "")
+    doAudited(router, "bootstrap-key", "req-missing", "DELETE", path, "")
+
+    page := readAudit(t, router, "bootstrap-key", "")
+    if len(page.Entries) != 3 {
+        t.Fatalf("Expected three entries, got %+v", page.Entries)
+    }
+    deleted, edited, added := page.Entries[0], page.Entries[1], page.Entries[2]
+    for i, want := range []struct {
+        entry     src.AuditEntry
+        action    string
+        requestID string
+    }{{deleted, src.AuditDelete, "req-delete"}, {edited, src.AuditUpdate, "req-edit"}, {added, src.AuditCreate, "req-create"}} {
+        entry := want.entry
+        if entry.Action != want.action || entry.RequestID != want.requestID || entry.Actor != "api_key:admin" || entry.ContactID != created.ID {
+            t.Fatalf("Entry %d: expected %s by api_key:admin in %s, got %+v", i, want.action, want.requestID, entry)
+        }
+        if time.Since(entry.CreatedAt) > time.Minute {
+            t.Fatalf("Entry %d: expected a recent timestamp, got %v", i, entry.CreatedAt)
+        }
+    }
+
+    if added.Before != nil || added.After == nil || added.After.Address != "Haifa" || added.After.Version != 1 || len(added.After.Emails) != 1 {
+        t.Fatalf("Expected the created contact with its email as the after snapshot, got %+v", added)
+    }
+    if edited.Before == nil || edited.Before.Address != "Haifa" || edited.After == nil || edited.After.Address != "Tel Aviv" || edited.After.Version != 2 {
+        t.Fatalf("Expected the address change between the snapshots, got %+v", edited)
+    }
+    if edited.After.Emails[0].Address != "dana@example.com" || edited.After.Addresses[0].Address != "Tel Aviv" {
+        t.Fatalf("Expected the after snapshot to carry the details, got %+v", edited.After)
+    }
+    if deleted.After != nil || deleted.Before == nil || deleted.Before.Version != 2 || deleted.Before.Address != "Tel Aviv" {
+        t.Fatalf("Expected the deleted contact as the before snapshot, got %+v", deleted)
+    }
+}
+
+// Test filtering by contact, actor and time, and paging through the log
+func testAuditFilters(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    var ids []int
+    for _, number := range []string{"0521111111", "0522222222", "0523333333"} {
+        rec := doAudited(router, "", "req-"+number, "POST", "/api/v1/contacts",
+            `{"first_name":"A","last_name":"B","phone_number":"`+number+`","address":"C"}`)
+        var created src.Contact
+        json.NewDecoder(rec.Body).Decode(&created)
+        ids = append(ids, created.ID)
+    }
+    if rec := doAudited(router, "", "req-edit", "PATCH", "/api/v1/contacts/"+strconv.Itoa(ids[0]), `{"last_name":"D"}`); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 patching the contact, got %d", rec.Code)
+    }
+
+    page := readAudit(t, router, "", "contact_id="+strconv.Itoa(ids[0]))
+    if len(page.Entries) != 2 || page.Entries[0].Action != src.AuditUpdate || page.Entries[1].Action != src.AuditCreate {
+        t.Fatalf("Expected the update and the creation of the first contact, got %+v", page.Entries)
+    }
+    if page := readAudit(t, router, "", "actor=anonymous"); len(page.Entries) != 4 {
+        t.Fatalf("Expected every entry by the anonymous actor, got %d", len(page.Entries))
+    }
+    if page := readAudit(t, router, "", "actor=api_key:1"); len(page.Entries) != 0 {
+        t.Fatalf("Expected no entry by another actor, got %d", len(page.Entries))
+    }
+
+    hourAgo := url.QueryEscape(time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+    inAnHour := url.QueryEscape(time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+    if page := readAudit(t, router, "", "since="+hourAgo+"&until="+inAnHour); len(page.Entries) != 4 {
+        t.Fatalf("Expected every entry within the last hour, got %d", len(page.Entries))
+    }
+    if page := readAudit(t, router, "", "since="+inAnHour); len(page.Entries) != 0 {
+        t.Fatalf("Expected no entry in the future, got %d", len(page.Entries))
+    }
+    if page := readAudit(t, router, "", "until="+hourAgo); len(page.Entries) != 0 {
+        t.Fatalf("Expected no entry older than an hour, got %d", len(page.Entries))
+    }
+
+    // Pages of three then one, newest first
+    first := readAudit(t, router, "", "limit=3")
+    if len(first.Entries) != 3 || first.NextCursor == "" {
+        t.Fatalf("Expected a full first page with a cursor, got %+v", first)
+    }
+    second := readAudit(t, router, "", "limit=3&before="+first.NextCursor)
+    if len(second.Entries) != 1 || second.NextCursor != "" || second.Entries[0].ContactID != ids[0] || second.Entries[0].Action != src.AuditCreate {
+        t.Fatalf("Expected the oldest entry on the last page, got %+v", second)
+    }
+
+    for _, query := range []string{"contact_id=abc", "since=yesterday", "until=2024-13-01T00:00:00Z", "before=not-a-cursor", "limit=0"} {
+        if rec := doAudited(router, "", "req-bad", "GET", "/audit?"+query, ""); rec.Code != http.StatusBadRequest {
+            t.Fatalf("Expected 400 for %q, got %d", query, rec.Code)
+        }
+    }
+}
+
+// Test that only callers with audit:read see the log, and only the entries of their tenant
+func testAuditPermissions(t *testing.T) {
+    router, keys := newAuthRouter(t, nil, src.RoleEditor)
+    if rec := doAudited(router, keys[src.RoleEditor], "req-1", "POST", "/api/v1/contacts",
+        `{"first_name":"A","last_name":"B","phone_number":"0521111111","address":"C"}`); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected the editor to create a contact, got %d", rec.Code)
+    }
+
+    rec := doAudited(router, keys[src.RoleEditor], "req-2", "GET", "/audit", "")
+    if rec.Code != http.StatusForbidden || !strings.Contains(decodeError(t, rec).Message, src.PermissionReadAudit) {
+        t.Fatalf("Expected 403 naming %s for an editor, got %d", src.PermissionReadAudit, rec.Code)
+    }
+    page := readAudit(t, router, "bootstrap-key", "")
+    if len(page.Entries) != 1 || !strings.HasPrefix(page.Entries[0].Actor, "api_key:") || page.Entries[0].Actor == "api_key:admin" {
+        t.Fatalf("Expected the editor's key as the actor, got %+v", page.Entries)
+    }
+
+    createTenant(t, router, "bootstrap-key", "acme")
+    rec = doTenantRequest(router, "acme", "bootstrap-key", "GET", "/api/v1/audit", "")
+    var other auditPage
+    json.NewDecoder(rec.Body).Decode(&other)
+    if rec.Code != http.StatusOK || len(other.Entries) != 0 {
+        t.Fatalf("Expected another tenant to see none of the entries, got %d %+v", rec.Code, other.Entries)
+    }
+}
+
+// Test that stored entries cannot be changed
+func testAuditAppendOnly(t *testing.T) {
+    db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "phonebook.db"))
+    if err != nil {
+        t.Fatalf("Failed to open sqlite database: %v", err)
+    }
+    defer db.Close()
+    store, err := src.NewSQLiteStore(db, "IL")
+    if err != nil {
+        t.Fatalf("Failed to create sqlite store: %v", err)
+    }
+    if _, err := store.AddContact(src.Contact{FirstName: "A", LastName: "B", PhoneNumber: "0521111111", Address: "C"}); err != nil {
+        t.Fatalf("Failed to add a contact: %v", err)
+    }
+
+    if _, err := db.Exec("UPDATE audit_log SET actor = 'someone else'"); err == nil || !strings.Contains(err.Error(), "append-only") {
+        t.Fatalf("Expected the update to be refused, got %v", err)
+    }
+    entries, _, err := store.AuditLog(src.AuditFilter{Limit: 10})
+    if err != nil || len(entries) != 1 || entries[0].Actor != "system" {
+        t.Fatalf("Expected the entry to be kept as written by the system, got %+v (err=%v)", entries, err)
+    }
+}
@@ -0,0 +1,384 @@
+package tests
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "Rise/src"
+    "Rise/src/auth"
+)
+
+// Test function to run all authentication tests
+func TestAuth(t *testing.T) {
+    t.Run("Test HS256 and RS256 Tokens", testAuthTokens)
+    t.Run("Test JSON Web Key Set", testAuthJWKS)
+    t.Run("Test Missing and Rejected Credentials", testAuthMiddleware)
+    t.Run("Test API Key Lifecycle", func(t *testing.T) { forEachStore(t, testAuthAPIKeys) })
+    t.Run("Test Route Permissions", testAuthRoutePermissions)
+    t.Run("Test Custom Roles", testAuthCustomRoles)
+}
+
+// signToken builds a compact JWT. key is a []byte secret for HS256 or an *rsa.PrivateKey for RS256.
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+    header := map[string]string{"alg": alg, "typ": "JWT"}
+    if kid != "" {
+        header["kid"] = kid
+    }
+    encode := func(v interface{}) string {
+        data, _ := json.Marshal(v)
+        return base64.RawURLEncoding.EncodeToString(data)
+    }
+    signed := encode(header) + "." + encode(claims)
+
+    var signature []byte
+    switch k := key.(type) {
+    case []byte:
+        mac := hmac.New(sha256.New, k)
+        mac.Write([]byte(signed))
+        signature = mac.Sum(nil)
+    case *rsa.PrivateKey:
+        digest := sha256.Sum256([]byte(signed))
+        var err error
+        if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+            t.Fatalf("Failed to sign token: %v", err)
+        }
+    }
+    return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Test verifying tokens, their time claims and the algorithm each key accepts
+func testAuthTokens(t *testing.T) {
+    secret := []byte("a-shared-secret-of-enough-length")
+    private, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("Failed to generate RSA key: %v", err)
+    }
+    now := time.Now()
+    validator := &auth.Validator{
+        Keys:     []auth.Key{auth.NewHMACKey("hmac-1", secret), auth.NewRSAKey("rsa-1", &private.PublicKey)},
+        Issuer:   "https://issuer.example",
+        Audience: "phonebook",
+        Leeway:   time.Minute,
+    }
+    claims := func(extra map[string]interface{}) map[string]interface{} {
+        c := map[string]interface{}{"sub": "user-1", "iss": "https://issuer.example", "aud": []string{"phonebook"}, "exp": now.Add(time.Hour).Unix()}
+        for k, v := range extra {
+            c[k] = v
+        }
+        return c
+    }
+
+    tests := []struct {
+        name  string
+        token string
+        err   error
+    }{
+        {"HS256", signToken(t, auth.HS256, "hmac-1", secret, claims(nil)), nil},
+        {"RS256", signToken(t, auth.RS256, "rsa-1", private, claims(nil)), nil},
+        {"expired within leeway", signToken(t, auth.HS256, "", secret, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), nil},
+        {"expired", signToken(t, auth.HS256, "", secret, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})), auth.ErrExpired},
+        {"no expiry", signToken(t, auth.HS256, "", secret, claims(map[string]interface{}{"exp": nil})), auth.ErrNoExpiry},
+        {"not yet valid", signToken(t, auth.HS256, "", secret, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})), auth.ErrNotYetValid},
+        {"wrong secret", signToken(t, auth.HS256, "hmac-1", []byte("another secret"), claims(nil)), auth.ErrBadSignature},
+        {"unknown kid", signToken(t, auth.RS256, "rsa-2", private, claims(nil)), auth.ErrUnknownKey},
+        {"unsupported alg", signToken(t, "none", "", secret, claims(nil)), auth.ErrUnknownKey},
+        {"wrong issuer", signToken(t, auth.HS256, "", secret, claims(map[string]interface{}{"iss": "https://other.example"})), auth.ErrClaims},
+        {"wrong audience", signToken(t, auth.HS256, "", secret, claims(map[string]interface{}{"aud": "billing"})), auth.ErrClaims},
+        {"malformed", "not-a-token", auth.ErrMalformedToken},
+    }
+    for _, tt := range tests {
+        verified, err := validator.Verify(tt.token, now)
+        if !errors.Is(err, tt.err) {
+            t.Fatalf("%s: expected error %v, got %v", tt.name, tt.err, err)
+        }
+        if err == nil && verified.Subject != "user-1" {
+            t.Fatalf("%s: expected subject user-1, got %q", tt.name, verified.Subject)
+        }
+    }
+
+    // An RS256 key is never used as an HMAC secret, even when the token asks for HS256
+    rsaOnly := &auth.Validator{Keys: []auth.Key{auth.NewRSAKey("", &private.PublicKey)}}
+    if _, err := rsaOnly.Verify(signToken(t, auth.HS256, "", private.PublicKey.N.Bytes(), claims(nil)), now); !errors.Is(err, auth.ErrUnknownKey) {
+        t.Fatalf("Expected an HS256 token to be refused by an RS256 key, got %v", err)
+    }
+}
+
+// Test reading HS256 and RS256 keys from a JSON Web Key Set
+func testAuthJWKS(t *testing.T) {
+    private, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatalf("Failed to generate RSA key: %v", err)
+    }
+    secret := []byte("jwks-shared-secret")
+    set, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+        {"kty": "oct", "kid": "hmac", "k": base64.RawURLEncoding.EncodeToString(secret)},
+        {"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig",
+            "n": base64.RawURLEncoding.EncodeToString(private.PublicKey.N.Bytes()),
+            "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.PublicKey.E)).Bytes())},
+        {"kty": "EC", "kid": "skipped", "crv": "P-256"},
+    }})
+
+    keys, err := auth.ParseJWKS(set)
+    if err != nil || len(keys) != 2 {
+        t.Fatalf("Expected two keys, got %d (err=%v)", len(keys), err)
+    }
+    validator := &auth.Validator{Keys: keys}
+    for _, token := range []string{
+        signToken(t, auth.HS256, "hmac", secret, map[string]interface{}{"sub": "a", "exp": time.Now().Add(time.Hour).Unix()}),
+        signToken(t, auth.RS256, "rsa", private, map[string]interface{}{"sub": "a", "exp": time.Now().Add(time.Hour).Unix()}),
+    } {
+        if _, err := validator.Verify(token, time.Now()); err != nil {
+            t.Fatalf("Expected the token to verify with the key set, got %v", err)
+        }
+    }
+
+    if _, err := auth.ParseJWKS([]byte(`{"keys":[{"kty":"RSA","n":"","e":"AQAB"}]}`)); err == nil {
+        t.Fatalf("Expected an RSA key without a modulus to be refused")
+    }
+}
+
+// Test that requests without accepted credentials get 401, and that the principal reaches handlers
+func testAuthMiddleware(t *testing.T) {
+    secret := []byte("middleware-secret")
+    validator := &auth.Validator{Keys: []auth.Key{auth.NewHMACKey("", secret)}}
+    authenticator := src.NewAuthenticator(src.NewMemoryStore("IL"), validator, nil, "bootstrap-key")
+
+    var seen src.Principal
+    handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        seen, _ = src.PrincipalFromContext(r.Context())
+        w.WriteHeader(http.StatusOK)
+    }))
+    call := func(header, value string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("GET", "/api/v1/contacts", nil)
+        if header != "" {
+            req.Header.Set(header, value)
+        }
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, req)
+        return rec
+    }
+
+    rejected := []struct {
+        name          string
+        header, value string
+    }{
+        {"no credentials", "", ""},
+        {"unknown API key", "X-API-Key", "rk_unknown"},
+        {"bad token", "Authorization", "Bearer " + signToken(t, auth.HS256, "", []byte("wrong"), map[string]interface{}{"sub": "a"})},
+        {"token without subject", "Authorization", "Bearer " + signToken(t, auth.HS256, "", secret, map[string]interface{}{"roles": "admin", "exp": time.Now().Add(time.Hour).Unix()})},
+        {"token without expiry", "Authorization", "Bearer " + signToken(t, auth.HS256, "", secret, map[string]interface{}{"sub": "a"})},
+    }
+    for _, tt := range rejected {
+        rec := call(tt.header, tt.value)
+        if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+            t.Fatalf("%s: expected 401 with WWW-Authenticate, got %d", tt.name, rec.Code)
+        }
+        if envelope := decodeError(t, rec); envelope.Code != src.CodeUnauthorized {
+            t.Fatalf("%s: expected code %q, got %q", tt.name, src.CodeUnauthorized, envelope.Code)
+        }
+    }
+
+    if rec := call("X-API-Key", "bootstrap-key"); rec.Code != http.StatusOK || seen.Method != src.AuthAPIKey || !seen.Can(src.PermissionManageKeys) {
+        t.Fatalf("Expected the bootstrap key to authenticate as an admin, got %d %+v", rec.Code, seen)
+    }
+    token := signToken(t, auth.HS256, "", secret, map[string]interface{}{"sub": "user-7", "roles": []string{"viewer"}, "exp": time.Now().Add(time.Hour).Unix()})
+    if rec := call("Authorization", "Bearer "+token); rec.Code != http.StatusOK || seen.Subject != "user-7" || seen.Method != src.AuthJWT ||
+        !seen.Can(src.PermissionRead) || seen.Can(src.PermissionWrite) {
+        t.Fatalf("Expected the token to authenticate user-7 as a viewer, got %d %+v", rec.Code, seen)
+    }
+}
+
+// Test creating, using, listing and revoking API keys through the admin endpoints
+func testAuthAPIKeys(t *testing.T, store src.ContactStore) {
+    authenticator := src.NewAuthenticator(store.(src.APIKeyStore), nil, nil, "bootstrap-key")
+    router := src.NewRouter(store, authenticator)
+    call := func(key, method, path, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer "+key)
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, req)
+        return rec
+    }
+
+    rec := call("bootstrap-key", "POST", "/api/v1/admin/api-keys", `{"name": "frontend"}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating an API key, got %d: %s", rec.Code, rec.Body.String())
+    }
+    var created struct {
+        src.APIKey
+        Key string `json:"key"`
+    }
+    json.NewDecoder(rec.Body).Decode(&created)
+    if created.ID == 0 || created.Key == "" || created.Role != src.RoleViewer || created.Key[:len(created.Prefix)] != created.Prefix {
+        t.Fatalf("Expected a new viewer key with its prefix, got %+v", created)
+    }
+
+    // The new key reads contacts but cannot manage keys
+    if rec := call(created.Key, "GET", "/api/v1/contacts", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected the new key to be accepted, got %d", rec.Code)
+    }
+    rec = call(created.Key, "GET", "/api/v1/admin/api-keys", "")
+    if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != src.CodeForbidden {
+        t.Fatalf("Expected 403 for a non-admin key on the admin routes, got %d", rec.Code)
+    }
+
+    rec = call("bootstrap-key", "GET", "/api/v1/admin/api-keys", "")
+    var list struct {
+        APIKeys []src.APIKey `json:"api_keys"`
+    }
+    json.NewDecoder(rec.Body).Decode(&list)
+    if rec.Code != http.StatusOK || len(list.APIKeys) != 1 || list.APIKeys[0].Name != "frontend" {
+        t.Fatalf("Expected the created key to be listed, got %d %+v", rec.Code, list)
+    }
+
+    if rec := call("bootstrap-key", "POST", "/api/v1/admin/api-keys", `{"name": " ", "role": "owner"}`); rec.Code != http.StatusUnprocessableEntity ||
+        len(decodeError(t, rec).Details) != 2 {
+        t.Fatalf("Expected 422 for a key without a name and with an unknown role, got %d", rec.Code)
+    }
+
+    revoke := "/api/v1/admin/api-keys/" + strconv.Itoa(created.ID)
+    if rec := call("bootstrap-key", "DELETE", revoke, ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 revoking the key, got %d", rec.Code)
+    }
+    if rec := call("bootstrap-key", "DELETE", revoke, ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 revoking the key twice, got %d", rec.Code)
+    }
+    if rec := call(created.Key, "GET", "/api/v1/contacts", ""); rec.Code != http.StatusUnauthorized {
+        t.Fatalf("Expected the revoked key to be refused, got %d", rec.Code)
+    }
+}
+
+// newAuthRouter returns a router whose API keys are created for the given roles, keyed by role
+func newAuthRouter(t *testing.T, roles src.Roles, keyRoles ...string) (http.Handler, map[string]string) {
+    store := src.NewMemoryStore("IL")
+    authenticator := src.NewAuthenticator(store, nil, roles, "bootstrap-key")
+    router := src.NewRouter(store, authenticator)
+    keys := map[string]string{}
+    for _, role := range keyRoles {
+        req := httptest.NewRequest("POST", "/api/v1/admin/api-keys", strings.NewReader(`{"name": "`+role+`", "role": "`+role+`"}`))
+        req.Header.Set("X-API-Key", "bootstrap-key")
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, req)
+        var created struct {
+            Key string `json:"key"`
+        }
+        if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated {
+            t.Fatalf("Failed to create a %s key: %d", role, rec.Code)
+        }
+        keys[role] = created.Key
+    }
+    return router, keys
+}
+
+// Test that each route requires its permission and that 403 names the missing one
+func testAuthRoutePermissions(t *testing.T) {
+    router, keys := newAuthRouter(t, nil, src.RoleViewer, src.RoleEditor)
+    call := func(key, method, path, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("X-API-Key", key)
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, req)
+        return rec
+    }
+
+    contact := `{"first_name": "Dana", "last_name": "Cohen", "phone_number": "0521234567", "address": "Haifa"}`
+    if rec := call(keys[src.RoleEditor], "POST", "/api/v1/contacts", contact); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected an editor to create a contact, got %d", rec.Code)
+    }
+
+    tests := []struct {
+        method, path, body string
+        permission         string
+    }{
+        {"POST", "/addContact", contact, src.PermissionWrite},
+        {"PUT", "/editContact/0521234567", contact, src.PermissionWrite},
+        {"PATCH", "/api/v1/contacts/1", `{"address": "Tel Aviv"}`, src.PermissionWrite},
+        {"DELETE", "/deleteContact/0521234567", "", src.PermissionDelete},
+        {"DELETE", "/api/v1/contacts/1", "", src.PermissionDelete},
+        {"POST", "/contacts/import.csv", "first_name\n", src.PermissionWrite},
+        {"GET", "/api/v1/admin/api-keys", "", src.PermissionManageKeys},
+    }
+    for _, tt := range tests {
+        rec := call(keys[src.RoleViewer], tt.method, tt.path, tt.body)
+        if rec.Code != http.StatusForbidden {
+            t.Fatalf("%s %s: expected 403 for a viewer, got %d", tt.method, tt.path, rec.Code)
+        }
+        envelope := decodeError(t, rec)
+        if envelope.Code != src.CodeForbidden || !strings.Contains(envelope.Message, tt.permission) ||
+            len(envelope.Details) != 1 || envelope.Details[0].Field != "permission" {
+            t.Fatalf("%s %s: expected the error to name %s, got %+v", tt.method, tt.path, tt.permission, envelope)
+        }
+    }
+
+    for _, path := range []string{"/getContacts", "/searchContact/0521234567", "/api/v1/contacts/1", "/contacts/search?q=dana", "/contacts/export.csv"} {
+        if rec := call(keys[src.RoleViewer], "GET", path, ""); rec.Code != http.StatusOK {
+            t.Fatalf("GET %s: expected a viewer to read, got %d", path, rec.Code)
+        }
+    }
+    if rec := call(keys[src.RoleEditor], "DELETE", "/api/v1/contacts/1", ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected an editor to delete a contact, got %d", rec.Code)
+    }
+    if rec := call(keys[src.RoleEditor], "GET", "/api/v1/admin/roles", ""); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected an editor to be refused the roles, got %d", rec.Code)
+    }
+}
+
+// Test custom roles from configuration, and that keys cannot be given more than their creator has
+func testAuthCustomRoles(t *testing.T) {
+    for _, bad := range []string{`{"viewer": ["contacts:read"]}`, `{"support": ["contacts:fly"]}`, `[]`} {
+        if _, err := src.ParseRoles([]byte(bad)); err == nil {
+            t.Fatalf("Expected roles %s to be refused", bad)
+        }
+    }
+    roles, err := src.ParseRoles([]byte(`{"support": ["contacts:read", "contacts:write"], "keymaster": ["api_keys:manage"]}`))
+    if err != nil || len(roles) != 5 {
+        t.Fatalf("Expected the custom roles next to the built-in ones, got %v (err=%v)", roles.Names(), err)
+    }
+
+    router, keys := newAuthRouter(t, roles, "support", "keymaster")
+    call := func(key, method, path, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("X-API-Key", key)
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, req)
+        return rec
+    }
+
+    if rec := call(keys["support"], "POST", "/addContact", `{"first_name": "Dana", "last_name": "Cohen", "phone_number": "0521234567", "address": "Haifa"}`); rec.Code != http.StatusOK {
+        t.Fatalf("Expected the support role to add a contact, got %d", rec.Code)
+    }
+    if rec := call(keys["support"], "DELETE", "/deleteContact/0521234567", ""); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected the support role to be refused deletes, got %d", rec.Code)
+    }
+
+    // A key manager without contact permissions cannot hand them out
+    rec := call(keys["keymaster"], "POST", "/api/v1/admin/api-keys", `{"name": "escalate", "role": "editor"}`)
+    if rec.Code != http.StatusForbidden || !strings.Contains(decodeError(t, rec).Message, src.PermissionRead) {
+        t.Fatalf("Expected 403 granting a role with more permissions, got %d", rec.Code)
+    }
+    if rec := call(keys["keymaster"], "POST", "/api/v1/admin/api-keys", `{"name": "another", "role": "keymaster"}`); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected a key manager to create a key of its own role, got %d", rec.Code)
+    }
+    rec = call(keys["keymaster"], "GET", "/api/v1/admin/roles", "")
+    var listed struct {
+        Roles src.Roles `json:"roles"`
+    }
+    json.NewDecoder(rec.Body).Decode(&listed)
+    if rec.Code != http.StatusOK || len(listed.Roles["support"]) != 2 {
+        t.Fatalf("Expected the roles to be listed, got %d %+v", rec.Code, listed)
+    }
+}
@@ -0,0 +1,170 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all batch tests
+func TestBatch(t *testing.T) {
+    t.Run("Test All or Nothing", func(t *testing.T) { forEachStore(t, testBatchAllOrNothing) })
+    t.Run("Test Best Effort", func(t *testing.T) { forEachStore(t, testBatchBestEffort) })
+    t.Run("Test Batch Permissions", testBatchPermissions)
+}
+
+// batchPage is the body of a successful POST /contacts:batch
+type batchPage struct {
+    Mode      string            `json:"mode"`
+    Succeeded int               `json:"succeeded"`
+    Failed    int               `json:"failed"`
+    Results   []src.BatchResult `json:"results"`
+}
+
+// runBatch posts the batch and decodes the results of a 200 answer
+func runBatch(t *testing.T, handler http.Handler, body string) batchPage {
+    rec := doRequest(handler, "POST", "/api/v1/contacts:batch", body)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 running the batch, got %d: %s", rec.Code, rec.Body.String())
+    }
+    var page batchPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page
+}
+
+// countContacts returns how many contacts the store lists
+func countContacts(t *testing.T, store src.ContactStore) int {
+    contacts, _, err := store.GetContacts(100, 0, 0)
+    if err != nil {
+        t.Fatalf("Failed to list contacts: %v", err)
+    }
+    return len(contacts)
+}
+
+// Test that an all_or_nothing batch applies every operation or none of them
+func testBatchAllOrNothing(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    dana := addNumbered(t, router, "Dana", "0521111111")
+    roni := addNumbered(t, router, "Roni", "0522222222")
+
+    page := runBatch(t, router, `{"operations":[
+        {"op":"create","contact":{"first_name":"Tal","last_name":"Mor","phone_number":"0523333333","address":"Acre"}},
+        {"op":"update","phone_number":"052-111-1111","contact":{"address":"Tel Aviv"}},
+        {"op":"delete","id":`+strconv.Itoa(roni)+`,"version":1}]}`)
+    if page.Mode != src.BatchAllOrNothing || page.Succeeded != 3 || page.Failed != 0 || len(page.Results) != 3 {
+        t.Fatalf("Expected three applied operations, got %+v", page)
+    }
+    created, updated, deleted := page.Results[0], page.Results[1], page.Results[2]
+    if created.Status != http.StatusCreated || len(created.Contacts) != 1 || created.Contacts[0].PhoneE164 != "+972523333333" {
+        t.Fatalf("Expected the created contact, got %+v", created)
+    }
+    if updated.Status != http.StatusOK || len(updated.IDs) != 1 || updated.IDs[0] != dana || updated.Contacts[0].Address != "Tel Aviv" || updated.Contacts[0].Version != 2 {
+        t.Fatalf("Expected the contact with the number updated, got %+v", updated)
+    }
+    if deleted.Index != 2 || deleted.Status != http.StatusNoContent || len(deleted.IDs) != 1 || deleted.IDs[0] != roni {
+        t.Fatalf("Expected the contact deleted by id, got %+v", deleted)
+    }
+    if _, err := store.GetContact(roni); err != src.ErrNotFound {
+        t.Fatalf("Expected the deleted contact to be gone, got %v", err)
+    }
+
+    // The update of a missing contact undoes the create before it
+    rec := doRequest(router, "POST", "/api/v1/contacts:batch", `{"mode":"all_or_nothing","operations":[
+        {"op":"create","contact":{"first_name":"Noa","last_name":"Bar","phone_number":"0524444444","address":"Eilat"}},
+        {"op":"update","id":999,"contact":{"address":"Haifa"}}]}`)
+    resp := decodeError(t, rec)
+    if rec.Code != http.StatusNotFound || resp.Code != src.CodeNotFound || len(resp.Details) != 1 || resp.Details[0].Field != "operations[1]" {
+        t.Fatalf("Expected 404 naming the failed operation, got %d %+v", rec.Code, resp)
+    }
+    if _, err := store.SearchContact("0524444444"); err != src.ErrNotFound {
+        t.Fatalf("Expected the create to be rolled back, got %v", err)
+    }
+    history := readHistory(t, router, "/api/v1/contacts/"+strconv.Itoa(dana))
+    if len(history.Revisions) != 2 {
+        t.Fatalf("Expected no audit entry from the rolled back batch, got %+v", history.Revisions)
+    }
+
+    // Invalid operations fail the batch with their details
+    rec = doRequest(router, "POST", "/api/v1/contacts:batch", `{"operations":[
+        {"op":"delete","id":`+strconv.Itoa(dana)+`},
+        {"op":"create","contact":{"first_name":"Noa"}}]}`)
+    resp = decodeError(t, rec)
+    if rec.Code != http.StatusUnprocessableEntity || len(resp.Details) != 4 || resp.Details[1].Field != "operations[1].last_name" {
+        t.Fatalf("Expected 422 with the missing fields of the operation, got %d %+v", rec.Code, resp)
+    }
+    if countContacts(t, store) != 2 {
+        t.Fatalf("Expected the delete before the invalid operation to be rolled back")
+    }
+
+    for _, body := range []string{`{"operations":[]}`, `{"mode":"sometimes","operations":[{"op":"delete","id":1}]}`, `[]`} {
+        if rec := doRequest(router, "POST", "/api/v1/contacts:batch", body); rec.Code != http.StatusBadRequest {
+            t.Fatalf("Expected 400 for %s, got %d", body, rec.Code)
+        }
+    }
+}
+
+// Test that a best_effort batch applies every operation it can and reports each result
+func testBatchBestEffort(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    dana := addNumbered(t, router, "Dana", "0521111111")
+    addNumbered(t, router, "Roni", "0522222222")
+    addNumbered(t, router, "Gal", "0522222222")
+
+    page := runBatch(t, router, `{"mode":"best_effort","operations":[
+        {"op":"create","contact":{"first_name":"Tal","last_name":"Mor","phone_number":"0523333333","address":"Acre"}},
+        {"op":"update","id":999,"contact":{"address":"Haifa"}},
+        {"op":"update","id":`+strconv.Itoa(dana)+`,"version":5,"contact":{"address":"Haifa"}},
+        {"op":"create","contact":{"first_name":"Noa","last_name":"Bar","phone_number":"12","address":"Eilat"}},
+        {"op":"delete","phone_number":"0522222222"},
+        {"op":"move","id":1},
+        {"op":"delete","phone_number":"0529999999"}]}`)
+    if page.Mode != src.BatchBestEffort || page.Succeeded != 2 || page.Failed != 5 || len(page.Results) != 7 {
+        t.Fatalf("Expected two applied and five failed operations, got %+v", page)
+    }
+    statuses := []int{http.StatusCreated, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusUnprocessableEntity,
+        http.StatusNoContent, http.StatusUnprocessableEntity, http.StatusNotFound}
+    for i, result := range page.Results {
+        if result.Index != i || result.Status != statuses[i] || (result.Error != nil) != (statuses[i] >= 400) {
+            t.Fatalf("Expected operation %d to answer %d, got %+v", i, statuses[i], result)
+        }
+    }
+    if page.Results[5].Error.Details[0].Field != "op" || page.Results[6].Error.Message != "The number provided is not in the phone book" {
+        t.Fatalf("Expected the errors of the operations, got %+v %+v", page.Results[5].Error, page.Results[6].Error)
+    }
+    if len(page.Results[4].IDs) != 2 {
+        t.Fatalf("Expected both contacts with the number deleted, got %+v", page.Results[4])
+    }
+
+    contacts, _, _ := store.GetContacts(10, 0, 0)
+    if len(contacts) != 2 || contacts[0].ID != dana || contacts[0].Version != 1 || contacts[1].FirstName != "Tal" {
+        t.Fatalf("Expected Dana unchanged and Tal added, got %+v", contacts)
+    }
+}
+
+// Test that a batch needs contacts:write, and contacts:delete once it deletes
+func testBatchPermissions(t *testing.T) {
+    roles := src.DefaultRoles()
+    roles["writer"] = []string{src.PermissionRead, src.PermissionWrite}
+    router, keys := newAuthRouter(t, roles, src.RoleViewer, "writer", src.RoleEditor)
+    create := `{"operations":[{"op":"create","contact":{"first_name":"A","last_name":"B","phone_number":"0521111111","address":"C"}}]}`
+    remove := `{"operations":[{"op":"delete","phone_number":"0521111111"}]}`
+
+    if rec := doAudited(router, keys[src.RoleViewer], "req-batch", "POST", "/api/v1/contacts:batch", create); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 for a viewer running a batch, got %d", rec.Code)
+    }
+    if rec := doAudited(router, keys["writer"], "req-batch", "POST", "/api/v1/contacts:batch", create); rec.Code != http.StatusOK {
+        t.Fatalf("Expected a writer to create through a batch, got %d", rec.Code)
+    }
+    if rec := doAudited(router, keys["writer"], "req-batch", "POST", "/contacts:batch", remove); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 for a writer deleting through a batch, got %d", rec.Code)
+    }
+    rec := doAudited(router, keys[src.RoleEditor], "req-batch", "POST", "/contacts:batch", remove)
+    var page batchPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    if rec.Code != http.StatusOK || page.Succeeded != 1 {
+        t.Fatalf("Expected the editor to delete through a batch, got %d %+v", rec.Code, page)
+    }
+}
@@ -0,0 +1,193 @@
+package tests
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "net/url"
+    "strings"
+    "testing"
+
+    "Rise/src"
+)
+
+const sampleCSV = "Given Name,Family Name,Mobile,Street,Notes\n" +
+    "Jonathan,Makovsky,054-343-5590,Tel Aviv,friend\n" +
+    "Dana,Cohen,,Haifa,\n" +
+    "Avi,Levi,not a phone,Eilat,\n" +
+    "Noa,Bar,+972521234567,Jerusalem,\n"
+
+// sampleMapping maps the sample CSV headers to contact fields
+var sampleMapping = url.QueryEscape(`{"Given Name":"first_name","Family Name":"last_name","Mobile":"phone_number","Street":"address"}`)
+
+// Test function to run all CSV tests
+func TestCSV(t *testing.T) {
+    t.Run("Test Import with Mapping", testCSVImportWithMapping)
+    t.Run("Test Import in Batches", testCSVImportBatches)
+    t.Run("Test Invalid Mapping", testCSVInvalidMapping)
+    t.Run("Test Error Report", testCSVErrorReport)
+    t.Run("Test Export and Import Round Trip", testCSVRoundTrip)
+    t.Run("Test Formula Cells", testCSVFormulaCells)
+    t.Run("Test Import Required Field", func(t *testing.T) { forEachStore(t, testCSVImportRequiredField) })
+}
+
+// Test that valid rows are imported and invalid ones reported by row
+func testCSVImportWithMapping(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+
+    rec := doRequest(router, "POST", "/contacts/import.csv?mapping="+sampleMapping, sampleCSV)
+    if rec.Code != 200 {
+        t.Fatalf("Expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 2 || response.Rejected != 2 {
+        t.Fatalf("Expected 2 imported and 2 rejected rows, got %+v", response)
+    }
+    if response.Results[1].Line != 3 || response.Results[1].Errors[0].Field != "phone_number" {
+        t.Fatalf("Expected the missing phone on line 3 to be reported, got %+v", response.Results[1])
+    }
+    if response.Results[2].Status != "rejected" || response.Results[2].Errors[0].Field != "phone_number" {
+        t.Fatalf("Expected the invalid phone to be rejected, got %+v", response.Results[2])
+    }
+    if response.Results[3].Status != "imported" || response.Results[3].Contact.ID == 0 {
+        t.Fatalf("Expected the last row to be imported with an id, got %+v", response.Results[3])
+    }
+    if _, err := store.SearchContact("0543435590"); err != nil {
+        t.Fatalf("Expected the first row to be stored: %v", err)
+    }
+}
+
+// Test that every batch is stored
+func testCSVImportBatches(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+
+    var body strings.Builder
+    body.WriteString("first_name,last_name,phone_number,address\n")
+    for i := 0; i < 25; i++ {
+        body.WriteString("First,Last,050-123-45" + string(rune('0'+i/10)) + string(rune('0'+i%10)) + ",Street\n")
+    }
+
+    rec := doRequest(router, "POST", "/contacts/import.csv?batch_size=10", body.String())
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 25 {
+        t.Fatalf("Expected 25 imported rows, got %+v", response)
+    }
+    contacts, _, _ := store.GetContacts(100, 0, 0)
+    if len(contacts) != 25 {
+        t.Fatalf("Expected 25 stored contacts, got %d", len(contacts))
+    }
+}
+
+// Test that an unusable mapping is rejected before any row is read
+func testCSVInvalidMapping(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+
+    rec := doRequest(router, "POST", "/contacts/import.csv?mapping="+url.QueryEscape(`{"Mobile":"cell"}`), sampleCSV)
+    if rec.Code != 400 {
+        t.Fatalf("Expected status 400, got %d", rec.Code)
+    }
+    envelope := decodeError(t, rec)
+    if len(envelope.Details) != 5 || envelope.Details[4].Field != "phone_number" {
+        t.Fatalf("Expected the unknown field and the 4 unmapped fields to be reported, got %+v", envelope.Details)
+    }
+}
+
+// Test downloading the rejected rows as a CSV report
+func testCSVErrorReport(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+
+    rec := doRequest(router, "POST", "/contacts/import.csv?dry_run=true&report=csv&mapping="+sampleMapping, sampleCSV)
+    if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+        t.Fatalf("Expected a CSV report, got %q", rec.Header().Get("Content-Type"))
+    }
+    rows, err := csv.NewReader(rec.Body).ReadAll()
+    if err != nil {
+        t.Fatalf("Failed to read the report: %v", err)
+    }
+    if len(rows) != 3 {
+        t.Fatalf("Expected a header and 2 rejected rows, got %v", rows)
+    }
+    if rows[0][0] != "line" || rows[0][2] != "Given Name" {
+        t.Fatalf("Expected the original header after line and errors, got %v", rows[0])
+    }
+    if rows[1][0] != "3" || !strings.HasPrefix(rows[1][1], "phone_number:") || rows[1][2] != "Dana" {
+        t.Fatalf("Expected Dana's row with its error, got %v", rows[1])
+    }
+}
+
+// Test that an exported file imports again without a mapping
+func testCSVRoundTrip(t *testing.T) {
+    source := src.NewMemoryStore("IL")
+    source.AddContact(src.Contact{FirstName: "Jonathan", LastName: "Makovsky", PhoneNumber: "054-343-5590", Address: "Tel Aviv, \"Center\""})
+    source.AddContact(src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "052-123-4567", Address: "Haifa"})
+
+    rec := doRequest(src.NewRouter(source, nil), "GET", "/contacts/export.csv", "")
+    if rec.Code != 200 {
+        t.Fatalf("Expected status 200, got %d", rec.Code)
+    }
+
+    target := src.NewMemoryStore("IL")
+    rec = doRequest(src.NewRouter(target, nil), "POST", "/contacts/import.csv", rec.Body.String())
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 2 {
+        t.Fatalf("Expected both exported contacts to import, got %+v", response)
+    }
+    contacts, err := target.SearchContact("+972543435590")
+    if err != nil || contacts[0].Address != "Tel Aviv, \"Center\"" {
+        t.Fatalf("Expected quoted address to survive the round trip, got %+v (err=%v)", contacts, err)
+    }
+}
+
+// Test that cells a spreadsheet would evaluate are quoted on export and restored on import
+func testCSVFormulaCells(t *testing.T) {
+    source := src.NewMemoryStore("IL")
+    source.AddContact(src.Contact{FirstName: "=HYPERLINK(\"http://x\")", LastName: "-Levi", PhoneNumber: "+972521234567", Address: "@Haifa"})
+
+    rec := doRequest(src.NewRouter(source, nil), "GET", "/contacts/export.csv", "")
+    export := rec.Body.String()
+    rows, err := csv.NewReader(strings.NewReader(export)).ReadAll()
+    if err != nil || len(rows) != 2 {
+        t.Fatalf("Expected a header and one row, got %v (err=%v)", rows, err)
+    }
+    expected := []string{"'=HYPERLINK(\"http://x\")", "'-Levi", "'+972521234567", "+972521234567", "'@Haifa"}
+    for i, want := range expected {
+        if rows[1][i+1] != want {
+            t.Fatalf("Expected column %s to be %q, got %q", rows[0][i+1], want, rows[1][i+1])
+        }
+    }
+
+    target := src.NewMemoryStore("IL")
+    rec = doRequest(src.NewRouter(target, nil), "POST", "/contacts/import.csv", export)
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 1 {
+        t.Fatalf("Expected the exported contact to import, got %+v", response)
+    }
+    contacts, err := target.SearchContact("0521234567")
+    if err != nil || contacts[0].FirstName != "=HYPERLINK(\"http://x\")" || contacts[0].Address != "@Haifa" {
+        t.Fatalf("Expected the quotes to be stripped on import, got %+v (err=%v)", contacts, err)
+    }
+}
+
+// Test that every row is checked against the custom fields defined for the tenant
+func testCSVImportRequiredField(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    defineField(t, router, `{"name":"employee_id","type":"number","required":true}`)
+
+    rec := doRequest(router, "POST", "/contacts/import.csv?mapping="+sampleMapping, sampleCSV)
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 0 || response.Rejected != 4 {
+        t.Fatalf("Expected every row to be rejected, got %+v", response)
+    }
+    if response.Results[0].Errors[0].Field != "custom_fields.employee_id" {
+        t.Fatalf("Expected the missing custom field to be reported, got %+v", response.Results[0])
+    }
+    if response.Results[2].Errors[0].Field != "phone_number" {
+        t.Fatalf("Expected the invalid phone to be reported first, got %+v", response.Results[2])
+    }
+}
@@ -3,6 +3,9 @@
 :: Step 1: Set the path to the docker-compose.yml file (change the path if necessary)
 set COMPOSE_PATH=C:\Users\Yonatan\Desktop\Rise\rise_project\setup
 
+:: The admin key comes from the environment, or a throwaway one is made for this run
+if not defined ADMIN_API_KEY set ADMIN_API_KEY=%RANDOM%%RANDOM%%RANDOM%%RANDOM%
+
 :: Step 2: Start the Docker containers using Docker Compose
 echo Starting Docker containers...
 docker-compose -f %COMPOSE_PATH%\docker-compose.yml up -d --build
@@ -0,0 +1,325 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "sync"
+    "testing"
+
+    "Rise/src"
+    "Rise/src/dedupe"
+)
+
+// Test function to run all duplicate tests
+func TestDuplicates(t *testing.T) {
+    t.Run("Test Scoring", testDuplicateScoring)
+    t.Run("Test Insert Policy", func(t *testing.T) { forEachStore(t, testDuplicatePolicy) })
+    t.Run("Test Bulk Policy", func(t *testing.T) { forEachStore(t, testBulkDuplicatePolicy) })
+    t.Run("Test Candidates", func(t *testing.T) { forEachStore(t, testDuplicateCandidates) })
+    t.Run("Test Concurrent Rejects", func(t *testing.T) { forEachStore(t, testConcurrentRejects) })
+    t.Run("Test Merge", func(t *testing.T) { forEachStore(t, testMergeContacts) })
+}
+
+// duplicatesPage is the body of GET /contacts/duplicates
+type duplicatesPage struct {
+    Threshold float64                `json:"threshold"`
+    Clusters  []src.DuplicateCluster `json:"clusters"`
+}
+
+// mergeResult is the body of POST /contacts/merge
+type mergeResult struct {
+    Contact src.Contact `json:"contact"`
+    Merged  []int       `json:"merged"`
+}
+
+// readDuplicates fetches GET /api/v1/contacts/duplicates and fails the test unless it answers 200
+func readDuplicates(t *testing.T, handler http.Handler) duplicatesPage {
+    rec := doRequest(handler, "GET", "/api/v1/contacts/duplicates", "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 listing duplicates, got %d: %s", rec.Code, rec.Body.String())
+    }
+    var page duplicatesPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page
+}
+
+// Test that pairs are scored on phone, name and address and grouped into clusters
+func testDuplicateScoring(t *testing.T) {
+    records := []dedupe.Record{
+        {ID: 1, FirstName: "Jonathan", LastName: "Makovsky", Address: "Kfar Saba", Phones: []string{"+972543436858"}},
+        {ID: 2, FirstName: "Jonatan", LastName: "Makovsky", Address: "Kfar-Saba", Phones: []string{"+972543436858"}},
+        {ID: 3, FirstName: "Makovsky", LastName: "Jonathan", Address: "Tel Aviv", Phones: []string{"+972501111111", "+972543436858"}},
+        {ID: 4, FirstName: "Jonathan", LastName: "Makovsky", Address: "Kfar Saba", Phones: []string{"+972529999999"}},
+        {ID: 5, FirstName: "Dana", LastName: "Cohen", Address: "Haifa", Phones: []string{"+972521234567"}},
+    }
+
+    if pair := dedupe.Compare(records[0], records[2]); pair.Phone != 1 || pair.Name != 1 || pair.Address > 0.5 {
+        t.Fatalf("Expected a shared phone and the swapped names to match, got %+v", pair)
+    }
+    // The same name and address without a shared number is not enough
+    if pair := dedupe.Compare(records[0], records[3]); pair.Score >= dedupe.DefaultThreshold {
+        t.Fatalf("Expected a pair without a shared phone to score below the threshold, got %+v", pair)
+    }
+
+    pairs := dedupe.Pairs(records, dedupe.DefaultThreshold)
+    if len(pairs) != 3 || pairs[0].A != 1 || pairs[0].B != 2 {
+        t.Fatalf("Expected the three pairs of the first contacts, best first, got %+v", pairs)
+    }
+    clusters := dedupe.Clusters(pairs)
+    if len(clusters) != 1 || len(clusters[0]) != 3 || clusters[0][0] != 1 || clusters[0][2] != 3 {
+        t.Fatalf("Expected one cluster of contacts 1 to 3, got %v", clusters)
+    }
+    if matches := dedupe.Matches(records[4], records, dedupe.DefaultThreshold); len(matches) != 0 {
+        t.Fatalf("Expected no match for an unrelated contact, got %+v", matches)
+    }
+}
+
+// Test that the insert policy warns about or refuses likely duplicates
+func testDuplicatePolicy(t *testing.T, store src.ContactStore) {
+    existing := addNumbered(t, src.NewRouter(store, nil), "Dana", "0521111111")
+    duplicate := `{"first_name":"Dana","last_name":"Cohen","phone_number":"052-111-1111","address":"Haifa"}`
+    other := `{"first_name":"Roni","last_name":"Levi","phone_number":"0522222222","address":"Eilat"}`
+
+    warn := src.WithDuplicatePolicy(src.DuplicatesWarn, src.NewRouter(store, nil))
+    rec := doRequest(warn, "POST", "/api/v1/contacts", duplicate)
+    if rec.Code != http.StatusCreated || rec.Header().Get("X-Possible-Duplicates") != strconv.Itoa(existing) {
+        t.Fatalf("Expected the duplicate added with a warning naming contact %d, got %d %q", existing, rec.Code, rec.Header().Get("X-Possible-Duplicates"))
+    }
+    rec = doRequest(warn, "POST", "/api/v1/contacts", other)
+    if rec.Code != http.StatusCreated || rec.Header().Get("X-Possible-Duplicates") != "" {
+        t.Fatalf("Expected an unrelated contact added without a warning, got %d %q", rec.Code, rec.Header().Get("X-Possible-Duplicates"))
+    }
+
+    reject := src.WithDuplicatePolicy(src.DuplicatesReject, src.NewRouter(store, nil))
+    for _, path := range []string{"/api/v1/contacts", "/addContact"} {
+        rec = doRequest(reject, "POST", path, duplicate)
+        if rec.Code != http.StatusConflict {
+            t.Fatalf("Expected 409 adding a duplicate on %s, got %d", path, rec.Code)
+        }
+        if resp := decodeError(t, rec); resp.Code != src.CodeConflict || len(resp.Details) != 2 || resp.Details[0].Field != "duplicate_of" {
+            t.Fatalf("Expected the duplicates in the error details, got %+v", resp)
+        }
+    }
+    if rec = doRequest(reject, "POST", "/api/v1/contacts", `{"first_name":"Tal","last_name":"Mor","phone_number":"0523333333","address":"Acre"}`); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 for a new contact under the reject policy, got %d", rec.Code)
+    }
+
+    if _, err := src.ParseDuplicatePolicy("ignore"); err == nil {
+        t.Fatalf("Expected an unknown policy to be refused")
+    }
+}
+
+// Test that batches and imports follow the insert policy like single adds
+func testBulkDuplicatePolicy(t *testing.T, store src.ContactStore) {
+    existing := addNumbered(t, src.NewRouter(store, nil), "Dana", "0521111111")
+    reject := src.WithDuplicatePolicy(src.DuplicatesReject, src.NewRouter(store, nil))
+    warn := src.WithDuplicatePolicy(src.DuplicatesWarn, src.NewRouter(store, nil))
+
+    // Best effort batches refuse the duplicate alone, all or nothing ones refuse everything
+    page := runBatch(t, reject, `{"mode":"best_effort","operations":[`+
+        `{"op":"create","contact":{"first_name":"Dana","last_name":"Cohen","phone_number":"052-111-1111","address":"Haifa"}},`+
+        `{"op":"create","contact":{"first_name":"Roni","last_name":"Levi","phone_number":"0522222222","address":"Eilat"}}]}`)
+    if page.Results[0].Status != http.StatusConflict || page.Results[0].Error.Details[0].Field != "duplicate_of" || page.Results[1].Status != http.StatusCreated {
+        t.Fatalf("Expected the duplicate refused with 409 and the other contact created, got %+v", page.Results)
+    }
+    rec := doRequest(reject, "POST", "/api/v1/contacts:batch", `{"operations":[`+
+        `{"op":"create","contact":{"first_name":"Tal","last_name":"Mor","phone_number":"0523333333","address":"Acre"}},`+
+        `{"op":"create","contact":{"first_name":"Tal","last_name":"Mor","phone_number":"0523333333","address":"Acre"}}]}`)
+    if resp := decodeError(t, rec); rec.Code != http.StatusConflict || resp.Details[0].Field != "operations[1]" {
+        t.Fatalf("Expected the second create to undo the batch with 409, got %d %+v", rec.Code, resp)
+    }
+    page = runBatch(t, warn, `{"operations":[{"op":"create","contact":{"first_name":"Dana","last_name":"Cohen","phone_number":"0521111111","address":"Haifa"}}]}`)
+    if len(page.Results[0].PossibleDuplicates) == 0 || page.Results[0].PossibleDuplicates[0] != existing {
+        t.Fatalf("Expected the batch create to name contact %d, got %+v", existing, page.Results[0])
+    }
+
+    // Imports check every row against the stored contacts and the rows stored before it
+    upload := "first_name,last_name,phone_number,address\n" +
+        "Dana,Cohen,052-111-1111,Haifa\n" +
+        "Noa,Bar,0524444444,Jerusalem\n" +
+        "Noa,Bar,0524444444,Jerusalem\n"
+    for _, tt := range []struct {
+        path     string
+        accepted int
+    }{
+        {"/contacts/import.csv?dry_run=true", 2},
+        {"/contacts/import.csv", 1},
+    } {
+        rec := doRequest(reject, "POST", tt.path, upload)
+        var response importResponse
+        json.NewDecoder(rec.Body).Decode(&response)
+        if response.Accepted != tt.accepted || response.Results[0].Status != "rejected" || response.Results[0].Errors[0].Field != "duplicate_of" {
+            t.Fatalf("Expected %d rows accepted from %s and Dana refused as a duplicate, got %+v", tt.accepted, tt.path, response)
+        }
+    }
+    card := "BEGIN:VCARD\r\nVERSION:3.0\r\nN:Bar;Noa;;;\r\nTEL:0524444444\r\nADR:;;;Jerusalem;;;\r\nEND:VCARD\r\n"
+    var response importResponse
+    json.NewDecoder(doRequest(reject, "POST", "/contacts/import", card).Body).Decode(&response)
+    if response.Rejected != 1 || response.Results[0].Errors[0].Field != "duplicate_of" {
+        t.Fatalf("Expected the vCard of a stored contact to be refused, got %+v", response)
+    }
+    json.NewDecoder(doRequest(warn, "POST", "/contacts/import", card).Body).Decode(&response)
+    if response.Accepted != 1 || len(response.Results[0].PossibleDuplicates) == 0 {
+        t.Fatalf("Expected the vCard imported with its likely duplicates named, got %+v", response)
+    }
+}
+
+// Test that only the contacts sharing a phone number are read as candidates, whatever the
+// accents of their names
+func testDuplicateCandidates(t *testing.T, store src.ContactStore) {
+    add := func(contact src.Contact) int {
+        id, err := store.AddContact(contact)
+        if err != nil {
+            t.Fatalf("Failed to add %s: %v", contact.FirstName, err)
+        }
+        return id
+    }
+    byPhone := add(src.Contact{FirstName: "Roni", LastName: "Levi", PhoneNumber: "0521111111", Address: "Eilat"})
+    add(src.Contact{FirstName: "Dan", LastName: "Ben Cohenson", PhoneNumber: "0522222222", Address: "Acre"})
+    accented := add(src.Contact{FirstName: "Émile", LastName: "Dahan", PhoneNumber: "0525555555", Address: "Haifa"})
+    add(src.Contact{FirstName: "Tal", LastName: "Mor", PhoneNumber: "0523333333", Address: "Haifa"})
+
+    merges := store.(src.MergeStore)
+    tests := []struct {
+        contact src.Contact
+        ids     []int
+    }{
+        {src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "052-111-1111", Address: "Haifa"}, []int{byPhone}},
+        {src.Contact{FirstName: "Emile", LastName: "Dahan", PhoneNumber: "052-555-5555", Address: "Haifa"}, []int{accented}},
+        {src.Contact{FirstName: "Emile", LastName: "Dahan", PhoneNumber: "0526666666", Address: "Haifa"}, nil},
+    }
+    for _, tt := range tests {
+        contact, err := store.PrepareContact(tt.contact)
+        if err != nil {
+            t.Fatalf("Failed to prepare %s: %v", tt.contact.FirstName, err)
+        }
+        candidates, err := merges.DuplicateCandidates(contact)
+        if err != nil {
+            t.Fatalf("Failed to read the candidates: %v", err)
+        }
+        if len(candidates) != len(tt.ids) || (len(tt.ids) > 0 && candidates[0].ID != tt.ids[0]) {
+            t.Fatalf("Expected candidates %v for %s %s, got %+v", tt.ids, tt.contact.FirstName, tt.contact.PhoneNumber, candidates)
+        }
+    }
+
+    reject := src.WithDuplicatePolicy(src.DuplicatesReject, src.NewRouter(store, nil))
+    rec := doRequest(reject, "POST", "/api/v1/contacts", `{"first_name":"Emile","last_name":"Dahan","phone_number":"0525555555","address":"Haifa"}`)
+    if rec.Code != http.StatusConflict {
+        t.Fatalf("Expected Emile to be refused as a duplicate of Émile, got %d", rec.Code)
+    }
+    if err := merges.LockDuplicates(); err != nil {
+        t.Fatalf("Failed to lock outside a transaction: %v", err)
+    }
+}
+
+// Test that similar contacts added at the same time under the reject policy are added once
+func testConcurrentRejects(t *testing.T, store src.ContactStore) {
+    reject := src.WithDuplicatePolicy(src.DuplicatesReject, src.NewRouter(store, nil))
+    duplicate := `{"first_name":"Dana","last_name":"Cohen","phone_number":"0521111111","address":"Haifa"}`
+
+    codes := make(chan int, 8)
+    var wg sync.WaitGroup
+    for i := 0; i < cap(codes); i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            codes <- doRequest(reject, "POST", "/api/v1/contacts", duplicate).Code
+        }()
+    }
+    wg.Wait()
+    close(codes)
+
+    created := 0
+    for code := range codes {
+        switch code {
+        case http.StatusCreated:
+            created++
+        case http.StatusConflict:
+        default:
+            t.Fatalf("Expected 201 or 409 adding the contact, got %d", code)
+        }
+    }
+    if created != 1 {
+        t.Fatalf("Expected the contact added once, got %d times", created)
+    }
+}
+
+// Test listing duplicate clusters and merging them field by field into a survivor
+func testMergeContacts(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    add := func(body string) int {
+        rec := doRequest(router, "POST", "/api/v1/contacts", body)
+        if rec.Code != http.StatusCreated {
+            t.Fatalf("Expected 201 adding a contact, got %d: %s", rec.Code, rec.Body.String())
+        }
+        var created src.Contact
+        json.NewDecoder(rec.Body).Decode(&created)
+        return created.ID
+    }
+    survivor := add(`{"first_name":"Dana","last_name":"Cohen","phone_number":"0521111111","address":"Haifa","emails":[{"address":"dana@example.com"}]}`)
+    duplicate := add(`{"first_name":"Dana","last_name":"Kohen","phone_number":"052-111-1111","address":"Tel Aviv","emails":[{"address":"DANA@example.com"},{"address":"dana@work.example"}]}`)
+    other := add(`{"first_name":"Roni","last_name":"Levi","phone_number":"0522222222","address":"Eilat"}`)
+
+    page := readDuplicates(t, router)
+    if page.Threshold != dedupe.DefaultThreshold || len(page.Clusters) != 1 || len(page.Clusters[0].Contacts) != 2 || len(page.Clusters[0].Pairs) != 1 {
+        t.Fatalf("Expected one cluster of two contacts, got %+v", page)
+    }
+    if pair := page.Clusters[0].Pairs[0]; pair.ContactIDs != [2]int{survivor, duplicate} || pair.Phone != 1 {
+        t.Fatalf("Expected the pair to share its phone, got %+v", pair)
+    }
+    if rec := doRequest(router, "GET", "/api/v1/contacts/duplicates?threshold=2", ""); rec.Code != http.StatusBadRequest {
+        t.Fatalf("Expected 400 for a threshold above 1, got %d", rec.Code)
+    }
+
+    // Invalid merges are refused before anything changes
+    ids := func(id int) string { return strconv.Itoa(id) }
+    invalid := []struct {
+        body string
+        code int
+    }{
+        {`{"survivor":` + ids(survivor) + `,"duplicates":[]}`, http.StatusUnprocessableEntity},
+        {`{"survivor":` + ids(survivor) + `,"duplicates":[` + ids(survivor) + `]}`, http.StatusUnprocessableEntity},
+        {`{"survivor":` + ids(survivor) + `,"duplicates":[` + ids(duplicate) + `],"fields":{"id":1}}`, http.StatusUnprocessableEntity},
+        {`{"survivor":` + ids(survivor) + `,"duplicates":[` + ids(duplicate) + `],"fields":{"address":` + ids(other) + `}}`, http.StatusUnprocessableEntity},
+        {`{"survivor":` + ids(survivor) + `,"duplicates":[999]}`, http.StatusNotFound},
+    }
+    for _, tt := range invalid {
+        if rec := doRequest(router, "POST", "/api/v1/contacts/merge", tt.body); rec.Code != tt.code {
+            t.Fatalf("Expected %d merging %s, got %d", tt.code, tt.body, rec.Code)
+        }
+    }
+
+    body := `{"survivor":` + ids(survivor) + `,"duplicates":[` + ids(duplicate) + `],"fields":{"last_name":` + ids(duplicate) + `,"address":` + ids(duplicate) + `}}`
+    rec := doRequest(router, "POST", "/api/v1/contacts/merge", body)
+    var result mergeResult
+    json.NewDecoder(rec.Body).Decode(&result)
+    merged := result.Contact
+    if rec.Code != http.StatusOK || merged.ID != survivor || merged.Version != 2 || rec.Header().Get("ETag") != `"v2"` {
+        t.Fatalf("Expected the survivor at version 2, got %d %+v", rec.Code, result)
+    }
+    if merged.FirstName != "Dana" || merged.LastName != "Kohen" || merged.Address != "Tel Aviv" || len(result.Merged) != 1 || result.Merged[0] != duplicate {
+        t.Fatalf("Expected the chosen fields from the duplicate, got %+v", result)
+    }
+    if len(merged.Phones) != 1 || len(merged.Emails) != 2 || len(merged.Addresses) != 2 || !merged.Addresses[0].Primary || merged.Addresses[0].Address != "Tel Aviv" {
+        t.Fatalf("Expected the details combined once each, got %+v %+v %+v", merged.Phones, merged.Emails, merged.Addresses)
+    }
+    if !merged.Emails[0].Primary || merged.Emails[0].Address != "dana@example.com" {
+        t.Fatalf("Expected the survivor's email to stay primary, got %+v", merged.Emails)
+    }
+
+    // The duplicate went to the trash and the survivor's history records the merge
+    if rec := doRequest(router, "GET", "/api/v1/contacts/"+strconv.Itoa(duplicate), ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 reading the merged duplicate, got %d", rec.Code)
+    }
+    if trash := readTrash(t, router, ""); len(trash.Contacts) != 1 || trash.Contacts[0].ID != duplicate {
+        t.Fatalf("Expected the duplicate in the trash, got %+v", trash.Contacts)
+    }
+    history := readHistory(t, router, "/api/v1/contacts/"+strconv.Itoa(survivor))
+    if len(history.Revisions) != 2 || history.Revisions[0].Action != src.AuditMerge {
+        t.Fatalf("Expected the merge in the survivor's history, got %+v", history.Revisions)
+    }
+    if page := readDuplicates(t, router); len(page.Clusters) != 0 {
+        t.Fatalf("Expected no duplicates left, got %+v", page.Clusters)
+    }
+}
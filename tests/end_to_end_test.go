@@ -5,11 +5,36 @@ import (
     "encoding/json"
     "log"
     "net/http"
+    "os"
     "testing"
 )
 
 const baseURL = "http://localhost:8080"
 
+// client sends the requests of the end-to-end tests to the running server with its API key:
+// RISE_API_KEY, or the ADMIN_API_KEY docker-compose was started with
+var client = &http.Client{Transport: apiKeyTransport{key: apiKey(), next: http.DefaultTransport}}
+
+// apiKey returns the API key the end-to-end tests authenticate with
+func apiKey() string {
+    if key := os.Getenv("RISE_API_KEY"); key != "" {
+        return key
+    }
+    return os.Getenv("ADMIN_API_KEY")
+}
+
+// apiKeyTransport adds an X-API-Key header to every request
+type apiKeyTransport struct {
+    key  string
+    next http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    req = req.Clone(req.Context())
+    req.Header.Set("X-API-Key", t.key)
+    return t.next.RoundTrip(req)
+}
+
 // Contact structure for JSON requests
 type Contact struct {
     FirstName   string `json:"first_name"`
@@ -30,7 +55,7 @@ func TestAddContact(t *testing.T) {
     }
 
     body, _ := json.Marshal(contact)
-    resp, err := http.Post(baseURL+"/addContact", "application/json", bytes.NewBuffer(body))
+    resp, err := client.Post(baseURL+"/addContact", "application/json", bytes.NewBuffer(body))
     if err != nil {
         t.Fatalf("❌ TestAddContact failed: %v", err)
     }
@@ -47,7 +72,7 @@ func TestAddContact(t *testing.T) {
 func TestGetContacts(t *testing.T) {
     log.Println("Running TestGetContacts...")
 
-    resp, err := http.Get(baseURL + "/getContacts")
+    resp, err := client.Get(baseURL + "/getContacts")
     if err != nil {
         t.Fatalf("❌ TestGetContacts failed: %v", err)
     }
@@ -64,7 +89,7 @@ func TestGetContacts(t *testing.T) {
 func TestSearchContact(t *testing.T) {
     log.Println("Running TestSearchContact...")
 
-    resp, err := http.Get(baseURL + "/searchContact/1234567890")
+    resp, err := client.Get(baseURL + "/searchContact/1234567890")
     if err != nil {
         t.Fatalf("❌ TestSearchContact failed: %v", err)
     }
@@ -92,7 +117,6 @@ func TestEditContact(t *testing.T) {
     req, _ := http.NewRequest(http.MethodPut, baseURL+"/editContact/1234567890", bytes.NewBuffer(body))
     req.Header.Set("Content-Type", "application/json")
 
-    client := &http.Client{}
     resp, err := client.Do(req)
     if err != nil {
         t.Fatalf("❌ TestEditContact failed: %v", err)
@@ -111,7 +135,6 @@ func TestDeleteContact(t *testing.T) {
     log.Println("Running TestDeleteContact...")
 
     req, _ := http.NewRequest(http.MethodDelete, baseURL+"/deleteContact/1234567890", nil)
-    client := &http.Client{}
     resp, err := client.Do(req)
     if err != nil {
         t.Fatalf("❌ TestDeleteContact failed: %v", err)
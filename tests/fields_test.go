@@ -0,0 +1,253 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "strconv"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all custom field tests
+func TestFields(t *testing.T) {
+    t.Run("Test Field Definitions", func(t *testing.T) { forEachStore(t, testFieldDefinitions) })
+    t.Run("Test Field Values", func(t *testing.T) { forEachStore(t, testFieldValues) })
+    t.Run("Test Field Filter and Sort", func(t *testing.T) { forEachStore(t, testFieldFilterAndSort) })
+    t.Run("Test Field Permissions", testFieldPermissions)
+}
+
+// sortedPage is the body of a sorted GET /api/v1/contacts
+type sortedPage struct {
+    Contacts   []src.Contact `json:"contacts"`
+    NextCursor string        `json:"next_cursor"`
+    PrevCursor string        `json:"prev_cursor"`
+}
+
+// defineField creates a custom field, failing the test unless it answers 201
+func defineField(t *testing.T, handler http.Handler, body string) {
+    if rec := doRequest(handler, "POST", "/api/v1/fields", body); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 defining %s, got %d: %s", body, rec.Code, rec.Body.String())
+    }
+}
+
+// addWithFields creates a contact with the custom fields, given as a JSON object, and
+// returns its id
+func addWithFields(t *testing.T, handler http.Handler, firstName, number, fields string) int {
+    rec := doRequest(handler, "POST", "/api/v1/contacts",
+        `{"first_name":"`+firstName+`","last_name":"Levi","phone_number":"`+number+`","address":"Haifa","custom_fields":`+fields+`}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 adding %s, got %d: %s", firstName, rec.Code, rec.Body.String())
+    }
+    var contact src.Contact
+    json.NewDecoder(rec.Body).Decode(&contact)
+    return contact.ID
+}
+
+// Test that custom fields are defined, listed, fetched and deleted with their values
+func testFieldDefinitions(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    rec := doRequest(router, "POST", "/api/v1/fields", `{"name":"team","type":"enum","options":["sales","support"]}`)
+    var team src.CustomField
+    json.NewDecoder(rec.Body).Decode(&team)
+    if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/api/v1/fields/team" || team.CreatedAt.IsZero() {
+        t.Fatalf("Expected the field created, got %d %+v", rec.Code, team)
+    }
+    defineField(t, router, `{"name":"birthday","type":"date"}`)
+
+    tests := []struct {
+        body   string
+        status int
+        fields int
+    }{
+        {`{"name":"team","type":"string"}`, http.StatusConflict, 0},
+        {`{"name":"Team Lead","type":"colour","pattern":"[","options":["a","a"]}`, http.StatusUnprocessableEntity, 5},
+        {`{"name":"code","type":"string","pattern":"["}`, http.StatusUnprocessableEntity, 1},
+        {`{"name":"level","type":"enum"}`, http.StatusUnprocessableEntity, 1},
+        {`{"name":"age","type":"number","options":["1"]}`, http.StatusUnprocessableEntity, 1},
+        {`[]`, http.StatusBadRequest, 0},
+    }
+    for _, tt := range tests {
+        rec := doRequest(router, "POST", "/api/v1/fields", tt.body)
+        resp := decodeError(t, rec)
+        if rec.Code != tt.status || len(resp.Details) != tt.fields {
+            t.Fatalf("Expected %d with %d details for %s, got %d %+v", tt.status, tt.fields, tt.body, rec.Code, resp)
+        }
+    }
+
+    rec = doRequest(router, "GET", "/fields", "")
+    var list struct {
+        Fields []src.CustomField `json:"fields"`
+    }
+    json.NewDecoder(rec.Body).Decode(&list)
+    if rec.Code != http.StatusOK || len(list.Fields) != 2 || list.Fields[0].Name != "birthday" || list.Fields[1].Name != "team" {
+        t.Fatalf("Expected both fields ordered by name, got %d %+v", rec.Code, list.Fields)
+    }
+    if rec := doRequest(router, "GET", "/api/v1/fields/team", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 fetching the field, got %d", rec.Code)
+    }
+
+    // Deleting a field deletes its values
+    id := addWithFields(t, router, "Dana", "0521111111", `{"team":"sales","birthday":"1990-04-01"}`)
+    if rec := doRequest(router, "DELETE", "/api/v1/fields/team", ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting the field, got %d", rec.Code)
+    }
+    if contact, _ := store.GetContact(id); !reflect.DeepEqual(contact.CustomFields, map[string]any{"birthday": "1990-04-01"}) {
+        t.Fatalf("Expected the value of the deleted field to be gone, got %+v", contact.CustomFields)
+    }
+    for _, method := range []string{"GET", "DELETE"} {
+        if rec := doRequest(router, method, "/api/v1/fields/team", ""); rec.Code != http.StatusNotFound {
+            t.Fatalf("Expected 404 for %s of a deleted field, got %d", method, rec.Code)
+        }
+    }
+}
+
+// Test that values are validated on every write, and that required fields must be set
+func testFieldValues(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    defineField(t, router, `{"name":"employee_id","type":"number","required":true}`)
+    defineField(t, router, `{"name":"code","type":"string","pattern":"^[A-Z]{3}$"}`)
+    defineField(t, router, `{"name":"vip","type":"bool"}`)
+
+    rec := doRequest(router, "POST", "/api/v1/contacts",
+        `{"first_name":"Dana","last_name":"Cohen","phone_number":"0521111111","address":"Haifa","custom_fields":{"code":"abc","vip":"yes","color":"red"}}`)
+    resp := decodeError(t, rec)
+    fields := []string{}
+    for _, detail := range resp.Details {
+        fields = append(fields, detail.Field)
+    }
+    expected := []string{"custom_fields.code", "custom_fields.color", "custom_fields.vip", "custom_fields.employee_id"}
+    if rec.Code != http.StatusUnprocessableEntity || !reflect.DeepEqual(fields, expected) {
+        t.Fatalf("Expected 422 naming the invalid, unknown and missing fields, got %d %+v", rec.Code, resp)
+    }
+
+    id := addWithFields(t, router, "Dana", "0521111111", `{"employee_id":1042,"code":"ABC","vip":true}`)
+    path := "/api/v1/contacts/" + strconv.Itoa(id)
+    contact, err := store.GetContact(id)
+    if err != nil || !reflect.DeepEqual(contact.CustomFields, map[string]any{"employee_id": 1042.0, "code": "ABC", "vip": true}) {
+        t.Fatalf("Expected the custom fields stored by their type, got %+v %v", contact.CustomFields, err)
+    }
+
+    // Merge patches set and remove single fields, but cannot remove a required one
+    if rec := doPatch(router, path, "application/merge-patch+json", `{"custom_fields":{"code":null,"vip":false}}`); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 patching the fields, got %d: %s", rec.Code, rec.Body.String())
+    }
+    if contact, _ := store.GetContact(id); !reflect.DeepEqual(contact.CustomFields, map[string]any{"employee_id": 1042.0, "vip": false}) {
+        t.Fatalf("Expected code removed and vip changed, got %+v", contact.CustomFields)
+    }
+    rec = doPatch(router, path, "application/merge-patch+json", `{"custom_fields":{"employee_id":null}}`)
+    if resp := decodeError(t, rec); rec.Code != http.StatusUnprocessableEntity || resp.Details[0].Field != "custom_fields.employee_id" {
+        t.Fatalf("Expected 422 removing a required field, got %d %+v", rec.Code, resp)
+    }
+    rec = doPatch(router, path, "application/merge-patch+json", `{"custom_fields":null}`)
+    if resp := decodeError(t, rec); rec.Code != http.StatusUnprocessableEntity || resp.Details[0].Issue != "is required" {
+        t.Fatalf("Expected 422 clearing every field while one is required, got %d %+v", rec.Code, resp)
+    }
+    if rec := doPatch(router, path, "application/merge-patch+json", `{"custom_fields":"none"}`); rec.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("Expected 422 for custom fields that are not an object, got %d", rec.Code)
+    }
+
+    // Patterns match whole values, even without ^ and $
+    defineField(t, router, `{"name":"ticket","type":"string","pattern":"[A-Z]+-\\d+|none"}`)
+    for _, tt := range []struct {
+        value string
+        code  int
+    }{
+        {"ABC-12", http.StatusOK},
+        {"none", http.StatusOK},
+        {"see ABC-12", http.StatusUnprocessableEntity},
+        {"ABC-12 or none", http.StatusUnprocessableEntity},
+    } {
+        rec := doPatch(router, path, "application/merge-patch+json", `{"custom_fields":{"ticket":"`+tt.value+`"}}`)
+        if rec.Code != tt.code {
+            t.Fatalf("Expected %d for the ticket %q, got %d: %s", tt.code, tt.value, rec.Code, rec.Body.String())
+        }
+    }
+
+    // The diff shows each changed field
+    rec = doRequest(router, "GET", path+"/diff?from=1&to=2", "")
+    var diff diffPage
+    json.NewDecoder(rec.Body).Decode(&diff)
+    if rec.Code != http.StatusOK || len(diff.Changes) != 2 || diff.Changes[0].Field != "custom_fields.code" || diff.Changes[1].Field != "custom_fields.vip" {
+        t.Fatalf("Expected the changed custom fields in the diff, got %d %+v", rec.Code, diff.Changes)
+    }
+}
+
+// Test that the contact list filters and sorts by custom fields, with pages missing values last
+func testFieldFilterAndSort(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    defineField(t, router, `{"name":"team","type":"enum","options":["sales","support"]}`)
+    defineField(t, router, `{"name":"score","type":"number"}`)
+    dana := addWithFields(t, router, "Dana", "0521111111", `{"team":"sales","score":9}`)
+    roni := addWithFields(t, router, "Roni", "0522222222", `{"team":"support","score":10}`)
+    gal := addWithFields(t, router, "Gal", "0523333333", `{"team":"sales"}`)
+    tal := addWithFields(t, router, "Tal", "0524444444", `{"score":2.5}`)
+
+    tests := []struct {
+        query    string
+        expected []int
+    }{
+        {"custom_fields.team=sales", []int{dana, gal}},
+        {"custom_fields.team=sales&custom_fields.score=9", []int{dana}},
+        {"custom_fields.score=2.50", []int{tal}},
+        {"sort=custom_fields.score", []int{tal, dana, roni, gal}},
+        {"sort=-custom_fields.score", []int{roni, dana, tal, gal}},
+        {"sort=custom_fields.team,-custom_fields.score", []int{dana, gal, roni, tal}},
+        {"custom_fields.team=sales&sort=-custom_fields.score", []int{dana, gal}},
+    }
+    for _, tt := range tests {
+        if ids := listIDs(t, router, "/api/v1/contacts?"+tt.query); !reflect.DeepEqual(ids, tt.expected) {
+            t.Fatalf("Expected %v for %s, got %v", tt.expected, tt.query, ids)
+        }
+    }
+
+    // Sorted pages are walked with cursors in both directions
+    read := func(query string) sortedPage {
+        rec := doRequest(router, "GET", "/api/v1/contacts?sort=custom_fields.score&limit=3"+query, "")
+        if rec.Code != http.StatusOK {
+            t.Fatalf("Expected 200 reading a sorted page, got %d: %s", rec.Code, rec.Body.String())
+        }
+        var page sortedPage
+        json.NewDecoder(rec.Body).Decode(&page)
+        return page
+    }
+    first := read("")
+    if len(first.Contacts) != 3 || first.NextCursor == "" || first.PrevCursor != "" {
+        t.Fatalf("Expected a first page with a next cursor, got %+v", first)
+    }
+    second := read("&after=" + first.NextCursor)
+    if len(second.Contacts) != 1 || second.Contacts[0].ID != gal || second.NextCursor != "" || second.PrevCursor == "" {
+        t.Fatalf("Expected the last contact on the second page, got %+v", second)
+    }
+    back := read("&before=" + second.PrevCursor)
+    if len(back.Contacts) != 3 || back.Contacts[0].ID != tal {
+        t.Fatalf("Expected the first page again, got %+v", back)
+    }
+
+    for _, query := range []string{"custom_fields.color=red", "custom_fields.score=high", "custom_fields.team=legal",
+        "sort=nickname", "sort=custom_fields.color", "sort=custom_fields.score&after=xyz"} {
+        if rec := doRequest(router, "GET", "/api/v1/contacts?"+query, ""); rec.Code != http.StatusBadRequest {
+            t.Fatalf("Expected 400 for %s, got %d", query, rec.Code)
+        }
+    }
+}
+
+// Test that defining and deleting custom fields needs fields:manage, which admins have
+func testFieldPermissions(t *testing.T) {
+    router, keys := newAuthRouter(t, nil, src.RoleEditor, src.RoleAdmin)
+    field := `{"name":"birthday","type":"date"}`
+
+    if rec := doAudited(router, keys[src.RoleEditor], "req-fields", "POST", "/api/v1/fields", field); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 for an editor defining a field, got %d", rec.Code)
+    }
+    if rec := doAudited(router, keys[src.RoleAdmin], "req-fields", "POST", "/api/v1/fields", field); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected an admin to define a field, got %d", rec.Code)
+    }
+    if rec := doAudited(router, keys[src.RoleEditor], "req-fields", "GET", "/fields/birthday", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected an editor to read the field, got %d", rec.Code)
+    }
+    if rec := doAudited(router, keys[src.RoleEditor], "req-fields", "DELETE", "/fields/birthday", ""); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 for an editor deleting a field, got %d", rec.Code)
+    }
+}
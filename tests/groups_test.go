@@ -0,0 +1,255 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all tag and group tests
+func TestGroups(t *testing.T) {
+    t.Run("Test Tags", func(t *testing.T) { forEachStore(t, testContactTags) })
+    t.Run("Test Groups", func(t *testing.T) { forEachStore(t, testContactGroups) })
+    t.Run("Test Tag Exports", testTagExports)
+}
+
+// contactList is the body of GET /api/v1/contacts
+type contactList struct {
+    Contacts []src.Contact `json:"contacts"`
+}
+
+// listIDs fetches a contact list or search and returns the ids in it, failing the test
+// unless it answers 200
+func listIDs(t *testing.T, handler http.Handler, path string) []int {
+    rec := doRequest(handler, "GET", path, "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 from %s, got %d: %s", path, rec.Code, rec.Body.String())
+    }
+    ids := []int{}
+    if strings.Contains(path, "/search") {
+        var page struct {
+            Results []src.SearchResult `json:"results"`
+        }
+        json.NewDecoder(rec.Body).Decode(&page)
+        for _, result := range page.Results {
+            ids = append(ids, result.Contact.ID)
+        }
+        return ids
+    }
+    var page contactList
+    json.NewDecoder(rec.Body).Decode(&page)
+    for _, contact := range page.Contacts {
+        ids = append(ids, contact.ID)
+    }
+    return ids
+}
+
+// decodeGroup decodes a group from a response, failing the test unless it has the status
+func decodeGroup(t *testing.T, rec *httptest.ResponseRecorder, status int) src.Group {
+    if rec.Code != status {
+        t.Fatalf("Expected %d, got %d: %s", status, rec.Code, rec.Body.String())
+    }
+    var group src.Group
+    json.NewDecoder(rec.Body).Decode(&group)
+    return group
+}
+
+// Test that tags are normalized, replaced by merge patches and filter the list and search
+func testContactTags(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    rec := doRequest(router, "POST", "/api/v1/contacts",
+        `{"first_name":"Dana","last_name":"Cohen","phone_number":"0521111111","address":"Haifa","tags":[" Family","work","family"]}`)
+    var dana src.Contact
+    json.NewDecoder(rec.Body).Decode(&dana)
+    if rec.Code != http.StatusCreated || !reflect.DeepEqual(dana.Tags, []string{"family", "work"}) {
+        t.Fatalf("Expected the tags trimmed, lowercased and sorted once each, got %d %+v", rec.Code, dana.Tags)
+    }
+    roni := addNumbered(t, router, "Roni", "0522222222")
+    if contact, _ := store.GetContact(roni); contact.Tags == nil || len(contact.Tags) != 0 {
+        t.Fatalf("Expected an empty tag list for a contact without tags, got %#v", contact.Tags)
+    }
+
+    invalid := []string{`{"tags":["a;b"]}`, `{"tags":[""]}`, `{"tags":["` + strings.Repeat("x", 51) + `"]}`, `{"tags":[1]}`}
+    for _, body := range invalid {
+        if rec := doRequest(router, "PATCH", "/api/v1/contacts/"+strconv.Itoa(roni), body); rec.Code != http.StatusUnprocessableEntity {
+            t.Fatalf("Expected 422 patching %s, got %d", body, rec.Code)
+        }
+    }
+
+    rec = doRequest(router, "PATCH", "/api/v1/contacts/"+strconv.Itoa(roni), `{"tags":["Work","VIP"]}`)
+    var patched src.Contact
+    json.NewDecoder(rec.Body).Decode(&patched)
+    if rec.Code != http.StatusOK || !reflect.DeepEqual(patched.Tags, []string{"vip", "work"}) || patched.Version != 2 {
+        t.Fatalf("Expected the tags replaced at version 2, got %d %+v", rec.Code, patched)
+    }
+
+    // A PUT without tags keeps them, like the other lists
+    rec = doRequest(router, "PUT", "/api/v1/contacts/"+strconv.Itoa(dana.ID), `{"first_name":"Dana","last_name":"Levi","phone_number":"0521111111","address":"Haifa"}`)
+    json.NewDecoder(rec.Body).Decode(&dana)
+    if rec.Code != http.StatusOK || len(dana.Tags) != 2 {
+        t.Fatalf("Expected the tags kept by a PUT without them, got %d %+v", rec.Code, dana.Tags)
+    }
+
+    tests := []struct {
+        path string
+        ids  []int
+    }{
+        {"/api/v1/contacts?tag=work", []int{dana.ID, roni}},
+        {"/api/v1/contacts?tag=WORK&limit=1", []int{dana.ID}},
+        {"/api/v1/contacts?tag=vip", []int{roni}},
+        {"/getContacts?tag=family", []int{dana.ID}},
+        {"/api/v1/contacts?tag=unknown", []int{}},
+        {"/api/v1/contacts/search?q=cohen&tag=vip", []int{roni}},
+    }
+    for _, tt := range tests {
+        if ids := listIDs(t, router, tt.path); !reflect.DeepEqual(ids, tt.ids) {
+            t.Fatalf("Expected %v from %s, got %v", tt.ids, tt.path, ids)
+        }
+    }
+
+    // Removing the tags shows up in the history
+    rec = doRequest(router, "PATCH", "/api/v1/contacts/"+strconv.Itoa(roni), `{"tags":null}`)
+    json.NewDecoder(rec.Body).Decode(&patched)
+    if rec.Code != http.StatusOK || patched.Tags == nil || len(patched.Tags) != 0 {
+        t.Fatalf("Expected null to remove every tag, got %d %+v", rec.Code, patched.Tags)
+    }
+    rec = doRequest(router, "GET", "/api/v1/contacts/"+strconv.Itoa(roni)+"/diff?from=2&to=3", "")
+    if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"field":"tags"`) {
+        t.Fatalf("Expected the tags in the diff, got %d %s", rec.Code, rec.Body.String())
+    }
+}
+
+// Test creating, renaming and deleting groups, changing their members and listing by group
+func testContactGroups(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    dana := addNumbered(t, router, "Dana", "0521111111")
+    roni := addNumbered(t, router, "Roni", "0522222222")
+    gal := addNumbered(t, router, "Gal", "0523333333")
+
+    rec := doRequest(router, "POST", "/api/v1/groups", `{"name":" Family "}`)
+    family := decodeGroup(t, rec, http.StatusCreated)
+    if family.Name != "Family" || family.ContactIDs == nil || rec.Header().Get("Location") != "/api/v1/groups/"+strconv.Itoa(family.ID) {
+        t.Fatalf("Expected the trimmed group with its location, got %+v %q", family, rec.Header().Get("Location"))
+    }
+    group := "/api/v1/groups/" + strconv.Itoa(family.ID)
+    friends := decodeGroup(t, doRequest(router, "POST", "/groups", `{"name":"Friends"}`), http.StatusCreated)
+
+    invalid := []struct {
+        method, path, body string
+        code               int
+    }{
+        {"POST", "/api/v1/groups", `{"name":"Family"}`, http.StatusConflict},
+        {"POST", "/api/v1/groups", `{"name":"  "}`, http.StatusUnprocessableEntity},
+        {"POST", "/api/v1/groups", `{"name":"` + strings.Repeat("x", 101) + `"}`, http.StatusUnprocessableEntity},
+        {"PATCH", group, `{"name":"Friends"}`, http.StatusConflict},
+        {"GET", "/api/v1/groups/999", "", http.StatusNotFound},
+        {"POST", group + "/members", `{"contact_ids":[]}`, http.StatusUnprocessableEntity},
+        {"POST", "/api/v1/groups/999/members", `{"contact_ids":[1]}`, http.StatusNotFound},
+        {"DELETE", group + "/members/" + strconv.Itoa(dana), "", http.StatusNotFound},
+        {"GET", "/api/v1/contacts?group=999", "", http.StatusNotFound},
+        {"GET", "/api/v1/contacts?group=family", "", http.StatusBadRequest},
+    }
+    for _, tt := range invalid {
+        if rec := doRequest(router, tt.method, tt.path, tt.body); rec.Code != tt.code {
+            t.Fatalf("Expected %d for %s %s, got %d: %s", tt.code, tt.method, tt.path, rec.Code, rec.Body.String())
+        }
+    }
+
+    // A missing contact adds no member at all
+    rec = doRequest(router, "POST", group+"/members", `{"contact_ids":[`+strconv.Itoa(dana)+`,999]}`)
+    if resp := decodeError(t, rec); rec.Code != http.StatusUnprocessableEntity || len(resp.Details) != 1 || resp.Details[0].Field != "contact_ids[1]" {
+        t.Fatalf("Expected 422 naming the missing contact, got %d %+v", rec.Code, resp)
+    }
+    rec = doRequest(router, "POST", group+"/members", `{"contact_ids":[`+strconv.Itoa(gal)+`,`+strconv.Itoa(dana)+`,`+strconv.Itoa(gal)+`]}`)
+    if family = decodeGroup(t, rec, http.StatusOK); !reflect.DeepEqual(family.ContactIDs, []int{dana, gal}) {
+        t.Fatalf("Expected Dana and Gal in the group once each, got %+v", family)
+    }
+    rec = doRequest(router, "POST", group+"/members", `{"contact_ids":[`+strconv.Itoa(dana)+`,`+strconv.Itoa(roni)+`]}`)
+    if family = decodeGroup(t, rec, http.StatusOK); len(family.ContactIDs) != 3 {
+        t.Fatalf("Expected members already in the group to be skipped, got %+v", family)
+    }
+    if ids := listIDs(t, router, "/api/v1/contacts?group="+strconv.Itoa(friends.ID)); len(ids) != 0 {
+        t.Fatalf("Expected no contact in an empty group, got %v", ids)
+    }
+
+    if rec := doRequest(router, "DELETE", group+"/members/"+strconv.Itoa(roni), ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 removing a member, got %d", rec.Code)
+    }
+    // Members in the trash are left out until they are restored
+    if rec := doRequest(router, "DELETE", "/api/v1/contacts/"+strconv.Itoa(gal), ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting a member, got %d", rec.Code)
+    }
+    if family = decodeGroup(t, doRequest(router, "GET", group, ""), http.StatusOK); !reflect.DeepEqual(family.ContactIDs, []int{dana}) {
+        t.Fatalf("Expected only Dana left in the group, got %+v", family)
+    }
+    if rec := doRequest(router, "POST", "/api/v1/trash/"+strconv.Itoa(gal)+"/restore", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 restoring a member, got %d", rec.Code)
+    }
+    if ids := listIDs(t, router, "/api/v1/contacts?group="+strconv.Itoa(family.ID)); !reflect.DeepEqual(ids, []int{dana, gal}) {
+        t.Fatalf("Expected the restored contact back in the group, got %v", ids)
+    }
+    if ids := listIDs(t, router, "/api/v1/contacts/search?q=cohen&group="+strconv.Itoa(family.ID)); len(ids) != 2 {
+        t.Fatalf("Expected the search narrowed down to the group, got %v", ids)
+    }
+
+    rec = doRequest(router, "PATCH", group, `{"name":"Relatives"}`)
+    if renamed := decodeGroup(t, rec, http.StatusOK); renamed.Name != "Relatives" || len(renamed.ContactIDs) != 2 {
+        t.Fatalf("Expected the group renamed with its members, got %+v", renamed)
+    }
+    var list struct {
+        Groups []src.Group `json:"groups"`
+    }
+    json.NewDecoder(doRequest(router, "GET", "/api/v1/groups", "").Body).Decode(&list)
+    if len(list.Groups) != 2 || list.Groups[0].Name != "Friends" || list.Groups[1].Name != "Relatives" {
+        t.Fatalf("Expected the groups ordered by name, got %+v", list.Groups)
+    }
+
+    if rec := doRequest(router, "DELETE", group, ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting the group, got %d", rec.Code)
+    }
+    if rec := doRequest(router, "GET", group, ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 reading a deleted group, got %d", rec.Code)
+    }
+    if _, err := store.GetContact(dana); err != nil {
+        t.Fatalf("Expected the members to outlive their group, got %v", err)
+    }
+}
+
+// Test that tags are written to and read from the CSV and vCard files, and narrow exports down
+func testTagExports(t *testing.T) {
+    source := src.NewMemoryStore("IL")
+    source.AddContact(src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "0521111111", Address: "Haifa", Tags: []string{"work", "family"}})
+    source.AddContact(src.Contact{FirstName: "Roni", LastName: "Levi", PhoneNumber: "0522222222", Address: "Eilat"})
+    router := src.NewRouter(source, nil)
+
+    rec := doRequest(router, "GET", "/contacts/export.csv", "")
+    lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+    if rec.Code != http.StatusOK || !strings.HasSuffix(lines[0], ",tags") || !strings.HasSuffix(lines[1], ",family;work") {
+        t.Fatalf("Expected a tags column, got %d %q", rec.Code, lines)
+    }
+    target := src.NewMemoryStore("IL")
+    doRequest(src.NewRouter(target, nil), "POST", "/contacts/import.csv", rec.Body.String())
+    if contacts, err := target.SearchContact("0521111111"); err != nil || !reflect.DeepEqual(contacts[0].Tags, []string{"family", "work"}) {
+        t.Fatalf("Expected the tags to survive the CSV round trip, got %+v (err=%v)", contacts, err)
+    }
+
+    rec = doRequest(router, "GET", "/contacts/export.vcf?tag=work", "")
+    if rec.Code != http.StatusOK || strings.Count(rec.Body.String(), "BEGIN:VCARD") != 1 || !strings.Contains(rec.Body.String(), "CATEGORIES:family,work\r\n") {
+        t.Fatalf("Expected only the tagged contact with its categories, got %d %s", rec.Code, rec.Body.String())
+    }
+    target = src.NewMemoryStore("IL")
+    doRequest(src.NewRouter(target, nil), "POST", "/contacts/import", rec.Body.String())
+    if contacts, err := target.SearchContact("0521111111"); err != nil || !reflect.DeepEqual(contacts[0].Tags, []string{"family", "work"}) {
+        t.Fatalf("Expected the categories imported as tags, got %+v (err=%v)", contacts, err)
+    }
+
+    if rec := doRequest(router, "GET", "/contacts/export.csv?phone_number=0522222222&tag=work", ""); strings.Count(rec.Body.String(), "\n") != 1 {
+        t.Fatalf("Expected no contact matching both the number and the tag, got %q", rec.Body.String())
+    }
+}
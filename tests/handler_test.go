@@ -0,0 +1,214 @@
+package tests
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all handler tests against the in-memory store
+func TestHandlers(t *testing.T) {
+    t.Run("Test Status Codes", testHandlerStatusCodes)
+    t.Run("Test Validation Details", testHandlerValidationDetails)
+    t.Run("Test Request ID", testHandlerRequestID)
+    t.Run("Test CORS Origins", testHandlerCORS)
+    t.Run("Test Changes by Number Are All or Nothing", func(t *testing.T) { forEachStore(t, testHandlerAllOrNothing) })
+}
+
+// failingStore fails every write to one contact, also inside its transactions
+type failingStore struct {
+    src.ContactStore
+    failID int
+}
+
+func (s failingStore) EditContact(id int, contact src.Contact, version int) (src.Contact, error) {
+    if id == s.failID {
+        return src.Contact{}, errors.New("write failed")
+    }
+    return s.ContactStore.EditContact(id, contact, version)
+}
+
+func (s failingStore) PatchContact(id int, patch src.ContactPatch, version int) (src.Contact, error) {
+    if id == s.failID {
+        return src.Contact{}, errors.New("write failed")
+    }
+    return s.ContactStore.PatchContact(id, patch, version)
+}
+
+func (s failingStore) DeleteContact(id int, version int) error {
+    if id == s.failID {
+        return errors.New("write failed")
+    }
+    return s.ContactStore.DeleteContact(id, version)
+}
+
+func (s failingStore) InTransaction(fn func(store src.ContactStore) error) error {
+    return s.ContactStore.(src.TransactionStore).InTransaction(func(tx src.ContactStore) error {
+        return fn(failingStore{tx, s.failID})
+    })
+}
+
+// doRequest sends a request to the handler and returns the recorded response
+func doRequest(handler http.Handler, method, path string, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+    req.Header.Set("Content-Type", "application/json")
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// decodeError decodes an error envelope from the response
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) src.ErrorResponse {
+    var envelope src.ErrorResponse
+    if err := json.NewDecoder(rec.Body).Decode(&envelope); err != nil {
+        t.Fatalf("Failed to decode error envelope: %v", err)
+    }
+    return envelope
+}
+
+// Test that every failure gets its own status code and error code
+func testHandlerStatusCodes(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+    validContact := `{"first_name":"Jonathan","last_name":"Makovsky","phone_number":"0543435590","address":"Tel Aviv"}`
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        body   string
+        status int
+        code   string
+    }{
+        {"malformed body", "POST", "/addContact", `{"first_name":`, http.StatusBadRequest, src.CodeBadRequest},
+        {"empty fields", "POST", "/addContact", `{"first_name":"Jonathan"}`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"add contact", "POST", "/addContact", validContact, http.StatusOK, ""},
+        {"search known number", "GET", "/searchContact/0543435590", "", http.StatusOK, ""},
+        {"search unknown number", "GET", "/searchContact/0000000000", "", http.StatusNotFound, src.CodeNotFound},
+        {"edit unknown number", "PUT", "/editContact/0000000000", validContact, http.StatusNotFound, src.CodeNotFound},
+        {"edit malformed body", "PUT", "/editContact/0543435590", `nope`, http.StatusBadRequest, src.CodeBadRequest},
+        {"delete unknown number", "DELETE", "/deleteContact/0000000000", "", http.StatusNotFound, src.CodeNotFound},
+        {"delete known number", "DELETE", "/deleteContact/0543435590", "", http.StatusOK, ""},
+        {"bad cursor", "GET", "/getContacts?after=not-a-cursor", "", http.StatusBadRequest, src.CodeBadRequest},
+        {"unknown route", "GET", "/nope", "", http.StatusNotFound, src.CodeNotFound},
+        {"wrong method", "PATCH", "/addContact", "", http.StatusMethodNotAllowed, src.CodeMethodNotAllowed},
+    }
+
+    for _, tc := range tests {
+        rec := doRequest(router, tc.method, tc.path, tc.body)
+        if rec.Code != tc.status {
+            t.Fatalf("%s: expected status %d, got %d (%s)", tc.name, tc.status, rec.Code, rec.Body.String())
+        }
+        if tc.code != "" {
+            if envelope := decodeError(t, rec); envelope.Code != tc.code {
+                t.Fatalf("%s: expected error code %q, got %q", tc.name, tc.code, envelope.Code)
+            }
+        }
+    }
+}
+
+// Test that validation failures list every offending field
+func testHandlerValidationDetails(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+
+    rec := doRequest(router, "POST", "/addContact", `{"first_name":"Jonathan","address":"Tel Aviv"}`)
+    envelope := decodeError(t, rec)
+    if len(envelope.Details) != 2 {
+        t.Fatalf("Expected 2 field errors, got %+v", envelope.Details)
+    }
+    if envelope.Details[0].Field != "last_name" || envelope.Details[1].Field != "phone_number" {
+        t.Fatalf("Expected last_name and phone_number to be reported, got %+v", envelope.Details)
+    }
+}
+
+// Test that the request id is echoed in the header and the error envelope
+func testHandlerRequestID(t *testing.T) {
+    router := src.NewRouter(src.NewMemoryStore("IL"), nil)
+
+    req := httptest.NewRequest("GET", "/searchContact/0000000000", nil)
+    req.Header.Set("X-Request-ID", "test-request")
+    rec := httptest.NewRecorder()
+    router.ServeHTTP(rec, req)
+
+    if got := rec.Header().Get("X-Request-ID"); got != "test-request" {
+        t.Fatalf("Expected X-Request-ID header to be echoed, got %q", got)
+    }
+    if envelope := decodeError(t, rec); envelope.RequestID != "test-request" {
+        t.Fatalf("Expected request_id in envelope, got %q", envelope.RequestID)
+    }
+
+    rec = doRequest(router, "GET", "/searchContact/0000000000", "")
+    if rec.Header().Get("X-Request-ID") == "" {
+        t.Fatalf("Expected a generated request id")
+    }
+}
+
+// Test that a failure on one of the contacts with a number leaves all of them unchanged
+func testHandlerAllOrNothing(t *testing.T, store src.ContactStore) {
+    first, _ := store.AddContact(src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "0521234567", Address: "Haifa"})
+    second, _ := store.AddContact(src.Contact{FirstName: "Avi", LastName: "Cohen", PhoneNumber: "0521234567", Address: "Haifa"})
+    router := src.NewRouter(failingStore{store, second}, nil)
+
+    requests := []struct {
+        method string
+        path   string
+        body   string
+    }{
+        {"PUT", "/editContact/0521234567", `{"first_name":"Noa","last_name":"Levi","phone_number":"0521234567","address":"Eilat"}`},
+        {"PATCH", "/editContact/0521234567", `{"address":"Eilat"}`},
+        {"DELETE", "/deleteContact/0521234567", ""},
+    }
+    for _, tt := range requests {
+        if rec := doRequest(router, tt.method, tt.path, tt.body); rec.Code != http.StatusInternalServerError {
+            t.Fatalf("Expected %s to fail with 500, got %d: %s", tt.method, rec.Code, rec.Body.String())
+        }
+        contact, err := store.GetContact(first)
+        if err != nil || contact.FirstName != "Dana" || contact.Address != "Haifa" {
+            t.Fatalf("Expected %s to leave the first contact unchanged, got %+v (err=%v)", tt.method, contact, err)
+        }
+    }
+}
+
+// Test that only listed origins are echoed back, and that preflights are answered directly
+func testHandlerCORS(t *testing.T) {
+    origins := src.ParseAllowedOrigins(" https://phonebook.example.com/, null,")
+    handler := src.CORS(origins, src.NewRouter(src.NewMemoryStore("IL"), nil))
+
+    tests := []struct {
+        method string
+        origin string
+        allow  string
+        status int
+    }{
+        {"GET", "https://phonebook.example.com", "https://phonebook.example.com", http.StatusOK},
+        {"GET", "null", "null", http.StatusOK},
+        {"GET", "https://evil.example.com", "", http.StatusOK},
+        {"GET", "", "", http.StatusOK},
+        {"OPTIONS", "https://phonebook.example.com", "https://phonebook.example.com", http.StatusOK},
+        {"OPTIONS", "https://evil.example.com", "", http.StatusOK},
+    }
+    for _, tt := range tests {
+        req := httptest.NewRequest(tt.method, "/api/v1/contacts", nil)
+        if tt.origin != "" {
+            req.Header.Set("Origin", tt.origin)
+        }
+        rec := httptest.NewRecorder()
+        handler.ServeHTTP(rec, req)
+        if rec.Code != tt.status || rec.Header().Get("Access-Control-Allow-Origin") != tt.allow || rec.Header().Get("Vary") != "Origin" {
+            t.Fatalf("Expected %d allowing %q for %s from %q, got %d with %v", tt.status, tt.allow, tt.method, tt.origin, rec.Code, rec.Header())
+        }
+    }
+
+    req := httptest.NewRequest("GET", "/api/v1/contacts", nil)
+    req.Header.Set("Origin", "null")
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    if exposed := rec.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Link") || !strings.Contains(exposed, "Accept-Patch") {
+        t.Fatalf("Expected Link and Accept-Patch to be exposed, got %q", exposed)
+    }
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all contact history tests
+func TestHistory(t *testing.T) {
+    t.Run("Test Contact History and Diff", func(t *testing.T) { forEachStore(t, testContactHistory) })
+    t.Run("Test Restore Contact", func(t *testing.T) { forEachStore(t, testRestore) })
+}
+
+// historyPage is the body of GET /api/v1/contacts/{id}/history
+type historyPage struct {
+    ContactID int            `json:"contact_id"`
+    Revisions []src.Revision `json:"revisions"`
+}
+
+// diffPage is the body of GET /api/v1/contacts/{id}/diff
+type diffPage struct {
+    From    int          `json:"from"`
+    To      int          `json:"to"`
+    Changes []src.Change `json:"changes"`
+}
+
+// createEditedContact creates a contact and edits its last name, then its address, and
+// returns its path under /api/v1
+func createEditedContact(t *testing.T, handler http.Handler) string {
+    rec := doAudited(handler, "", "req-create", "POST", "/api/v1/contacts",
+        `{"first_name":"Dana","last_name":"Cohen","phone_number":"052-123-4567","address":"Haifa","emails":[{"address":"dana@example.com"}]}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating the contact, got %d", rec.Code)
+    }
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    path := "/api/v1/contacts/" + strconv.Itoa(created.ID)
+    for _, patch := range []string{`{"last_name":"Levi"}`, `{"address":"Tel Aviv","emails":[]}`} {
+        if rec := doAudited(handler, "", "req-edit", "PATCH", path, patch); rec.Code != http.StatusOK {
+            t.Fatalf("Expected 200 patching the contact with %s, got %d", patch, rec.Code)
+        }
+    }
+    return path
+}
+
+// readHistory fetches the history of the contact and fails the test unless it answers 200
+func readHistory(t *testing.T, handler http.Handler, path string) historyPage {
+    rec := doAudited(handler, "", "req-history", "GET", path+"/history", "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 reading the history, got %d: %s", rec.Code, rec.Body.String())
+    }
+    var page historyPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page
+}
+
+// Test that every version of a contact is listed, deletion included, and that revisions can be compared
+func testContactHistory(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    path := createEditedContact(t, router)
+
+    page := readHistory(t, router, path)
+    if len(page.Revisions) != 3 {
+        t.Fatalf("Expected three revisions, got %+v", page.Revisions)
+    }
+    for i, want := range []struct {
+        revision int
+        action   string
+        lastName string
+    }{{3, src.AuditUpdate, "Levi"}, {2, src.AuditUpdate, "Levi"}, {1, src.AuditCreate, "Cohen"}} {
+        revision := page.Revisions[i]
+        if revision.Revision != want.revision || revision.Action != want.action || revision.Contact == nil || revision.Contact.LastName != want.lastName {
+            t.Fatalf("Revision %d: expected %s of %s, got %+v", want.revision, want.action, want.lastName, revision)
+        }
+    }
+
+    rec := doAudited(router, "", "req-diff", "GET", path+"/diff?from=1", "")
+    var diff diffPage
+    json.NewDecoder(rec.Body).Decode(&diff)
+    if rec.Code != http.StatusOK || diff.From != 1 || diff.To != 3 {
+        t.Fatalf("Expected the diff from revision 1 to the latest, got %d %+v", rec.Code, diff)
+    }
+    changed := map[string]bool{}
+    for _, change := range diff.Changes {
+        changed[change.Field] = true
+    }
+    if len(diff.Changes) != 4 || !changed["last_name"] || !changed["address"] || !changed["addresses"] || !changed["emails"] {
+        t.Fatalf("Expected last_name, address, addresses and emails to differ, got %+v", diff.Changes)
+    }
+    rec = doAudited(router, "", "req-diff", "GET", path+"/diff?from=2&to=3", "")
+    json.NewDecoder(rec.Body).Decode(&diff)
+    if len(diff.Changes) != 3 || diff.Changes[0].Field != "address" || diff.Changes[0].From != "Haifa" || diff.Changes[0].To != "Tel Aviv" {
+        t.Fatalf("Expected the address change between revisions 2 and 3, got %+v", diff.Changes)
+    }
+
+    // Deleted contacts keep their history
+    if rec := doAudited(router, "", "req-delete", "DELETE", path, ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting the contact, got %d", rec.Code)
+    }
+    page = readHistory(t, router, path)
+    if len(page.Revisions) != 4 || page.Revisions[0].Action != src.AuditDelete || page.Revisions[0].Revision != 3 || page.Revisions[0].Contact != nil {
+        t.Fatalf("Expected the deletion on top of the history, got %+v", page.Revisions)
+    }
+
+    for _, bad := range []struct {
+        path   string
+        status int
+    }{
+        {"/api/v1/contacts/999/history", http.StatusNotFound},
+        {path + "/diff", http.StatusBadRequest},
+        {path + "/diff?from=x", http.StatusBadRequest},
+        {path + "/diff?from=1&to=9", http.StatusUnprocessableEntity},
+    } {
+        if rec := doAudited(router, "", "req-bad", "GET", bad.path, ""); rec.Code != bad.status {
+            t.Fatalf("Expected %d for %s, got %d", bad.status, bad.path, rec.Code)
+        }
+    }
+}
+
+// Test reverting an edited contact and bringing a deleted one back
+func testRestore(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    path := createEditedContact(t, router)
+
+    rec := doAudited(router, "", "req-restore", "POST", path+"/restore?revision=1", "")
+    var restored src.Contact
+    json.NewDecoder(rec.Body).Decode(&restored)
+    if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"v4"` {
+        t.Fatalf("Expected 200 with the new version's ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+    }
+    if restored.LastName != "Cohen" || restored.Address != "Haifa" || restored.Version != 4 || len(restored.Emails) != 1 || restored.Emails[0].Address != "dana@example.com" {
+        t.Fatalf("Expected the first revision back as version 4, got %+v", restored)
+    }
+    page := readHistory(t, router, path)
+    if page.Revisions[0].Action != src.AuditRestore || page.Revisions[0].Revision != 4 || len(page.Revisions) != 4 {
+        t.Fatalf("Expected the restore on top of the history, got %+v", page.Revisions)
+    }
+
+    // A deleted contact comes back under its id
+    if rec := doAudited(router, "", "req-delete", "DELETE", path, ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting the contact, got %d", rec.Code)
+    }
+    rec = doAudited(router, "", "req-undelete", "POST", path+"/restore?revision=3", "")
+    json.NewDecoder(rec.Body).Decode(&restored)
+    if rec.Code != http.StatusOK || restored.LastName != "Levi" || restored.Address != "Tel Aviv" || restored.Version != 5 {
+        t.Fatalf("Expected revision 3 back as version 5, got %d %+v", rec.Code, restored)
+    }
+    rec = doAudited(router, "", "req-read", "GET", path, "")
+    var read src.Contact
+    json.NewDecoder(rec.Body).Decode(&read)
+    if rec.Code != http.StatusOK || read.ID != restored.ID || read.Version != 5 || len(read.Emails) != 0 || len(read.Addresses) != 1 {
+        t.Fatalf("Expected the un-deleted contact to be readable again, got %d %+v", rec.Code, read)
+    }
+    if rec := doAudited(router, "", "req-search", "GET", "/searchContact/0521234567", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected the un-deleted contact to be found by its number, got %d", rec.Code)
+    }
+
+    for _, bad := range []struct {
+        path   string
+        status int
+    }{
+        {path + "/restore", http.StatusBadRequest},
+        {path + "/restore?revision=0", http.StatusBadRequest},
+        {path + "/restore?revision=42", http.StatusUnprocessableEntity},
+        {"/api/v1/contacts/999/restore?revision=1", http.StatusNotFound},
+    } {
+        if rec := doAudited(router, "", "req-bad", "POST", bad.path, ""); rec.Code != bad.status {
+            t.Fatalf("Expected %d for %s, got %d", bad.status, bad.path, rec.Code)
+        }
+    }
+}
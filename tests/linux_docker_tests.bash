@@ -1,3 +1,6 @@
+# The admin key comes from the environment, or a throwaway one is made for this run
+export ADMIN_API_KEY=${ADMIN_API_KEY:-$(head -c 16 /dev/urandom | od -An -tx1 | tr -d ' \n')}
+
 # Step 1: Start the Docker containers using Docker Compose
 echo "Starting Docker containers..."
 docker-compose -f ../setup/docker-compose.yml up -d --build
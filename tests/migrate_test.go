@@ -0,0 +1,152 @@
+package tests
+
+import (
+    "database/sql"
+    "path/filepath"
+    "regexp"
+    "testing"
+    "testing/fstest"
+    "time"
+
+    "github.com/DATA-DOG/go-sqlmock"
+    _ "modernc.org/sqlite"
+
+    "Rise/src"
+    "Rise/src/migrate"
+)
+
+// Test function to run all migration tests
+func TestMigrate(t *testing.T) {
+    t.Run("Test Up, Status and Down on SQLite", testMigrateSQLite)
+    t.Run("Test Migration File Names", testMigrateFiles)
+    t.Run("Test PostgreSQL Advisory Lock", testMigratePostgresLock)
+}
+
+// Test applying, listing and reverting the embedded migrations
+func testMigrateSQLite(t *testing.T) {
+    db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "phonebook.db"))
+    if err != nil {
+        t.Fatalf("Failed to open sqlite database: %v", err)
+    }
+    defer db.Close()
+    db.SetMaxOpenConns(1)
+
+    migrator, err := src.Migrator(db, migrate.SQLite)
+    if err != nil {
+        t.Fatalf("Failed to load the migrations: %v", err)
+    }
+    applied, err := migrator.Up()
+    if err != nil || len(applied) < 2 || applied[0].Version != 1 {
+        t.Fatalf("Expected every migration to be applied in order, got %+v (err=%v)", applied, err)
+    }
+    if again, err := migrator.Up(); err != nil || len(again) != 0 {
+        t.Fatalf("Expected a second run to apply nothing, got %+v (err=%v)", again, err)
+    }
+
+    // The store opens on the migrated database without applying anything twice
+    store, err := src.NewSQLiteStore(db, "IL")
+    if err != nil {
+        t.Fatalf("Failed to create sqlite store: %v", err)
+    }
+    if _, err := store.AddContact(src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "0521234567", Address: "Haifa"}); err != nil {
+        t.Fatalf("Failed to add a contact to the migrated schema: %v", err)
+    }
+
+    last := applied[len(applied)-1]
+    reverted, err := migrator.Down(1)
+    if err != nil || len(reverted) != 1 || reverted[0].Version != last.Version {
+        t.Fatalf("Expected the last migration to be reverted, got %+v (err=%v)", reverted, err)
+    }
+    statuses, err := migrator.Status()
+    if err != nil || len(statuses) != len(applied) {
+        t.Fatalf("Expected a status per migration, got %+v (err=%v)", statuses, err)
+    }
+    if statuses[0].AppliedAt == nil || statuses[len(statuses)-1].AppliedAt != nil {
+        t.Fatalf("Expected only the reverted migration to be pending, got %+v", statuses)
+    }
+
+    if reverted, err := migrator.Down(100); err != nil || len(reverted) != len(applied)-1 {
+        t.Fatalf("Expected the remaining migrations to be reverted, got %+v (err=%v)", reverted, err)
+    }
+    var tables int
+    db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name LIKE 'contact%'").Scan(&tables)
+    if tables != 0 {
+        t.Fatalf("Expected every contact table to be dropped, %d remain", tables)
+    }
+}
+
+// Test that badly named or incomplete migration files are refused
+func testMigrateFiles(t *testing.T) {
+    tests := []struct {
+        name  string
+        files fstest.MapFS
+    }{
+        {"missing down file", fstest.MapFS{"0001_init.up.sql": {Data: []byte("SELECT 1")}}},
+        {"no version", fstest.MapFS{"init.up.sql": {Data: []byte("SELECT 1")}, "init.down.sql": {Data: []byte("SELECT 1")}}},
+        {"no direction", fstest.MapFS{"0001_init.sql": {Data: []byte("SELECT 1")}}},
+        {"two names", fstest.MapFS{"0001_init.up.sql": {Data: []byte("SELECT 1")}, "0001_other.down.sql": {Data: []byte("SELECT 1")}}},
+    }
+    for _, tt := range tests {
+        if _, err := migrate.New(nil, migrate.SQLite, tt.files); err == nil {
+            t.Fatalf("%s: expected the migrations to be refused", tt.name)
+        }
+    }
+    if _, err := migrate.New(nil, "oracle", fstest.MapFS{}); err == nil {
+        t.Fatalf("Expected an unknown dialect to be refused")
+    }
+}
+
+// Test that PostgreSQL migrations run under the advisory lock, each in its own transaction
+func testMigratePostgresLock(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    files := fstest.MapFS{
+        "0001_create_things.up.sql":   {Data: []byte("CREATE TABLE things (id INTEGER)")},
+        "0001_create_things.down.sql": {Data: []byte("DROP TABLE things")},
+        "0002_add_name.up.sql":        {Data: []byte("ALTER TABLE things ADD COLUMN name TEXT")},
+        "0002_add_name.down.sql":      {Data: []byte("ALTER TABLE things DROP COLUMN name")},
+    }
+    migrator, err := migrate.New(db, migrate.Postgres, files)
+    if err != nil {
+        t.Fatalf("Failed to load the migrations: %v", err)
+    }
+
+    // Migration 1 is already applied, so only migration 2 runs
+    mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT version, name, applied_at FROM schema_migrations")).
+        WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).AddRow(1, "create_things", time.Now()))
+    mock.ExpectBegin()
+    mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE things ADD COLUMN name TEXT")).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)")).
+        WithArgs(2, "add_name", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+    mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    applied, err := migrator.Up()
+    if err != nil || len(applied) != 1 || applied[0].Name != "add_name" {
+        t.Fatalf("Expected only the pending migration to run, got %+v (err=%v)", applied, err)
+    }
+
+    // A failing migration is rolled back and the lock is still released
+    mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT version, name, applied_at FROM schema_migrations")).
+        WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}))
+    mock.ExpectBegin()
+    mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE things (id INTEGER)")).WillReturnError(sql.ErrConnDone)
+    mock.ExpectRollback()
+    mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1)")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+    if applied, err := migrator.Up(); err == nil || len(applied) != 0 {
+        t.Fatalf("Expected the failing migration to be reported, got %+v (err=%v)", applied, err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
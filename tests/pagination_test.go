@@ -0,0 +1,158 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "regexp"
+    "strconv"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all list paging tests
+func TestPagination(t *testing.T) {
+    t.Run("Test Totals", func(t *testing.T) { forEachStore(t, testPageTotals) })
+    t.Run("Test Link Headers", func(t *testing.T) { forEachStore(t, testPageLinks) })
+}
+
+// listPage is the body of GET /api/v1/contacts with its page metadata
+type listPage struct {
+    Contacts       []src.Contact `json:"contacts"`
+    Limit          int           `json:"limit"`
+    Total          *int          `json:"total"`
+    TotalEstimated bool          `json:"total_estimated"`
+    TotalCapped    bool          `json:"total_capped"`
+    HasMore        bool          `json:"has_more"`
+    NextCursor     string        `json:"next_cursor"`
+    PrevCursor     string        `json:"prev_cursor"`
+}
+
+// addSeries adds n contacts named Contact1..Contactn and returns their ids
+func addSeries(t *testing.T, store src.ContactStore, n int) []int {
+    var ids []int
+    for i := 1; i <= n; i++ {
+        id, err := store.AddContact(src.Contact{FirstName: "Contact" + strconv.Itoa(i), LastName: "Levi",
+            PhoneNumber: "05211111" + strconv.Itoa(10+i), Address: "Haifa"})
+        if err != nil {
+            t.Fatalf("Failed to add contact %d: %v", i, err)
+        }
+        ids = append(ids, id)
+    }
+    return ids
+}
+
+// readListPage requests a page of the contact list, failing the test unless it answers 200
+func readListPage(t *testing.T, handler http.Handler, path string) (listPage, http.Header) {
+    rec := doRequest(handler, "GET", path, "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 from %s, got %d: %s", path, rec.Code, rec.Body.String())
+    }
+    var page listPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page, rec.Header()
+}
+
+// Test that list pages report their size, the total of the list and whether more follow
+func testPageTotals(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    addSeries(t, store, 12)
+
+    tests := []struct {
+        path     string
+        contacts int
+        limit    int
+        total    int // -1 when the total is left out
+        hasMore  bool
+    }{
+        {"/api/v1/contacts", 10, 10, 12, true},
+        {"/api/v1/contacts?limit=5", 5, 5, 12, true},
+        {"/api/v1/contacts?limit=500", 12, 100, 12, false},
+        {"/api/v1/contacts?first_name.prefix=contact1", 4, 10, 4, false},
+        {"/api/v1/contacts?sort=-first_name&limit=3&count=capped", 3, 3, 12, true},
+        {"/api/v1/contacts?limit=3&count=exact", 3, 3, 12, true},
+        {"/api/v1/contacts?limit=3&count=estimated", 3, 3, 12, true},
+        {"/api/v1/contacts?count=none", 10, 10, -1, true},
+        {"/getContacts?limit=20", 12, 20, 12, false},
+    }
+    for _, tt := range tests {
+        page, _ := readListPage(t, router, tt.path)
+        total := -1
+        if page.Total != nil {
+            total = *page.Total
+        }
+        if len(page.Contacts) != tt.contacts || page.Limit != tt.limit || total != tt.total || page.HasMore != tt.hasMore || page.TotalEstimated || page.TotalCapped {
+            t.Fatalf("Expected %d contacts, limit %d, total %d and has_more %v from %s, got %+v",
+                tt.contacts, tt.limit, tt.total, tt.hasMore, tt.path, page)
+        }
+    }
+
+    for _, query := range []string{"count=all", "limit=0", "limit=ten"} {
+        rec := doRequest(router, "GET", "/api/v1/contacts?"+query, "")
+        if resp := decodeError(t, rec); rec.Code != http.StatusBadRequest || resp.Code != src.CodeBadRequest {
+            t.Fatalf("Expected 400 for %s, got %d %+v", query, rec.Code, resp)
+        }
+    }
+}
+
+// linkPattern matches one link of a Link header
+var linkPattern = regexp.MustCompile(`<([^>]*)>; rel="(\w+)"`)
+
+// pageLinkTargets returns the targets of the Link header by relation
+func pageLinkTargets(header http.Header) map[string]string {
+    links := map[string]string{}
+    for _, match := range linkPattern.FindAllStringSubmatch(header.Get("Link"), -1) {
+        links[match[2]] = match[1]
+    }
+    return links
+}
+
+// Test that the Link header leads to the first, previous, next and last pages and keeps the
+// other parameters of the request
+func testPageLinks(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    ids := addSeries(t, store, 7)
+
+    tests := []struct {
+        query string
+        first string
+    }{
+        {"limit=3&last_name.eq=levi", "/api/v1/contacts?last_name.eq=levi&limit=3"},
+        {"sort=first_name&limit=3&last_name.eq=levi", "/api/v1/contacts?last_name.eq=levi&limit=3&sort=first_name"},
+    }
+    for _, tt := range tests {
+        query := tt.query
+        first, header := readListPage(t, router, "/api/v1/contacts?"+query)
+        links := pageLinkTargets(header)
+        if _, ok := links["prev"]; ok || links["first"] != tt.first {
+            t.Fatalf("Expected a first link without cursors and no prev link for %s, got %v", query, links)
+        }
+
+        // The next link leads to the following page, whose prev link leads back
+        second, header := readListPage(t, router, links["next"])
+        if second.Contacts[0].ID != ids[3] || !second.HasMore {
+            t.Fatalf("Expected the next link to lead to the second page for %s, got %+v", query, second)
+        }
+        back, _ := readListPage(t, router, pageLinkTargets(header)["prev"])
+        if back.Contacts[0].ID != first.Contacts[0].ID || len(back.Contacts) != 3 {
+            t.Fatalf("Expected the prev link to lead back to the first page for %s, got %+v", query, back)
+        }
+
+        // The last page holds the last contacts and has no next link
+        last, header := readListPage(t, router, links["last"])
+        if len(last.Contacts) != 3 || last.Contacts[2].ID != ids[6] || last.HasMore {
+            t.Fatalf("Expected the last link to lead to the last three contacts for %s, got %+v", query, last)
+        }
+        if _, ok := pageLinkTargets(header)["next"]; ok {
+            t.Fatalf("Expected no next link on the last page for %s, got %s", query, header.Get("Link"))
+        }
+    }
+
+    // Sorted lists lead to their last page without counting them
+    _, header := readListPage(t, router, "/api/v1/contacts?sort=-first_name&count=none&limit=2")
+    last, _ := readListPage(t, router, pageLinkTargets(header)["last"])
+    if len(last.Contacts) != 2 || last.Contacts[1].ID != ids[0] || last.HasMore {
+        t.Fatalf("Expected the last link to lead to the last two contacts without a total, got %+v", last)
+    }
+}
+
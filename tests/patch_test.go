@@ -0,0 +1,169 @@
+package tests
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all PATCH tests
+func TestPatch(t *testing.T) {
+    t.Run("Test Merge Patch", testMergePatch)
+    t.Run("Test Merge Patch Errors", testMergePatchErrors)
+    t.Run("Test JSON Patch", testJSONPatch)
+    t.Run("Test Unsupported Media Type", testPatchUnsupportedMediaType)
+    t.Run("Test Legacy Patch Route", testLegacyPatch)
+}
+
+// doPatch sends a PATCH request with the given Content-Type
+func doPatch(handler http.Handler, path, contentType, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest("PATCH", path, bytes.NewBufferString(body))
+    req.Header.Set("Content-Type", contentType)
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// newPatchFixture returns a router over a store holding one contact and that contact's path
+func newPatchFixture(t *testing.T) (http.Handler, *src.MemoryStore, string) {
+    store := src.NewMemoryStore("IL")
+    id, err := store.AddContact(src.Contact{FirstName: "Jonathan", LastName: "Makovsky", PhoneNumber: "0543435590", Address: "Tel Aviv"})
+    if err != nil {
+        t.Fatalf("Failed to add contact: %v", err)
+    }
+    return src.NewRouter(store, nil), store, fmt.Sprintf("/api/v1/contacts/%d", id)
+}
+
+// Test that a merge patch changes only the fields it names
+func testMergePatch(t *testing.T) {
+    router, _, path := newPatchFixture(t)
+
+    rec := doPatch(router, path, "application/merge-patch+json", `{"address":"Haifa","phone_number":"052-123-4567"}`)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    var contact src.Contact
+    json.NewDecoder(rec.Body).Decode(&contact)
+    if contact.FirstName != "Jonathan" || contact.Address != "Haifa" || contact.PhoneE164 != "+972521234567" {
+        t.Fatalf("Expected address and phone to change, got %+v", contact)
+    }
+
+    // Plain application/json bodies are read as merge patches too
+    rec = doPatch(router, path, "application/json", `{"last_name":"M"}`)
+    json.NewDecoder(rec.Body).Decode(&contact)
+    if rec.Code != http.StatusOK || contact.LastName != "M" || contact.Address != "Haifa" {
+        t.Fatalf("Expected only the last name to change, got %d %+v", rec.Code, contact)
+    }
+}
+
+// Test the fields a merge patch may not touch
+func testMergePatchErrors(t *testing.T) {
+    router, _, path := newPatchFixture(t)
+
+    rec := doPatch(router, path, "application/merge-patch+json", `{"address":null,"id":7,"nickname":"J","first_name":""}`)
+    if rec.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("Expected status 422, got %d", rec.Code)
+    }
+    envelope := decodeError(t, rec)
+    want := map[string]string{
+        "address":    "is required and cannot be removed",
+        "first_name": "is required",
+        "id":         "is read-only",
+        "nickname":   "is not a contact field",
+    }
+    if len(envelope.Details) != len(want) {
+        t.Fatalf("Expected %d details, got %+v", len(want), envelope.Details)
+    }
+    for _, detail := range envelope.Details {
+        if want[detail.Field] != detail.Issue {
+            t.Fatalf("Expected %s to be reported as %q, got %q", detail.Field, want[detail.Field], detail.Issue)
+        }
+    }
+
+    for _, body := range []string{`["not","an","object"]`, `null`, `{`} {
+        if rec := doPatch(router, path, "application/merge-patch+json", body); rec.Code != http.StatusBadRequest {
+            t.Fatalf("Expected status 400 for %s, got %d", body, rec.Code)
+        }
+    }
+    if rec := doPatch(router, "/api/v1/contacts/999", "application/merge-patch+json", `{"address":"Haifa"}`); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected status 404 for an unknown id, got %d", rec.Code)
+    }
+}
+
+// Test the operations of a JSON Patch and its atomicity
+func testJSONPatch(t *testing.T) {
+    router, store, path := newPatchFixture(t)
+
+    rec := doPatch(router, path, "application/json-patch+json",
+        `[{"op":"test","path":"/first_name","value":"Jonathan"},{"op":"replace","path":"/address","value":"Eilat"},{"op":"copy","from":"/last_name","path":"/first_name"}]`)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    var contact src.Contact
+    json.NewDecoder(rec.Body).Decode(&contact)
+    if contact.FirstName != "Makovsky" || contact.Address != "Eilat" {
+        t.Fatalf("Expected the copy and replace to apply, got %+v", contact)
+    }
+
+    tests := []struct {
+        name   string
+        body   string
+        status int
+        code   string
+    }{
+        {"failed test", `[{"op":"replace","path":"/address","value":"Haifa"},{"op":"test","path":"/first_name","value":"Jonathan"}]`, http.StatusConflict, src.CodeConflict},
+        {"remove required field", `[{"op":"remove","path":"/address"}]`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"move leaves a field empty", `[{"op":"move","from":"/address","path":"/last_name"}]`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"read-only path", `[{"op":"replace","path":"/id","value":"3"}]`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"unknown operation", `[{"op":"swap","path":"/address","value":"Haifa"}]`, http.StatusUnprocessableEntity, src.CodeValidationFailed},
+        {"not an array", `{"op":"replace"}`, http.StatusBadRequest, src.CodeBadRequest},
+    }
+    for _, tt := range tests {
+        rec := doPatch(router, path, "application/json-patch+json", tt.body)
+        if rec.Code != tt.status {
+            t.Fatalf("%s: expected status %d, got %d (%s)", tt.name, tt.status, rec.Code, rec.Body.String())
+        }
+        if envelope := decodeError(t, rec); envelope.Code != tt.code {
+            t.Fatalf("%s: expected error code %q, got %q", tt.name, tt.code, envelope.Code)
+        }
+    }
+
+    // None of the failed patches changed the contact
+    if got, _ := store.GetContact(contact.ID); !reflect.DeepEqual(got, contact) {
+        t.Fatalf("Expected failed patches to leave %+v untouched, got %+v", contact, got)
+    }
+}
+
+// Test that other media types are refused with the accepted ones listed
+func testPatchUnsupportedMediaType(t *testing.T) {
+    router, _, path := newPatchFixture(t)
+
+    rec := doPatch(router, path, "text/plain", `address=Haifa`)
+    if rec.Code != http.StatusUnsupportedMediaType {
+        t.Fatalf("Expected status 415, got %d", rec.Code)
+    }
+    if rec.Header().Get("Accept-Patch") == "" {
+        t.Fatalf("Expected an Accept-Patch header")
+    }
+}
+
+// Test that the legacy edit route accepts a partial update for every contact with the number
+func testLegacyPatch(t *testing.T) {
+    router, store, _ := newPatchFixture(t)
+    store.AddContact(src.Contact{FirstName: "Yael", LastName: "Makovsky", PhoneNumber: "054-343-5590", Address: "Haifa"})
+
+    rec := doPatch(router, "/editContact/0543435590", "application/merge-patch+json", `{"address":"Jerusalem"}`)
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    contacts, _ := store.SearchContact("0543435590")
+    if len(contacts) != 2 || contacts[0].Address != "Jerusalem" || contacts[1].Address != "Jerusalem" || contacts[1].FirstName != "Yael" {
+        t.Fatalf("Expected both contacts to move to Jerusalem keeping their names, got %+v", contacts)
+    }
+}
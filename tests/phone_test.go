@@ -0,0 +1,52 @@
+package tests
+
+import (
+    "errors"
+    "testing"
+
+    "Rise/src/phone"
+)
+
+// Test parsing phone numbers in their different written forms
+func TestPhoneNormalize(t *testing.T) {
+    tests := []struct {
+        raw    string
+        region string
+        want   string
+        err    error
+    }{
+        {"0543435590", "IL", "+972543435590", nil},
+        {"054-343-5590", "IL", "+972543435590", nil},
+        {"+972543435590", "IL", "+972543435590", nil},
+        {"+972 (54) 343.5590", "US", "+972543435590", nil},
+        {"00972543435590", "IL", "+972543435590", nil},
+        {"03-6123456", "IL", "+97236123456", nil},
+        {"(212) 555-1234", "US", "+12125551234", nil},
+        {"1 212 555 1234", "us", "+12125551234", nil},
+        {"011 44 20 7946 0958", "US", "+442079460958", nil},
+        {"020 7946 0958", "GB", "+442079460958", nil},
+        {"+41 44 668 18 00", "IL", "+41446681800", nil},
+        {"+90 212 555 1234", "IL", "+902125551234", nil},
+        {"+30 21 0123 4567", "IL", "+302101234567", nil},
+        {"00 353 1 234 5678", "IL", "+35312345678", nil},
+        {"044 668 18 00", "ch", "+41446681800", nil},
+        {"", "IL", "", phone.ErrEmpty},
+        {" - ", "IL", "", phone.ErrEmpty},
+        {"054-CALL-ME", "IL", "", phone.ErrInvalidCharacters},
+        {"1", "IL", "", phone.ErrTooShort},
+        {"05434355901234", "IL", "", phone.ErrTooLong},
+        {"+999123456789", "IL", "", phone.ErrInvalidCountryCode},
+        {"+41 44 668 18 00 12345", "IL", "", phone.ErrTooLong},
+        {"0543435590", "XX", "", phone.ErrUnknownRegion},
+    }
+
+    for _, tc := range tests {
+        got, err := phone.Normalize(tc.raw, tc.region)
+        if !errors.Is(err, tc.err) {
+            t.Fatalf("Normalize(%q, %q): expected error %v, got %v", tc.raw, tc.region, tc.err, err)
+        }
+        if got != tc.want {
+            t.Fatalf("Normalize(%q, %q): expected %q, got %q", tc.raw, tc.region, tc.want, got)
+        }
+    }
+}
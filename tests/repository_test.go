@@ -2,8 +2,10 @@ package tests
 
 import (
     "fmt"
+    "reflect"
     "regexp"
     "testing"
+    "time"
     "github.com/DATA-DOG/go-sqlmock"
     "Rise/src" 
 ) 
@@ -13,10 +15,111 @@ func TestRepository(t *testing.T) {
     t.Run("Test Pagination with Multiple Contacts", testPaginationWithMultipleContacts)
     t.Run("Test Add and Delete Contacts", testAddDeleteContacts)
     t.Run("Test add and edit Contacts", testEditContact)
+    t.Run("Test Add Contacts in one Transaction", testAddContactsTransaction)
+    t.Run("Test Versioned Edit and Delete", testVersionedWrites)
+    t.Run("Test Contact Details", testContactDetails)
+    t.Run("Test Audit Log", testAuditLog)
+    t.Run("Test Restore Contact", testRestoreContact)
+    t.Run("Test List Trash", testListTrash)
+    t.Run("Test Writes Joining a Transaction", testWithTransaction)
 
     
 }
 
+// contactRows returns mock rows with the columns read by every contact query
+func contactRows() *sqlmock.Rows {
+    return sqlmock.NewRows([]string{"id", "first_name", "last_name", "phone_number", "phone_e164", "address", "version", "created_at"})
+}
+
+// testActor makes the writes of the repository tests
+var testActor = src.Actor{Name: "api_key:7", RequestID: "req-1"}
+
+// expectAudit expects the audit entry written before a transaction commits
+func expectAudit(mock sqlmock.Sqlmock, action string, contactID int) {
+    mock.ExpectExec(regexp.QuoteMeta(
+        "INSERT INTO audit_log (tenant_id, actor, action, contact_id, contact_before, contact_after, request_id, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+    )).WithArgs(src.DefaultTenant, testActor.Name, action, contactID, sqlmock.AnyArg(), sqlmock.AnyArg(), testActor.RequestID, sqlmock.AnyArg()).
+        WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectSnapshot expects the contact to be read with its details at the start of an edit or
+// delete, nil when it does not exist
+func expectSnapshot(mock sqlmock.Sqlmock, id int, contact *src.Contact) {
+    rows := contactRows()
+    if contact != nil {
+        rows.AddRow(id, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, contact.Version, contact.CreatedAt)
+    }
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT id, first_name, last_name, phone_number, phone_e164, address, version, created_at FROM contacts WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL",
+    )).WithArgs(id, src.DefaultTenant).WillReturnRows(rows)
+    if contact == nil {
+        return
+    }
+
+    phones := sqlmock.NewRows([]string{"contact_id", "type", "number", "e164", "is_primary"})
+    for _, p := range contact.Phones {
+        phones.AddRow(id, p.Type, p.Number, p.E164, p.Primary)
+    }
+    emails := sqlmock.NewRows([]string{"contact_id", "type", "address", "is_primary"})
+    for _, e := range contact.Emails {
+        emails.AddRow(id, e.Type, e.Address, e.Primary)
+    }
+    addresses := sqlmock.NewRows([]string{"contact_id", "type", "address", "is_primary"})
+    for _, a := range contact.Addresses {
+        addresses.AddRow(id, a.Type, a.Address, a.Primary)
+    }
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, type, number, e164, is_primary FROM contact_phones WHERE contact_id IN ($1) ORDER BY id")).
+        WithArgs(id).WillReturnRows(phones)
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, type, address, is_primary FROM contact_emails WHERE contact_id IN ($1) ORDER BY id")).
+        WithArgs(id).WillReturnRows(emails)
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, type, address, is_primary FROM contact_addresses WHERE contact_id IN ($1) ORDER BY id")).
+        WithArgs(id).WillReturnRows(addresses)
+    tags := sqlmock.NewRows([]string{"contact_id", "tag"})
+    for _, tag := range contact.Tags {
+        tags.AddRow(id, tag)
+    }
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, tag FROM contact_tags WHERE contact_id IN ($1) ORDER BY id")).
+        WithArgs(id).WillReturnRows(tags)
+    fields := sqlmock.NewRows([]string{"contact_id", "name", "type", "value"})
+    for name, value := range contact.CustomFields {
+        fields.AddRow(id, name, src.FieldString, value)
+    }
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT v.contact_id, f.name, f.type, v.value FROM contact_field_values v JOIN contact_fields f ON f.id = v.field_id WHERE v.contact_id IN ($1)")).
+        WithArgs(id).WillReturnRows(fields)
+}
+
+// expectAddContact expects the transaction inserting a contact and its phones, emails, addresses, tags and
+// custom fields, which must have string values
+func expectAddContact(mock sqlmock.Sqlmock, contact src.Contact, id int) {
+    mock.ExpectBegin()
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, phone_e164, address, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+    )).WithArgs(src.DefaultTenant, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, sqlmock.AnyArg()).
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id))
+    for _, p := range contact.Phones {
+        mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_phones (contact_id, type, number, e164, is_primary) VALUES ($1, $2, $3, $4, $5)")).
+            WithArgs(id, p.Type, p.Number, p.E164, p.Primary).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    for _, e := range contact.Emails {
+        mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_emails (contact_id, type, address, is_primary) VALUES ($1, $2, $3, $4)")).
+            WithArgs(id, e.Type, e.Address, e.Primary).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    for _, a := range contact.Addresses {
+        mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_addresses (contact_id, type, address, is_primary) VALUES ($1, $2, $3, $4)")).
+            WithArgs(id, a.Type, a.Address, a.Primary).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    for _, tag := range contact.Tags {
+        mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_tags (contact_id, tag) VALUES ($1, $2)")).
+            WithArgs(id, tag).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    for name, value := range contact.CustomFields {
+        mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_field_values (contact_id, field_id, value) SELECT c.id, f.id, $1 FROM contacts c")).
+            WithArgs(value, id, name).WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    expectAudit(mock, src.AuditCreate, id)
+    mock.ExpectCommit()
+}
+
 // Test adding, searching, and deleting a contact
 func testAddSearchDeleteContact(t *testing.T) {
     db, mock, err := sqlmock.New()
@@ -29,17 +132,16 @@ func testAddSearchDeleteContact(t *testing.T) {
         FirstName:   "Jonathan",
         LastName:    "Makovsky",
         PhoneNumber: "0543435590",
+        PhoneE164:   "+972543435590",
         Address:     "Tel Aviv",
+        Version:     1,
     }
 
-    // Mock the insert query
-    mock.ExpectQuery(regexp.QuoteMeta(
-        "INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES ($1, $2, $3, $4) RETURNING id",
-    )).WithArgs(newContact.FirstName, newContact.LastName, newContact.PhoneNumber, newContact.Address).
-        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+    // Mock the insert transaction
+    expectAddContact(mock, newContact, 1)
 
     // Add the contact and check for errors
-    id, err := src.AddContact(db, newContact)
+    id, err := src.AddContact(db, src.DefaultTenant, testActor, newContact)
     if err != nil {
         t.Fatalf("Failed to add contact: %v", err)
     }
@@ -60,34 +162,34 @@ func testAddSearchDeleteContact(t *testing.T) {
 
     // Mock the search query by phone number
     mock.ExpectQuery(regexp.QuoteMeta(
-        "SELECT id, first_name, last_name, phone_number, address FROM contacts WHERE phone_number = $1",
-    )).WithArgs(newContact.PhoneNumber).
-        WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "phone_number", "address"}).
-            AddRow(newContact.ID, newContact.FirstName, newContact.LastName, newContact.PhoneNumber, newContact.Address))
+        "SELECT id, first_name, last_name, phone_number, phone_e164, address, version, created_at FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL AND (phone_e164 = $2 OR id IN (SELECT contact_id FROM contact_phones WHERE e164 = $2))",
+    )).WithArgs(src.DefaultTenant, newContact.PhoneE164).
+        WillReturnRows(contactRows().
+            AddRow(newContact.ID, newContact.FirstName, newContact.LastName, newContact.PhoneNumber, newContact.PhoneE164, newContact.Address, 1, nil))
 
     // Search for the contact and check the result
-    contacts, err := src.SearchContact(db, newContact.PhoneNumber)
+    contacts, err := src.SearchContact(db, src.DefaultTenant, newContact.PhoneE164)
     if err != nil {
         t.Fatalf("Failed to search contact: %v", err)
     }
-    if len(contacts) != 1 || contacts[0] != newContact {
+    if len(contacts) != 1 || !reflect.DeepEqual(contacts[0], newContact) {
         t.Fatalf("Expected contact %+v, got %+v", newContact, contacts[0])
     }
 
-    // Mock the delete query
+    // Mock the delete transaction, which records the contact as it was
+    mock.ExpectBegin()
+    expectSnapshot(mock, newContact.ID, &newContact)
     mock.ExpectExec(regexp.QuoteMeta(
-        "DELETE FROM contacts WHERE phone_number = $1",
-    )).WithArgs(newContact.PhoneNumber).
+        "UPDATE contacts SET deleted_at = $3 WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL",
+    )).WithArgs(newContact.ID, src.DefaultTenant, sqlmock.AnyArg()).
         WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditDelete, newContact.ID)
+    mock.ExpectCommit()
 
     // Delete the contact and check for success
-    deletedCount, err := src.DeleteContact(db, newContact.PhoneNumber)
-    if err != nil {
+    if err := src.DeleteContact(db, src.DefaultTenant, testActor, newContact.ID, 0); err != nil {
         t.Fatalf("Failed to delete contact: %v", err)
     }
-    if deletedCount != 1 {
-        t.Fatalf("Expected to delete 1 contact, deleted %d", deletedCount)
-    }
 
     // Mock the query to check the count of contacts after deletion
     mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM contacts")).
@@ -120,18 +222,16 @@ func testPaginationWithMultipleContacts(t *testing.T) {
         contactsToAdd = append(contactsToAdd, src.Contact{
             FirstName:   fmt.Sprintf("FirstName%d", i),
             LastName:    fmt.Sprintf("LastName%d", i),
-            PhoneNumber: fmt.Sprintf("12345678%02d", i),
+            PhoneNumber: fmt.Sprintf("05012345%02d", i),
+            PhoneE164:   fmt.Sprintf("+9725012345%02d", i),
             Address:     fmt.Sprintf("%d Elm St", i),
         })
     }
     // Mock the insert query
     for i, contact := range contactsToAdd {
-        mock.ExpectQuery(regexp.QuoteMeta(
-            "INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES ($1, $2, $3, $4) RETURNING id",
-        )).WithArgs(contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address).
-            WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(i + 1))
+        expectAddContact(mock, contact, i+1)
 
-        id, err := src.AddContact(db, contact)
+        id, err := src.AddContact(db, src.DefaultTenant, testActor, contact)
         if err != nil {
             t.Fatalf("Failed to add contact: %v", err)
         }
@@ -140,40 +240,86 @@ func testPaginationWithMultipleContacts(t *testing.T) {
 
     pageSize := 10
     totalContacts := len(contactsToAdd)
-    totalPages := (totalContacts + pageSize - 1) / pageSize
-
-    for page := 0; page < totalPages; page++ {
-        offset := page * pageSize
-        limit := pageSize
 
+    // Walk forward through the table using the last id of each page as the cursor
+    afterID := 0
+    for offset := 0; offset < totalContacts; offset += pageSize {
         expectedCount := pageSize
-        if offset+limit > totalContacts {
+        if offset+pageSize > totalContacts {
             expectedCount = totalContacts - offset
         }
 
-        rows := sqlmock.NewRows([]string{"id", "first_name", "last_name", "phone_number", "address"})
-        for i := offset; i < offset+expectedCount; i++ {
+        // The repository asks for one extra row to detect the next page
+        rows := contactRows()
+        for i := offset; i < offset+expectedCount+1 && i < totalContacts; i++ {
             contact := contactsToAdd[i]
-            rows.AddRow(contact.ID, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address)
+            rows.AddRow(contact.ID, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, 1, nil)
         }
         mock.ExpectQuery(regexp.QuoteMeta(
-            "SELECT id, first_name, last_name, phone_number, address FROM contacts LIMIT $1 OFFSET $2",
-        )).WithArgs(limit, offset).
+            "SELECT id, first_name, last_name, phone_number, phone_e164, address, version, created_at FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL AND id > $2 ORDER BY id ASC LIMIT $3",
+        )).WithArgs(src.DefaultTenant, afterID, pageSize+1).
             WillReturnRows(rows)
 
-        // Correct variable assignment
-        contacts, message, err := src.GetContacts(db, limit, offset)
+        contacts, hasMore, err := src.GetContacts(db, src.DefaultTenant, pageSize, afterID, 0)
         if err != nil {
             t.Fatalf("Failed to retrieve contacts: %v", err)
         }
         if len(contacts) != expectedCount {
             t.Fatalf("Expected to retrieve %d contacts, but got %d", expectedCount, len(contacts))
         }
-
-        // Optionally, handle the message if needed
-        if message != "" {
-            fmt.Printf("Message: %s\n", message)
+        if wantMore := offset+pageSize < totalContacts; hasMore != wantMore {
+            t.Fatalf("Expected hasMore to be %v at offset %d, got %v", wantMore, offset, hasMore)
         }
+        if contacts[0].ID != contactsToAdd[offset].ID {
+            t.Fatalf("Expected page to start at id %d, got %d", contactsToAdd[offset].ID, contacts[0].ID)
+        }
+        afterID = contacts[len(contacts)-1].ID
+    }
+
+    // Walk back one page from the last page, rows come back in descending order
+    rows := contactRows()
+    for i := 19; i >= 9; i-- {
+        contact := contactsToAdd[i]
+        rows.AddRow(contact.ID, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, 1, nil)
+    }
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT id, first_name, last_name, phone_number, phone_e164, address, version, created_at FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL AND id < $2 ORDER BY id DESC LIMIT $3",
+    )).WithArgs(src.DefaultTenant, contactsToAdd[20].ID, pageSize+1).
+        WillReturnRows(rows)
+
+    contacts, hasMore, err := src.GetContacts(db, src.DefaultTenant, pageSize, 0, contactsToAdd[20].ID)
+    if err != nil {
+        t.Fatalf("Failed to retrieve previous page: %v", err)
+    }
+    if !hasMore || len(contacts) != pageSize || contacts[0].ID != contactsToAdd[10].ID {
+        t.Fatalf("Expected previous page to hold ids 11-20 in order, got %+v (hasMore=%v)", contacts, hasMore)
+    }
+
+    // Count the whole list, then stop counting early
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT COUNT(*) FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL",
+    )).WithArgs(src.DefaultTenant).
+        WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(totalContacts))
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT COUNT(*) FROM (SELECT id FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL AND LOWER(last_name) LIKE $2 ESCAPE '\\' LIMIT $3) AS counted",
+    )).WithArgs(src.DefaultTenant, "lastname1%", 5).
+        WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+
+    if total, err := src.CountContacts(db, src.DefaultTenant, src.ContactFilter{}, 0); err != nil || total != totalContacts {
+        t.Fatalf("Expected %d contacts counted, got %d (err=%v)", totalContacts, total, err)
+    }
+    filter := src.ContactFilter{Columns: []src.ColumnCondition{{Field: "last_name", Op: src.FilterPrefix, Value: "LastName1"}}}
+    if total, err := src.CountContacts(db, src.DefaultTenant, filter, 5); err != nil || total != 5 {
+        t.Fatalf("Expected the count to stop at 5, got %d (err=%v)", total, err)
+    }
+
+    // Estimate the list from the query plan without reading it
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "EXPLAIN (FORMAT JSON) SELECT id FROM contacts WHERE tenant_id = $1 AND deleted_at IS NULL",
+    )).WithArgs(src.DefaultTenant).
+        WillReturnRows(sqlmock.NewRows([]string{"QUERY PLAN"}).AddRow(`[{"Plan": {"Node Type": "Seq Scan", "Plan Rows": 1048576.4}}]`))
+    if total, err := src.EstimateContacts(db, src.DefaultTenant, src.ContactFilter{}); err != nil || total != 1048576 {
+        t.Fatalf("Expected the planner's estimate of 1048576 contacts, got %d (err=%v)", total, err)
     }
 
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -190,38 +336,42 @@ func testAddDeleteContacts(t *testing.T) {
     defer db.Close()
 
     contactsToAdd := []src.Contact{
-        {FirstName: "Alice", LastName: "Smith", PhoneNumber: "1111111111", Address: "123 Maple St"},
-        {FirstName: "Bob", LastName: "Johnson", PhoneNumber: "2222222222", Address: "456 Oak St"},
+        {FirstName: "Alice", LastName: "Smith", PhoneNumber: "050-111-1111", PhoneE164: "+972501111111", Address: "123 Maple St"},
+        {FirstName: "Bob", LastName: "Johnson", PhoneNumber: "050-222-2222", PhoneE164: "+972502222222", Address: "456 Oak St"},
     }
 
     for i, contact := range contactsToAdd {
         // Mock the insert query
-        mock.ExpectQuery(regexp.QuoteMeta(
-            "INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES ($1, $2, $3, $4) RETURNING id",
-        )).
-            WithArgs(contact.FirstName, contact.LastName, contact.PhoneNumber, contact.Address).
-            WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(i + 1))
+        expectAddContact(mock, contact, i+1)
 
-        id, err := src.AddContact(db, contact)
+        id, err := src.AddContact(db, src.DefaultTenant, testActor, contact)
         if err != nil {
             t.Fatalf("Failed to add contact: %v", err)
         }
         contactsToAdd[i].ID = id
     }
-    // Mock the delete query
+    // Mock the delete transaction
+    mock.ExpectBegin()
+    expectSnapshot(mock, contactsToAdd[0].ID, &contactsToAdd[0])
     mock.ExpectExec(regexp.QuoteMeta(
-        "DELETE FROM contacts WHERE phone_number = $1",
+        "UPDATE contacts SET deleted_at = $3 WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL",
     )).
-        WithArgs(contactsToAdd[0].PhoneNumber).
+        WithArgs(contactsToAdd[0].ID, src.DefaultTenant, sqlmock.AnyArg()).
         WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditDelete, contactsToAdd[0].ID)
+    mock.ExpectCommit()
 
-    deletedCount, err := src.DeleteContact(db, contactsToAdd[0].PhoneNumber)
-    if err != nil {
+    if err := src.DeleteContact(db, src.DefaultTenant, testActor, contactsToAdd[0].ID, 0); err != nil {
         t.Fatalf("Failed to delete contact: %v", err)
     }
 
-    if deletedCount != 1 {
-        t.Fatalf("Expected to delete 1 contact, deleted %d", deletedCount)
+    // Deleting the same id again finds nothing
+    mock.ExpectBegin()
+    expectSnapshot(mock, contactsToAdd[0].ID, nil)
+    mock.ExpectRollback()
+
+    if err := src.DeleteContact(db, src.DefaultTenant, testActor, contactsToAdd[0].ID, 0); err != src.ErrNotFound {
+        t.Fatalf("Expected ErrNotFound when deleting a missing contact, got %v", err)
     }
 
     if err := mock.ExpectationsWereMet(); err != nil {
@@ -242,55 +392,478 @@ func testEditContact(t *testing.T) {
         FirstName:   "Jonathan",
         LastName:    "Makovsky",
         PhoneNumber: "0543435590",
+        PhoneE164:   "+972543435590",
         Address:     "Tel Aviv",
     }
-    // Mock the insert query
-    mock.ExpectQuery(regexp.QuoteMeta(
-        "INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES ($1, $2, $3, $4) RETURNING id",
-    )).WithArgs(newContact.FirstName, newContact.LastName, newContact.PhoneNumber, newContact.Address).
-        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+    // Mock the insert transaction
+    expectAddContact(mock, newContact, 1)
 
-    id, err := src.AddContact(db, newContact)
+    id, err := src.AddContact(db, src.DefaultTenant, testActor, newContact)
     if err != nil {
         t.Fatalf("Failed to add contact: %v", err)
     }
     newContact.ID = id
 
-    // Step 2: Attempt to edit someone's phone number (not possible)
-    otherPhoneNumber := "0543435591"
     updatedContact := src.Contact{
         FirstName:   "Jonathan",
         LastName:    "Makovsky",
-        PhoneNumber: otherPhoneNumber, // Someone else's phone number
+        PhoneNumber: "0543435591",
+        PhoneE164:   "+972543435591",
         Address:     "New Address",
     }
+    fullPatch := src.ContactPatch{
+        FirstName:   &updatedContact.FirstName,
+        LastName:    &updatedContact.LastName,
+        PhoneNumber: &updatedContact.PhoneNumber,
+        PhoneE164:   &updatedContact.PhoneE164,
+        Address:     &updatedContact.Address,
+    }
+    update := regexp.QuoteMeta(
+        "UPDATE contacts SET first_name = $1, last_name = $2, phone_number = $3, phone_e164 = $4, address = $5, version = version + 1 WHERE id = $6 AND tenant_id = $7 AND deleted_at IS NULL RETURNING id, first_name, last_name, phone_number, phone_e164, address, version, created_at",
+    )
 
-    mock.ExpectExec(regexp.QuoteMeta(
-        "UPDATE contacts SET first_name = $1, last_name = $2, phone_number = $3, address = $4 WHERE phone_number = $5",
-    )).WithArgs(updatedContact.FirstName, updatedContact.LastName, updatedContact.PhoneNumber, updatedContact.Address, newContact.PhoneNumber).
-        WillReturnResult(sqlmock.NewResult(0, 0)) // No rows affected (not possible)
+    updatePrimaryPhone := regexp.QuoteMeta("UPDATE contact_phones SET number = $1, e164 = $2 WHERE contact_id = $3 AND is_primary")
+    updatePrimaryAddress := regexp.QuoteMeta("UPDATE contact_addresses SET address = $1 WHERE contact_id = $2 AND is_primary")
 
-    // Try to edit with a different phone number, should not succeed
-    rowsUpdated, err := src.EditContact(db, newContact.PhoneNumber, updatedContact)
-    if err == nil || rowsUpdated != 0 {
-        t.Fatalf("Expected no rows to be updated when editing a non-existent contact, but got %d rows", rowsUpdated)
+    // Step 2: Edit an id that does not exist
+    mock.ExpectBegin()
+    expectSnapshot(mock, 99, nil)
+    mock.ExpectRollback()
+
+    if _, err := src.EditContact(db, src.DefaultTenant, testActor, 99, fullPatch, 0); err != src.ErrNotFound {
+        t.Fatalf("Expected ErrNotFound when editing a non-existent contact, got %v", err)
     }
 
-    // Step 3: Try to edit the same contact's phone number (should succeed)
-    updatedContact.PhoneNumber = newContact.PhoneNumber // Correct the phone number to match
-    mock.ExpectExec(regexp.QuoteMeta(
-        "UPDATE contacts SET first_name = $1, last_name = $2, phone_number = $3, address = $4 WHERE phone_number = $5",
-    )).WithArgs(updatedContact.FirstName, updatedContact.LastName, updatedContact.PhoneNumber, updatedContact.Address, newContact.PhoneNumber).
-        WillReturnResult(sqlmock.NewResult(1, 1)) // 1 row updated
+    // Step 3: Edit the added contact, including its phone number, which also rewrites its primary phone and address
+    newContact.Version = 1
+    mock.ExpectBegin()
+    expectSnapshot(mock, newContact.ID, &newContact)
+    mock.ExpectQuery(update).
+        WithArgs(updatedContact.FirstName, updatedContact.LastName, updatedContact.PhoneNumber, updatedContact.PhoneE164, updatedContact.Address, newContact.ID, src.DefaultTenant).
+        WillReturnRows(contactRows().
+            AddRow(newContact.ID, updatedContact.FirstName, updatedContact.LastName, updatedContact.PhoneNumber, updatedContact.PhoneE164, updatedContact.Address, 2, nil))
+    mock.ExpectExec(updatePrimaryPhone).WithArgs(updatedContact.PhoneNumber, updatedContact.PhoneE164, newContact.ID).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec(updatePrimaryAddress).WithArgs(updatedContact.Address, newContact.ID).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditUpdate, newContact.ID)
+    mock.ExpectCommit()
+
+    edited, err := src.EditContact(db, src.DefaultTenant, testActor, newContact.ID, fullPatch, 0)
+    updatedContact.ID, updatedContact.Version = newContact.ID, 2
+    if err != nil || !reflect.DeepEqual(edited, updatedContact) {
+        t.Fatalf("Expected the updated row %+v, got %+v (err=%v)", updatedContact, edited, err)
+    }
 
-    // Now edit with the correct phone number
-    rowsUpdated, err = src.EditContact(db, newContact.PhoneNumber, updatedContact)
-    if err != nil || rowsUpdated != 1 {
-        t.Fatalf("Expected 1 row to be updated when editing the contact, but got %d rows", rowsUpdated)
+    // Step 4: Patch only the address, the UPDATE sets just that column
+    address := "Haifa"
+    mock.ExpectBegin()
+    expectSnapshot(mock, newContact.ID, &updatedContact)
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "UPDATE contacts SET address = $1, version = version + 1 WHERE id = $2 AND tenant_id = $3 AND deleted_at IS NULL RETURNING id, first_name, last_name, phone_number, phone_e164, address, version, created_at",
+    )).WithArgs(address, newContact.ID, src.DefaultTenant).
+        WillReturnRows(contactRows().
+            AddRow(newContact.ID, updatedContact.FirstName, updatedContact.LastName, updatedContact.PhoneNumber, updatedContact.PhoneE164, address, 3, nil))
+    mock.ExpectExec(updatePrimaryAddress).WithArgs(address, newContact.ID).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditUpdate, newContact.ID)
+    mock.ExpectCommit()
+
+    edited, err = src.EditContact(db, src.DefaultTenant, testActor, newContact.ID, src.ContactPatch{Address: &address}, 0)
+    if err != nil || edited.Address != address || edited.FirstName != updatedContact.FirstName {
+        t.Fatalf("Expected only the address to change, got %+v (err=%v)", edited, err)
     }
 
     // Check all mock expectations were met
     if err := mock.ExpectationsWereMet(); err != nil {
         t.Fatalf("There were unfulfilled expectations: %s", err)
     }
-}
\ No newline at end of file
+}
+
+// Test that bulk inserts commit together and roll back together
+func testAddContactsTransaction(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    contacts := []src.Contact{
+        {FirstName: "Alice", LastName: "Smith", PhoneNumber: "050-111-1111", PhoneE164: "+972501111111", Address: "123 Maple St"},
+        {FirstName: "Bob", LastName: "Johnson", PhoneNumber: "050-222-2222", PhoneE164: "+972502222222", Address: "456 Oak St"},
+    }
+    insert := regexp.QuoteMeta("INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, phone_e164, address, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id")
+
+    // Both rows are inserted and committed
+    mock.ExpectBegin()
+    prepared := mock.ExpectPrepare(insert)
+    for i, contact := range contacts {
+        prepared.ExpectQuery().
+            WithArgs(src.DefaultTenant, contact.FirstName, contact.LastName, contact.PhoneNumber, contact.PhoneE164, contact.Address, sqlmock.AnyArg()).
+            WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(i + 1))
+        expectAudit(mock, src.AuditCreate, i+1)
+    }
+    mock.ExpectCommit()
+
+    ids, err := src.AddContacts(db, src.DefaultTenant, testActor, contacts)
+    if err != nil || len(ids) != 2 || ids[1] != 2 {
+        t.Fatalf("Expected ids [1 2], got %v (err=%v)", ids, err)
+    }
+
+    // The second row fails, so the first one is rolled back
+    mock.ExpectBegin()
+    prepared = mock.ExpectPrepare(insert)
+    prepared.ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+    expectAudit(mock, src.AuditCreate, 3)
+    prepared.ExpectQuery().WillReturnError(fmt.Errorf("value too long for type character varying(20)"))
+    mock.ExpectRollback()
+
+    if ids, err := src.AddContacts(db, src.DefaultTenant, testActor, contacts); err == nil || ids != nil {
+        t.Fatalf("Expected the batch to fail, got ids %v", ids)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+// Test that writes made with a version only succeed while the contact is at that version
+func testVersionedWrites(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    address := "Haifa"
+    update := regexp.QuoteMeta(
+        "UPDATE contacts SET address = $1, version = version + 1 WHERE id = $2 AND tenant_id = $3 AND deleted_at IS NULL AND version = $4 RETURNING id, first_name, last_name, phone_number, phone_e164, address, version, created_at",
+    )
+    exists := regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM contacts WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL)")
+
+    updatePrimaryAddress := regexp.QuoteMeta("UPDATE contact_addresses SET address = $1 WHERE contact_id = $2 AND is_primary")
+
+    stored := src.Contact{FirstName: "Jonathan", LastName: "Makovsky", PhoneNumber: "0543435590", PhoneE164: "+972543435590", Address: "Tel Aviv", Version: 2}
+
+    // The expected version matches and the row comes back one version later
+    mock.ExpectBegin()
+    expectSnapshot(mock, 1, &stored)
+    mock.ExpectQuery(update).WithArgs(address, 1, src.DefaultTenant, 2).
+        WillReturnRows(contactRows().AddRow(1, "Jonathan", "Makovsky", "0543435590", "+972543435590", address, 3, nil))
+    mock.ExpectExec(updatePrimaryAddress).WithArgs(address, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditUpdate, 1)
+    mock.ExpectCommit()
+    contact, err := src.EditContact(db, src.DefaultTenant, testActor, 1, src.ContactPatch{Address: &address}, 2)
+    if err != nil || contact.Version != 3 {
+        t.Fatalf("Expected the contact at version 3, got %+v (err=%v)", contact, err)
+    }
+
+    // Someone else updated the row first, which is found before the details are read
+    stored.Version = 3
+    selectStored := regexp.QuoteMeta("SELECT id, first_name, last_name, phone_number, phone_e164, address, version, created_at FROM contacts WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL")
+    storedRow := contactRows().AddRow(1, stored.FirstName, stored.LastName, stored.PhoneNumber, stored.PhoneE164, stored.Address, stored.Version, nil)
+    mock.ExpectBegin()
+    mock.ExpectQuery(selectStored).WithArgs(1, src.DefaultTenant).WillReturnRows(storedRow)
+    mock.ExpectRollback()
+    if _, err := src.EditContact(db, src.DefaultTenant, testActor, 1, src.ContactPatch{Address: &address}, 2); err != src.ErrVersionMismatch {
+        t.Fatalf("Expected ErrVersionMismatch for a stale version, got %v", err)
+    }
+
+    // Someone else updated the row between the snapshot and the update
+    mock.ExpectBegin()
+    expectSnapshot(mock, 1, &stored)
+    mock.ExpectQuery(update).WithArgs(address, 1, src.DefaultTenant, 3).WillReturnRows(contactRows())
+    mock.ExpectQuery(exists).WithArgs(1, src.DefaultTenant).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+    mock.ExpectRollback()
+    if _, err := src.EditContact(db, src.DefaultTenant, testActor, 1, src.ContactPatch{Address: &address}, 3); err != src.ErrVersionMismatch {
+        t.Fatalf("Expected ErrVersionMismatch for a concurrent update, got %v", err)
+    }
+
+    // A stale delete is refused, a delete of a missing row is not found
+    storedRow = contactRows().AddRow(1, stored.FirstName, stored.LastName, stored.PhoneNumber, stored.PhoneE164, stored.Address, stored.Version, nil)
+    mock.ExpectBegin()
+    mock.ExpectQuery(selectStored).WithArgs(1, src.DefaultTenant).WillReturnRows(storedRow)
+    mock.ExpectRollback()
+    if err := src.DeleteContact(db, src.DefaultTenant, testActor, 1, 2); err != src.ErrVersionMismatch {
+        t.Fatalf("Expected ErrVersionMismatch for a stale delete, got %v", err)
+    }
+    mock.ExpectBegin()
+    expectSnapshot(mock, 9, nil)
+    mock.ExpectRollback()
+    if err := src.DeleteContact(db, src.DefaultTenant, testActor, 9, 1); err != src.ErrNotFound {
+        t.Fatalf("Expected ErrNotFound for a missing contact, got %v", err)
+    }
+
+    // The row was deleted between the snapshot and the delete
+    mock.ExpectBegin()
+    expectSnapshot(mock, 1, &stored)
+    mock.ExpectExec(regexp.QuoteMeta("UPDATE contacts SET deleted_at = $3 WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL AND version = $4")).WithArgs(1, src.DefaultTenant, sqlmock.AnyArg(), 3).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectQuery(exists).WithArgs(1, src.DefaultTenant).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+    mock.ExpectRollback()
+    if err := src.DeleteContact(db, src.DefaultTenant, testActor, 1, 3); err != src.ErrNotFound {
+        t.Fatalf("Expected ErrNotFound for a concurrent delete, got %v", err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+// Test that phones, emails and addresses are written with the contact and read back per contact
+func testContactDetails(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    contact := src.Contact{
+        FirstName:   "Jonathan",
+        LastName:    "Makovsky",
+        PhoneNumber: "0543435590",
+        PhoneE164:   "+972543435590",
+        Address:     "Tel Aviv",
+        Phones: []src.Phone{
+            {Type: "mobile", Number: "0543435590", E164: "+972543435590", Primary: true},
+            {Type: "work", Number: "03-6123456", E164: "+97236123456"},
+        },
+        Emails:    []src.Email{{Type: "work", Address: "jonathan@example.com", Primary: true}},
+        Addresses: []src.PostalAddress{{Type: "home", Address: "Tel Aviv", Primary: true}},
+    }
+    expectAddContact(mock, contact, 1)
+    if id, err := src.AddContact(db, src.DefaultTenant, testActor, contact); err != nil || id != 1 {
+        t.Fatalf("Expected the contact to be added with id 1, got %d (err=%v)", id, err)
+    }
+
+    // Replacing the phones deletes the old rows and inserts the new list
+    phones := []src.Phone{{Type: "work", Number: "03-6123456", E164: "+97236123456", Primary: true}}
+    contact.Version = 1
+    mock.ExpectBegin()
+    expectSnapshot(mock, 1, &contact)
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "UPDATE contacts SET phone_number = $1, phone_e164 = $2, version = version + 1 WHERE id = $3 AND tenant_id = $4 AND deleted_at IS NULL RETURNING id, first_name, last_name, phone_number, phone_e164, address, version, created_at",
+    )).WithArgs("03-6123456", "+97236123456", 1, src.DefaultTenant).
+        WillReturnRows(contactRows().AddRow(1, "Jonathan", "Makovsky", "03-6123456", "+97236123456", "Tel Aviv", 2, nil))
+    mock.ExpectExec(regexp.QuoteMeta("DELETE FROM contact_phones WHERE contact_id = $1")).WithArgs(1).
+        WillReturnResult(sqlmock.NewResult(0, 2))
+    mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_phones (contact_id, type, number, e164, is_primary) VALUES ($1, $2, $3, $4, $5)")).
+        WithArgs(1, "work", "03-6123456", "+97236123456", true).WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditUpdate, 1)
+    mock.ExpectCommit()
+
+    number, e164 := phones[0].Number, phones[0].E164
+    if _, err := src.EditContact(db, src.DefaultTenant, testActor, 1, src.ContactPatch{PhoneNumber: &number, PhoneE164: &e164, Phones: &phones}, 0); err != nil {
+        t.Fatalf("Failed to replace the phones: %v", err)
+    }
+
+    // Details are loaded for every contact of a page at once
+    contacts := []src.Contact{{ID: 1}, {ID: 2}}
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, type, number, e164, is_primary FROM contact_phones WHERE contact_id IN ($1, $2) ORDER BY id")).
+        WithArgs(1, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"contact_id", "type", "number", "e164", "is_primary"}).
+            AddRow(1, "work", "03-6123456", "+97236123456", true).
+            AddRow(2, "mobile", "0521234567", nil, true))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, type, address, is_primary FROM contact_emails WHERE contact_id IN ($1, $2) ORDER BY id")).
+        WithArgs(1, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"contact_id", "type", "address", "is_primary"}).
+            AddRow(1, "work", "jonathan@example.com", true))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, type, address, is_primary FROM contact_addresses WHERE contact_id IN ($1, $2) ORDER BY id")).
+        WithArgs(1, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"contact_id", "type", "address", "is_primary"}))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT contact_id, tag FROM contact_tags WHERE contact_id IN ($1, $2) ORDER BY id")).
+        WithArgs(1, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"contact_id", "tag"}).AddRow(2, "family"))
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT v.contact_id, f.name, f.type, v.value FROM contact_field_values v JOIN contact_fields f ON f.id = v.field_id WHERE v.contact_id IN ($1, $2)")).
+        WithArgs(1, 2).
+        WillReturnRows(sqlmock.NewRows([]string{"contact_id", "name", "type", "value"}).
+            AddRow(1, "employee_id", src.FieldNumber, "1042").
+            AddRow(1, "vip", src.FieldBool, "true"))
+
+    if err := src.LoadContactDetails(db, contacts); err != nil {
+        t.Fatalf("Failed to load contact details: %v", err)
+    }
+    if !reflect.DeepEqual(contacts[0].Phones, phones) || len(contacts[0].Emails) != 1 || len(contacts[1].Phones) != 1 {
+        t.Fatalf("Expected the details to be matched to their contacts, got %+v", contacts)
+    }
+    if contacts[1].Emails == nil || len(contacts[1].Addresses) != 0 || contacts[0].Tags == nil || len(contacts[1].Tags) != 1 {
+        t.Fatalf("Expected empty lists rather than nil for contacts without details, got %+v", contacts[1])
+    }
+    if !reflect.DeepEqual(contacts[0].CustomFields, map[string]any{"employee_id": 1042.0, "vip": true}) || contacts[1].CustomFields == nil {
+        t.Fatalf("Expected the custom fields read back by their type, got %+v %+v", contacts[0].CustomFields, contacts[1].CustomFields)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+// Test that every write is audited in its own transaction and that entries are filtered and paged
+func testAuditLog(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    // The write is rolled back when its audit entry cannot be stored
+    contact := src.Contact{FirstName: "Dana", LastName: "Cohen", PhoneNumber: "0521234567", PhoneE164: "+972521234567", Address: "Haifa"}
+    mock.ExpectBegin()
+    mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, phone_e164, address, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id")).
+        WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+    mock.ExpectExec(regexp.QuoteMeta("INSERT INTO audit_log")).WillReturnError(fmt.Errorf("disk full"))
+    mock.ExpectRollback()
+    if _, err := src.AddContact(db, src.DefaultTenant, testActor, contact); err == nil {
+        t.Fatalf("Expected the insert to fail with its audit entry")
+    }
+
+    // Filters become conditions, one extra row tells that more entries match
+    since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    before := `{"id":4,"first_name":"Dana","last_name":"Cohen","phone_number":"0521234567","phone_e164":"+972521234567","address":"Haifa","version":1,"phones":[],"emails":[],"addresses":[]}`
+    rows := sqlmock.NewRows([]string{"id", "actor", "action", "contact_id", "contact_before", "contact_after", "request_id", "created_at"}).
+        AddRow(9, testActor.Name, src.AuditDelete, 4, before, nil, "req-2", since.Add(time.Hour)).
+        AddRow(8, testActor.Name, src.AuditCreate, 4, nil, before, "req-1", since)
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT id, actor, action, contact_id, contact_before, contact_after, request_id, created_at FROM audit_log WHERE tenant_id = $1 AND contact_id = $2 AND actor = $3 AND created_at >= $4 AND id < $5 ORDER BY id DESC LIMIT $6",
+    )).WithArgs(src.DefaultTenant, 4, testActor.Name, since, 10, 2).WillReturnRows(rows)
+
+    entries, hasMore, err := src.AuditLog(db, src.DefaultTenant, src.AuditFilter{ContactID: 4, Actor: testActor.Name, Since: since, BeforeID: 10, Limit: 1})
+    if err != nil || !hasMore || len(entries) != 1 {
+        t.Fatalf("Expected one entry and more to come, got %+v (hasMore=%v, err=%v)", entries, hasMore, err)
+    }
+    if entry := entries[0]; entry.Action != src.AuditDelete || entry.After != nil || entry.Before == nil || entry.Before.FirstName != "Dana" || entry.RequestID != "req-2" {
+        t.Fatalf("Expected the delete with the contact before it, got %+v", entry)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+// Test that restoring a purged contact inserts it again under its id at a new version
+func testRestoreContact(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    first := `{"id":4,"first_name":"Dana","last_name":"Cohen","phone_number":"0521234567","phone_e164":"+972521234567","address":"Haifa","version":1,"phones":[],"emails":[{"type":"home","address":"dana@example.com","primary":true}],"addresses":[]}`
+    second := `{"id":4,"first_name":"Dana","last_name":"Levi","phone_number":"0521234567","phone_e164":"+972521234567","address":"Haifa","version":2,"phones":[],"emails":[],"addresses":[]}`
+    created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    history := sqlmock.NewRows([]string{"id", "actor", "action", "contact_id", "contact_before", "contact_after", "request_id", "created_at"}).
+        AddRow(1, testActor.Name, src.AuditCreate, 4, nil, first, "req-1", created).
+        AddRow(2, testActor.Name, src.AuditUpdate, 4, first, second, "req-2", created).
+        AddRow(3, testActor.Name, src.AuditDelete, 4, second, nil, "req-3", created)
+
+    mock.ExpectBegin()
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT id, actor, action, contact_id, contact_before, contact_after, request_id, created_at FROM audit_log WHERE tenant_id = $1 AND contact_id = $2 ORDER BY id",
+    )).WithArgs(src.DefaultTenant, 4).WillReturnRows(history)
+    mock.ExpectQuery(regexp.QuoteMeta("SELECT name, type, required, pattern, options, created_at FROM contact_fields WHERE tenant_id = $1 ORDER BY name")).
+        WithArgs(src.DefaultTenant).WillReturnRows(sqlmock.NewRows([]string{"name", "type", "required", "pattern", "options", "created_at"}))
+    expectSnapshot(mock, 4, nil)
+    mock.ExpectExec(regexp.QuoteMeta("UPDATE contacts SET deleted_at = NULL WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NOT NULL")).
+        WithArgs(4, src.DefaultTenant).WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec(regexp.QuoteMeta(
+        "INSERT INTO contacts (id, tenant_id, first_name, last_name, phone_number, phone_e164, address, version, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+    )).WithArgs(4, src.DefaultTenant, "Dana", "Cohen", "0521234567", "+972521234567", "Haifa", 3, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(4, 1))
+    mock.ExpectExec(regexp.QuoteMeta("INSERT INTO contact_emails (contact_id, type, address, is_primary) VALUES ($1, $2, $3, $4)")).
+        WithArgs(4, "home", "dana@example.com", true).WillReturnResult(sqlmock.NewResult(1, 1))
+    expectAudit(mock, src.AuditRestore, 4)
+    mock.ExpectCommit()
+
+    contact, err := src.RestoreContact(db, src.DefaultTenant, testActor, 4, 1)
+    if err != nil || contact.LastName != "Cohen" || contact.Version != 3 {
+        t.Fatalf("Expected the first revision back at version 3, got %+v (err=%v)", contact, err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+// Test that the trash lists rows stored before phone numbers were normalized
+func testListTrash(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    deleted := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+    rows := sqlmock.NewRows([]string{"id", "first_name", "last_name", "phone_number", "phone_e164", "address", "version", "created_at", "deleted_at"}).
+        AddRow(4, "Dana", "Cohen", "0521234567", nil, "Haifa", 2, nil, deleted).
+        AddRow(5, "Avi", "Levi", "0527654321", "+972527654321", "Tel Aviv", 1, nil, deleted)
+    mock.ExpectQuery(regexp.QuoteMeta(
+        "SELECT id, first_name, last_name, phone_number, phone_e164, address, version, created_at, deleted_at FROM contacts WHERE tenant_id = $1 AND deleted_at IS NOT NULL AND id > $2 ORDER BY id ASC LIMIT $3",
+    )).WithArgs(src.DefaultTenant, 0, 11).WillReturnRows(rows)
+
+    contacts, hasMore, err := src.ListTrash(db, src.DefaultTenant, 10, 0)
+    if err != nil || hasMore || len(contacts) != 2 {
+        t.Fatalf("Expected both deleted contacts, got %+v (hasMore=%v, err=%v)", contacts, hasMore, err)
+    }
+    if contacts[0].PhoneE164 != "" || contacts[1].PhoneE164 != "+972527654321" {
+        t.Fatalf("Expected an empty phone_e164 for the row not yet backfilled, got %+v", contacts)
+    }
+    if contacts[0].DeletedAt == nil || !contacts[0].DeletedAt.Equal(deleted) {
+        t.Fatalf("Expected the deletion time, got %v", contacts[0].DeletedAt)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+// Test that repository writes given a transaction run in it instead of committing on their own
+func testWithTransaction(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    contact := src.Contact{ID: 2, FirstName: "Dana", LastName: "Cohen", PhoneNumber: "0521111111", PhoneE164: "+972521111111", Address: "Haifa", Version: 1}
+    insert := regexp.QuoteMeta("INSERT INTO contacts (tenant_id, first_name, last_name, phone_number, phone_e164, address, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id")
+    trash := regexp.QuoteMeta("UPDATE contacts SET deleted_at = $3 WHERE id = $1 AND tenant_id = $2 AND deleted_at IS NULL")
+
+    // An add and a delete share one transaction, committed once
+    mock.ExpectBegin()
+    mock.ExpectQuery(insert).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+    expectAudit(mock, src.AuditCreate, 1)
+    expectSnapshot(mock, contact.ID, &contact)
+    mock.ExpectExec(trash).WithArgs(contact.ID, src.DefaultTenant, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+    expectAudit(mock, src.AuditDelete, contact.ID)
+    mock.ExpectCommit()
+
+    err = src.WithTransaction(db, func(tx src.Executor) error {
+        if _, err := src.AddContact(tx, src.DefaultTenant, testActor, contact); err != nil {
+            return err
+        }
+        return src.DeleteContact(tx, src.DefaultTenant, testActor, contact.ID, 0)
+    })
+    if err != nil {
+        t.Fatalf("Expected the transaction to commit, got %v", err)
+    }
+
+    // A failed write rolls back the writes before it
+    mock.ExpectBegin()
+    mock.ExpectQuery(insert).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+    expectAudit(mock, src.AuditCreate, 3)
+    expectSnapshot(mock, 9, nil)
+    mock.ExpectRollback()
+
+    err = src.WithTransaction(db, func(tx src.Executor) error {
+        if _, err := src.AddContact(tx, src.DefaultTenant, testActor, contact); err != nil {
+            return err
+        }
+        return src.DeleteContact(tx, src.DefaultTenant, testActor, 9, 0)
+    })
+    if err != src.ErrNotFound {
+        t.Fatalf("Expected ErrNotFound to roll the transaction back, got %v", err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Fatalf("There were unfulfilled expectations: %s", err)
+    }
+}
@@ -0,0 +1,263 @@
+package tests
+
+import (
+    "encoding/json"
+    "io/fs"
+    "net/http"
+    "net/url"
+    "regexp"
+    "sort"
+    "strings"
+    "testing"
+
+    "Rise/database"
+    "Rise/src"
+    "Rise/src/search"
+)
+
+// Test function to run all search tests
+func TestSearch(t *testing.T) {
+    t.Run("Test Parse", testSearchParse)
+    t.Run("Test Normalize and Distance", testSearchNormalize)
+    t.Run("Test SQL Fold Matches Normalize", testSearchFoldParity)
+    t.Run("Test Score", testSearchScore)
+    t.Run("Test Fragments", testSearchFragments)
+    t.Run("Test Handler", func(t *testing.T) { forEachStore(t, testSearchHandler) })
+}
+
+// Test splitting a query into free text, phone and field-scoped terms
+func testSearchParse(t *testing.T) {
+    q := search.Parse(`Jon city:"Tel Aviv" 054-343 last:Mako unknown:x`)
+    want := []search.Term{
+        {Text: "jon"},
+        {Text: "tel", Field: search.FieldAddress},
+        {Text: "aviv", Field: search.FieldAddress},
+        {Text: "054343", Phone: true},
+        {Text: "mako", Field: search.FieldLast},
+        {Text: "unknown"},
+        {Text: "x"},
+    }
+    if len(q.Terms) != len(want) {
+        t.Fatalf("Expected %d terms, got %+v", len(want), q.Terms)
+    }
+    for i := range want {
+        if q.Terms[i] != want[i] {
+            t.Fatalf("Expected term %d to be %+v, got %+v", i, want[i], q.Terms[i])
+        }
+    }
+    if !search.Parse("  ").Empty() {
+        t.Fatalf("Expected a blank query to be empty")
+    }
+}
+
+// Test that the search_fold function of the PostgreSQL migrations drops the marks and folds
+// the letters search.Normalize does, so SQL narrows searches down to a superset of Score
+func testSearchFoldParity(t *testing.T) {
+    // The latest migration defining search_fold is the one in effect
+    migrations := database.Migrations("postgres")
+    names, _ := fs.Glob(migrations, "*.up.sql")
+    sort.Strings(names)
+    var definition string
+    for _, name := range names {
+        data, err := fs.ReadFile(migrations, name)
+        if err != nil {
+            t.Fatalf("Failed to read %s: %v", name, err)
+        }
+        if strings.Contains(string(data), "FUNCTION search_fold") {
+            definition = string(data)
+        }
+    }
+
+    marks := regexp.MustCompile(`regexp_replace\(lower\(value\), '([^']*)'`).FindStringSubmatch(definition)
+    if marks == nil || marks[1] != search.MarkClass() {
+        t.Fatalf("Expected search_fold to drop %s, got %v", search.MarkClass(), marks)
+    }
+    folded := map[string]string{
+        "مُحَمَّد":          "محمد", // Arabic harakat
+        "שָׁלוֹם":          "שלום", // Hebrew points
+        "e\u0301":     "e",
+        "\u0439\u0483": "\u0439",
+    }
+    for text, want := range folded {
+        if got := search.Normalize(text); got != want {
+            t.Fatalf("Expected Normalize to drop the marks of %q, got %q", text, got)
+        }
+    }
+
+    letters := regexp.MustCompile(`'g'\),\s*'([^']*)',\s*'([^']*)'\)`).FindStringSubmatch(definition)
+    if letters == nil {
+        t.Fatalf("Expected search_fold to translate accented letters")
+    }
+    from, to := []rune(letters[1]), []rune(letters[2])
+    if len(from) != len(to) {
+        t.Fatalf("Expected as many plain letters as accented ones, got %d and %d", len(from), len(to))
+    }
+    for i := range from {
+        if got := search.Normalize(string(from[i])); got != string(to[i]) {
+            t.Fatalf("Expected Normalize to fold %q to %q like search_fold, got %q", from[i], to[i], got)
+        }
+    }
+    for _, pair := range regexp.MustCompile(`'(\S)', '([a-z]+)'\)`).FindAllStringSubmatch(definition, -1) {
+        if got := search.Normalize(pair[1]); got != pair[2] {
+            t.Fatalf("Expected Normalize to fold %q to %q like search_fold, got %q", pair[1], pair[2], got)
+        }
+    }
+}
+
+// Test diacritic folding and the edit distance
+func testSearchNormalize(t *testing.T) {
+    if got := search.Normalize("José MÜLLER-Łukasz Straße"); got != "jose muller-lukasz strasse" {
+        t.Fatalf("Expected accents to be folded, got %q", got)
+    }
+    distances := map[[2]string]int{
+        {"jonathan", "jonathan"}: 0,
+        {"jonatan", "jonathan"}:  1,
+        {"jno", "jon"}:           1, // swapped neighbours count once
+        {"cohen", "kohen"}:       1,
+        {"levi", "cohen"}:        5,
+    }
+    for pair, want := range distances {
+        if got := search.Distance(pair[0], pair[1]); got != want {
+            t.Fatalf("Expected distance %d between %q and %q, got %d", want, pair[0], pair[1], got)
+        }
+    }
+}
+
+// Test which documents match and how they rank
+func testSearchScore(t *testing.T) {
+    jonathan := search.Document{FirstName: "Jonathan", LastName: "Makovsky", Address: "1 Rothschild Blvd, Tel Aviv", Phones: []string{"054-343-5590", "+972543435590"}}
+    jose := search.Document{FirstName: "José", LastName: "Muñoz", Address: "Haifa", Phones: []string{"+972521234567"}}
+
+    tests := []struct {
+        query string
+        doc   search.Document
+        match bool
+    }{
+        {"jon mako", jonathan, true},
+        {"jonatan", jonathan, true},     // typo
+        {"mkaovsky", jonathan, true},    // swapped letters
+        {"5590", jonathan, true},        // last four digits
+        {"+97254", jonathan, true},      // start of the E.164 number
+        {"343-55", jonathan, true},      // middle of the number
+        {"tel aviv", jonathan, true},    // address words
+        {"city:haifa", jonathan, false}, // filter on another city
+        {"last:jonathan", jonathan, false},
+        {"jose munoz", jose, true}, // diacritics
+        {"jon cohen", jonathan, false},
+        {"xy", jonathan, false}, // short terms need a prefix match
+    }
+    for _, tt := range tests {
+        if _, ok := search.Score(search.Parse(tt.query), tt.doc); ok != tt.match {
+            t.Fatalf("Expected %q matching %+v to be %v", tt.query, tt.doc, tt.match)
+        }
+    }
+
+    exact, _ := search.Score(search.Parse("jonathan"), jonathan)
+    prefix, _ := search.Score(search.Parse("jon"), jonathan)
+    typo, _ := search.Score(search.Parse("jonatan"), jonathan)
+    if !(exact > prefix && prefix > typo) {
+        t.Fatalf("Expected exact > prefix > typo, got %v, %v, %v", exact, prefix, typo)
+    }
+}
+
+// Test that every word a term matches contains one of the fragments stores narrow searches with
+func testSearchFragments(t *testing.T) {
+    tests := []struct {
+        term      string
+        fragments []string
+        words     []string // words the term matches
+    }{
+        {"jo", []string{"jo"}, []string{"jo", "jonathan"}},
+        {"jon", []string{"j", "o", "n"}, []string{"jon", "jonas", "jan", "ojn"}},
+        {"makofsky", []string{"m", "ak", "o", "fs", "ky"}, []string{"makovsky", "mkaovsky", "makofskyy"}},
+        {"munoz", []string{"m", "un", "oz"}, []string{"muñoz", "munos"}},
+    }
+    for _, tt := range tests {
+        term := search.Parse(tt.term).Terms[0]
+        fragments := term.Fragments()
+        if strings.Join(fragments, ",") != strings.Join(tt.fragments, ",") {
+            t.Fatalf("Expected the fragments %v for %q, got %v", tt.fragments, tt.term, fragments)
+        }
+        for _, word := range tt.words {
+            if _, ok := search.Score(search.Parse(tt.term), search.Document{FirstName: word}); !ok {
+                t.Fatalf("Expected %q to match %q", tt.term, word)
+            }
+            found := false
+            for _, fragment := range fragments {
+                found = found || strings.Contains(search.Normalize(word), fragment)
+            }
+            if !found {
+                t.Fatalf("Expected %q to contain one of the fragments %v", word, fragments)
+            }
+        }
+    }
+}
+
+// Test the endpoint ranks matches and rejects empty queries
+func testSearchHandler(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    for _, contact := range []src.Contact{
+        {FirstName: "Jonathan", LastName: "Makovsky", PhoneNumber: "054-343-5590", Address: "Tel Aviv"},
+        {FirstName: "Jon", LastName: "Cohen", PhoneNumber: "052-123-5590", Address: "Haifa"},
+        {FirstName: "Dana", LastName: "Jonas", PhoneNumber: "050-765-4321", Address: "Eilat"},
+        {FirstName: "Zoé", LastName: "Muñoz", PhoneNumber: "053-222-3344", Address: "Beer Sheva",
+            Addresses: []src.PostalAddress{{Address: "Beer Sheva", Primary: true}, {Type: "work", Address: "Rishon LeZion"}}},
+    } {
+        if _, err := store.AddContact(contact); err != nil {
+            t.Fatalf("Failed to add contact: %v", err)
+        }
+    }
+
+    find := func(q string) []src.SearchResult {
+        rec := doRequest(router, "GET", "/contacts/search?q="+url.QueryEscape(q), "")
+        if rec.Code != http.StatusOK {
+            t.Fatalf("Expected status 200 for %q, got %d (%s)", q, rec.Code, rec.Body.String())
+        }
+        var response struct {
+            Results []src.SearchResult `json:"results"`
+        }
+        json.NewDecoder(rec.Body).Decode(&response)
+        return response.Results
+    }
+
+    results := find("jon")
+    if len(results) != 3 || results[0].Contact.FirstName != "Jon" || results[0].Score < results[1].Score {
+        t.Fatalf("Expected the exact name first among 3 matches, got %+v", results)
+    }
+    if results = find("5590"); len(results) != 2 {
+        t.Fatalf("Expected 2 contacts ending in 5590, got %+v", results)
+    }
+    if results = find("5590 city:haifa"); len(results) != 1 || results[0].Contact.LastName != "Cohen" {
+        t.Fatalf("Expected the city filter to keep only Cohen, got %+v", results)
+    }
+    if results = find("makofsky"); len(results) != 1 {
+        t.Fatalf("Expected the typo to find Makovsky, got %+v", results)
+    }
+    // Accents, typos, secondary addresses and numbers typed in another form than stored
+    for _, q := range []string{"munoz", "ZOÉ", "mnuoz", "rishon", "053-222", "+9725322", "first:zoe phone:3344"} {
+        if results = find(q); len(results) != 1 || results[0].Contact.LastName != "Muñoz" {
+            t.Fatalf("Expected %q to find Muñoz, got %+v", q, results)
+        }
+    }
+    if results = find("phone:zoe"); len(results) != 0 {
+        t.Fatalf("Expected no results for text restricted to phone numbers, got %+v", results)
+    }
+    if results = find("nobody"); len(results) != 0 {
+        t.Fatalf("Expected no results, got %+v", results)
+    }
+
+    if rec := doRequest(router, "GET", "/contacts/search?q=jon&limit=1", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected status 200, got %d", rec.Code)
+    } else {
+        var response struct {
+            Results []src.SearchResult `json:"results"`
+        }
+        json.NewDecoder(rec.Body).Decode(&response)
+        if len(response.Results) != 1 {
+            t.Fatalf("Expected limit to cap the results, got %+v", response.Results)
+        }
+    }
+    if rec := doRequest(router, "GET", "/contacts/search?q=", ""); rec.Code != http.StatusBadRequest {
+        t.Fatalf("Expected status 400 for an empty query, got %d", rec.Code)
+    }
+}
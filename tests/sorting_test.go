@@ -0,0 +1,147 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "reflect"
+    "testing"
+
+    "Rise/src"
+)
+
+// Test function to run all sorting and column filter tests
+func TestSorting(t *testing.T) {
+    t.Run("Test Sort", func(t *testing.T) { forEachStore(t, testSort) })
+    t.Run("Test Column Filters", func(t *testing.T) { forEachStore(t, testColumnFilters) })
+}
+
+// addSortable creates a contact, failing the test unless it answers 201, and returns its id
+func addSortable(t *testing.T, handler http.Handler, firstName, lastName, number, address string) int {
+    rec := doRequest(handler, "POST", "/api/v1/contacts",
+        `{"first_name":"`+firstName+`","last_name":"`+lastName+`","phone_number":"`+number+`","address":"`+address+`"}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 adding %s, got %d: %s", firstName, rec.Code, rec.Body.String())
+    }
+    var contact src.Contact
+    json.NewDecoder(rec.Body).Decode(&contact)
+    if contact.CreatedAt.IsZero() {
+        t.Fatalf("Expected the creation time of %s, got %+v", firstName, contact)
+    }
+    return contact.ID
+}
+
+// Test that the contact list orders by several keys in either direction, case insensitively,
+// and walks sorted pages with cursors
+func testSort(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    dana := addSortable(t, router, "Dana", "Levi", "0521111111", "Haifa")
+    gal := addSortable(t, router, "gal", "Cohen", "0522222222", "Acre")
+    tal := addSortable(t, router, "Tal", "levi", "0523333333", "acre")
+    roni := addSortable(t, router, "Roni", "Cohen", "0524444444", "Eilat")
+
+    tests := []struct {
+        query    string
+        expected []int
+    }{
+        {"sort=first_name", []int{dana, gal, roni, tal}},
+        {"sort=-first_name", []int{tal, roni, gal, dana}},
+        {"sort=last_name,first_name", []int{gal, roni, dana, tal}},
+        {"sort=last_name,-first_name", []int{roni, gal, tal, dana}},
+        {"sort=address,-phone_number", []int{tal, gal, roni, dana}},
+        {"sort=-phone_number", []int{roni, tal, gal, dana}},
+        {"sort=created_at", []int{dana, gal, tal, roni}},
+        {"last_name.eq=levi&sort=-first_name", []int{tal, dana}},
+    }
+    for _, tt := range tests {
+        if ids := listIDs(t, router, "/api/v1/contacts?"+tt.query); !reflect.DeepEqual(ids, tt.expected) {
+            t.Fatalf("Expected %v for %s, got %v", tt.expected, tt.query, ids)
+        }
+        // One contact a page, the next cursors walk the same order and the prev cursors walk it back
+        var forward, backward []int
+        page, _ := readListPage(t, router, "/api/v1/contacts?limit=1&"+tt.query)
+        for {
+            forward = append(forward, page.Contacts[0].ID)
+            if page.NextCursor == "" {
+                break
+            }
+            page, _ = readListPage(t, router, "/api/v1/contacts?limit=1&"+tt.query+"&after="+page.NextCursor)
+        }
+        for {
+            backward = append([]int{page.Contacts[0].ID}, backward...)
+            if page.PrevCursor == "" {
+                break
+            }
+            page, _ = readListPage(t, router, "/api/v1/contacts?limit=1&"+tt.query+"&before="+page.PrevCursor)
+        }
+        if !reflect.DeepEqual(forward, tt.expected) || !reflect.DeepEqual(backward, tt.expected) {
+            t.Fatalf("Expected the cursors of %s to walk %v, got %v forwards and %v backwards", tt.query, tt.expected, forward, backward)
+        }
+    }
+
+    read := func(query string) sortedPage {
+        rec := doRequest(router, "GET", "/api/v1/contacts?sort=last_name,first_name&limit=3"+query, "")
+        if rec.Code != http.StatusOK {
+            t.Fatalf("Expected 200 reading a sorted page, got %d: %s", rec.Code, rec.Body.String())
+        }
+        var page sortedPage
+        json.NewDecoder(rec.Body).Decode(&page)
+        return page
+    }
+    first := read("")
+    second := read("&after=" + first.NextCursor)
+    if len(first.Contacts) != 3 || len(second.Contacts) != 1 || second.Contacts[0].ID != tal || second.NextCursor != "" {
+        t.Fatalf("Expected the last contact on the second page, got %+v then %+v", first, second)
+    }
+    // The cursor holds a position rather than a count, so contacts added before it shift nothing
+    addSortable(t, router, "Avi", "Adler", "0525555555", "Haifa")
+    if again := read("&after=" + first.NextCursor); len(again.Contacts) != 1 || again.Contacts[0].ID != tal {
+        t.Fatalf("Expected the second page unchanged by a contact added on the first, got %+v", again)
+    }
+
+    for _, query := range []string{"sort=nickname", "sort=first_name,id", "sort=-", "sort=phone_e164"} {
+        if rec := doRequest(router, "GET", "/api/v1/contacts?"+query, ""); rec.Code != http.StatusBadRequest {
+            t.Fatalf("Expected 400 for %s, got %d", query, rec.Code)
+        }
+    }
+}
+
+// Test that the column filters match whole values, prefixes and substrings case insensitively,
+// treat LIKE wildcards as plain text and combine with each other
+func testColumnFilters(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    dana := addSortable(t, router, "Dana", "Levi", "0521111111", "100% Herzl St")
+    daniel := addSortable(t, router, "Daniel", "Cohen", "0522222222", "Herzl_St 5")
+    adan := addSortable(t, router, "Adan", "Levinson", "0532222222", "Tel Aviv")
+
+    tests := []struct {
+        query    string
+        expected []int
+    }{
+        {"first_name.eq=DANA", []int{dana}},
+        {"first_name.prefix=dan", []int{dana, daniel}},
+        {"first_name.contains=dan", []int{dana, daniel, adan}},
+        {"last_name.eq=levi", []int{dana}},
+        {"last_name.prefix=levi", []int{dana, adan}},
+        {"phone_number.prefix=052", []int{dana, daniel}},
+        {"phone_number.contains=2222", []int{daniel, adan}},
+        {"address.contains=" + url.QueryEscape("%"), []int{dana}},
+        {"address.contains=l_s", []int{daniel}},
+        {"address.prefix=" + url.QueryEscape("100%"), []int{dana}},
+        {"first_name.prefix=dan&last_name.prefix=le", []int{dana}},
+        {"first_name.contains=an&address.eq=tel%20aviv", []int{adan}},
+        {"first_name.eq=dan", []int{}},
+    }
+    for _, tt := range tests {
+        if ids := listIDs(t, router, "/api/v1/contacts?"+tt.query); !reflect.DeepEqual(ids, tt.expected) {
+            t.Fatalf("Expected %v for %s, got %v", tt.expected, tt.query, ids)
+        }
+    }
+
+    for _, query := range []string{"first_name.like=dan", "address.eq=", "last_name.prefix=%20"} {
+        rec := doRequest(router, "GET", "/api/v1/contacts?"+query, "")
+        if resp := decodeError(t, rec); rec.Code != http.StatusBadRequest || resp.Code != src.CodeBadRequest {
+            t.Fatalf("Expected 400 for %s, got %d %+v", query, rec.Code, resp)
+        }
+    }
+}
@@ -0,0 +1,314 @@
+package tests
+
+import (
+    "database/sql"
+    "errors"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    _ "modernc.org/sqlite"
+
+    "Rise/src"
+)
+
+// Test function to run the store suite against every backend that needs no Docker
+func TestStores(t *testing.T) {
+    backends := map[string]func(t *testing.T) src.ContactStore{
+        "memory": func(t *testing.T) src.ContactStore {
+            return src.NewMemoryStore("IL")
+        },
+        "sqlite": newSQLiteStore,
+    }
+
+    for name, newStore := range backends {
+        t.Run(name, func(t *testing.T) {
+            t.Run("Test Add, Get, Search, Edit, Delete Contact", func(t *testing.T) { testStoreCRUD(t, newStore(t)) })
+            t.Run("Test Cursor Pagination", func(t *testing.T) { testStorePagination(t, newStore(t)) })
+            t.Run("Test Patch Contact", func(t *testing.T) { testStorePatch(t, newStore(t)) })
+            t.Run("Test Phones, Emails and Addresses", func(t *testing.T) { testStoreDetails(t, newStore(t)) })
+        })
+    }
+}
+
+// newSQLiteStore opens a SQLite store in a temporary file
+func newSQLiteStore(t *testing.T) src.ContactStore {
+    db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "phonebook.db"))
+    if err != nil {
+        t.Fatalf("Failed to open sqlite database: %v", err)
+    }
+    t.Cleanup(func() { db.Close() })
+
+    store, err := src.NewSQLiteStore(db, "IL")
+    if err != nil {
+        t.Fatalf("Failed to create sqlite store: %v", err)
+    }
+    return store
+}
+
+// forEachStore runs test as a "memory" and a "sqlite" subtest, each on a fresh store
+func forEachStore(t *testing.T, test func(t *testing.T, store src.ContactStore)) {
+    t.Run("memory", func(t *testing.T) { test(t, src.NewMemoryStore("IL")) })
+    t.Run("sqlite", func(t *testing.T) { test(t, newSQLiteStore(t)) })
+}
+
+// Test the full lifecycle of a contact
+func testStoreCRUD(t *testing.T, store src.ContactStore) {
+    contact := src.Contact{FirstName: "Jonathan", LastName: "Makovsky", PhoneNumber: "0543435590", Address: "Tel Aviv"}
+
+    id, err := store.AddContact(contact)
+    if err != nil {
+        t.Fatalf("Failed to add contact: %v", err)
+    }
+    contact.ID = id
+    contact.PhoneE164 = "+972543435590"
+    contact.Version = 1
+    contact.Phones = []src.Phone{{Type: src.PhoneMobile, Number: "0543435590", E164: "+972543435590", Primary: true}}
+    contact.Emails = []src.Email{}
+    contact.Addresses = []src.PostalAddress{{Type: src.AddressHome, Address: "Tel Aviv", Primary: true}}
+    contact.Tags = []string{}
+    contact.CustomFields = map[string]any{}
+
+    got, err := store.GetContact(id)
+    if err == nil && time.Since(got.CreatedAt) > time.Minute {
+        t.Fatalf("Expected the creation time stored, got %v", got.CreatedAt)
+    }
+    contact.CreatedAt = got.CreatedAt
+    if err != nil || !reflect.DeepEqual(got, contact) {
+        t.Fatalf("Expected contact %+v, got %+v (err=%v)", contact, got, err)
+    }
+
+    // Every way of writing the number finds the same contact
+    for _, number := range []string{"0543435590", "054-343-5590", "+972 54 343 5590", "00972543435590"} {
+        contacts, err := store.SearchContact(number)
+        if err != nil || len(contacts) != 1 || !reflect.DeepEqual(contacts[0], contact) {
+            t.Fatalf("Expected %q to find %+v, got %+v (err=%v)", number, contact, contacts, err)
+        }
+    }
+
+    var validationErr *src.ValidationError
+    if _, err := store.AddContact(src.Contact{FirstName: "Bad", LastName: "Number", PhoneNumber: "12ab", Address: "Nowhere"}); !errors.As(err, &validationErr) {
+        t.Fatalf("Expected a validation error for an invalid phone number, got %v", err)
+    }
+
+    // The lists win over the single fields, so both are changed
+    contact.Address = "Jerusalem"
+    contact.Addresses[0].Address = "Jerusalem"
+    updated, err := store.EditContact(id, contact, 1)
+    contact.Version = 2
+    if err != nil || !reflect.DeepEqual(updated, contact) {
+        t.Fatalf("Expected the updated contact %+v, got %+v (err=%v)", contact, updated, err)
+    }
+    if got, _ := store.GetContact(id); got.Address != "Jerusalem" {
+        t.Fatalf("Expected updated address, got %+v", got)
+    }
+
+    if _, err := store.EditContact(id+100, contact, 0); !errors.Is(err, src.ErrNotFound) {
+        t.Fatalf("Expected ErrNotFound when editing an unknown id, got %v", err)
+    }
+
+    // Writes against an old version are refused
+    if _, err := store.EditContact(id, contact, 1); !errors.Is(err, src.ErrVersionMismatch) {
+        t.Fatalf("Expected ErrVersionMismatch when editing a stale version, got %v", err)
+    }
+    if err := store.DeleteContact(id, 1); !errors.Is(err, src.ErrVersionMismatch) {
+        t.Fatalf("Expected ErrVersionMismatch when deleting a stale version, got %v", err)
+    }
+
+    if err := store.DeleteContact(id, 2); err != nil {
+        t.Fatalf("Failed to delete contact: %v", err)
+    }
+    if err := store.DeleteContact(id, 0); !errors.Is(err, src.ErrNotFound) {
+        t.Fatalf("Expected ErrNotFound when deleting twice, got %v", err)
+    }
+    if _, err := store.GetContact(id); err == nil {
+        t.Fatalf("Expected deleted contact to be gone")
+    }
+    if _, err := store.SearchContact(contact.PhoneNumber); err == nil {
+        t.Fatalf("Expected no contacts after deletion")
+    }
+}
+
+// Test walking the table forwards and backwards with cursors
+func testStorePagination(t *testing.T, store src.ContactStore) {
+    var ids []int
+    for i := 0; i < 25; i++ {
+        id, err := store.AddContact(src.Contact{FirstName: "First", LastName: "Last", PhoneNumber: "050-123-4567", Address: "Street"})
+        if err != nil {
+            t.Fatalf("Failed to add contact: %v", err)
+        }
+        ids = append(ids, id)
+    }
+
+    var seen []int
+    afterID, hasMore := 0, true
+    for hasMore {
+        var page []src.Contact
+        var err error
+        page, hasMore, err = store.GetContacts(10, afterID, 0)
+        if err != nil {
+            t.Fatalf("Failed to retrieve contacts: %v", err)
+        }
+        for _, contact := range page {
+            seen = append(seen, contact.ID)
+        }
+        afterID = page[len(page)-1].ID
+    }
+    if len(seen) != len(ids) {
+        t.Fatalf("Expected to walk %d contacts, walked %d", len(ids), len(seen))
+    }
+    for i := range ids {
+        if seen[i] != ids[i] {
+            t.Fatalf("Expected contacts in id order, got %v", seen)
+        }
+    }
+
+    page, hasMore, err := store.GetContacts(10, 0, ids[20])
+    if err != nil {
+        t.Fatalf("Failed to retrieve previous page: %v", err)
+    }
+    if !hasMore || len(page) != 10 || page[0].ID != ids[10] || page[9].ID != ids[19] {
+        t.Fatalf("Expected previous page to hold ids %v, got %+v (hasMore=%v)", ids[10:20], page, hasMore)
+    }
+}
+
+// Test normalizing rows stored before phone_e164 existed, like the ones seeded by the sample contacts migration
+func TestSQLiteBackfillPhoneNumbers(t *testing.T) {
+    db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "phonebook.db"))
+    if err != nil {
+        t.Fatalf("Failed to open sqlite database: %v", err)
+    }
+    defer db.Close()
+
+    store, err := src.NewSQLiteStore(db, "IL")
+    if err != nil {
+        t.Fatalf("Failed to create sqlite store: %v", err)
+    }
+    _, err = db.Exec(`INSERT INTO contacts (first_name, last_name, phone_number, address) VALUES
+        ('Jonathan', 'Makovsky', '0543435590', 'Tel Aviv'),
+        ('Jonathan', 'Makovsky', '054-343-5590', 'Jerusalem'),
+        ('Jonathan', 'Makovsky', '1', 'Tel Aviv')`)
+    if err != nil {
+        t.Fatalf("Failed to seed legacy rows: %v", err)
+    }
+
+    updated, err := store.BackfillPhoneNumbers()
+    if err != nil || updated != 3 {
+        t.Fatalf("Expected 3 rows to be backfilled, got %d (err=%v)", updated, err)
+    }
+    if contacts, err := store.SearchContact("+972543435590"); err != nil || len(contacts) != 2 {
+        t.Fatalf("Expected both spellings to share one normalized number, got %+v (err=%v)", contacts, err)
+    }
+    if contacts, err := store.SearchContact("1"); err != nil || len(contacts) != 1 {
+        t.Fatalf("Expected the unparseable legacy number to stay reachable, got %+v (err=%v)", contacts, err)
+    }
+    if contacts, _ := store.SearchContact("1"); len(contacts[0].Phones) != 1 || len(contacts[0].Addresses) != 1 {
+        t.Fatalf("Expected the legacy number and address to be copied to the detail tables, got %+v", contacts[0])
+    }
+    if updated, _ := store.BackfillPhoneNumbers(); updated != 0 {
+        t.Fatalf("Expected a second backfill to be a no-op, updated %d rows", updated)
+    }
+}
+
+// Test that a patch changes only the given fields and keeps the E.164 form in sync
+func testStorePatch(t *testing.T, store src.ContactStore) {
+    id, err := store.AddContact(src.Contact{FirstName: "Jonathan", LastName: "Makovsky", PhoneNumber: "0543435590", Address: "Tel Aviv"})
+    if err != nil {
+        t.Fatalf("Failed to add contact: %v", err)
+    }
+
+    address := "Haifa"
+    patched, err := store.PatchContact(id, src.ContactPatch{Address: &address}, 0)
+    if err != nil || patched.Address != "Haifa" || patched.FirstName != "Jonathan" || patched.PhoneE164 != "+972543435590" {
+        t.Fatalf("Expected only the address to change, got %+v (err=%v)", patched, err)
+    }
+
+    number := "052-123-4567"
+    patched, err = store.PatchContact(id, src.ContactPatch{PhoneNumber: &number}, 0)
+    if err != nil || patched.PhoneNumber != number || patched.PhoneE164 != "+972521234567" || patched.Address != "Haifa" {
+        t.Fatalf("Expected the phone number and its E.164 form to change, got %+v (err=%v)", patched, err)
+    }
+
+    if got, err := store.PatchContact(id, src.ContactPatch{}, 0); err != nil || !reflect.DeepEqual(got, patched) {
+        t.Fatalf("Expected an empty patch to return the contact unchanged, got %+v (err=%v)", got, err)
+    }
+
+    invalid := "12ab"
+    var validationErr *src.ValidationError
+    if _, err := store.PatchContact(id, src.ContactPatch{PhoneNumber: &invalid}, 0); !errors.As(err, &validationErr) {
+        t.Fatalf("Expected a validation error for an invalid phone number, got %v", err)
+    }
+    if _, err := store.PatchContact(id+100, src.ContactPatch{Address: &address}, 0); !errors.Is(err, src.ErrNotFound) {
+        t.Fatalf("Expected ErrNotFound when patching an unknown id, got %v", err)
+    }
+}
+
+// Test contacts with several phone numbers, emails and addresses
+func testStoreDetails(t *testing.T, store src.ContactStore) {
+    id, err := store.AddContact(src.Contact{
+        FirstName: "Jonathan",
+        LastName:  "Makovsky",
+        Phones: []src.Phone{
+            {Number: "0543435590"},
+            {Type: src.PhoneWork, Number: "03-6123456", Primary: true},
+        },
+        Emails:    []src.Email{{Address: "jonathan@example.com"}},
+        Addresses: []src.PostalAddress{{Address: "Tel Aviv"}, {Type: src.AddressWork, Address: "Haifa"}},
+    })
+    if err != nil {
+        t.Fatalf("Failed to add contact: %v", err)
+    }
+
+    // The single fields mirror the primary entries
+    contact, err := store.GetContact(id)
+    if err != nil || contact.PhoneNumber != "03-6123456" || contact.PhoneE164 != "+97236123456" || contact.Address != "Tel Aviv" {
+        t.Fatalf("Expected the primary phone and address to be mirrored, got %+v (err=%v)", contact, err)
+    }
+    if contact.Phones[0].Type != src.PhoneMobile || contact.Phones[0].Primary || !contact.Emails[0].Primary || !contact.Addresses[0].Primary {
+        t.Fatalf("Expected default types and primary flags, got %+v", contact)
+    }
+
+    // Any of the numbers finds the contact
+    for _, number := range []string{"054-343-5590", "+97236123456"} {
+        if contacts, err := store.SearchContact(number); err != nil || len(contacts) != 1 || contacts[0].ID != id {
+            t.Fatalf("Expected %q to find the contact, got %+v (err=%v)", number, contacts, err)
+        }
+    }
+
+    // A new phone_number replaces only the primary phone
+    number := "052-123-4567"
+    patched, err := store.PatchContact(id, src.ContactPatch{PhoneNumber: &number}, 0)
+    if err != nil || len(patched.Phones) != 2 || patched.Phones[0].Number != "0543435590" || patched.Phones[1].E164 != "+972521234567" || patched.Phones[1].Type != src.PhoneWork {
+        t.Fatalf("Expected the primary phone to change, got %+v (err=%v)", patched, err)
+    }
+    if _, err := store.SearchContact("03-6123456"); !errors.Is(err, src.ErrNotFound) {
+        t.Fatalf("Expected the replaced number to be gone, got %v", err)
+    }
+
+    // Replacing the lists
+    emails := []src.Email{}
+    addresses := []src.PostalAddress{{Type: src.AddressOther, Address: "Eilat"}}
+    patched, err = store.PatchContact(id, src.ContactPatch{Emails: &emails, Addresses: &addresses}, 0)
+    if err != nil || len(patched.Emails) != 0 || len(patched.Addresses) != 1 || patched.Address != "Eilat" || len(patched.Phones) != 2 {
+        t.Fatalf("Expected the emails and addresses to be replaced, got %+v (err=%v)", patched, err)
+    }
+
+    var validationErr *src.ValidationError
+    twoPrimaries := []src.Phone{{Number: "0501111111", Primary: true}, {Number: "0502222222", Primary: true}}
+    if _, err := store.PatchContact(id, src.ContactPatch{Phones: &twoPrimaries}, 0); !errors.As(err, &validationErr) || validationErr.Details[0].Field != "phones" {
+        t.Fatalf("Expected a validation error for two primary phones, got %v", err)
+    }
+    badEmail := []src.Email{{Type: "pager", Address: "not an email"}}
+    if _, err := store.PatchContact(id, src.ContactPatch{Emails: &badEmail}, 0); !errors.As(err, &validationErr) || len(validationErr.Details) != 2 {
+        t.Fatalf("Expected the email type and address to be rejected, got %v", err)
+    }
+
+    // Deleting the contact removes every number with it
+    if err := store.DeleteContact(id, 0); err != nil {
+        t.Fatalf("Failed to delete contact: %v", err)
+    }
+    if _, err := store.SearchContact("0543435590"); !errors.Is(err, src.ErrNotFound) {
+        t.Fatalf("Expected the secondary number to be gone with the contact, got %v", err)
+    }
+}
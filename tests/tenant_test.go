@@ -0,0 +1,329 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "Rise/src"
+    "Rise/src/auth"
+)
+
+// Test function to run all tenant tests
+func TestTenants(t *testing.T) {
+    t.Run("Test Tenant Isolation", func(t *testing.T) { forEachStore(t, testTenantIsolation) })
+    t.Run("Test Tenant Bound API Keys", testTenantBoundKeys)
+    t.Run("Test Tenant Administration", func(t *testing.T) { forEachStore(t, testTenantAdministration) })
+    t.Run("Test Tenant Subdomains", testTenantSubdomains)
+}
+
+// doTenantRequest sends a request for the tenant named in the X-Tenant-ID header, with the
+// API key when one is given
+func doTenantRequest(handler http.Handler, tenant, key, method, path, body string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, path, strings.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    if tenant != "" {
+        req.Header.Set("X-Tenant-ID", tenant)
+    }
+    if key != "" {
+        req.Header.Set("X-API-Key", key)
+    }
+    rec := httptest.NewRecorder()
+    handler.ServeHTTP(rec, req)
+    return rec
+}
+
+// createTenant provisions a tenant through the admin API
+func createTenant(t *testing.T, handler http.Handler, key, id string) {
+    rec := doTenantRequest(handler, "", key, "POST", "/api/v1/admin/tenants", `{"id": "`+id+`"}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating tenant %s, got %d: %s", id, rec.Code, rec.Body.String())
+    }
+}
+
+// listTenantContacts returns the contacts the tenant sees on GET /api/v1/contacts
+func listTenantContacts(t *testing.T, handler http.Handler, tenant, key string) []src.Contact {
+    rec := doTenantRequest(handler, tenant, key, "GET", "/api/v1/contacts", "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 listing the contacts of %q, got %d", tenant, rec.Code)
+    }
+    var page struct {
+        Contacts []src.Contact `json:"contacts"`
+    }
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page.Contacts
+}
+
+// Test that a tenant never sees or changes the contacts of another tenant
+func testTenantIsolation(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    createTenant(t, router, "", "acme")
+    createTenant(t, router, "", "globex")
+
+    body := `{"first_name":"Wile","last_name":"Coyote","phone_number":"0501234567","address":"Desert"}`
+    rec := doTenantRequest(router, "acme", "", "POST", "/api/v1/contacts", body)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating a contact of acme, got %d: %s", rec.Code, rec.Body.String())
+    }
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    path := "/api/v1/contacts/" + strconv.Itoa(created.ID)
+
+    // The same number may be stored by another tenant
+    if rec := doTenantRequest(router, "globex", "", "POST", "/api/v1/contacts", body); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected another tenant to store the same number, got %d", rec.Code)
+    }
+
+    if contacts := listTenantContacts(t, router, "acme", ""); len(contacts) != 1 || contacts[0].ID != created.ID {
+        t.Fatalf("Expected acme to list only its contact, got %+v", contacts)
+    }
+    if contacts := listTenantContacts(t, router, "", ""); len(contacts) != 0 {
+        t.Fatalf("Expected the default tenant to see no contacts, got %+v", contacts)
+    }
+
+    // Addressed by id, acme's contact does not exist for globex
+    for _, tt := range []struct{ method, body string }{
+        {"GET", ""},
+        {"PUT", body},
+        {"PATCH", `{"last_name":"Genius"}`},
+        {"DELETE", ""},
+    } {
+        if rec := doTenantRequest(router, "globex", "", tt.method, path, tt.body); rec.Code != http.StatusNotFound {
+            t.Fatalf("Expected 404 for %s %s from another tenant, got %d", tt.method, path, rec.Code)
+        }
+    }
+
+    // Addressed by number, globex only reaches its own contact
+    edited := `{"first_name":"Road","last_name":"Runner","phone_number":"0501234567","address":"Canyon"}`
+    if rec := doTenantRequest(router, "globex", "", "PUT", "/editContact/0501234567", edited); rec.Code != http.StatusOK {
+        t.Fatalf("Expected globex to edit its own contact, got %d", rec.Code)
+    }
+    if rec := doTenantRequest(router, "globex", "", "DELETE", "/deleteContact/0501234567", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected globex to delete its own contact, got %d", rec.Code)
+    }
+    if contacts := listTenantContacts(t, router, "globex", ""); len(contacts) != 0 {
+        t.Fatalf("Expected globex's contact to be deleted, got %+v", contacts)
+    }
+
+    rec = doTenantRequest(router, "acme", "", "GET", path, "")
+    var stored src.Contact
+    json.NewDecoder(rec.Body).Decode(&stored)
+    if rec.Code != http.StatusOK || stored.LastName != "Coyote" {
+        t.Fatalf("Expected acme's contact to be untouched, got %d %+v", rec.Code, stored)
+    }
+
+    rec = doTenantRequest(router, "initech", "", "GET", "/api/v1/contacts", "")
+    if rec.Code != http.StatusNotFound || decodeError(t, rec).Code != src.CodeNotFound {
+        t.Fatalf("Expected 404 for an unknown tenant, got %d", rec.Code)
+    }
+}
+
+// Test that keys bound to a tenant are confined to it, whatever tenant the request names
+func testTenantBoundKeys(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, src.NewAuthenticator(store, nil, nil, "bootstrap-key"))
+    createTenant(t, router, "bootstrap-key", "acme")
+    createTenant(t, router, "bootstrap-key", "globex")
+
+    rec := doTenantRequest(router, "", "bootstrap-key", "POST", "/api/v1/admin/api-keys", `{"name": "acme admin", "role": "admin", "tenant": "acme"}`)
+    var created struct {
+        src.APIKey
+        Key string `json:"key"`
+    }
+    json.NewDecoder(rec.Body).Decode(&created)
+    if rec.Code != http.StatusCreated || created.Tenant != "acme" {
+        t.Fatalf("Expected 201 with a key bound to acme, got %d %+v", rec.Code, created.APIKey)
+    }
+    acmeKey := created.Key
+
+    body := `{"first_name":"Wile","last_name":"Coyote","phone_number":"0501234567","address":"Desert"}`
+    rec = doTenantRequest(router, "globex", "bootstrap-key", "POST", "/api/v1/contacts", body)
+    var other src.Contact
+    json.NewDecoder(rec.Body).Decode(&other)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating a contact of globex, got %d", rec.Code)
+    }
+
+    // Without a header the key works on its own tenant
+    if rec := doTenantRequest(router, "", acmeKey, "POST", "/api/v1/contacts", body); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected the bound key to create a contact, got %d", rec.Code)
+    }
+    if contacts := listTenantContacts(t, router, "acme", "bootstrap-key"); len(contacts) != 1 {
+        t.Fatalf("Expected the contact to be stored for acme, got %+v", contacts)
+    }
+
+    rec = doTenantRequest(router, "globex", acmeKey, "GET", "/api/v1/contacts", "")
+    if rec.Code != http.StatusForbidden || decodeError(t, rec).Code != src.CodeForbidden {
+        t.Fatalf("Expected 403 when a bound key names another tenant, got %d", rec.Code)
+    }
+    if rec := doTenantRequest(router, "", acmeKey, "DELETE", "/api/v1/contacts/"+strconv.Itoa(other.ID), ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 deleting another tenant's contact, got %d", rec.Code)
+    }
+    if contacts := listTenantContacts(t, router, "globex", "bootstrap-key"); len(contacts) != 1 {
+        t.Fatalf("Expected globex's contact to survive, got %+v", contacts)
+    }
+
+    // Bound keys neither manage tenants nor create keys for other tenants
+    if rec := doTenantRequest(router, "", acmeKey, "GET", "/api/v1/admin/tenants", ""); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 listing tenants with a bound key, got %d", rec.Code)
+    }
+    if rec := doTenantRequest(router, "", acmeKey, "POST", "/api/v1/admin/api-keys", `{"name": "sneaky", "tenant": "globex"}`); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 creating a key of another tenant, got %d", rec.Code)
+    }
+    rec = doTenantRequest(router, "", acmeKey, "POST", "/api/v1/admin/api-keys", `{"name": "acme reader"}`)
+    json.NewDecoder(rec.Body).Decode(&created)
+    if rec.Code != http.StatusCreated || created.Tenant != "acme" {
+        t.Fatalf("Expected keys created by a bound key to be bound to its tenant, got %d %+v", rec.Code, created.APIKey)
+    }
+
+    if rec := doTenantRequest(router, "", "bootstrap-key", "POST", "/api/v1/admin/api-keys", `{"name": "lost", "tenant": "initech"}`); rec.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("Expected 422 binding a key to an unknown tenant, got %d", rec.Code)
+    }
+
+    // Keys naming no tenant are bound to the default tenant unless they may manage tenants
+    rec = doTenantRequest(router, "", "bootstrap-key", "POST", "/api/v1/admin/api-keys", `{"name": "reader", "role": "viewer"}`)
+    json.NewDecoder(rec.Body).Decode(&created)
+    if rec.Code != http.StatusCreated || created.Tenant != src.DefaultTenant {
+        t.Fatalf("Expected a viewer key bound to the default tenant, got %d %+v", rec.Code, created.APIKey)
+    }
+    if _, err := store.CreateAPIKey(src.APIKey{Name: "legacy", Role: src.RoleEditor}, auth.HashAPIKey("legacy-key")); err != nil {
+        t.Fatalf("Failed to store an unbound key: %v", err)
+    }
+    for _, key := range []string{created.Key, "legacy-key"} {
+        if rec := doTenantRequest(router, "globex", key, "GET", "/api/v1/contacts", ""); rec.Code != http.StatusForbidden {
+            t.Fatalf("Expected 403 when a key without a tenant names another tenant, got %d", rec.Code)
+        }
+        if rec := doTenantRequest(router, "", key, "GET", "/api/v1/contacts", ""); rec.Code != http.StatusOK {
+            t.Fatalf("Expected the key to read the default tenant, got %d", rec.Code)
+        }
+    }
+
+    // So are tokens without a tenant claim
+    secret := []byte("tenant test secret")
+    tokens := &auth.Validator{Keys: []auth.Key{auth.NewHMACKey("", secret)}}
+    router = src.NewRouter(store, src.NewAuthenticator(store, tokens, nil, "bootstrap-key"))
+    expires := time.Now().Add(time.Hour).Unix()
+    tests := []struct {
+        roles  string
+        status int
+    }{
+        {src.RoleEditor, http.StatusForbidden},
+        {src.RoleAdmin, http.StatusOK},
+    }
+    for _, tt := range tests {
+        token := signToken(t, auth.HS256, "", secret, map[string]interface{}{"sub": "someone", "roles": tt.roles, "exp": expires})
+        req := httptest.NewRequest("GET", "/api/v1/contacts", nil)
+        req.Header.Set("Authorization", "Bearer "+token)
+        req.Header.Set("X-Tenant-ID", "globex")
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, req)
+        if rec.Code != tt.status {
+            t.Fatalf("Expected %d for a %s token without a tenant naming globex, got %d", tt.status, tt.roles, rec.Code)
+        }
+    }
+}
+
+// Test provisioning, listing and deleting tenants
+func testTenantAdministration(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+
+    rec := doTenantRequest(router, "", "", "POST", "/api/v1/admin/tenants", `{"id": "acme", "name": "Acme Corporation"}`)
+    var created src.Tenant
+    json.NewDecoder(rec.Body).Decode(&created)
+    if rec.Code != http.StatusCreated || created.Name != "Acme Corporation" || rec.Header().Get("Location") != "/api/v1/admin/tenants/acme" {
+        t.Fatalf("Expected 201 with the tenant and its location, got %d %+v", rec.Code, created)
+    }
+    if rec := doTenantRequest(router, "", "", "POST", "/api/v1/admin/tenants", `{"id": "acme"}`); rec.Code != http.StatusConflict {
+        t.Fatalf("Expected 409 for a duplicate tenant, got %d", rec.Code)
+    }
+    for _, id := range []string{"", "Acme", "-acme", "acme.example", strings.Repeat("a", 64)} {
+        rec := doTenantRequest(router, "", "", "POST", "/api/v1/admin/tenants", `{"id": "`+id+`"}`)
+        if rec.Code != http.StatusUnprocessableEntity || decodeError(t, rec).Details[0].Field != "id" {
+            t.Fatalf("Expected 422 for tenant id %q, got %d", id, rec.Code)
+        }
+    }
+
+    rec = doTenantRequest(router, "", "", "GET", "/api/v1/admin/tenants", "")
+    var list struct {
+        Tenants []src.Tenant `json:"tenants"`
+    }
+    json.NewDecoder(rec.Body).Decode(&list)
+    if rec.Code != http.StatusOK || len(list.Tenants) != 2 || list.Tenants[0].ID != "acme" || list.Tenants[1].ID != src.DefaultTenant {
+        t.Fatalf("Expected acme and the default tenant, got %d %+v", rec.Code, list)
+    }
+    if rec := doTenantRequest(router, "", "", "GET", "/api/v1/admin/tenants/acme", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 reading the tenant, got %d", rec.Code)
+    }
+
+    body := `{"first_name":"Wile","last_name":"Coyote","phone_number":"0501234567","address":"Desert"}`
+    if rec := doTenantRequest(router, "acme", "", "POST", "/api/v1/contacts", body); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating a contact of acme, got %d", rec.Code)
+    }
+    if rec := doTenantRequest(router, "", "", "POST", "/api/v1/contacts", body); rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating a contact of the default tenant, got %d", rec.Code)
+    }
+
+    if rec := doTenantRequest(router, "", "", "DELETE", "/api/v1/admin/tenants/acme", ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting the tenant, got %d", rec.Code)
+    }
+    if rec := doTenantRequest(router, "", "", "DELETE", "/api/v1/admin/tenants/acme", ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 deleting the tenant twice, got %d", rec.Code)
+    }
+    if rec := doTenantRequest(router, "", "", "DELETE", "/api/v1/admin/tenants/default", ""); rec.Code != http.StatusConflict {
+        t.Fatalf("Expected 409 deleting the default tenant, got %d", rec.Code)
+    }
+
+    // A tenant created again with the same id starts empty
+    createTenant(t, router, "", "acme")
+    if contacts := listTenantContacts(t, router, "acme", ""); len(contacts) != 0 {
+        t.Fatalf("Expected the deleted tenant's contacts to be gone, got %+v", contacts)
+    }
+    if contacts := listTenantContacts(t, router, "", ""); len(contacts) != 1 {
+        t.Fatalf("Expected the default tenant's contact to be kept, got %+v", contacts)
+    }
+}
+
+// Test that the subdomain selects the tenant and that the header takes precedence
+func testTenantSubdomains(t *testing.T) {
+    router := src.TenantSubdomains("phonebook.example.com", src.NewRouter(src.NewMemoryStore("IL"), nil))
+    createTenant(t, router, "", "acme")
+    call := func(host, tenant string) []src.Contact {
+        req := httptest.NewRequest("GET", "/api/v1/contacts", nil)
+        req.Host = host
+        if tenant != "" {
+            req.Header.Set("X-Tenant-ID", tenant)
+        }
+        rec := httptest.NewRecorder()
+        router.ServeHTTP(rec, req)
+        if rec.Code != http.StatusOK {
+            t.Fatalf("Expected 200 from %s, got %d", host, rec.Code)
+        }
+        var page struct {
+            Contacts []src.Contact `json:"contacts"`
+        }
+        json.NewDecoder(rec.Body).Decode(&page)
+        return page.Contacts
+    }
+
+    req := httptest.NewRequest("POST", "/api/v1/contacts", strings.NewReader(`{"first_name":"Wile","last_name":"Coyote","phone_number":"0501234567","address":"Desert"}`))
+    req.Host = "acme.phonebook.example.com:8080"
+    rec := httptest.NewRecorder()
+    router.ServeHTTP(rec, req)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 creating a contact through the subdomain, got %d", rec.Code)
+    }
+
+    if contacts := call("ACME.phonebook.example.com", ""); len(contacts) != 1 {
+        t.Fatalf("Expected the subdomain to select acme, got %+v", contacts)
+    }
+    if contacts := call("phonebook.example.com", ""); len(contacts) != 0 {
+        t.Fatalf("Expected the bare domain to select the default tenant, got %+v", contacts)
+    }
+    if contacts := call("acme.phonebook.example.com", src.DefaultTenant); len(contacts) != 0 {
+        t.Fatalf("Expected the header to take precedence over the subdomain, got %+v", contacts)
+    }
+}
@@ -0,0 +1,171 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+
+    "Rise/src"
+)
+
+// Test function to run all trash tests
+func TestTrash(t *testing.T) {
+    t.Run("Test Soft Delete and Restore", func(t *testing.T) { forEachStore(t, testSoftDelete) })
+    t.Run("Test Purge", func(t *testing.T) { forEachStore(t, testPurgeTrash) })
+    t.Run("Test Trash Permissions", testTrashPermissions)
+}
+
+// trashPage is the body of GET /trash
+type trashPage struct {
+    Contacts   []src.Contact `json:"contacts"`
+    NextCursor string        `json:"next_cursor"`
+}
+
+// readTrash fetches GET /trash with the query and fails the test unless it answers 200
+func readTrash(t *testing.T, handler http.Handler, query string) trashPage {
+    rec := doAudited(handler, "", "req-trash", "GET", "/trash?"+query, "")
+    if rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 listing the trash, got %d: %s", rec.Code, rec.Body.String())
+    }
+    var page trashPage
+    json.NewDecoder(rec.Body).Decode(&page)
+    return page
+}
+
+// addNumbered adds a contact with the phone number through the API and returns its id
+func addNumbered(t *testing.T, handler http.Handler, firstName, number string) int {
+    rec := doAudited(handler, "", "req-add", "POST", "/api/v1/contacts",
+        `{"first_name":"`+firstName+`","last_name":"Cohen","phone_number":"`+number+`","address":"Haifa"}`)
+    if rec.Code != http.StatusCreated {
+        t.Fatalf("Expected 201 adding %s, got %d", firstName, rec.Code)
+    }
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    return created.ID
+}
+
+// Test that deleted contacts leave every read for the trash and can be brought back
+func testSoftDelete(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    dana := addNumbered(t, router, "Dana", "0521111111")
+    roni := addNumbered(t, router, "Roni", "0521111111")
+    kept := addNumbered(t, router, "Kept", "0522222222")
+
+    // The legacy route deletes every contact with the number, now into the trash
+    if rec := doAudited(router, "", "req-delete", "DELETE", "/deleteContact/0521111111", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected 200 deleting by number, got %d", rec.Code)
+    }
+    contacts, _, err := store.GetContacts(10, 0, 0)
+    if err != nil || len(contacts) != 1 || contacts[0].ID != kept {
+        t.Fatalf("Expected only the kept contact to be listed, got %+v (err=%v)", contacts, err)
+    }
+    if _, err := store.SearchContact("0521111111"); err != src.ErrNotFound {
+        t.Fatalf("Expected deleted contacts to be left out of the search, got %v", err)
+    }
+    path := "/api/v1/contacts/" + strconv.Itoa(dana)
+    for _, method := range []string{"GET", "PATCH", "DELETE"} {
+        if rec := doAudited(router, "", "req-gone", method, path, `{"address":"Tel Aviv"}`); rec.Code != http.StatusNotFound {
+            t.Fatalf("Expected 404 for %s of a deleted contact, got %d", method, rec.Code)
+        }
+    }
+
+    page := readTrash(t, router, "limit=1")
+    if len(page.Contacts) != 1 || page.Contacts[0].ID != dana || page.Contacts[0].DeletedAt == nil || page.NextCursor == "" {
+        t.Fatalf("Expected the first deleted contact with its deletion time and a cursor, got %+v", page)
+    }
+    if time.Since(*page.Contacts[0].DeletedAt) > time.Minute {
+        t.Fatalf("Expected a recent deletion time, got %v", page.Contacts[0].DeletedAt)
+    }
+    page = readTrash(t, router, "limit=1&after="+page.NextCursor)
+    if len(page.Contacts) != 1 || page.Contacts[0].ID != roni || page.NextCursor != "" {
+        t.Fatalf("Expected the second deleted contact on the last page, got %+v", page)
+    }
+
+    rec := doAudited(router, "", "req-undelete", "POST", "/api/v1/trash/"+strconv.Itoa(dana)+"/restore", "")
+    var restored src.Contact
+    json.NewDecoder(rec.Body).Decode(&restored)
+    if rec.Code != http.StatusOK || restored.ID != dana || restored.Version != 2 || restored.DeletedAt != nil || rec.Header().Get("ETag") != `"v2"` {
+        t.Fatalf("Expected the contact back at version 2, got %d %+v", rec.Code, restored)
+    }
+    if found, err := store.SearchContact("0521111111"); err != nil || len(found) != 1 || found[0].ID != dana {
+        t.Fatalf("Expected the restored contact to be found again, got %+v (err=%v)", found, err)
+    }
+    if rec := doAudited(router, "", "req-undelete", "POST", "/trash/"+strconv.Itoa(dana)+"/restore", ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 restoring a contact no longer in the trash, got %d", rec.Code)
+    }
+
+    // Restoring a revision also takes the contact out of the trash
+    rec = doAudited(router, "", "req-revert", "POST", "/api/v1/contacts/"+strconv.Itoa(roni)+"/restore?revision=1", "")
+    json.NewDecoder(rec.Body).Decode(&restored)
+    if rec.Code != http.StatusOK || restored.ID != roni || restored.Version != 2 {
+        t.Fatalf("Expected the contact reverted out of the trash at version 2, got %d %+v", rec.Code, restored)
+    }
+    if page := readTrash(t, router, ""); len(page.Contacts) != 0 {
+        t.Fatalf("Expected an empty trash, got %+v", page.Contacts)
+    }
+    history := readHistory(t, router, "/api/v1/contacts/"+strconv.Itoa(dana))
+    if len(history.Revisions) != 3 || history.Revisions[0].Action != src.AuditRestore || history.Revisions[0].Revision != 2 {
+        t.Fatalf("Expected the restore from the trash in the history, got %+v", history.Revisions)
+    }
+}
+
+// Test that purging removes contacts for good once they stayed in the trash long enough
+func testPurgeTrash(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    id := addNumbered(t, router, "Dana", "0521111111")
+    if rec := doAudited(router, "", "req-delete", "DELETE", "/api/v1/contacts/"+strconv.Itoa(id), ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected 204 deleting the contact, got %d", rec.Code)
+    }
+    trash := store.(src.TrashStore)
+
+    // Contacts deleted after the cutoff are kept
+    if purged, err := trash.PurgeTrash(time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+        t.Fatalf("Expected nothing to be purged yet, got %d (err=%v)", purged, err)
+    }
+    stop := src.StartPurger(trash, -time.Hour, 10*time.Millisecond)
+    deadline := time.Now().Add(5 * time.Second)
+    for len(readTrash(t, router, "").Contacts) > 0 {
+        if time.Now().After(deadline) {
+            t.Fatalf("Expected the purger to empty the trash")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    stop()
+
+    if rec := doAudited(router, "", "req-undelete", "POST", "/trash/"+strconv.Itoa(id)+"/restore", ""); rec.Code != http.StatusNotFound {
+        t.Fatalf("Expected 404 restoring a purged contact from the trash, got %d", rec.Code)
+    }
+    // The history outlives the purge and can recreate the contact
+    rec := doAudited(router, "", "req-revert", "POST", "/api/v1/contacts/"+strconv.Itoa(id)+"/restore?revision=1", "")
+    var restored src.Contact
+    json.NewDecoder(rec.Body).Decode(&restored)
+    if rec.Code != http.StatusOK || restored.ID != id || restored.Version != 2 || restored.FirstName != "Dana" {
+        t.Fatalf("Expected the purged contact recreated at version 2, got %d %+v", rec.Code, restored)
+    }
+}
+
+// Test that the trash is read with contacts:read and emptied back with contacts:delete
+func testTrashPermissions(t *testing.T) {
+    router, keys := newAuthRouter(t, nil, src.RoleViewer, src.RoleEditor)
+    rec := doAudited(router, keys[src.RoleEditor], "req-add", "POST", "/api/v1/contacts",
+        `{"first_name":"A","last_name":"B","phone_number":"0521111111","address":"C"}`)
+    var created src.Contact
+    json.NewDecoder(rec.Body).Decode(&created)
+    path := "/api/v1/contacts/" + strconv.Itoa(created.ID)
+    if rec := doAudited(router, keys[src.RoleEditor], "req-delete", "DELETE", path, ""); rec.Code != http.StatusNoContent {
+        t.Fatalf("Expected the editor to delete the contact, got %d", rec.Code)
+    }
+
+    if rec := doAudited(router, keys[src.RoleViewer], "req-trash", "GET", "/api/v1/trash", ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected a viewer to list the trash, got %d", rec.Code)
+    }
+    restore := "/api/v1/trash/" + strconv.Itoa(created.ID) + "/restore"
+    if rec := doAudited(router, keys[src.RoleViewer], "req-undelete", "POST", restore, ""); rec.Code != http.StatusForbidden {
+        t.Fatalf("Expected 403 for a viewer restoring from the trash, got %d", rec.Code)
+    }
+    if rec := doAudited(router, keys[src.RoleEditor], "req-undelete", "POST", restore, ""); rec.Code != http.StatusOK {
+        t.Fatalf("Expected the editor to restore the contact, got %d", rec.Code)
+    }
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+
+    "Rise/src"
+    "Rise/src/validate"
+)
+
+// Test function to run all validation tests
+func TestValidation(t *testing.T) {
+    t.Run("Test Rules", testValidationRules)
+    t.Run("Test Schema", testValidationSchema)
+    t.Run("Test Write Paths", func(t *testing.T) { forEachStore(t, testValidationWritePaths) })
+}
+
+// Test that each rule normalizes or rejects a value
+func testValidationRules(t *testing.T) {
+    tests := []struct {
+        rule     validate.Rule
+        value    string
+        expected string
+        issue    string
+    }{
+        {validate.Trim, "  Dana \t", "Dana", ""},
+        {validate.Lower, "Family", "family", ""},
+        {validate.Required, "", "", "is required"},
+        {validate.Required, "x", "x", ""},
+        {validate.MaxLength(3), "אבג", "אבג", ""},
+        {validate.MaxLength(3), "abcd", "abcd", "must be at most 3 characters"},
+        {validate.Printable, "Dana\nCohen", "Dana\nCohen", "must not contain control characters"},
+        {validate.Printable, "Zoë O'Neil-Smith", "Zoë O'Neil-Smith", ""},
+        {validate.Excludes(",;", "commas or semicolons"), "a;b", "a;b", "must not contain commas or semicolons"},
+        {validate.Phone, "+972 (54) 343-5590", "+972 (54) 343-5590", ""},
+        {validate.Phone, "", "", ""},
+        {validate.Phone, "054-343-559O", "054-343-559O", "must only contain digits, a leading + and the separators - . ( ) /"},
+        {validate.Phone, "05+4", "05+4", "must only contain digits, a leading + and the separators - . ( ) /"},
+        {validate.Phone, "+ -", "+ -", "must contain digits"},
+    }
+    for _, tt := range tests {
+        value, issue := tt.rule(tt.value)
+        if value != tt.expected || issue != tt.issue {
+            t.Fatalf("Expected %q and issue %q for %q, got %q and %q", tt.expected, tt.issue, tt.value, value, issue)
+        }
+    }
+}
+
+// Test that a schema reports the first broken rule of every field and normalizes the valid ones
+func testValidationSchema(t *testing.T) {
+    schema := validate.Schema{
+        {Field: "name", Rules: []validate.Rule{validate.Trim, validate.Required, validate.MaxLength(5)}},
+        {Field: "phone", Rules: []validate.Rule{validate.Trim, validate.Required, validate.Phone}},
+        {Field: "city", Rules: []validate.Rule{validate.Trim, validate.Required}},
+        {Field: "note", Rules: []validate.Rule{validate.Trim}},
+    }
+    name, phone, city := "  Dana ", "   ", "Haifa is far"
+    violations := schema.Validate(map[string]*string{"name": &name, "phone": &phone, "city": &city, "note": nil})
+    expected := []validate.Violation{{Field: "phone", Issue: "is required"}}
+    if !reflect.DeepEqual(violations, expected) {
+        t.Fatalf("Expected only the blank phone reported, got %+v", violations)
+    }
+    if name != "Dana" || phone != "   " || city != "Haifa is far" {
+        t.Fatalf("Expected the valid values normalized and the invalid one kept, got %q %q %q", name, phone, city)
+    }
+
+    long := "Jonathan"
+    if violations := validate.Check("names[2]", &long, validate.MaxLength(5)); len(violations) != 1 || violations[0].Field != "names[2]" {
+        t.Fatalf("Expected the value checked under its path, got %+v", violations)
+    }
+}
+
+// Test that every write path trims the fields and rejects values the database cannot hold
+// with 422 rather than a database error
+func testValidationWritePaths(t *testing.T, store src.ContactStore) {
+    router := src.NewRouter(store, nil)
+    long := strings.Repeat("a", 101)
+
+    rec := doRequest(router, "POST", "/addContact",
+        `{"first_name":"`+long+`","last_name":"  ","phone_number":"052-111-1111 ext 5","address":"Haifa\n"}`)
+    resp := decodeError(t, rec)
+    expected := []src.ErrorDetail{
+        {Field: "first_name", Issue: "must be at most 100 characters"},
+        {Field: "last_name", Issue: "is required"},
+        {Field: "phone_number", Issue: "must only contain digits, a leading + and the separators - . ( ) /"},
+    }
+    if rec.Code != http.StatusUnprocessableEntity || !reflect.DeepEqual(resp.Details, expected) {
+        t.Fatalf("Expected 422 with every invalid field, got %d %+v", rec.Code, resp.Details)
+    }
+
+    rec = doRequest(router, "POST", "/api/v1/contacts",
+        `{"first_name":" Dana ","last_name":"Cohen ","phone_number":" 052-111-1111","address":" Haifa","emails":[{"address":" dana@example.com "}]}`)
+    var dana src.Contact
+    json.NewDecoder(rec.Body).Decode(&dana)
+    if rec.Code != http.StatusCreated || dana.FirstName != "Dana" || dana.LastName != "Cohen" || dana.PhoneNumber != "052-111-1111" ||
+        dana.Address != "Haifa" || dana.Emails[0].Address != "dana@example.com" {
+        t.Fatalf("Expected the fields trimmed, got %d %+v", rec.Code, dana)
+    }
+    path := "/api/v1/contacts/" + strconv.Itoa(dana.ID)
+
+    tests := []struct {
+        method string
+        path   string
+        body   string
+        field  string
+    }{
+        {"PUT", path, `{"first_name":"Dana","last_name":"` + long + `","phone_number":"0521111111","address":"Haifa"}`, "last_name"},
+        {"PATCH", path, `{"first_name":"   "}`, "first_name"},
+        {"PATCH", path, `{"phone_number":"+972 52 111 1111 1111 1111"}`, "phone_number"},
+        {"PATCH", path, `{"phones":[{"number":"0521111111"},{"number":"052 111 1111 111 111 111"}]}`, "phones[1].number"},
+        {"PATCH", path, `{"addresses":[{"address":"` + strings.Repeat("b", 256) + `"}]}`, "addresses[0].address"},
+        {"PATCH", path, `{"emails":[{"address":"` + strings.Repeat("c", 250) + `@example.com"}]}`, "emails[0].address"},
+        {"PATCH", path, `{"tags":["x,y"]}`, "tags[0]"},
+        {"PUT", "/editContact/0521111111", `{"first_name":"Dana\u0000","last_name":"Cohen","phone_number":"0521111111","address":"Haifa"}`, "first_name"},
+    }
+    for _, tt := range tests {
+        rec := doRequest(router, tt.method, tt.path, tt.body)
+        resp := decodeError(t, rec)
+        if rec.Code != http.StatusUnprocessableEntity || len(resp.Details) != 1 || resp.Details[0].Field != tt.field {
+            t.Fatalf("Expected 422 naming %s for %s %s, got %d %+v", tt.field, tt.method, tt.body, rec.Code, resp)
+        }
+    }
+
+    // Batches and imports share the rules
+    rec = doRequest(router, "POST", "/api/v1/contacts:batch", `{"operations":[
+        {"op":"update","id":`+strconv.Itoa(dana.ID)+`,"contact":{"address":"`+strings.Repeat("d", 300)+`"}}]}`)
+    if resp := decodeError(t, rec); rec.Code != http.StatusUnprocessableEntity || resp.Details[1].Field != "operations[0].address" {
+        t.Fatalf("Expected 422 naming the address of the operation, got %d %+v", rec.Code, resp)
+    }
+    rec = doRequest(router, "POST", "/contacts/import.csv", "first_name,last_name,phone_number,address\n"+long+",Levi,0522222222,Acre\n")
+    var imported importResponse
+    json.NewDecoder(rec.Body).Decode(&imported)
+    if len(imported.Results) != 1 || imported.Results[0].Errors[0].Field != "first_name" {
+        t.Fatalf("Expected the long name of the row rejected, got %d %+v", rec.Code, imported)
+    }
+    if contact, _ := store.GetContact(dana.ID); contact.Version != 1 {
+        t.Fatalf("Expected no invalid write to be stored, got %+v", contact)
+    }
+}
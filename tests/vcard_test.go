@@ -0,0 +1,178 @@
+package tests
+
+import (
+    "bytes"
+    "encoding/json"
+    "strings"
+    "testing"
+
+    "Rise/src"
+    "Rise/src/vcard"
+)
+
+const sampleVCards = "BEGIN:VCARD\r\n" +
+    "VERSION:3.0\r\n" +
+    "N:Makovsky;Jonathan;;;\r\n" +
+    "FN:Jonathan Makovsky\r\n" +
+    "TEL;TYPE=HOME:03-6123456\r\n" +
+    "TEL;TYPE=CELL,PREF:054-343-5590\r\n" +
+    "ADR;TYPE=HOME:;;1 Rothschild Blvd;Tel Aviv;;6688101;Israel\r\n" +
+    "END:VCARD\r\n" +
+    "BEGIN:VCARD\r\n" +
+    "VERSION:4.0\r\n" +
+    "FN:Dana Cohen\r\n" +
+    "TEL;VALUE=uri;TYPE=cell:tel:+972-52-123-4567\r\n" +
+    "ADR:;;Herzl 5\\, apt 2;Haifa;;;\r\n" +
+    "NOTE:this line is very long and gets folded across two lines because it\r\n" +
+    " is over seventy five octets\r\n" +
+    "END:VCARD\r\n" +
+    "BEGIN:VCARD\r\n" +
+    "VERSION:3.0\r\n" +
+    "N:Nophone;No;;;\r\n" +
+    "ADR:;;Somewhere;;;;\r\n" +
+    "END:VCARD\r\n" +
+    "BEGIN:VCARD\r\n" +
+    "VERSION:3.0\r\n" +
+    "TEL:0501234567\r\n"
+
+// Test function to run all vCard tests
+func TestVCard(t *testing.T) {
+    t.Run("Test Parse", testVCardParse)
+    t.Run("Test Write and Parse Round Trip", testVCardRoundTrip)
+    t.Run("Test Import Dry Run", testVCardImportDryRun)
+    t.Run("Test Import and Export", testVCardImportExport)
+}
+
+// Test reading cards of both versions, including malformed ones
+func testVCardParse(t *testing.T) {
+    entries, err := vcard.Parse(strings.NewReader(sampleVCards))
+    if err != nil {
+        t.Fatalf("Failed to parse vCards: %v", err)
+    }
+    if len(entries) != 4 {
+        t.Fatalf("Expected 4 entries, got %d", len(entries))
+    }
+
+    first := entries[0].Card
+    if first.FamilyName != "Makovsky" || first.GivenName != "Jonathan" {
+        t.Fatalf("Expected N to be parsed, got %+v", first)
+    }
+    if phone, _ := first.PreferredPhone(); phone.Number != "054-343-5590" {
+        t.Fatalf("Expected the preferred phone to be picked, got %+v", phone)
+    }
+    if address, _ := first.PreferredAddress(); address.String() != "1 Rothschild Blvd, Tel Aviv, 6688101, Israel" {
+        t.Fatalf("Expected ADR components to be joined, got %q", address.String())
+    }
+
+    second := entries[1].Card
+    if second.FormattedName != "Dana Cohen" || second.Phones[0].Number != "+972-52-123-4567" {
+        t.Fatalf("Expected vCard 4.0 FN and tel: URI to be parsed, got %+v", second)
+    }
+    if second.Addresses[0].Street != "Herzl 5, apt 2" {
+        t.Fatalf("Expected escaped comma to be unescaped, got %q", second.Addresses[0].Street)
+    }
+
+    if entries[2].Err != nil {
+        t.Fatalf("Expected card without phone to parse, got %v", entries[2].Err)
+    }
+    if entries[3].Err != vcard.ErrMissingEnd || entries[3].Line != 22 {
+        t.Fatalf("Expected unterminated card at line 22 to be reported, got line %d: %v", entries[3].Line, entries[3].Err)
+    }
+}
+
+// Test that written cards read back the same in both versions
+func testVCardRoundTrip(t *testing.T) {
+    card := vcard.Card{
+        GivenName:  "Jonathan",
+        FamilyName: "Makovsky; Jr",
+        Phones:     []vcard.Phone{{Number: "+972543435590", Types: []string{"cell"}}},
+        Addresses:  []vcard.Address{{Street: strings.Repeat("Long street name, ", 6) + "Tel Aviv"}},
+    }
+    for _, version := range []string{vcard.Version3, vcard.Version4} {
+        var buf bytes.Buffer
+        if err := vcard.Write(&buf, []vcard.Card{card}, version); err != nil {
+            t.Fatalf("Failed to write vCard %s: %v", version, err)
+        }
+        for _, line := range strings.Split(buf.String(), "\r\n") {
+            if len(line) > 75 {
+                t.Fatalf("Expected lines to be folded at 75 octets, got %q", line)
+            }
+        }
+
+        entries, err := vcard.Parse(&buf)
+        if err != nil || len(entries) != 1 || entries[0].Err != nil {
+            t.Fatalf("Failed to read back vCard %s: %+v (err=%v)", version, entries, err)
+        }
+        got := entries[0].Card
+        if got.FamilyName != card.FamilyName || got.Phones[0].Number != card.Phones[0].Number || got.Addresses[0].Street != card.Addresses[0].Street {
+            t.Fatalf("Expected %+v after round trip in %s, got %+v", card, version, got)
+        }
+    }
+}
+
+// importResponse mirrors the JSON returned by the import endpoints
+type importResponse struct {
+    Accepted int                `json:"accepted"`
+    Rejected int                `json:"rejected"`
+    Results  []src.ImportResult `json:"results"`
+}
+
+// Test that a dry run reports every card and stores nothing
+func testVCardImportDryRun(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+
+    rec := doRequest(router, "POST", "/contacts/import?dry_run=true", sampleVCards)
+    if rec.Code != 200 {
+        t.Fatalf("Expected status 200, got %d (%s)", rec.Code, rec.Body.String())
+    }
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 2 || response.Rejected != 2 {
+        t.Fatalf("Expected 2 valid and 2 rejected cards, got %+v", response)
+    }
+    if response.Results[0].Status != "valid" || response.Results[0].Contact.PhoneE164 != "+972543435590" {
+        t.Fatalf("Expected the first card to be valid and normalized, got %+v", response.Results[0])
+    }
+    if response.Results[2].Errors[0].Field != "phone_number" {
+        t.Fatalf("Expected the missing phone to be reported, got %+v", response.Results[2])
+    }
+    if _, err := store.SearchContact("0543435590"); err == nil {
+        t.Fatalf("Expected a dry run not to store contacts")
+    }
+}
+
+// Test importing cards and exporting them again
+func testVCardImportExport(t *testing.T) {
+    store := src.NewMemoryStore("IL")
+    router := src.NewRouter(store, nil)
+
+    rec := doRequest(router, "POST", "/contacts/import", sampleVCards)
+    var response importResponse
+    json.NewDecoder(rec.Body).Decode(&response)
+    if response.Accepted != 2 {
+        t.Fatalf("Expected 2 imported contacts, got %+v", response)
+    }
+    contacts, err := store.SearchContact("+972521234567")
+    if err != nil || contacts[0].FirstName != "Dana" || contacts[0].LastName != "Cohen" {
+        t.Fatalf("Expected FN to be split into first and last name, got %+v (err=%v)", contacts, err)
+    }
+
+    rec = doRequest(router, "GET", "/contacts/export.vcf?version=4.0", "")
+    if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/vcard") {
+        t.Fatalf("Expected a vCard download, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+    }
+    entries, _ := vcard.Parse(rec.Body)
+    if len(entries) != 2 || len(entries[0].Card.Phones) != 2 {
+        t.Fatalf("Expected both contacts to be exported with every number, got %+v", entries)
+    }
+    if preferred, _ := entries[0].Card.PreferredPhone(); preferred.Number != "+972543435590" || entries[0].Card.Phones[0].Types[0] != "home" {
+        t.Fatalf("Expected E.164 numbers with the preferred one marked, got %+v", entries[0].Card.Phones)
+    }
+
+    rec = doRequest(router, "GET", "/contacts/export.vcf?phone_number=052-123-4567", "")
+    entries, _ = vcard.Parse(rec.Body)
+    if len(entries) != 1 || entries[0].Card.GivenName != "Dana" {
+        t.Fatalf("Expected the filtered export to contain only Dana, got %+v", entries)
+    }
+}